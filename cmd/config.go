@@ -4,54 +4,396 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 
+	"github.com/crossedbot/simpleloadbalancer/pkg/loadbalancers"
 	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
 )
 
 // LBTarget represents a load balancer target in the configuration. Setting the
-//URL will override the other fields.
+// URL will override the other fields. Setting the SRV record name instead
+// resolves the target into the record's hosts, ports and weights; which are
+// refreshed periodically.
 type LBTarget struct {
-	Host string `json:"host" yaml:"host"` // Hostname (IP/Domain/etc)
-	Port int    `json:"port" yaml:"port"` // Port number of the targeted service
-	Url  string `json:"url" yaml:"url"`   // URL of the targeted service
+	Name          string `json:"name" yaml:"name"`                           // Target name
+	Host          string `json:"host" yaml:"host"`                           // Hostname (IP/Domain/etc)
+	Port          int    `json:"port" yaml:"port"`                           // Port number of the targeted service
+	Protocol      string `json:"protocol" yaml:"protocol"`                   // Overrides the group's protocol
+	Url           string `json:"url" yaml:"url"`                             // URL of the targeted service
+	Srv           string `json:"srv" yaml:"srv"`                             // SRV record name of the targeted service
+	Weight        int    `json:"weight" yaml:"weight"`                       // Relative weight of the target
+	TlsServerName string `json:"tls_server_name" yaml:"tls_server_name"`     // ALB SNI and certificate name of an HTTPS target
+	HealthPort    int    `json:"health_check_port" yaml:"health_check_port"` // Port health checks probe; defaults to the target's port
+	Backup        bool   `json:"backup" yaml:"backup"`                       // Target only used while no primary is alive
+	DialTimeout   int64  `json:"dial_timeout" yaml:"dial_timeout"`           // NLB dial timeout in seconds; overrides the group's
+	IdleTimeout   int64  `json:"idle_timeout" yaml:"idle_timeout"`           // NLB relay idle timeout in seconds; overrides the group's
+}
+
+// LBSplit represents a weighted target group of a rule with the split action in
+// the configuration.
+type LBSplit struct {
+	TargetGroup string `json:"target_group" yaml:"target_group"` // TG name
+	Weight      int    `json:"weight" yaml:"weight"`             // Relative weight
 }
 
 // LBRule represents a load balancer rule in the configuration. Rules are
 // commonly used with application load balancer to route strategies to specific
-// target groups.
+// target groups. Rules with the split action forward requests to the target
+// groups in Split by their weights, keeping clients on the same target group
+// by hashing the SplitKey ("source-ip" or "cookie:<name>"). A condition's
+// value may list alternatives separated by '|'; E.g. "http-request-method =
+// GET|POST".
 type LBRule struct {
 	Action     string              `json:"action" yaml:"action"`
 	Conditions [][]rules.Condition `json:"conditions" yaml:"conditions"`
+	Split      []LBSplit           `json:"split" yaml:"split"`
+	SplitKey   string              `json:"split_key" yaml:"split_key"`
+}
+
+// LBBasicAuth represents the HTTP basic authentication settings of a target
+// group in the configuration. Credentials are formatted as
+// "<username>:<bcrypt hash>". Requests from the allowed IPs (or CIDR ranges)
+// bypass authentication.
+type LBBasicAuth struct {
+	Realm       string   `json:"realm" yaml:"realm"`
+	Credentials []string `json:"credentials" yaml:"credentials"`
+	AllowIps    []string `json:"allow_ips" yaml:"allow_ips"`
+}
+
+// LBCache represents the response cache settings of a target group in the
+// configuration. When set, GET responses that are marked cacheable by their
+// Cache-Control or Expires headers are cached.
+type LBCache struct {
+	MaxEntries int   `json:"max_entries" yaml:"max_entries"` // Max cached responses
+	TTL        int64 `json:"ttl" yaml:"ttl"`                 // Max response TTL in seconds
+}
+
+// LBCors represents the CORS settings of a target group in the configuration.
+// When set, the load balancer answers CORS preflight requests for the group.
+type LBCors struct {
+	AllowOrigins     []string `json:"allow_origins" yaml:"allow_origins"`
+	AllowMethods     []string `json:"allow_methods" yaml:"allow_methods"`
+	AllowHeaders     []string `json:"allow_headers" yaml:"allow_headers"`
+	AllowCredentials bool     `json:"allow_credentials" yaml:"allow_credentials"`
+	MaxAge           int64    `json:"max_age" yaml:"max_age"` // In seconds
+}
+
+// LBDns represents the settings of an experimental DNS target group in the
+// configuration. A network load balancer answers A and AAAA queries for the name
+// on the "dns" listeners the group is bound to with the addresses of the group's
+// alive targets, instead of relaying connections to them.
+type LBDns struct {
+	Name string `json:"name" yaml:"name"` // Answered domain name
+	TTL  int64  `json:"ttl" yaml:"ttl"`   // Answer TTL in seconds
+}
+
+// LBHealthCheck represents the health check settings of a target group in the
+// configuration. Each ALB target is sent a request for the path with the given
+// method, headers, and body; and is healthy if it responds with a 2xx or 3xx
+// status, and a body matching the body_match regular expression if it is set.
+// The host overrides the request's host header. Each NLB target is sent the
+// send payload, and is healthy if its response starts with the expect payload;
+// E.g. send "PING\r\n" and expect "PONG". Targets checked with the grpc type
+// are healthy if the grpc.health.v1 Check RPC for the service reports SERVING.
+type LBHealthCheck struct {
+	Type      string            `json:"type" yaml:"type"` // http (default) or grpc
+	Path      string            `json:"path" yaml:"path"`
+	Method    string            `json:"method" yaml:"method"`
+	Headers   map[string]string `json:"headers" yaml:"headers"`
+	Body      string            `json:"body" yaml:"body"`
+	BodyMatch string            `json:"body_match" yaml:"body_match"` // ALB response body regular expression
+	Host      string            `json:"host" yaml:"host"`
+	Send      string            `json:"send" yaml:"send"`       // NLB probe payload
+	Expect    string            `json:"expect" yaml:"expect"`   // NLB response prefix
+	Service   string            `json:"service" yaml:"service"` // gRPC service name
+}
+
+// LBRedirect represents the redirect settings of a target group with the
+// redirect action in the configuration. The scheme, host, path, and query are
+// templates that may contain the {scheme}, {host}, {port}, {path}, and {query}
+// placeholders; unset parts keep the request's value. E.g. a host of
+// "new.example.com" and a path of "/v2{path}" redirects
+// old.example.com/foo to new.example.com/v2/foo.
+type LBRedirect struct {
+	Scheme      string `json:"scheme" yaml:"scheme"`
+	Host        string `json:"host" yaml:"host"`
+	Path        string `json:"path" yaml:"path"`
+	Query       string `json:"query" yaml:"query"`
+	StripPrefix string `json:"strip_prefix" yaml:"strip_prefix"` // Removed from the request path
+	StatusCode  int    `json:"status_code" yaml:"status_code"`   // Defaults to 301
+}
+
+// LBRateLimit represents the rate limit of the requests matching an ALB target
+// group's rule in the configuration; each client IP is allowed a request per
+// rate, in addition to the load balancer's request_rate. Clients are keyed by
+// their connection's IP, or by the IP forwarded by one of the TrustedProxies.
+type LBRateLimit struct {
+	Rate           int64    `json:"rate" yaml:"rate"`                       // Time between requests in milliseconds
+	Capacity       int64    `json:"capacity" yaml:"capacity"`               // Queued requests per client
+	TrustedProxies []string `json:"trusted_proxies" yaml:"trusted_proxies"` // Proxy IPs and CIDRs
+}
+
+// LBRetryBackoff represents the exponential backoff between the retries of a
+// failed target in the configuration. Each delay is the last one grown by the
+// multiplier, up to the maximum, and jittered so retries do not synchronize.
+type LBRetryBackoff struct {
+	Base       int64   `json:"base" yaml:"base"`             // First delay in milliseconds; defaults to 100
+	Multiplier float64 `json:"multiplier" yaml:"multiplier"` // Growth per retry; defaults to 2
+	Max        int64   `json:"max" yaml:"max"`               // Maximum delay in milliseconds; defaults to 2000
+}
+
+// LBResponseHeaders represents the rules applied to the headers of an ALB
+// target group's responses in the configuration. Removed headers are stripped
+// and set headers replace the backend's values; E.g. remove "Server". With
+// rewrite_location, redirects to a target's own URL are rewritten to the host
+// the client used; the load balancer's rewrite_location enables it for every
+// target group, and either one is enough.
+type LBResponseHeaders struct {
+	Remove          []string          `json:"remove" yaml:"remove"`
+	Set             map[string]string `json:"set" yaml:"set"`
+	RewriteLocation bool              `json:"rewrite_location" yaml:"rewrite_location"`
+}
+
+// LBJwt represents the JSON web token authentication settings of a target
+// group in the configuration. HS256 tokens are verified with the secret and
+// RS256 tokens with the PEM encoded public key file or the JWKS URL. Each
+// required claim must match its configured value. The token's subject is passed
+// to backends in the subject header.
+type LBJwt struct {
+	Secret        string            `json:"secret" yaml:"secret"`
+	PublicKeyFile string            `json:"public_key_file" yaml:"public_key_file"`
+	JwksUrl       string            `json:"jwks_url" yaml:"jwks_url"`
+	Claims        map[string]string `json:"claims" yaml:"claims"`
+	SubjectHeader string            `json:"subject_header" yaml:"subject_header"`
+}
+
+// LBConsul represents the Consul service discovery settings of a target group
+// in the configuration. The passing instances of the service are added to the
+// group's targets, and updated as instances register and deregister.
+type LBConsul struct {
+	Address    string `json:"address" yaml:"address"`       // Consul agent address
+	Service    string `json:"service" yaml:"service"`       // Service name
+	Tag        string `json:"tag" yaml:"tag"`               // Only instances with this tag
+	Datacenter string `json:"datacenter" yaml:"datacenter"` // Datacenter to query
+	Token      string `json:"token" yaml:"token"`           // ACL token
+}
+
+// LBTransport represents the settings of the connections an application target
+// group makes to its targets in the configuration. Disable keep-alives for
+// backends that misbehave with persistent connections, and set an idle timeout
+// shorter than a backend's or NAT's to recycle idle connections before they are
+// dropped.
+type LBTransport struct {
+	DisableKeepAlives bool  `json:"disable_keep_alives" yaml:"disable_keep_alives"`
+	IdleConnTimeout   int64 `json:"idle_conn_timeout" yaml:"idle_conn_timeout"`   // In seconds; defaults to 90
+	MaxConnsPerHost   int   `json:"max_conns_per_host" yaml:"max_conns_per_host"` // Per target; defaults to no limit
+}
+
+// LBTimeouts represents the connection timeouts of a network target group in the
+// configuration; E.g. a longer dial timeout for backends that are slow to
+// accept connections. Zero values keep the load balancer's timeouts.
+type LBTimeouts struct {
+	Dial int64 `json:"dial" yaml:"dial"` // In seconds; defaults to the LB timeout
+	Idle int64 `json:"idle" yaml:"idle"` // In seconds; defaults to the LB relay idle timeout
 }
 
 // LBTargetGroup represents a load balancer target group in the configuration.
 // It is a named collection of targets for a given load balancer. Set the Rule
-// and protocol fields to route requests for application load balancers.
+// and protocol fields to route requests for application load balancers. Set
+// the Listener field to a listener's name or port to only apply the group's
+// rule to requests received by that listener. Set MirrorTo to the name of
+// another group to send it a copy of each forwarded request; its responses are
+// discarded. A group that should only receive mirrored requests can leave its
+// rule's action unset. Set TargetsFile to a file of "host:port" lines or a
+// JSON array of targets to add its targets to the group; the file is watched
+// and its targets are reloaded whenever it changes. A group may not list a
+// backend twice, and MaxTargets optionally caps its number of targets,
+// including those of its providers. Methods, PathPrefix and
+// Hosts are shorthands for common rule conditions; requests must match one of
+// the methods, start with the path prefix, and match one of the hosts. Using
+// them without a rule action forwards the matching requests. Set PathIgnoreCase
+// and PathTrimSlash to match request paths against the group's path patterns
+// without regard to case and trailing slashes; E.g. so "/foo" also matches
+// "/Foo/". Path patterns only match the request path, without its query; set
+// PathQuery to match "<path>?<raw query>" instead, E.g. so "/search?type=a" and
+// "/search?type=b" may be routed apart. Strategy sets how targets are picked;
+// "round_robin" (default), "weighted_random" to pick targets in proportion to
+// their weights, "power_of_two" to pick the target with fewer requests in
+// flight of two random targets of an application load balancer,
+// "consistent_hash" to pin each value of the HashHeader request header to a
+// target of an application load balancer, E.g. a tenant ID, or "ip_hash" to pin
+// each client IP to a target of a network load balancer. Set HashLoadFactor to
+// bound consistent_hash loads; a target serving that factor times the average
+// requests in flight overflows its keys to the next target, E.g. 1.25 for hot
+// keys of a cache fleet. Set Dns to answer DNS queries with the group's targets
+// instead.
 type LBTargetGroup struct {
-	Name     string     `json:"name" yaml:"name"`         // TG name
-	Protocol string     `json:"protocol" yaml:"protocol"` // TG protocol
-	Rule     LBRule     `json:"rule" yaml:"rule"`         // ALB Rule
-	Targets  []LBTarget `json:"targets" yaml:"targets"`   // The groups targets
+	Name            string             `json:"name" yaml:"name"`                         // TG name
+	Listener        string             `json:"listener" yaml:"listener"`                 // Bound listener
+	MirrorTo        string             `json:"mirror_to" yaml:"mirror_to"`               // Shadow TG name
+	Protocol        string             `json:"protocol" yaml:"protocol"`                 // TG protocol
+	Strategy        string             `json:"strategy" yaml:"strategy"`                 // Balancing strategy
+	HashHeader      string             `json:"hash_header" yaml:"hash_header"`           // ALB header keying consistent_hash
+	HashLoadFactor  float64            `json:"hash_load_factor" yaml:"hash_load_factor"` // ALB consistent_hash load bound
+	Rule            LBRule             `json:"rule" yaml:"rule"`                         // ALB Rule
+	Methods         []string           `json:"methods" yaml:"methods"`                   // ALB allowed request methods
+	PathPrefix      string             `json:"path_prefix" yaml:"path_prefix"`           // ALB request path prefix
+	PathIgnoreCase  bool               `json:"path_ignore_case" yaml:"path_ignore_case"` // ALB case-insensitive paths
+	PathTrimSlash   bool               `json:"path_trim_slash" yaml:"path_trim_slash"`   // ALB paths with or without a trailing slash
+	PathQuery       bool               `json:"path_query" yaml:"path_query"`             // ALB paths with their query
+	Hosts           []string           `json:"hosts" yaml:"hosts"`                       // ALB request hosts
+	Targets         []LBTarget         `json:"targets" yaml:"targets"`                   // The groups targets
+	SrvRefresh      int64              `json:"srv_refresh" yaml:"srv_refresh"`           // SRV refresh interval in seconds
+	TargetsFile     string             `json:"targets_file" yaml:"targets_file"`         // Watched file of targets
+	MaxTargets      int                `json:"max_targets" yaml:"max_targets"`           // Maximum number of targets
+	Cache           *LBCache           `json:"cache" yaml:"cache"`                       // ALB response cache
+	Cors            *LBCors            `json:"cors" yaml:"cors"`                         // ALB CORS preflights
+	Dns             *LBDns             `json:"dns" yaml:"dns"`                           // NLB DNS answers (experimental)
+	HealthCheck     *LBHealthCheck     `json:"health_check" yaml:"health_check"`         // Target health check
+	BasicAuth       *LBBasicAuth       `json:"basic_auth" yaml:"basic_auth"`             // ALB basic auth
+	Jwt             *LBJwt             `json:"jwt" yaml:"jwt"`                           // ALB JWT auth
+	RateLimit       *LBRateLimit       `json:"rate_limit" yaml:"rate_limit"`             // ALB rate limit of the route
+	Redirect        *LBRedirect        `json:"redirect" yaml:"redirect"`                 // ALB redirect templates
+	ResponseHeaders *LBResponseHeaders `json:"response_headers" yaml:"response_headers"` // ALB response header rules
+	Consul          *LBConsul          `json:"consul" yaml:"consul"`                     // Consul discovery
+	Timeouts        *LBTimeouts        `json:"timeouts" yaml:"timeouts"`                 // NLB connection timeouts
+	Transport       *LBTransport       `json:"transport" yaml:"transport"`               // ALB upstream connections
 }
 
-// Config is the main configuration for this application.
+// RuleConditions returns the group's rule conditions along with the conditions
+// of its Methods, PathPrefix, and Hosts shorthands.
+func (tg LBTargetGroup) RuleConditions() [][]rules.Condition {
+	conds := append([][]rules.Condition{}, tg.Rule.Conditions...)
+	if len(tg.Methods) > 0 {
+		conds = append(conds,
+			keyConditions(rules.ConditionKeyMethod, tg.Methods))
+	}
+	if tg.PathPrefix != "" {
+		conds = append(conds, keyConditions(rules.ConditionKeyPath,
+			[]string{tg.PathPrefix + "*"}))
+	}
+	if len(tg.Hosts) > 0 {
+		conds = append(conds,
+			keyConditions(rules.ConditionKeyHost, tg.Hosts))
+	}
+	return conds
+}
+
+// RuleAction returns the group's rule action. If the action is not set but the
+// group uses the rule shorthands, the forward action is returned.
+func (tg LBTargetGroup) RuleAction() string {
+	if tg.Rule.Action == "" && (len(tg.Methods) > 0 ||
+		tg.PathPrefix != "" || len(tg.Hosts) > 0) {
+		return rules.RuleActionForward.String()
+	}
+	return tg.Rule.Action
+}
+
+// keyConditions returns a group of equality conditions for the given key; one
+// for each value. The group matches if any of them match.
+func keyConditions(key rules.ConditionKey, values []string) []rules.Condition {
+	conds := []rules.Condition{}
+	for _, v := range values {
+		conds = append(conds, rules.Condition(
+			fmt.Sprintf("%s = %s", key, v)))
+	}
+	return conds
+}
+
+// LBTlsHeaders represents the names of the headers that pass the details of a
+// client's connection to backends in the configuration; E.g. "X-Client-Cert"
+// for the subject of a client certificate verified by the load balancer.
+// Headers without a name are not sent, and client sent values are removed.
+type LBTlsHeaders struct {
+	Proto         string `json:"proto" yaml:"proto"`                   // Original scheme
+	Cipher        string `json:"cipher" yaml:"cipher"`                 // TLS cipher suite
+	Version       string `json:"version" yaml:"version"`               // TLS version
+	ClientSubject string `json:"client_subject" yaml:"client_subject"` // Client cert subject
+}
+
+// LBListener represents a load balancer listener in the configuration. Each
+// listener has its own address, protocol, and TLS settings. Set TlsClientCaFile
+// to require client certificates signed by its CAs (mutual TLS), and
+// TlsClientNames to only allow certificates with one of the common or subject
+// alternative names.
+type LBListener struct {
+	Name            string   `json:"name" yaml:"name"`         // Listener name
+	Host            string   `json:"host" yaml:"host"`         // Listener host
+	Port            int      `json:"port" yaml:"port"`         // Listener port
+	Protocol        string   `json:"protocol" yaml:"protocol"` // Listener protocol
+	TlsEnabled      bool     `json:"tls_enabled" yaml:"tls_enabled"`
+	TlsCertFile     string   `json:"tls_cert_file" yaml:"tls_cert_file"`
+	TlsKeyFile      string   `json:"tls_key_file" yaml:"tls_key_file"`
+	TlsClientCaFile string   `json:"tls_client_ca_file" yaml:"tls_client_ca_file"`
+	TlsClientNames  []string `json:"tls_client_names" yaml:"tls_client_names"`
+}
+
+// Config is the main configuration for this application. If no listeners are
+// set, a single listener is made from the Host, Port, Protocol and TLS fields.
+// Middleware sets the order of the ALB's target group filters ("rate_limit",
+// "cors", "basic_auth" and "jwt"); filters left out of the list are disabled.
+// Set AdminAddr to serve the operational endpoints (E.g. /healthz, /readyz and
+// /stats) on a separate admin server. Admin requests must come from
+// AdminAllowIps and carry AdminToken (or the SLB_ADMIN_TOKEN environment
+// variable) as a bearer token, if they are set; mutating admin routes are only
+// served if one is set. Requests from TraceAllowIps that set the TraceHeader
+// (X-LB-Trace by default) to 1 are answered with the target group that matched
+// them in that header. SIGHUP reloads only ServingDisabled; changes to the
+// other fields are logged and take effect on restart.
 type Config struct {
-	Type                string          `json:"type" yaml:"type"`         // LB type
-	Host                string          `json:"host" yaml:"host"`         // Listener host
-	Port                int             `json:"port" yaml:"port"`         // Listener port
-	Protocol            string          `json:"protocol" yaml:"protocol"` // Listener protocol
-	TlsEnabled          bool            `json:"tls_enabled" yaml:"tls_enabled"`
-	TlsCertFile         string          `json:"tls_cert_file" yaml:"tls_cert_file"`
-	TlsKeyFile          string          `json:"tls_key_file" yaml:"tls_key_file"`
-	Timeout             int64           `json:"timeout" yaml:"timeout"` // Connection timeout
-	RequestRate         int64           `json:"request_rate" yaml:"request_rate"`
-	RequestRateCap      int64           `json:"request_rate_cap" yaml:"request_rate_cap"`
-	HealthCheckInterval int             `json:"health_check_interval" yaml:"health_check_interval"`
-	TargetGroups        []LBTargetGroup `json:"target_groups" yaml:"target_groups"`
-	RespFormat          string          `json:"resp_format" yaml:"resp_format"` // Override LB response format
+	Type                 string          `json:"type" yaml:"type"`         // LB type
+	Host                 string          `json:"host" yaml:"host"`         // Listener host
+	Port                 int             `json:"port" yaml:"port"`         // Listener port
+	Protocol             string          `json:"protocol" yaml:"protocol"` // Listener protocol
+	TlsEnabled           bool            `json:"tls_enabled" yaml:"tls_enabled"`
+	TlsCertFile          string          `json:"tls_cert_file" yaml:"tls_cert_file"`
+	TlsKeyFile           string          `json:"tls_key_file" yaml:"tls_key_file"`
+	TlsClientCaFile      string          `json:"tls_client_ca_file" yaml:"tls_client_ca_file"`
+	TlsClientNames       []string        `json:"tls_client_names" yaml:"tls_client_names"`
+	TlsHeaders           *LBTlsHeaders   `json:"tls_headers" yaml:"tls_headers"` // ALB client connection headers
+	Listeners            []LBListener    `json:"listeners" yaml:"listeners"`
+	Timeout              int64           `json:"timeout" yaml:"timeout"`                               // Connection timeout
+	RequestTimeout       int64           `json:"request_timeout" yaml:"request_timeout"`               // ALB total request timeout in seconds
+	RelayIdleTimeout     int64           `json:"relay_idle_timeout" yaml:"relay_idle_timeout"`         // NLB relay idle timeout in seconds
+	MaxConns             int             `json:"max_connections" yaml:"max_connections"`               // NLB open connections
+	MaxConnsPerIp        int             `json:"max_connections_per_ip" yaml:"max_connections_per_ip"` // NLB open connections per source IP
+	RequestRate          int64           `json:"request_rate" yaml:"request_rate"`
+	RequestRateCap       int64           `json:"request_rate_cap" yaml:"request_rate_cap"`
+	SharedRateLimit      bool            `json:"shared_rate_limit" yaml:"shared_rate_limit"` // ALB rate limit clients across target groups
+	ServingDisabled      bool            `json:"serving_disabled" yaml:"serving_disabled"`   // ALB answer every request with 503; reloaded on SIGHUP
+	HealthCheckInterval  int             `json:"health_check_interval" yaml:"health_check_interval"`
+	HealthCheckTimeout   int64           `json:"health_check_timeout" yaml:"health_check_timeout"`             // Health check probe timeout in seconds
+	HealthCheckRetries   int             `json:"health_check_probe_retries" yaml:"health_check_probe_retries"` // Failed probe retries per check
+	WebhookUrl           string          `json:"webhook_url" yaml:"webhook_url"`                               // Health transition webhook
+	TargetGroups         []LBTargetGroup `json:"target_groups" yaml:"target_groups"`
+	RequestIdHeader      string          `json:"request_id_header" yaml:"request_id_header"`           // ALB request ID header; defaults to X-Request-ID
+	RespFormat           string          `json:"resp_format" yaml:"resp_format"`                       // Override LB response format; "auto" follows the Accept header
+	HealthPath           string          `json:"health_path" yaml:"health_path"`                       // ALB reserved HEAD health path
+	HealthzPath          string          `json:"healthz_path" yaml:"healthz_path"`                     // ALB reserved self health path; E.g. /healthz
+	MaxHeaderBytes       int             `json:"max_header_bytes" yaml:"max_header_bytes"`             // ALB maximum request header bytes; defaults to 1MB
+	AdminAddr            string          `json:"admin_addr" yaml:"admin_addr"`                         // Admin server address; E.g. 127.0.0.1:9000
+	AdminToken           string          `json:"admin_token" yaml:"admin_token"`                       // Admin bearer token
+	AdminAllowIps        []string        `json:"admin_allow_ips" yaml:"admin_allow_ips"`               // Admin source IPs and CIDRs
+	RetryAllMethods      bool            `json:"retry_all_methods" yaml:"retry_all_methods"`           // ALB retry non-idempotent requests
+	RetryBudget          *int            `json:"retry_budget" yaml:"retry_budget"`                     // ALB re-serves allowed per request
+	RetryBackoff         *LBRetryBackoff `json:"retry_backoff" yaml:"retry_backoff"`                   // Backoff between retries of a failed target
+	UpstreamHeaders      bool            `json:"upstream_headers" yaml:"upstream_headers"`             // ALB name the backend in X-LB-Upstream and X-LB-Group
+	RewriteLocation      bool            `json:"rewrite_location" yaml:"rewrite_location"`             // ALB rewrite redirects to targets to the client's host
+	SlowRequestThreshold int64           `json:"slow_request_threshold" yaml:"slow_request_threshold"` // ALB slow request log threshold in milliseconds
+	TraceHeader          string          `json:"trace_header" yaml:"trace_header"`                     // ALB route trace request header
+	TraceAllowIps        []string        `json:"trace_allow_ips" yaml:"trace_allow_ips"`               // ALB route trace source IPs and CIDRs
+	LatencyBuckets       []int64         `json:"latency_buckets" yaml:"latency_buckets"`               // ALB latency histogram bucket bounds in milliseconds
+	ReadinessGate        bool            `json:"readiness_gate" yaml:"readiness_gate"`                 // Probe targets before starting
+	LogFormat            string          `json:"log_format" yaml:"log_format"`                         // "text" or "json"
+	LogLevel             string          `json:"log_level" yaml:"log_level"`                           // Defaults to "info"; "debug" logs request timings
+	Middleware           []string        `json:"middleware" yaml:"middleware"`                         // ALB ordered target group filters
 }
 
 // LoadConfig loads the given JSON file and returns a newly populated Config.
@@ -74,3 +416,316 @@ func LoadConfig(fname string) (Config, error) {
 	}
 	return config, nil
 }
+
+// Validate returns an error listing every problem found in the configuration;
+// E.g. an unknown load balancer type, duplicate names, or references to
+// listeners and target groups that do not exist. Nil is returned if none are
+// found.
+//
+// Listener protocols depend on the load balancer type. Application listeners
+// are "http" or "https"; "https" implies TLS, and TLS listeners need a
+// certificate and key of their own or the default ones. Network listeners are
+// "tcp" (the default), or an application protocol carried over TCP, and do not
+// terminate TLS; UDP is not supported.
+func (c Config) Validate() error {
+	problems := []string{}
+	lbType := loadbalancers.Type(c.Type)
+	if lbType == loadbalancers.LoadBalancerTypeUnknown {
+		problems = append(problems,
+			fmt.Sprintf("unknown load balancer type '%s'", c.Type))
+	}
+	lbListeners := newListeners(c)
+	for _, l := range lbListeners {
+		problems = append(problems, c.listenerProblems(lbType, l)...)
+	}
+	listeners := map[string]bool{}
+	for _, l := range c.Listeners {
+		if l.Port < 1 || l.Port > 65535 {
+			problems = append(problems, fmt.Sprintf(
+				"invalid port %d of listener '%s'", l.Port,
+				l.Name))
+		}
+		if l.Name == "" {
+			if len(c.Listeners) > 1 {
+				problems = append(problems, fmt.Sprintf(
+					"listener %s:%d without a name", l.Host,
+					l.Port))
+			}
+			continue
+		}
+		if listeners[strings.ToLower(l.Name)] {
+			problems = append(problems, fmt.Sprintf(
+				"duplicate listener '%s'", l.Name))
+		}
+		listeners[strings.ToLower(l.Name)] = true
+	}
+	if len(c.Listeners) == 0 && (c.Port < 1 || c.Port > 65535) {
+		problems = append(problems, fmt.Sprintf("invalid port %d",
+			c.Port))
+	}
+	if c.MaxHeaderBytes < 0 {
+		problems = append(problems, fmt.Sprintf(
+			"invalid max_header_bytes %d", c.MaxHeaderBytes))
+	}
+	if c.SlowRequestThreshold < 0 {
+		problems = append(problems, fmt.Sprintf(
+			"invalid slow_request_threshold %d", c.SlowRequestThreshold))
+	}
+	if b := c.RetryBackoff; b != nil {
+		if b.Base < 0 || b.Max < 0 || b.Multiplier < 0 ||
+			(b.Multiplier > 0 && b.Multiplier < 1) {
+			problems = append(problems, "invalid retry_backoff")
+		}
+	}
+	for i, b := range c.LatencyBuckets {
+		if b <= 0 || (i > 0 && b <= c.LatencyBuckets[i-1]) {
+			problems = append(problems,
+				"latency_buckets must be positive and increasing")
+			break
+		}
+	}
+	if len(c.TargetGroups) == 0 {
+		problems = append(problems, "no target groups")
+	}
+	groups := map[string]bool{}
+	for _, tg := range c.TargetGroups {
+		if tg.Name == "" {
+			problems = append(problems, "target group without a name")
+		} else if groups[tg.Name] {
+			problems = append(problems, fmt.Sprintf(
+				"duplicate target group '%s'", tg.Name))
+		}
+		groups[tg.Name] = true
+		if hc := tg.HealthCheck; hc != nil && hc.Type != "" &&
+			hc.Type != targets.HealthCheckTypeHttp &&
+			hc.Type != targets.HealthCheckTypeGrpc {
+			problems = append(problems, fmt.Sprintf(
+				"unknown health check type '%s' of target group '%s'",
+				hc.Type, tg.Name))
+		}
+		if targets.ToStrategy(tg.Strategy) == targets.StrategyConsistentHash {
+			if tg.HashHeader == "" {
+				problems = append(problems, fmt.Sprintf(
+					"consistent_hash strategy of target group '%s' without a hash_header",
+					tg.Name))
+			}
+			if lbType == loadbalancers.LoadBalancerTypeNet {
+				problems = append(problems, fmt.Sprintf(
+					"consistent_hash strategy of target group '%s' requires an application load balancer",
+					tg.Name))
+			}
+		}
+		rule := rules.Rule{Conditions: tg.RuleConditions()}
+		for _, l := range lbListeners {
+			if !l.Matches(tg.Listener) {
+				continue
+			}
+			if err := rule.ValidTls(l.TlsEnabled); err != nil {
+				problems = append(problems, fmt.Sprintf(
+					"target group '%s' on listener %s: %s",
+					tg.Name, l.Addr, err))
+			} else if l.TlsClientCaFile == "" && rule.RequiresClientCa() {
+				problems = append(problems, fmt.Sprintf(
+					"target group '%s' on listener %s: %s",
+					tg.Name, l.Addr, rules.ErrClientCnCondition))
+			}
+		}
+		if tg.MaxTargets < 0 {
+			problems = append(problems, fmt.Sprintf(
+				"invalid max_targets %d of target group '%s'",
+				tg.MaxTargets, tg.Name))
+		}
+		if tg.HashLoadFactor != 0 && tg.HashLoadFactor < 1 {
+			problems = append(problems, fmt.Sprintf(
+				"invalid hash_load_factor %g of target group '%s'",
+				tg.HashLoadFactor, tg.Name))
+		}
+		if hc := tg.HealthCheck; hc != nil && hc.BodyMatch != "" {
+			if lbType != loadbalancers.LoadBalancerTypeApp {
+				problems = append(problems, fmt.Sprintf(
+					"health check body_match of target group '%s' is not supported by %s load balancers",
+					tg.Name, lbType.Long()))
+			}
+			if _, err := regexp.Compile(hc.BodyMatch); err != nil {
+				problems = append(problems, fmt.Sprintf(
+					"invalid health check body_match of target group '%s': %s",
+					tg.Name, err))
+			}
+		}
+		if tg.Dns != nil {
+			if lbType != loadbalancers.LoadBalancerTypeNet {
+				problems = append(problems, fmt.Sprintf(
+					"DNS target group '%s' is not supported by %s load balancers",
+					tg.Name, lbType.Long()))
+			}
+			if tg.Dns.Name == "" {
+				problems = append(problems, fmt.Sprintf(
+					"DNS target group '%s' is missing a name",
+					tg.Name))
+			}
+		}
+		if rl := tg.RateLimit; rl != nil {
+			if lbType != loadbalancers.LoadBalancerTypeApp {
+				problems = append(problems, fmt.Sprintf(
+					"rate limit of target group '%s' is not supported by %s load balancers",
+					tg.Name, lbType.Long()))
+			}
+			if rl.Rate <= 0 || rl.Capacity < 0 {
+				problems = append(problems, fmt.Sprintf(
+					"invalid rate limit of target group '%s'",
+					tg.Name))
+			}
+		}
+		if to := tg.Timeouts; to != nil {
+			if lbType != loadbalancers.LoadBalancerTypeNet {
+				problems = append(problems, fmt.Sprintf(
+					"timeouts of target group '%s' are not supported by %s load balancers",
+					tg.Name, lbType.Long()))
+			}
+			if to.Dial < 0 || to.Idle < 0 {
+				problems = append(problems, fmt.Sprintf(
+					"invalid timeouts of target group '%s'",
+					tg.Name))
+			}
+		}
+		if tg.Listener != "" && !listeners[strings.ToLower(tg.Listener)] {
+			problems = append(problems, fmt.Sprintf(
+				"unknown listener '%s' of target group '%s'",
+				tg.Listener, tg.Name))
+		}
+	}
+	for _, tg := range c.TargetGroups {
+		for _, t := range tg.Targets {
+			if t.HealthPort < 0 || t.HealthPort > 65535 {
+				problems = append(problems, fmt.Sprintf(
+					"invalid health check port %d of target group '%s'",
+					t.HealthPort, tg.Name))
+			}
+			if (t.DialTimeout != 0 || t.IdleTimeout != 0) &&
+				lbType != loadbalancers.LoadBalancerTypeNet {
+				problems = append(problems, fmt.Sprintf(
+					"timeouts of a target of target group '%s' are not supported by %s load balancers",
+					tg.Name, lbType.Long()))
+			}
+			if t.DialTimeout < 0 || t.IdleTimeout < 0 {
+				problems = append(problems, fmt.Sprintf(
+					"invalid timeouts of a target of target group '%s'",
+					tg.Name))
+			}
+			if p := t.protocol(tg); !validTargetProtocol(lbType, p) {
+				problems = append(problems, fmt.Sprintf(
+					"target protocol '%s' of target group '%s' is not supported by %s load balancers",
+					p, tg.Name, lbType.Long()))
+			}
+		}
+		for _, s := range tg.Rule.Split {
+			if !groups[s.TargetGroup] {
+				problems = append(problems, fmt.Sprintf(
+					"unknown split target group '%s' of '%s'",
+					s.TargetGroup, tg.Name))
+			}
+		}
+		if tg.MirrorTo != "" && !groups[tg.MirrorTo] {
+			problems = append(problems, fmt.Sprintf(
+				"unknown mirror target group '%s' of '%s'",
+				tg.MirrorTo, tg.Name))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid configuration: %s",
+			strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// changedFields returns the names of the fields of the given configurations
+// that differ, other than ServingDisabled; the fields a reload does not apply.
+func changedFields(prev, next Config) []string {
+	changed := []string{}
+	pv, nv := reflect.ValueOf(prev), reflect.ValueOf(next)
+	for i := 0; i < pv.NumField(); i++ {
+		field := pv.Type().Field(i)
+		if field.Name == "ServingDisabled" {
+			continue
+		}
+		if !reflect.DeepEqual(pv.Field(i).Interface(),
+			nv.Field(i).Interface()) {
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// protocol returns the protocol of the target in the given group; the URL's
+// scheme, the target's protocol, or else the group's protocol.
+func (t LBTarget) protocol(tg LBTargetGroup) string {
+	if t.Url != "" {
+		if u, err := url.Parse(t.Url); err == nil && u.Scheme != "" {
+			return u.Scheme
+		}
+	}
+	if t.Protocol != "" {
+		return t.Protocol
+	}
+	return tg.Protocol
+}
+
+// validTargetProtocol returns true if load balancers of the given type can
+// proxy to targets of the protocol; application load balancers to "http" and
+// "https" targets, and network load balancers to targets reached over TCP. An
+// empty protocol is left to the load balancer.
+func validTargetProtocol(lbType loadbalancers.LoadBalancerType, protocol string) bool {
+	if protocol == "" {
+		return true
+	}
+	switch lbType {
+	case loadbalancers.LoadBalancerTypeApp:
+		return strings.EqualFold(protocol, "http") ||
+			strings.EqualFold(protocol, "https")
+	case loadbalancers.LoadBalancerTypeNet:
+		for _, t := range targets.GetTransport(protocol) {
+			if t == "tcp" {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// listenerProblems returns the problems of the given listener's protocol and TLS
+// settings for the load balancer type.
+func (c Config) listenerProblems(lbType loadbalancers.LoadBalancerType, l loadbalancers.Listener) []string {
+	problems := []string{}
+	switch lbType {
+	case loadbalancers.LoadBalancerTypeApp:
+		if err := l.ValidAppProtocol(); err != nil {
+			problems = append(problems, fmt.Sprintf(
+				"listener %s: %s", l.Addr, err))
+		}
+		hasCert := (l.TlsCertFile != "" && l.TlsKeyFile != "") ||
+			(c.TlsCertFile != "" && c.TlsKeyFile != "")
+		if l.TlsEnabled && !hasCert {
+			problems = append(problems, fmt.Sprintf(
+				"listener %s: %s", l.Addr,
+				loadbalancers.ErrMissingTlsCert))
+		}
+	case loadbalancers.LoadBalancerTypeNet:
+		if _, err := l.Network(); err != nil {
+			problems = append(problems, fmt.Sprintf(
+				"listener %s: %s", l.Addr, err))
+		}
+		if l.TlsEnabled {
+			problems = append(problems, fmt.Sprintf(
+				"listener %s: network load balancers do not terminate TLS",
+				l.Addr))
+		}
+	}
+	if l.TlsClientCaFile != "" && !l.TlsEnabled {
+		problems = append(problems, fmt.Sprintf(
+			"listener %s: %s", l.Addr,
+			loadbalancers.ErrClientCaWithoutTls))
+	}
+	return problems
+}
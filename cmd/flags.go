@@ -6,12 +6,18 @@ import (
 
 type Flags struct {
 	ConfigFile string
+	Validate   bool // Validate the configuration and exit
+	Version    bool // Print the build version and exit
 }
 
 func ParseFlags() Flags {
 	config := flag.String("config-file", "config.json", "path to configuration file")
+	validate := flag.Bool("validate", false, "validate the configuration file and exit without starting")
+	version := flag.Bool("version", false, "print the build version and exit")
 	flag.Parse()
 	return Flags{
 		ConfigFile: *config,
+		Validate:   *validate,
+		Version:    *version,
 	}
 }
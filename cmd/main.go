@@ -3,18 +3,23 @@ package main
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/crossedbot/common/golang/logger"
 	"github.com/crossedbot/common/golang/service"
 
+	"github.com/crossedbot/simpleloadbalancer/pkg/discovery/consul"
 	"github.com/crossedbot/simpleloadbalancer/pkg/loadbalancers"
+	"github.com/crossedbot/simpleloadbalancer/pkg/logging"
 	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
+	"github.com/crossedbot/simpleloadbalancer/pkg/services"
 	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
 )
 
@@ -23,32 +28,243 @@ const (
 	FATAL_EXITCODE = iota + 1
 )
 
+// AdminTokenEnv is the environment variable the admin token is read from when
+// the configuration does not set one.
+const AdminTokenEnv = "SLB_ADMIN_TOKEN"
+
+// log is the logger of the command.
+var log = logging.New("main")
+
 // fatal logs the given format string and arguments as an error and exits with
 // FATAL_EXITCODE.
 func fatal(format string, a ...interface{}) {
-	logger.Error(fmt.Errorf(format, a...))
+	log.Error(fmt.Sprintf(format, a...))
 	os.Exit(FATAL_EXITCODE)
 }
 
+// newBasicAuthConfig returns the basic authentication settings for the given
+// configuration. An error is returned if a credential is not formatted as
+// "<username>:<bcrypt hash>".
+func newBasicAuthConfig(c LBBasicAuth) (*targets.BasicAuthConfig, error) {
+	auth := &targets.BasicAuthConfig{
+		Realm:       c.Realm,
+		Credentials: make(map[string]string),
+		AllowIps:    c.AllowIps,
+	}
+	for _, cred := range c.Credentials {
+		parts := strings.SplitN(cred, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf(
+				"Invalid basic auth credential for '%s'",
+				parts[0])
+		}
+		auth.Credentials[parts[0]] = parts[1]
+	}
+	return auth, nil
+}
+
+// newJwtConfig returns the JWT authentication settings for the given
+// configuration. The public key file is read if set.
+func newJwtConfig(c LBJwt) (*targets.JwtConfig, error) {
+	jwt := &targets.JwtConfig{
+		Secret:        c.Secret,
+		JwksUrl:       c.JwksUrl,
+		Claims:        c.Claims,
+		SubjectHeader: c.SubjectHeader,
+	}
+	if c.PublicKeyFile != "" {
+		b, err := ioutil.ReadFile(c.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		jwt.PublicKey = string(b)
+	}
+	return jwt, nil
+}
+
+// newConsulProvider returns a target provider of the Consul service in the
+// given configuration.
+func newConsulProvider(c LBConsul) (targets.Provider, error) {
+	return consul.New(consul.Config{
+		Address:    c.Address,
+		Datacenter: c.Datacenter,
+		Service:    c.Service,
+		Tag:        c.Tag,
+		Token:      c.Token,
+	})
+}
+
 // addTargetGroups adds the configured target groups to the given load balancer.
 func addTargetGroups(lb loadbalancers.LoadBalancer, targetGroups []LBTargetGroup) error {
 	for _, targetGroup := range targetGroups {
 		rule := rules.Rule{
-			Action:     rules.NewRuleAction(targetGroup.Rule.Action),
-			Conditions: targetGroup.Rule.Conditions,
+			Action:     rules.NewRuleAction(targetGroup.RuleAction()),
+			Conditions: targetGroup.RuleConditions(),
+			SplitKey:   targetGroup.Rule.SplitKey,
+			Path: rules.PathOptions{
+				IgnoreCase:          targetGroup.PathIgnoreCase,
+				IgnoreTrailingSlash: targetGroup.PathTrimSlash,
+				IncludeQuery:        targetGroup.PathQuery,
+			},
+		}
+		for _, split := range targetGroup.Rule.Split {
+			rule.Split = append(rule.Split, rules.SplitTarget{
+				Name:   split.TargetGroup,
+				Weight: split.Weight,
+			})
+		}
+		// Groups without an action only receive mirrored requests or
+		// belong to a network load balancer
+		if targetGroup.RuleAction() != "" {
+			if err := rule.Valid(); err != nil {
+				return fmt.Errorf("%s - '%s'", err,
+					targetGroup.Name)
+			}
 		}
 		tg := targets.NewTargetGroup(targetGroup.Name,
 			targetGroup.Protocol, rule)
+		tg.Listener = targetGroup.Listener
+		tg.MirrorTo = targetGroup.MirrorTo
+		tg.HashHeader = targetGroup.HashHeader
+		tg.MaxTargets = targetGroup.MaxTargets
+		tg.HashLoad = targetGroup.HashLoadFactor
+		if targetGroup.Strategy != "" {
+			tg.Strategy = targets.ToStrategy(targetGroup.Strategy)
+			if tg.Strategy == targets.StrategyUnknown {
+				return fmt.Errorf("Unknown strategy - '%s'",
+					targetGroup.Strategy)
+			}
+		}
+		if targetGroup.BasicAuth != nil {
+			auth, err := newBasicAuthConfig(*targetGroup.BasicAuth)
+			if err != nil {
+				return err
+			}
+			tg.BasicAuth = auth
+		}
+		if targetGroup.Jwt != nil {
+			jwt, err := newJwtConfig(*targetGroup.Jwt)
+			if err != nil {
+				return err
+			}
+			tg.Jwt = jwt
+		}
+		if cors := targetGroup.Cors; cors != nil {
+			tg.Cors = &targets.CorsConfig{
+				AllowOrigins:     cors.AllowOrigins,
+				AllowMethods:     cors.AllowMethods,
+				AllowHeaders:     cors.AllowHeaders,
+				AllowCredentials: cors.AllowCredentials,
+				MaxAge: time.Duration(cors.MaxAge) *
+					time.Second,
+			}
+		}
+		if dns := targetGroup.Dns; dns != nil {
+			tg.Dns = &targets.DnsConfig{
+				Name: dns.Name,
+				TTL:  time.Duration(dns.TTL) * time.Second,
+			}
+		}
+		if to := targetGroup.Timeouts; to != nil {
+			tg.Timeouts = &targets.TimeoutConfig{
+				Dial: time.Duration(to.Dial) * time.Second,
+				Idle: time.Duration(to.Idle) * time.Second,
+			}
+		}
+		if tr := targetGroup.Transport; tr != nil {
+			tg.Transport = &targets.TransportConfig{
+				DisableKeepAlives: tr.DisableKeepAlives,
+				IdleConnTimeout: time.Duration(
+					tr.IdleConnTimeout) * time.Second,
+				MaxConnsPerHost: tr.MaxConnsPerHost,
+			}
+		}
+		if c := targetGroup.Cache; c != nil {
+			tg.Cache = &targets.CacheConfig{
+				MaxEntries: c.MaxEntries,
+				TTL:        time.Duration(c.TTL) * time.Second,
+			}
+		}
+		if hc := targetGroup.HealthCheck; hc != nil {
+			tg.Health = &targets.HealthCheckConfig{
+				Type:      hc.Type,
+				Path:      hc.Path,
+				Method:    hc.Method,
+				Headers:   hc.Headers,
+				Body:      hc.Body,
+				BodyMatch: hc.BodyMatch,
+				Host:      hc.Host,
+				Send:      hc.Send,
+				Expect:    hc.Expect,
+				Service:   hc.Service,
+			}
+		}
+		if rd := targetGroup.Redirect; rd != nil {
+			tg.Redirect = &targets.RedirectConfig{
+				Scheme:      rd.Scheme,
+				Host:        rd.Host,
+				Path:        rd.Path,
+				Query:       rd.Query,
+				StripPrefix: rd.StripPrefix,
+				StatusCode:  rd.StatusCode,
+			}
+		}
+		if rl := targetGroup.RateLimit; rl != nil {
+			tg.RateLimit = &targets.RateLimitConfig{
+				Rate:           time.Duration(rl.Rate) * time.Millisecond,
+				Capacity:       rl.Capacity,
+				TrustedProxies: rl.TrustedProxies,
+			}
+		}
+		if rh := targetGroup.ResponseHeaders; rh != nil {
+			tg.Response = &targets.ResponseHeadersConfig{
+				Remove:          rh.Remove,
+				Set:             rh.Set,
+				RewriteLocation: rh.RewriteLocation,
+			}
+		}
+		if targetGroup.Consul != nil {
+			p, err := newConsulProvider(*targetGroup.Consul)
+			if err != nil {
+				return err
+			}
+			tg.Providers = append(tg.Providers, p)
+		}
+		if targetGroup.TargetsFile != "" {
+			tg.Providers = append(tg.Providers,
+				targets.NewFileProvider(targetGroup.TargetsFile))
+		}
+		srvRefresh := time.Duration(targetGroup.SrvRefresh) *
+			time.Second
 		for _, target := range targetGroup.Targets {
+			var t targets.Target
+			if target.Srv != "" {
+				tg.Providers = append(tg.Providers,
+					targets.NewSrvProvider(target.Srv, srvRefresh))
+				continue
+			}
 			if target.Url != "" {
 				v, err := url.Parse(target.Url)
+				if err == nil {
+					err = targets.ValidServiceURL(v)
+				}
 				if err != nil {
 					return err
 				}
-				tg.AddServiceTarget(v)
+				t = tg.AddServiceTarget(v)
 			} else {
-				tg.AddTarget(target.Host, target.Port)
+				t = tg.AddProtocolTarget(target.Host,
+					target.Port, target.Protocol)
 			}
+			t.SetName(target.Name)
+			t.SetBackup(target.Backup)
+			t.SetDialTimeout(
+				time.Duration(target.DialTimeout) * time.Second)
+			t.SetHealthPort(target.HealthPort)
+			t.SetIdleTimeout(
+				time.Duration(target.IdleTimeout) * time.Second)
+			t.SetTlsServerName(target.TlsServerName)
+			t.SetWeight(target.Weight)
 		}
 		if err := lb.AddTargetGroup(tg); err != nil {
 			return err
@@ -57,65 +273,335 @@ func addTargetGroups(lb loadbalancers.LoadBalancer, targetGroups []LBTargetGroup
 	return nil
 }
 
+// newListeners returns the load balancer listeners for the given
+// configuration. If no listeners are configured, a single listener is returned
+// using the top-level listener fields.
+func newListeners(c Config) []loadbalancers.Listener {
+	configured := c.Listeners
+	if len(configured) == 0 {
+		configured = []LBListener{{
+			Host:            c.Host,
+			Port:            c.Port,
+			Protocol:        c.Protocol,
+			TlsEnabled:      c.TlsEnabled,
+			TlsCertFile:     c.TlsCertFile,
+			TlsKeyFile:      c.TlsKeyFile,
+			TlsClientCaFile: c.TlsClientCaFile,
+			TlsClientNames:  c.TlsClientNames,
+		}}
+	}
+	listeners := []loadbalancers.Listener{}
+	for _, l := range configured {
+		laddr := net.JoinHostPort(l.Host, strconv.Itoa(l.Port))
+		listener := loadbalancers.NewListener(l.Name, laddr,
+			l.Protocol)
+		if l.TlsEnabled || strings.EqualFold(l.Protocol, "https") {
+			listener.SetTLS(l.TlsCertFile, l.TlsKeyFile)
+		}
+		if l.TlsClientCaFile != "" {
+			listener.SetClientAuth(l.TlsClientCaFile,
+				l.TlsClientNames...)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners
+}
+
+// reloadServing sets whether the given load balancer serves requests from the
+// configuration file each time SIGHUP is received, until the given context is
+// done. Changes to the file's other fields, from the given running
+// configuration, are logged as not applied.
+func reloadServing(ctx context.Context, fname string, running Config, lb loadbalancers.LoadBalancer) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sig)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sig:
+			}
+			c, err := LoadConfig(fname)
+			if err != nil {
+				log.Error("Failed to reload configuration", logging.Fields{
+					logging.FieldError: err,
+				})
+				continue
+			}
+			lb.SetServing(!c.ServingDisabled)
+			log.Info("Reloaded configuration", logging.Fields{
+				"serving": lb.Serving(),
+			})
+			if changed := changedFields(running, c); len(changed) > 0 {
+				log.Warning("Configuration changes not applied until restart",
+					logging.Fields{"fields": changed})
+			}
+		}
+	}()
+}
+
+// logHealthChange logs the alive state transitions of targets.
+func logHealthChange(group string, t targets.Target, wasAlive, alive bool) {
+	state := "down"
+	if alive {
+		state = "up"
+	}
+	log.Info(fmt.Sprintf("Target is %s", state), logging.Fields{
+		logging.FieldTarget: t.URL(),
+		"group":             group,
+	})
+}
+
+// configureLogging sets the log format and level of the given configuration;
+// unset values keep the defaults of text logs at the info level.
+func configureLogging(c Config) error {
+	if c.LogFormat != "" {
+		if err := logging.SetFormat(c.LogFormat); err != nil {
+			return err
+		}
+	}
+	if c.LogLevel != "" {
+		if err := logging.SetLevel(c.LogLevel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // newLb returns a new LoadBalancer using the given configuration.
 func newLb(c Config) (loadbalancers.LoadBalancer, error) {
 	var lb loadbalancers.LoadBalancer
+	opts := []loadbalancers.Option{
+		loadbalancers.WithHealthPath(c.HealthPath),
+		loadbalancers.WithHealthzPath(c.HealthzPath),
+		loadbalancers.WithMaxHeaderBytes(c.MaxHeaderBytes),
+		loadbalancers.WithRequestIdHeader(c.RequestIdHeader),
+		loadbalancers.WithResponseFormat(c.RespFormat),
+		loadbalancers.WithHealthChange(logHealthChange),
+		loadbalancers.WithHealthCheckRetries(c.HealthCheckRetries),
+		loadbalancers.WithTimeouts(loadbalancers.Timeouts{
+			HealthCheck: time.Duration(c.HealthCheckTimeout) *
+				time.Second,
+			RelayIdle: time.Duration(c.RelayIdleTimeout) *
+				time.Second,
+			Request: time.Duration(c.RequestTimeout) *
+				time.Second,
+		}),
+	}
+	if c.TlsCertFile != "" || c.TlsKeyFile != "" {
+		// Default certificate of TLS listeners that do not set one
+		opts = append(opts,
+			loadbalancers.WithTLS(c.TlsCertFile, c.TlsKeyFile))
+	}
+	if c.ReadinessGate {
+		opts = append(opts, loadbalancers.WithReadinessGate())
+	}
+	if c.UpstreamHeaders {
+		opts = append(opts, loadbalancers.WithUpstreamHeaders())
+	}
+	if c.RewriteLocation {
+		opts = append(opts, loadbalancers.WithRewriteLocation())
+	}
+	if c.SharedRateLimit {
+		opts = append(opts, loadbalancers.WithSharedRateLimit())
+	}
+	if c.SlowRequestThreshold > 0 {
+		opts = append(opts, loadbalancers.WithSlowRequestThreshold(
+			time.Duration(c.SlowRequestThreshold)*time.Millisecond))
+	}
+	if len(c.TraceAllowIps) > 0 {
+		opts = append(opts, loadbalancers.WithRouteTrace(
+			loadbalancers.RouteTrace{
+				Header:   c.TraceHeader,
+				AllowIps: c.TraceAllowIps,
+			}))
+	}
+	if len(c.LatencyBuckets) > 0 {
+		bounds := make([]time.Duration, len(c.LatencyBuckets))
+		for i, b := range c.LatencyBuckets {
+			bounds[i] = time.Duration(b) * time.Millisecond
+		}
+		opts = append(opts, loadbalancers.WithLatencyBuckets(bounds...))
+	}
+	if c.RetryAllMethods {
+		opts = append(opts, loadbalancers.WithRetryAllMethods())
+	}
+	if c.RetryBudget != nil {
+		opts = append(opts,
+			loadbalancers.WithRetryBudget(*c.RetryBudget))
+	}
+	if b := c.RetryBackoff; b != nil {
+		opts = append(opts, loadbalancers.WithRetryBackoff(
+			targets.Backoff{
+				Base: time.Duration(b.Base) *
+					time.Millisecond,
+				Multiplier: b.Multiplier,
+				Max: time.Duration(b.Max) *
+					time.Millisecond,
+			}))
+	}
+	if h := c.TlsHeaders; h != nil {
+		opts = append(opts, loadbalancers.WithTlsHeaders(
+			services.TlsHeaders{
+				Proto:         h.Proto,
+				Cipher:        h.Cipher,
+				Version:       h.Version,
+				ClientSubject: h.ClientSubject,
+			}))
+	}
 	lbType := loadbalancers.Type(c.Type)
 	switch lbType {
 	case loadbalancers.LoadBalancerTypeApp:
 		rate := time.Duration(c.RequestRate) * time.Second
 		lb = loadbalancers.NewApplicationLoadBalancer(rate,
-			c.RequestRateCap)
+			c.RequestRateCap, opts...)
 	case loadbalancers.LoadBalancerTypeNet:
 		timeout := time.Duration(c.Timeout) * time.Second
-		lb = loadbalancers.NewNetworkLoadBalancer(timeout)
+		opts = append(opts, loadbalancers.WithConnLimits(
+			loadbalancers.ConnLimits{
+				Total: c.MaxConns,
+				PerIp: c.MaxConnsPerIp,
+			}))
+		lb = loadbalancers.NewNetworkLoadBalancer(timeout, opts...)
 	default:
 		return nil, fmt.Errorf("Invalid load balancer type")
 	}
-	if c.TlsEnabled {
-		lb.SetTLS(c.TlsCertFile, c.TlsKeyFile)
-	}
-	if c.RespFormat != "" {
-		lb.SetResponseFormat(c.RespFormat)
+	if c.Middleware != nil {
+		if err := lb.SetMiddleware(c.Middleware...); err != nil {
+			return nil, err
+		}
 	}
 	err := addTargetGroups(lb, c.TargetGroups)
 	return lb, err
 }
 
+// validate loads and validates the given configuration file, and builds its
+// load balancer and listeners without binding ports or starting health checks.
+// A report is printed if the configuration is valid, otherwise an error is
+// returned.
+func validate(fname string) error {
+	c, err := LoadConfig(fname)
+	if err != nil {
+		return err
+	}
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if err := configureLogging(c); err != nil {
+		return err
+	}
+	lb, err := newLb(c)
+	if err != nil {
+		return err
+	}
+	listeners := newListeners(c)
+	fmt.Printf("Configuration '%s' is valid: %s load balancer, %d listener(s), %d target group(s)\n",
+		fname, lb.Type(), len(listeners), len(c.TargetGroups))
+	return nil
+}
+
 // run is the main routine that runs the loadbalancer using its given
 // configuration file. Returns nil if exited cleanly, otherwise an error is
 // returned.
-func run(ctx context.Context) error {
-	f := ParseFlags()
+func run(ctx context.Context, f Flags) error {
 	c, err := LoadConfig(f.ConfigFile)
 	if err != nil {
 		return err
 	}
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if err := configureLogging(c); err != nil {
+		return err
+	}
 	lb, err := newLb(c)
 	if err != nil {
 		return err
 	}
+	lb.SetServing(!c.ServingDisabled)
+	reloadServing(ctx, f.ConfigFile, c, lb)
+	if c.WebhookUrl != "" {
+		notify, stopWebhook := loadbalancers.NewHealthWebhook(
+			c.WebhookUrl)
+		defer stopWebhook()
+		lb.OnHealthChange(func(group string, t targets.Target, wasAlive, alive bool) {
+			logHealthChange(group, t, wasAlive, alive)
+			notify(group, t, wasAlive, alive)
+		})
+	}
 	stopGC := lb.GC()
 	defer stopGC()
 	stopHealthCheck := lb.HealthCheck(
 		time.Duration(c.HealthCheckInterval) * time.Second)
 	defer stopHealthCheck()
-	laddr := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
-	stopLb, err := lb.Start(laddr, c.Protocol)
+	stopDiscover := lb.Discover()
+	defer stopDiscover()
+	listeners := newListeners(c)
+	stopLb, err := lb.Start(listeners...)
 	if err != nil {
 		return err
 	}
 	defer stopLb()
-	logger.Info(fmt.Sprintf("Listening on %s", laddr))
+	for _, l := range listeners {
+		log.Info("Listening", logging.Fields{
+			"listener": l.Addr,
+			"version":  Version,
+		})
+	}
+	if c.AdminAddr != "" {
+		admin := loadbalancers.NewAdminServer(lb)
+		token := c.AdminToken
+		if token == "" {
+			token = os.Getenv(AdminTokenEnv)
+		}
+		admin.SetAuth(loadbalancers.AdminAuth{
+			Token:    token,
+			AllowIps: c.AdminAllowIps,
+		})
+		if err := admin.HandleMutating(loadbalancers.DefaultServingPath,
+			loadbalancers.ServingHandler(lb)); err != nil {
+			log.Warning("Serving switch disabled", logging.Fields{
+				logging.FieldError: err,
+			})
+		}
+		if err := admin.HandleMutating(
+			loadbalancers.DefaultTargetHealthPath,
+			loadbalancers.TargetHealthHandler(lb)); err != nil {
+			log.Warning("Target health override disabled",
+				logging.Fields{logging.FieldError: err})
+		}
+		stopAdmin, err := admin.Start(c.AdminAddr)
+		if err != nil {
+			return err
+		}
+		defer stopAdmin()
+		log.Info("Admin listening", logging.Fields{
+			"listener": c.AdminAddr,
+		})
+	}
 	<-ctx.Done()
-	logger.Info("Received signal, shutting down...")
+	log.Info("Received signal, shutting down...")
 	return nil
 }
 
 func main() {
+	f := ParseFlags()
+	if f.Version {
+		fmt.Println(versionString())
+		return
+	}
+	loadbalancers.Version = Version
+	if f.Validate {
+		if err := validate(f.ConfigFile); err != nil {
+			fatal("Error: %s", err)
+		}
+		return
+	}
 	ctx := context.Background()
 	svc := service.New(ctx)
-	if err := svc.Run(run, syscall.SIGINT, syscall.SIGTERM); err != nil {
+	runFn := func(ctx context.Context) error { return run(ctx, f) }
+	if err := svc.Run(runFn, syscall.SIGINT, syscall.SIGTERM); err != nil {
 		fatal("Error: %s", err)
 	}
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information; set at build time with the linker. E.g.
+//
+//	go build -ldflags "-X main.Version=v1.2.3 -X main.Commit=$(git rev-parse HEAD)"
+var (
+	Version = "dev" // Build version
+	Commit  = ""    // Source commit; defaults to the VCS revision
+)
+
+// commit returns the source commit of the build; the commit set at build time
+// or the VCS revision stamped by the Go toolchain, otherwise "unknown".
+func commit() string {
+	if Commit != "" {
+		return Commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				return s.Value
+			}
+		}
+	}
+	return "unknown"
+}
+
+// versionString returns the build version, commit, and Go version.
+func versionString() string {
+	return fmt.Sprintf("%s (commit %s, %s)", Version, commit(),
+		runtime.Version())
+}
@@ -5,15 +5,17 @@ go 1.19
 require (
 	github.com/crossedbot/collections v0.0.0-20220911043123-33647ad44e42
 	github.com/crossedbot/common v0.0.0-20220911035328-a84c7bdd9808
+	github.com/fsnotify/fsnotify v1.6.0
+	github.com/sirupsen/logrus v1.9.0
 	github.com/stretchr/testify v1.8.0
 	github.com/valyala/quicktemplate v1.7.0
+	golang.org/x/crypto v0.0.0-20220829220503-c86fa9a7ed90
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/sirupsen/logrus v1.9.0 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	golang.org/x/sys v0.0.0-20220909162455-aba9fc2a8ff2 // indirect
 )
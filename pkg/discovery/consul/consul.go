@@ -0,0 +1,219 @@
+// Package consul implements a target provider backed by the Consul health API.
+// It only uses the standard library, so it adds no dependencies for users that
+// do not use Consul.
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/logging"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+const (
+	// DefaultAddress is the address of the Consul agent when none is set.
+	DefaultAddress = "http://127.0.0.1:8500"
+
+	// DefaultWaitTime is how long a blocking query waits for changes
+	// before Consul returns the current instances.
+	DefaultWaitTime = 5 * time.Minute
+
+	// RetryInterval is the minimum time between queries after one fails.
+	RetryInterval = time.Second
+
+	// MaxRetryInterval is the maximum time between queries after several
+	// fail.
+	MaxRetryInterval = 30 * time.Second
+)
+
+// log is the logger of the consul package.
+var log = logging.New("consul")
+
+var (
+	ErrMissingService = errors.New("Missing Consul service name")
+)
+
+// Config represents the configuration of a Consul provider.
+type Config struct {
+	Address    string // Consul agent address; E.g. http://127.0.0.1:8500
+	Datacenter string // Datacenter to query; defaults to the agent's
+	Service    string // Service name
+	Tag        string // Only instances with this tag
+	Token      string // ACL token
+}
+
+// serviceEntry represents an entry of a Consul health service response.
+type serviceEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string `json:"Address"`
+		Port    int    `json:"Port"`
+		Weights struct {
+			Passing int `json:"Passing"`
+		} `json:"Weights"`
+	} `json:"Service"`
+}
+
+// provider implements the targets.Provider interface for the passing instances
+// of a Consul service.
+type provider struct {
+	Client *http.Client // Client for querying Consul
+	Config Config       // Provider configuration
+}
+
+// New returns a new targets.Provider of the passing instances of the service in
+// the given configuration.
+func New(c Config) (targets.Provider, error) {
+	if c.Service == "" {
+		return nil, ErrMissingService
+	}
+	if c.Address == "" {
+		c.Address = DefaultAddress
+	}
+	if _, err := url.Parse(c.Address); err != nil {
+		return nil, err
+	}
+	return &provider{
+		// Blocking queries are held open for up to the wait time, plus
+		// some jitter added by Consul
+		Client: &http.Client{Timeout: DefaultWaitTime + time.Minute},
+		Config: c,
+	}, nil
+}
+
+func (p *provider) Targets(protocol string) ([]targets.Target, error) {
+	ts, _, err := p.query(context.Background(), protocol, 0, 0)
+	return ts, err
+}
+
+func (p *provider) Watch(protocol string, fn func([]targets.Target)) targets.StopFn {
+	// Cancelling the context also cancels a blocked query
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		var index uint64
+		retry := time.Duration(0)
+		for {
+			if retry > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(retry):
+				}
+			}
+			ts, next, err := p.query(ctx, protocol, index,
+				DefaultWaitTime)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Error("Failed to query Consul service",
+					logging.Fields{
+						"service":          p.Config.Service,
+						logging.FieldError: err,
+					})
+				retry = nextRetry(retry)
+				continue
+			}
+			retry = 0
+			if next < index {
+				// The index went backwards (E.g. the Consul
+				// state was restored); start over
+				index = 0
+				continue
+			}
+			if next == index {
+				// The wait time elapsed without changes
+				continue
+			}
+			index = next
+			if len(ts) == 0 {
+				log.Error("No passing instances of Consul service",
+					logging.Fields{"service": p.Config.Service})
+				continue
+			}
+			fn(ts)
+		}
+	}()
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
+
+// query returns the passing instances of the service as targets of the given
+// protocol, and the Consul index of the result. If the index is set, the query
+// blocks until the result changes, the given wait time elapses, or the context
+// is cancelled.
+func (p *provider) query(ctx context.Context, protocol string, index uint64, wait time.Duration) ([]targets.Target, uint64, error) {
+	q := url.Values{}
+	q.Set("passing", "1")
+	if p.Config.Tag != "" {
+		q.Set("tag", p.Config.Tag)
+	}
+	if p.Config.Datacenter != "" {
+		q.Set("dc", p.Config.Datacenter)
+	}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", fmt.Sprintf("%ds", int(wait.Seconds())))
+	}
+	u := fmt.Sprintf("%s/v1/health/service/%s?%s", p.Config.Address,
+		url.PathEscape(p.Config.Service), q.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if p.Config.Token != "" {
+		req.Header.Set("X-Consul-Token", p.Config.Token)
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("Unexpected status code %d",
+			resp.StatusCode)
+	}
+	var entries []serviceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	ts := []targets.Target{}
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		t := targets.NewTarget(host, e.Service.Port, protocol)
+		if e.Service.Weights.Passing > 0 {
+			t.SetWeight(e.Service.Weights.Passing)
+		}
+		ts = append(ts, t)
+	}
+	return ts, next, nil
+}
+
+// nextRetry returns the time to wait before the next query after a failed
+// query; doubling the last wait up to the maximum.
+func nextRetry(last time.Duration) time.Duration {
+	if last <= 0 {
+		return RetryInterval
+	}
+	if next := last * 2; next < MaxRetryInterval {
+		return next
+	}
+	return MaxRetryInterval
+}
@@ -0,0 +1,140 @@
+package consul
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+// fakeConsul is a Consul health API that serves the passing instances of a
+// single service and blocks queries until they change.
+type fakeConsul struct {
+	lock    sync.Mutex
+	changed chan struct{}
+	index   uint64
+	body    string
+	token   string
+}
+
+func newFakeConsul(body string) *fakeConsul {
+	return &fakeConsul{changed: make(chan struct{}), index: 1, body: body}
+}
+
+func (c *fakeConsul) Set(body string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.index++
+	c.body = body
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.lock.Lock()
+	c.token = r.Header.Get("X-Consul-Token")
+	changed := c.changed
+	index := c.index
+	c.lock.Unlock()
+	if r.URL.Path != "/v1/health/service/web" ||
+		r.URL.Query().Get("passing") != "1" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Query().Get("index") == fmt.Sprint(index) {
+		select {
+		case <-changed:
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	w.Header().Set("X-Consul-Index", fmt.Sprint(c.index))
+	fmt.Fprint(w, c.body)
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(Config{})
+	require.Equal(t, ErrMissingService, err)
+	p, err := New(Config{Service: "web"})
+	require.Nil(t, err)
+	require.Equal(t, DefaultAddress, p.(*provider).Config.Address)
+}
+
+func TestProviderTargets(t *testing.T) {
+	consul := newFakeConsul(`[
+		{"Node": {"Address": "10.0.0.1"},
+		 "Service": {"Address": "", "Port": 8080}},
+		{"Node": {"Address": "10.0.0.1"},
+		 "Service": {"Address": "10.0.1.2", "Port": 9090,
+			     "Weights": {"Passing": 3}}}
+	]`)
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	p, err := New(Config{
+		Address: server.URL,
+		Service: "web",
+		Token:   "secret",
+	})
+	require.Nil(t, err)
+	ts, err := p.Targets("http")
+	require.Nil(t, err)
+	require.Len(t, ts, 2)
+	require.Equal(t, "http://10.0.0.1:8080", ts[0].URL())
+	require.Equal(t, 1, ts[0].Weight())
+	require.Equal(t, "http://10.0.1.2:9090", ts[1].URL())
+	require.Equal(t, 3, ts[1].Weight())
+	require.Equal(t, "secret", consul.token)
+
+	p, err = New(Config{Address: server.URL, Service: "missing"})
+	require.Nil(t, err)
+	_, err = p.Targets("http")
+	require.NotNil(t, err)
+}
+
+func TestProviderWatch(t *testing.T) {
+	consul := newFakeConsul(
+		`[{"Service": {"Address": "10.0.0.1", "Port": 8080}}]`)
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	p, err := New(Config{Address: server.URL, Service: "web"})
+	require.Nil(t, err)
+	updated := make(chan []targets.Target, 2)
+	stop := p.Watch("http", func(ts []targets.Target) { updated <- ts })
+	defer stop()
+
+	// The first query returns the current instances
+	select {
+	case ts := <-updated:
+		require.Len(t, ts, 1)
+	case <-time.After(time.Second):
+		t.Fatal("targets were not watched")
+	}
+	consul.Set(`[
+		{"Service": {"Address": "10.0.0.1", "Port": 8080}},
+		{"Service": {"Address": "10.0.0.2", "Port": 8080}}
+	]`)
+	select {
+	case ts := <-updated:
+		require.Len(t, ts, 2)
+		require.Equal(t, "http://10.0.0.2:8080", ts[1].URL())
+	case <-time.After(2 * time.Second):
+		t.Fatal("targets were not updated")
+	}
+}
+
+func TestNextRetry(t *testing.T) {
+	require.Equal(t, RetryInterval, nextRetry(0))
+	require.Equal(t, 2*RetryInterval, nextRetry(RetryInterval))
+	require.Equal(t, MaxRetryInterval, nextRetry(MaxRetryInterval))
+}
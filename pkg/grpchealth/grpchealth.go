@@ -0,0 +1,302 @@
+// Package grpchealth implements a client of the gRPC health checking protocol,
+// speaking just enough HTTP/2 to make a single Check call.
+package grpchealth
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// gRPC health checking protocol (grpc.health.v1)
+const (
+	CheckPath     = "/grpc.health.v1.Health/Check"
+	ServingStatus = 1 // HealthCheckResponse SERVING status
+)
+
+// HTTP/2 framing used by the gRPC health check; see RFC 7540
+const (
+	h2Preface      = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	h2StreamId     = 1
+	h2MaxFrameSize = 1 << 14 // Default SETTINGS_MAX_FRAME_SIZE
+
+	h2FrameData      = 0x0
+	h2FrameHeaders   = 0x1
+	h2FrameRstStream = 0x3
+	h2FrameSettings  = 0x4
+	h2FramePing      = 0x6
+	h2FrameGoAway    = 0x7
+
+	h2FlagAck        = 0x1
+	h2FlagEndStream  = 0x1
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded     = 0x8
+)
+
+var (
+	// Errors
+	ErrInvalidFrame    = errors.New("Invalid HTTP/2 frame")
+	ErrInvalidResponse = errors.New("Invalid gRPC health check response")
+)
+
+// Check connects to the address using the given network protocol and returns
+// true if the grpc.health.v1 Check RPC for the service reports it is SERVING;
+// all within the given timeout. An empty service checks the server's overall
+// health. The connection is made with HTTP/2 over TLS if useTls is set, else
+// with cleartext HTTP/2 (h2c) using prior knowledge.
+func Check(network, addr string, to time.Duration, useTls bool, service string) bool {
+	status, err := healthStatus(network, addr, to, useTls, service)
+	return err == nil && status == ServingStatus
+}
+
+// healthStatus returns the serving status reported by the gRPC health service
+// at the given address.
+func healthStatus(network, addr string, to time.Duration, useTls bool, service string) (int, error) {
+	dialer := &net.Dialer{Timeout: to}
+	var conn net.Conn
+	var err error
+	scheme := "http"
+	if useTls {
+		// Like the connection checks, the cert's validity is skipped
+		config := &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"h2"},
+		}
+		conn, err = tls.DialWithDialer(dialer, network, addr, config)
+		scheme = "https"
+	} else {
+		conn, err = dialer.Dial(network, addr)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(to))
+	req := []byte(h2Preface)
+	req = appendFrame(req, h2FrameSettings, 0, 0, nil)
+	req = appendFrame(req, h2FrameHeaders, h2FlagEndHeaders, h2StreamId,
+		healthCheckHeaders(scheme, addr))
+	req = appendFrame(req, h2FrameData, h2FlagEndStream, h2StreamId,
+		grpcMessage(healthCheckRequest(service)))
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(conn)
+	var data []byte
+	for {
+		typ, flags, stream, payload, err := readFrame(r)
+		if err != nil {
+			return 0, err
+		}
+		switch typ {
+		case h2FrameSettings:
+			if flags&h2FlagAck == 0 {
+				ack := appendFrame(nil, h2FrameSettings, h2FlagAck, 0, nil)
+				if _, err := conn.Write(ack); err != nil {
+					return 0, err
+				}
+			}
+		case h2FramePing:
+			if flags&h2FlagAck == 0 {
+				ack := appendFrame(nil, h2FramePing, h2FlagAck, 0, payload)
+				if _, err := conn.Write(ack); err != nil {
+					return 0, err
+				}
+			}
+		case h2FrameGoAway:
+			return 0, ErrInvalidResponse
+		case h2FrameRstStream:
+			if stream == h2StreamId {
+				return 0, ErrInvalidResponse
+			}
+		case h2FrameHeaders:
+			// A trailers-only response carries an error status
+			if stream == h2StreamId && flags&h2FlagEndStream != 0 {
+				return 0, ErrInvalidResponse
+			}
+		case h2FrameData:
+			if stream != h2StreamId {
+				continue
+			}
+			payload, err = unpadFrame(flags, payload)
+			if err != nil {
+				return 0, err
+			}
+			data = append(data, payload...)
+			if msg, ok := grpcMessageBody(data); ok {
+				return healthCheckStatus(msg)
+			}
+			if flags&h2FlagEndStream != 0 {
+				return 0, ErrInvalidResponse
+			}
+		}
+	}
+}
+
+// healthCheckHeaders returns the HPACK encoded request headers of the health
+// check RPC. Each header is a literal without indexing, so the encoder needs no
+// dynamic table.
+func healthCheckHeaders(scheme, authority string) []byte {
+	b := []byte{0x83} // :method POST (static index 3)
+	if scheme == "https" {
+		b = append(b, 0x87) // :scheme https (static index 7)
+	} else {
+		b = append(b, 0x86) // :scheme http (static index 6)
+	}
+	b = appendHpackInt(b, 0, 4, 4) // :path
+	b = appendHpackString(b, CheckPath)
+	b = appendHpackInt(b, 0, 4, 1) // :authority
+	b = appendHpackString(b, authority)
+	b = appendHpackInt(b, 0, 4, 31) // content-type
+	b = appendHpackString(b, "application/grpc")
+	b = append(b, 0) // te has no static table entry
+	b = appendHpackString(b, "te")
+	b = appendHpackString(b, "trailers")
+	return b
+}
+
+// appendHpackInt appends the HPACK integer representation of n, using the given
+// number of prefix bits of the first byte; the rest of which hold the flags.
+func appendHpackInt(b []byte, flags byte, prefix uint, n int) []byte {
+	max := 1<<prefix - 1
+	if n < max {
+		return append(b, flags|byte(n))
+	}
+	b = append(b, flags|byte(max))
+	for n -= max; n >= 0x80; n >>= 7 {
+		b = append(b, byte(n&0x7f)|0x80)
+	}
+	return append(b, byte(n))
+}
+
+// appendHpackString appends the HPACK string literal of s without Huffman
+// encoding.
+func appendHpackString(b []byte, s string) []byte {
+	b = appendHpackInt(b, 0, 7, len(s))
+	return append(b, s...)
+}
+
+// appendFrame appends the HTTP/2 frame of the given type, flags, stream, and
+// payload.
+func appendFrame(b []byte, typ, flags byte, stream uint32, payload []byte) []byte {
+	n := len(payload)
+	b = append(b, byte(n>>16), byte(n>>8), byte(n), typ, flags)
+	b = binary.BigEndian.AppendUint32(b, stream&0x7fffffff)
+	return append(b, payload...)
+}
+
+// readFrame reads the next HTTP/2 frame from the reader and returns its type,
+// flags, stream, and payload.
+func readFrame(r io.Reader) (typ, flags byte, stream uint32, payload []byte, err error) {
+	var h [9]byte
+	if _, err = io.ReadFull(r, h[:]); err != nil {
+		return
+	}
+	n := int(h[0])<<16 | int(h[1])<<8 | int(h[2])
+	if n > h2MaxFrameSize {
+		err = ErrInvalidFrame
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	typ, flags = h[3], h[4]
+	stream = binary.BigEndian.Uint32(h[5:]) & 0x7fffffff
+	return
+}
+
+// unpadFrame returns the given DATA frame payload without its padding.
+func unpadFrame(flags byte, payload []byte) ([]byte, error) {
+	if flags&h2FlagPadded == 0 {
+		return payload, nil
+	}
+	if len(payload) == 0 || int(payload[0]) >= len(payload) {
+		return nil, ErrInvalidFrame
+	}
+	return payload[1 : len(payload)-int(payload[0])], nil
+}
+
+// grpcMessage returns the length-prefixed, uncompressed gRPC message of the
+// given protobuf encoded message.
+func grpcMessage(msg []byte) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// grpcMessageBody returns the first message of the given gRPC stream data, and
+// false if the message has not been fully received.
+func grpcMessageBody(data []byte) ([]byte, bool) {
+	if len(data) < 5 {
+		return nil, false
+	}
+	n := binary.BigEndian.Uint32(data[1:5])
+	if uint64(len(data)-5) < uint64(n) {
+		return nil, false
+	}
+	return data[:5+n], true
+}
+
+// healthCheckRequest returns the protobuf encoded HealthCheckRequest of the
+// given service.
+func healthCheckRequest(service string) []byte {
+	if service == "" {
+		return nil
+	}
+	b := []byte{0x0a} // Field 1 (service), length-delimited
+	b = binary.AppendUvarint(b, uint64(len(service)))
+	return append(b, service...)
+}
+
+// healthCheckStatus returns the status of the given length-prefixed gRPC
+// HealthCheckResponse message; unknown fields are skipped.
+func healthCheckStatus(msg []byte) (int, error) {
+	if len(msg) < 5 || msg[0] != 0 {
+		// Compression is never requested
+		return 0, ErrInvalidResponse
+	}
+	msg = msg[5:]
+	status := 0
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, ErrInvalidResponse
+		}
+		msg = msg[n:]
+		switch tag & 0x7 {
+		case 0: // Varint
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, ErrInvalidResponse
+			}
+			msg = msg[n:]
+			if tag>>3 == 1 {
+				status = int(v)
+			}
+		case 1: // 64-bit
+			if len(msg) < 8 {
+				return 0, ErrInvalidResponse
+			}
+			msg = msg[8:]
+		case 2: // Length-delimited
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || l > uint64(len(msg)-n) {
+				return 0, ErrInvalidResponse
+			}
+			msg = msg[n+int(l):]
+		case 5: // 32-bit
+			if len(msg) < 4 {
+				return 0, ErrInvalidResponse
+			}
+			msg = msg[4:]
+		default:
+			return 0, ErrInvalidResponse
+		}
+	}
+	return status, nil
+}
@@ -0,0 +1,207 @@
+package grpchealth
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	statuses := map[string]byte{
+		"":        ServingStatus,
+		"serving": ServingStatus,
+		"down":    2, // NOT_SERVING
+	}
+	errs := make(chan error, 10)
+	ts := httptest.NewUnstartedServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			msg, ok := grpcMessageBody(body)
+			switch {
+			case r.URL.Path != CheckPath:
+				errs <- errors.New("unexpected path " + r.URL.Path)
+			case r.Header.Get("Content-Type") != "application/grpc":
+				errs <- errors.New("unexpected content type")
+			case !ok:
+				errs <- errors.New("incomplete request message")
+			}
+			service := ""
+			if len(msg) > 7 {
+				service = string(msg[7:])
+			}
+			status, ok := statuses[service]
+			w.Header().Set("Content-Type", "application/grpc")
+			if !ok {
+				// Trailers-only NOT_FOUND response
+				w.Header().Set("Grpc-Status", "5")
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.Write(grpcMessage([]byte{0x08, status}))
+			w.Header().Set("Grpc-Status", "0")
+		}),
+	)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "https://")
+
+	require.True(t, Check("tcp", addr, time.Second, true, ""))
+	require.True(t, Check("tcp", addr, time.Second, true, "serving"))
+	require.False(t, Check("tcp", addr, time.Second, true, "down"))
+	require.False(t, Check("tcp", addr, time.Second, true, "unknown"))
+	close(errs)
+	for err := range errs {
+		require.Nil(t, err)
+	}
+
+	// Connection failures are unhealthy
+	ts.Close()
+	require.False(t, Check("tcp", addr, time.Second, true, ""))
+}
+
+func TestCheckH2c(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	// A raw HTTP/2 server that pings the client and answers with a padded
+	// SERVING response, then reads the client's acknowledgements
+	errs := make(chan error, 1)
+	go func() {
+		errs <- serveH2cHealthCheck(ln)
+	}()
+	require.True(t, Check("tcp", ln.Addr().String(), time.Second, false,
+		"serving"))
+	require.Nil(t, <-errs)
+}
+
+// serveH2cHealthCheck accepts a single cleartext HTTP/2 connection from the
+// listener and answers its health check with the SERVING status. An error is
+// returned if the client's frames are not those of a health check.
+func serveH2cHealthCheck(ln net.Listener) error {
+	conn, err := ln.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(conn)
+	preface := make([]byte, len(h2Preface))
+	if _, err := io.ReadFull(r, preface); err != nil {
+		return err
+	}
+	if string(preface) != h2Preface {
+		return errors.New("invalid preface")
+	}
+	var headers, data []byte
+	for done := false; !done; {
+		typ, flags, stream, payload, err := readFrame(r)
+		if err != nil {
+			return err
+		}
+		switch {
+		case typ == h2FrameHeaders && stream == h2StreamId:
+			headers = payload
+		case typ == h2FrameData && stream == h2StreamId:
+			data = append(data, payload...)
+			done = flags&h2FlagEndStream != 0
+		}
+	}
+	if len(headers) < 2 || headers[1] != 0x86 {
+		return errors.New("request scheme is not http")
+	}
+	if !bytes.Contains(headers, []byte(CheckPath)) {
+		return errors.New("request path is not the health check")
+	}
+	if msg, ok := grpcMessageBody(data); !ok ||
+		!bytes.Equal(msg[5:], healthCheckRequest("serving")) {
+		return errors.New("invalid health check request")
+	}
+
+	resp := appendFrame(nil, h2FrameSettings, 0, 0, nil)
+	resp = appendFrame(resp, h2FramePing, 0, 0, []byte("12345678"))
+	resp = appendFrame(resp, h2FrameHeaders, h2FlagEndHeaders, h2StreamId,
+		[]byte{0x88}) // :status 200
+	padded := append([]byte{2}, grpcMessage([]byte{0x08, ServingStatus})...)
+	resp = appendFrame(resp, h2FrameData, h2FlagPadded, h2StreamId,
+		append(padded, 0, 0))
+	if _, err := conn.Write(resp); err != nil {
+		return err
+	}
+	settingsAck, pingAck := false, false
+	for !settingsAck || !pingAck {
+		typ, flags, _, payload, err := readFrame(r)
+		if err != nil {
+			return err
+		}
+		if flags&h2FlagAck == 0 {
+			continue
+		}
+		switch typ {
+		case h2FrameSettings:
+			settingsAck = true
+		case h2FramePing:
+			if string(payload) != "12345678" {
+				return errors.New("invalid ping acknowledgement")
+			}
+			pingAck = true
+		}
+	}
+	return nil
+}
+
+func TestCheckNotHttp2(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+	require.False(t, Check("tcp", addr, time.Second, false, ""))
+}
+
+func TestAppendHpackInt(t *testing.T) {
+	// RFC 7541 C.1 examples
+	require.Equal(t, []byte{0x0a}, appendHpackInt(nil, 0, 5, 10))
+	require.Equal(t, []byte{0x1f, 0x9a, 0x0a}, appendHpackInt(nil, 0, 5, 1337))
+	require.Equal(t, []byte{0x2a}, appendHpackInt(nil, 0, 8, 42))
+}
+
+func TestReadFrame(t *testing.T) {
+	b := appendFrame(nil, h2FrameData, h2FlagPadded|h2FlagEndStream,
+		h2StreamId, []byte{2, 'o', 'k', 0, 0})
+	typ, flags, stream, payload, err := readFrame(bytes.NewReader(b))
+	require.Nil(t, err)
+	require.Equal(t, byte(h2FrameData), typ)
+	require.Equal(t, uint32(h2StreamId), stream)
+	payload, err = unpadFrame(flags, payload)
+	require.Nil(t, err)
+	require.Equal(t, []byte("ok"), payload)
+
+	_, err = unpadFrame(h2FlagPadded, []byte{4, 'o', 'k'})
+	require.Equal(t, ErrInvalidFrame, err)
+}
+
+func TestHealthCheckStatus(t *testing.T) {
+	// Unknown fields are skipped
+	msg := []byte{0x12, 0x01, 'x', 0x08, 0x01, 0x1d, 0, 0, 0, 0}
+	status, err := healthCheckStatus(grpcMessage(msg))
+	require.Nil(t, err)
+	require.Equal(t, ServingStatus, status)
+
+	_, err = healthCheckStatus(grpcMessage([]byte{0x12, 0x05, 'x'}))
+	require.Equal(t, ErrInvalidResponse, err)
+
+	require.Equal(t, []byte{0x0a, 0x03, 'f', 'o', 'o'}, healthCheckRequest("foo"))
+	require.Nil(t, healthCheckRequest(""))
+}
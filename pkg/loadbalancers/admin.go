@@ -0,0 +1,163 @@
+package loadbalancers
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/logging"
+	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
+	"github.com/crossedbot/simpleloadbalancer/pkg/services"
+)
+
+var ErrAdminUnsecured = errors.New("Admin authentication must be set before mutating routes are registered")
+
+// AdminAuth represents the authentication of admin requests. Requests must come
+// from one of the allowed source IPs or CIDR ranges, and carry the token as a
+// bearer token; each check is skipped if it is not set.
+type AdminAuth struct {
+	Token    string   // Required bearer token
+	AllowIps []string // Allowed source IPs and CIDR ranges
+}
+
+// IsSet returns true if the authentication checks anything.
+func (a AdminAuth) IsSet() bool {
+	return a.Token != "" || len(a.AllowIps) > 0
+}
+
+// AdminServer represents the load balancer's operational HTTP server; E.g. for
+// health, status, and metrics endpoints. Features register their routes onto
+// it, so every operational endpoint is served on one address and passes
+// through the same middleware.
+type AdminServer interface {
+	// Handle registers the handler for the given pattern, like
+	// http.ServeMux.
+	Handle(pattern string, h http.Handler)
+
+	// HandleMutating registers the handler of a route that changes the
+	// load balancer's state; E.g. draining a target. ErrAdminUnsecured is
+	// returned if the admin authentication is not set.
+	HandleMutating(pattern string, h http.Handler) error
+
+	// SetAuth sets the authentication of all admin requests. Requests from
+	// other source IPs are forbidden (403), and requests without the token
+	// are unauthorized (401).
+	SetAuth(a AdminAuth)
+
+	// Start binds the given address and serves the admin routes in a
+	// separate routine. It returns a stop function to shutdown the server.
+	Start(addr string) (StopFn, error)
+
+	// Use appends the given middleware to the chain that all admin
+	// requests pass through in order, after authentication.
+	Use(mw ...services.Middleware)
+}
+
+// adminServer implements the AdminServer interface.
+type adminServer struct {
+	Auth  AdminAuth      // Admin authentication
+	Chain services.Chain // Admin middleware chain
+	Mux   *http.ServeMux // Admin routes
+}
+
+// NewAdminServer returns a new AdminServer for the given load balancer with
+// its healthz, readyz, stats and rules routes registered.
+func NewAdminServer(lb LoadBalancer) AdminServer {
+	admin := &adminServer{Mux: http.NewServeMux()}
+	admin.Handle(DefaultHealthzPath, HealthzHandler(lb))
+	admin.Handle(DefaultReadyzPath, ReadyzHandler(lb))
+	admin.Handle(DefaultStatsPath, StatsHandler(lb))
+	admin.Handle(DefaultRulesPath, RulesHandler(lb))
+	return admin
+}
+
+func (admin *adminServer) Handle(pattern string, h http.Handler) {
+	admin.Mux.Handle(pattern, h)
+}
+
+func (admin *adminServer) HandleMutating(pattern string, h http.Handler) error {
+	if !admin.Auth.IsSet() {
+		return fmt.Errorf("%s - '%s'", ErrAdminUnsecured, pattern)
+	}
+	admin.Handle(pattern, h)
+	return nil
+}
+
+func (admin *adminServer) SetAuth(a AdminAuth) {
+	admin.Auth = a
+}
+
+func (admin *adminServer) Start(addr string) (StopFn, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := http.Server{
+		Addr: addr,
+		Handler: adminAuthMiddleware(admin.Auth)(
+			admin.Chain.Then(admin.Mux)),
+	}
+	go func() {
+		err := server.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			log.Error("Admin server failed", logging.Fields{
+				logging.FieldError: err,
+			})
+		}
+	}()
+	return func() {
+		server.Shutdown(context.Background())
+		ln.Close()
+	}, nil
+}
+
+func (admin *adminServer) Use(mw ...services.Middleware) {
+	admin.Chain = append(admin.Chain, mw...)
+}
+
+// adminAuthMiddleware returns a middleware that rejects admin requests that are
+// not authenticated by the given configuration. The source IP is taken from the
+// connection only, since forwarding headers can be set by anyone.
+func adminAuthMiddleware(a AdminAuth) services.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(a.AllowIps) > 0 &&
+				!rules.ContainsIP(a.AllowIps, remoteIp(r)) {
+				http.Error(w, http.StatusText(http.StatusForbidden),
+					http.StatusForbidden)
+				return
+			}
+			if a.Token != "" && !hasBearerToken(r, a.Token) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, http.StatusText(
+					http.StatusUnauthorized),
+					http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// hasBearerToken returns true if the given request's Authorization header
+// carries the token as a bearer token.
+func hasBearerToken(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	given := strings.TrimPrefix(auth, "Bearer ")
+	return given != auth &&
+		subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// remoteIp returns the IP address of the given request's connection; nil if it
+// could not be parsed.
+func remoteIp(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,90 @@
+package loadbalancers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminServer(t *testing.T) {
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	admin := NewAdminServer(lb)
+	admin.Handle("/status", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "status")
+		}))
+	admin.SetAuth(AdminAuth{Token: "secret"})
+	addr := getFreeAddr(t)
+	stop, err := admin.Start(addr)
+	require.Nil(t, err)
+	defer stop()
+
+	get := func(path, token string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, "http://"+addr+path,
+			nil)
+		require.Nil(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return resp.StatusCode, string(b)
+	}
+	code, _ := get(DefaultHealthzPath, "")
+	require.Equal(t, http.StatusUnauthorized, code)
+	code, _ = get(DefaultHealthzPath, "wrong")
+	require.Equal(t, http.StatusUnauthorized, code)
+	code, _ = get(DefaultHealthzPath, "secret")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = get(DefaultReadyzPath, "secret")
+	require.Equal(t, http.StatusOK, code)
+	code, body := get("/status", "secret")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "status", body)
+}
+
+func TestAdminServerHandleMutating(t *testing.T) {
+	admin := NewAdminServer(NewApplicationLoadBalancer(time.Second, 100))
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	require.NotNil(t, admin.HandleMutating("/drain", h))
+	admin.SetAuth(AdminAuth{AllowIps: []string{"127.0.0.1"}})
+	require.Nil(t, admin.HandleMutating("/drain", h))
+}
+
+func TestAdminAuthMiddleware(t *testing.T) {
+	handler := adminAuthMiddleware(AdminAuth{
+		Token:    "secret",
+		AllowIps: []string{"10.0.0.0/8"},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(remoteAddr, auth string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/status", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-Real-IP", "10.0.0.1")
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	require.Equal(t, http.StatusOK, serve("10.1.2.3:5000", "Bearer secret"))
+	require.Equal(t, http.StatusUnauthorized, serve("10.1.2.3:5000", ""))
+	require.Equal(t, http.StatusUnauthorized,
+		serve("10.1.2.3:5000", "secret"))
+	// Forwarding headers do not bypass the allow-list
+	require.Equal(t, http.StatusForbidden,
+		serve("192.168.1.1:5000", "Bearer secret"))
+
+	// Without authentication every request is allowed
+	handler = adminAuthMiddleware(AdminAuth{})(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	require.Equal(t, http.StatusOK, serve("192.168.1.1:5000", ""))
+}
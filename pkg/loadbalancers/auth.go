@@ -0,0 +1,75 @@
+package loadbalancers
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
+	"github.com/crossedbot/simpleloadbalancer/pkg/services"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+// DefaultBasicAuthRealm is the realm sent to clients when a target group's
+// basic authentication does not set one.
+const DefaultBasicAuthRealm = "Restricted"
+
+// dummyBcryptHash is compared against when a username is unknown, so that
+// unknown and known users take the same amount of time to reject.
+var dummyBcryptHash = []byte(
+	"$2a$10$uocbTl50urTGJtrlu3eauONC/eWZ.6sCz5qalmKMDYSlQ1.8WafXq")
+
+// basicAuthorized returns true if the given request is authorized by the given
+// basic authentication configuration. Requests from allowed source IPs bypass
+// authentication; the source IP is taken from the connection only, since
+// forwarding headers can be set by anyone.
+func basicAuthorized(r *http.Request, c *targets.BasicAuthConfig) bool {
+	if rules.ContainsIP(c.AllowIps, remoteIp(r)) {
+		return true
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	// Compare against every username in constant time to avoid leaking
+	// which usernames exist.
+	var hash []byte
+	for name, h := range c.Credentials {
+		if subtle.ConstantTimeCompare([]byte(name), []byte(user)) == 1 {
+			hash = []byte(h)
+		}
+	}
+	if hash == nil {
+		bcrypt.CompareHashAndPassword(dummyBcryptHash, []byte(pass))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(pass)) == nil
+}
+
+// basicAuthChallenge returns the WWW-Authenticate header value for the given
+// basic authentication configuration.
+func basicAuthChallenge(c *targets.BasicAuthConfig) string {
+	realm := c.Realm
+	if realm == "" {
+		realm = DefaultBasicAuthRealm
+	}
+	return fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm)
+}
+
+// basicAuthMiddleware returns a middleware that rejects requests that are not
+// authorized by the given basic authentication configuration.
+func basicAuthMiddleware(c *targets.BasicAuthConfig, format services.ResponseFormat) services.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !basicAuthorized(r, c) {
+				w.Header().Set("WWW-Authenticate",
+					basicAuthChallenge(c))
+				handleUnauthorized(w, format.Negotiate(r))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
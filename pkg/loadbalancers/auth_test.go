@@ -0,0 +1,52 @@
+package loadbalancers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+func TestBasicAuthorized(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"),
+		bcrypt.MinCost)
+	require.Nil(t, err)
+	c := &targets.BasicAuthConfig{
+		Credentials: map[string]string{"alice": string(hash)},
+		AllowIps:    []string{"10.0.0.0/8"},
+	}
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+	req.RemoteAddr = "127.0.0.1:8080"
+	require.False(t, basicAuthorized(req, c))
+
+	req.SetBasicAuth("alice", "secret")
+	require.True(t, basicAuthorized(req, c))
+	req.SetBasicAuth("alice", "wrong")
+	require.False(t, basicAuthorized(req, c))
+	req.SetBasicAuth("bob", "secret")
+	require.False(t, basicAuthorized(req, c))
+
+	// Allowed source IPs bypass authentication
+	req.Header.Del("Authorization")
+	req.RemoteAddr = "10.1.2.3:8080"
+	require.True(t, basicAuthorized(req, c))
+
+	// Forwarding headers are not trusted to bypass authentication
+	req.RemoteAddr = "127.0.0.1:8080"
+	req.Header.Set("X-Real-IP", "10.1.2.3")
+	req.Header.Set("X-Forward-For", "10.1.2.3")
+	require.False(t, basicAuthorized(req, c))
+}
+
+func TestBasicAuthChallenge(t *testing.T) {
+	c := &targets.BasicAuthConfig{}
+	require.Equal(t, `Basic realm="Restricted", charset="UTF-8"`,
+		basicAuthChallenge(c))
+	c.Realm = "admin"
+	require.Equal(t, `Basic realm="admin", charset="UTF-8"`,
+		basicAuthChallenge(c))
+}
@@ -0,0 +1,131 @@
+package loadbalancers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/services"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+// DefaultCorsAllowMethods is the list of methods allowed by CORS preflight
+// responses when a target group does not configure its own.
+var DefaultCorsAllowMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+}
+
+// isPreflight returns true if the given request is a CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// allowedOrigin returns the value of the Access-Control-Allow-Origin header for
+// the given origin, and whether the origin is allowed at all.
+func allowedOrigin(c *targets.CorsConfig, origin string) (string, bool) {
+	for _, o := range c.AllowOrigins {
+		if o == "*" {
+			if c.AllowCredentials {
+				// Wildcards can not be used with credentials,
+				// so echo the origin instead
+				return origin, true
+			}
+			return "*", true
+		}
+		if strings.EqualFold(o, origin) {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+// containsFold returns true if the list contains the given value; ignoring
+// case.
+func containsFold(list []string, v string) bool {
+	for _, s := range list {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// handlePreflight responds to the given CORS preflight request using the given
+// CORS configuration. Preflights from origins or for methods that are not
+// allowed are forbidden (HTTP code 403).
+func handlePreflight(w http.ResponseWriter, r *http.Request, c *targets.CorsConfig, format services.ResponseFormat) {
+	origin, ok := allowedOrigin(c, r.Header.Get("Origin"))
+	methods := c.AllowMethods
+	if len(methods) == 0 {
+		methods = DefaultCorsAllowMethods
+	}
+	method := r.Header.Get("Access-Control-Request-Method")
+	if !ok || !containsFold(methods, method) {
+		handleForbidden(w, format.Negotiate(r))
+		return
+	}
+	headers := w.Header()
+	headers.Set("Access-Control-Allow-Origin", origin)
+	if origin != "*" {
+		headers.Add("Vary", "Origin")
+	}
+	headers.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if containsFold(c.AllowHeaders, "*") {
+		requested := r.Header.Get("Access-Control-Request-Headers")
+		if requested != "" {
+			headers.Set("Access-Control-Allow-Headers", requested)
+		}
+	} else if len(c.AllowHeaders) > 0 {
+		headers.Set("Access-Control-Allow-Headers",
+			strings.Join(c.AllowHeaders, ", "))
+	}
+	if c.AllowCredentials {
+		headers.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if c.MaxAge > 0 {
+		headers.Set("Access-Control-Max-Age",
+			strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setCorsHeaders sets the CORS headers of the response to the given request,
+// if it is from an allowed origin; so browsers let the origin read it.
+func setCorsHeaders(w http.ResponseWriter, r *http.Request, c *targets.CorsConfig) {
+	if r.Header.Get("Origin") == "" {
+		return
+	}
+	origin, ok := allowedOrigin(c, r.Header.Get("Origin"))
+	if !ok {
+		return
+	}
+	headers := w.Header()
+	headers.Set("Access-Control-Allow-Origin", origin)
+	if origin != "*" {
+		headers.Add("Vary", "Origin")
+	}
+	if c.AllowCredentials {
+		headers.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// corsMiddleware returns a middleware that answers CORS preflight requests
+// using the given configuration. Other requests are passed on, and their
+// responses to allowed origins carry the CORS headers; so backends behind it
+// should not set their own.
+func corsMiddleware(c *targets.CorsConfig, format services.ResponseFormat) services.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isPreflight(r) {
+				handlePreflight(w, r, c, format)
+				return
+			}
+			setCorsHeaders(w, r, c)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package loadbalancers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/services"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+func TestIsPreflight(t *testing.T) {
+	req, err := http.NewRequest(http.MethodOptions, "/", nil)
+	require.Nil(t, err)
+	require.False(t, isPreflight(req))
+	req.Header.Set("Origin", "https://example.com")
+	require.False(t, isPreflight(req))
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	require.True(t, isPreflight(req))
+	req.Method = http.MethodGet
+	require.False(t, isPreflight(req))
+}
+
+func TestAllowedOrigin(t *testing.T) {
+	origin := "https://example.com"
+	c := &targets.CorsConfig{AllowOrigins: []string{origin}}
+	actual, ok := allowedOrigin(c, origin)
+	require.True(t, ok)
+	require.Equal(t, origin, actual)
+	_, ok = allowedOrigin(c, "https://evil.com")
+	require.False(t, ok)
+
+	c.AllowOrigins = []string{"*"}
+	actual, ok = allowedOrigin(c, origin)
+	require.True(t, ok)
+	require.Equal(t, "*", actual)
+
+	c.AllowCredentials = true
+	actual, ok = allowedOrigin(c, origin)
+	require.True(t, ok)
+	require.Equal(t, origin, actual)
+}
+
+func TestHandlePreflight(t *testing.T) {
+	origin := "https://example.com"
+	c := &targets.CorsConfig{
+		AllowOrigins:     []string{origin},
+		AllowMethods:     []string{"GET", "PUT"},
+		AllowHeaders:     []string{"*"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}
+	req, err := http.NewRequest(http.MethodOptions, "/", nil)
+	require.Nil(t, err)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	req.Header.Set("Access-Control-Request-Headers", "X-Custom")
+
+	rr1 := httptest.NewRecorder()
+	handlePreflight(rr1, req, c, services.ResponseFormatPlain)
+	require.Equal(t, http.StatusNoContent, rr1.Code)
+	headers := rr1.Header()
+	require.Equal(t, origin, headers.Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "GET, PUT", headers.Get("Access-Control-Allow-Methods"))
+	require.Equal(t, "X-Custom", headers.Get("Access-Control-Allow-Headers"))
+	require.Equal(t, "true",
+		headers.Get("Access-Control-Allow-Credentials"))
+	require.Equal(t, "600", headers.Get("Access-Control-Max-Age"))
+	require.Equal(t, "Origin", headers.Get("Vary"))
+
+	// Methods that are not allowed are forbidden
+	req.Header.Set("Access-Control-Request-Method", "DELETE")
+	rr2 := httptest.NewRecorder()
+	handlePreflight(rr2, req, c, services.ResponseFormatPlain)
+	require.Equal(t, http.StatusForbidden, rr2.Code)
+
+	// Origins that are not allowed are forbidden
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	req.Header.Set("Origin", "https://evil.com")
+	rr3 := httptest.NewRecorder()
+	handlePreflight(rr3, req, c, services.ResponseFormatPlain)
+	require.Equal(t, http.StatusForbidden, rr3.Code)
+
+	// Default methods are used when none are configured
+	c = &targets.CorsConfig{AllowOrigins: []string{"*"}}
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	rr4 := httptest.NewRecorder()
+	handlePreflight(rr4, req, c, services.ResponseFormatPlain)
+	require.Equal(t, http.StatusNoContent, rr4.Code)
+	require.Equal(t, "*", rr4.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "GET, HEAD, POST",
+		rr4.Header().Get("Access-Control-Allow-Methods"))
+}
+
+func TestCorsMiddleware(t *testing.T) {
+	origin := "https://example.com"
+	c := &targets.CorsConfig{
+		AllowOrigins:     []string{origin},
+		AllowCredentials: true,
+	}
+	handler := corsMiddleware(c, services.ResponseFormatPlain)(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+	req.Header.Set("Origin", origin)
+
+	// Responses to allowed origins may be read by them
+	rr1 := httptest.NewRecorder()
+	handler.ServeHTTP(rr1, req)
+	require.Equal(t, http.StatusOK, rr1.Code)
+	headers := rr1.Header()
+	require.Equal(t, origin, headers.Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "true",
+		headers.Get("Access-Control-Allow-Credentials"))
+	require.Equal(t, "Origin", headers.Get("Vary"))
+
+	// but not by other origins
+	req.Header.Set("Origin", "https://evil.com")
+	rr2 := httptest.NewRecorder()
+	handler.ServeHTTP(rr2, req)
+	require.Equal(t, http.StatusOK, rr2.Code)
+	require.Empty(t, rr2.Header().Get("Access-Control-Allow-Origin"))
+	require.Empty(t, rr2.Header().Get("Vary"))
+
+	// Wildcard origins do not vary
+	c.AllowOrigins = []string{"*"}
+	c.AllowCredentials = false
+	rr3 := httptest.NewRecorder()
+	handler.ServeHTTP(rr3, req)
+	require.Equal(t, "*", rr3.Header().Get("Access-Control-Allow-Origin"))
+	require.Empty(t, rr3.Header().Get("Vary"))
+}
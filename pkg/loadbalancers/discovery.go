@@ -0,0 +1,125 @@
+package loadbalancers
+
+import (
+	"sync"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/logging"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+// groupTargets tracks the current targets of a target group; its static
+// targets along with the latest targets of each of its providers.
+type groupTargets struct {
+	Group    *targets.TargetGroup // Target group
+	Lock     sync.Mutex           // Guards the provided targets
+	Provided [][]targets.Target   // Latest targets of each provider
+}
+
+// resolveGroup returns the current targets of the given group; fetching the
+// targets of each of its providers. An error is returned if the targets contain
+// duplicates or exceed the group's maximum.
+func resolveGroup(group *targets.TargetGroup) (*groupTargets, error) {
+	g := &groupTargets{Group: group}
+	for _, p := range group.Providers {
+		ts, err := p.Targets(group.Protocol)
+		if err != nil {
+			return nil, err
+		}
+		g.Provided = append(g.Provided, ts)
+	}
+	if err := group.CheckTargets(g.all()); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// All returns all of the group's current targets.
+func (g *groupTargets) All() []targets.Target {
+	g.Lock.Lock()
+	defer g.Lock.Unlock()
+	return g.all()
+}
+
+// all returns all of the group's current targets; the lock must be held.
+func (g *groupTargets) all() []targets.Target {
+	all := append([]targets.Target{}, g.Group.Targets...)
+	for _, ts := range g.Provided {
+		all = append(all, ts...)
+	}
+	return all
+}
+
+// others returns the group's current targets other than those of the given
+// provider; the lock must be held.
+func (g *groupTargets) others(provider int) []targets.Target {
+	others := append([]targets.Target{}, g.Group.Targets...)
+	for i, ts := range g.Provided {
+		if i != provider {
+			others = append(others, ts...)
+		}
+	}
+	return others
+}
+
+// withoutDuplicates returns the given targets without those of the same backend
+// as one of the other targets or a target before them, along with the URLs of
+// the removed duplicates.
+func withoutDuplicates(others, ts []targets.Target) ([]targets.Target, []string) {
+	seen := make(map[string]bool, len(others)+len(ts))
+	for _, t := range others {
+		seen[targets.BackendKey(t)] = true
+	}
+	unique := make([]targets.Target, 0, len(ts))
+	dups := []string{}
+	for _, t := range ts {
+		key := targets.BackendKey(t)
+		if seen[key] {
+			dups = append(dups, t.URL()+t.Path())
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, t)
+	}
+	return unique, dups
+}
+
+// Watch starts watching each of the group's providers and calls fn with all of
+// the group's targets whenever a provider's targets are updated. Targets of an
+// update that duplicate the group's other targets are logged and removed from
+// it. Updates that would leave the group with too many targets are logged and
+// dropped, keeping the provider's previous targets. It returns a stop function
+// to stop watching.
+func (g *groupTargets) Watch(fn func([]targets.Target)) StopFn {
+	stops := []StopFn{}
+	for i, p := range g.Group.Providers {
+		i := i
+		stop := p.Watch(g.Group.Protocol, func(ts []targets.Target) {
+			g.Lock.Lock()
+			unique, dups := withoutDuplicates(g.others(i), ts)
+			prev := g.Provided[i]
+			g.Provided[i] = unique
+			all := g.all()
+			err := g.Group.CheckTargets(all)
+			if err != nil {
+				g.Provided[i] = prev
+			}
+			g.Lock.Unlock()
+			if len(dups) > 0 {
+				log.Warning("Removed duplicate targets", logging.Fields{
+					"group":   g.Group.Name,
+					"targets": dups,
+				})
+			}
+			if err != nil {
+				log.Error("Rejected target update", logging.Fields{
+					"group":            g.Group.Name,
+					logging.FieldError: err,
+				})
+				return
+			}
+			fn(all)
+		})
+		stops = append(stops, StopFn(stop))
+	}
+	return combineStopFns(stops)
+}
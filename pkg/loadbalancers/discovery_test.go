@@ -0,0 +1,137 @@
+package loadbalancers
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+// fakeProvider is a targets.Provider that returns fixed targets and sends
+// updates from a channel to its watcher.
+type fakeProvider struct {
+	Initial []targets.Target
+	Updates chan []targets.Target
+}
+
+func (p *fakeProvider) Targets(protocol string) ([]targets.Target, error) {
+	return p.Initial, nil
+}
+
+func (p *fakeProvider) Watch(protocol string, fn func([]targets.Target)) targets.StopFn {
+	quit := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case ts := <-p.Updates:
+				fn(ts)
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() { close(quit) }
+}
+
+func TestGroupTargets(t *testing.T) {
+	group := targets.NewTargetGroup("web", "http", rules.Rule{})
+	group.AddTarget("127.0.0.1", 8080)
+	provider := &fakeProvider{
+		Initial: []targets.Target{
+			targets.NewTarget("127.0.0.2", 8080, "http"),
+		},
+		Updates: make(chan []targets.Target),
+	}
+	group.Providers = append(group.Providers, provider)
+	g, err := resolveGroup(group)
+	require.Nil(t, err)
+	ts := g.All()
+	require.Len(t, ts, 2)
+	require.Equal(t, "http://127.0.0.1:8080", ts[0].URL())
+	require.Equal(t, "http://127.0.0.2:8080", ts[1].URL())
+
+	updated := make(chan []targets.Target, 1)
+	stop := g.Watch(func(ts []targets.Target) { updated <- ts })
+	defer stop()
+	provider.Updates <- []targets.Target{
+		targets.NewTarget("127.0.0.3", 8080, "http"),
+		targets.NewTarget("127.0.0.4", 8080, "http"),
+	}
+	select {
+	case ts := <-updated:
+		require.Len(t, ts, 3)
+		require.Equal(t, "http://127.0.0.1:8080", ts[0].URL())
+		require.Equal(t, "http://127.0.0.3:8080", ts[1].URL())
+		require.Equal(t, "http://127.0.0.4:8080", ts[2].URL())
+	case <-time.After(time.Second):
+		t.Fatal("targets were not updated")
+	}
+	require.Len(t, g.All(), 3)
+}
+
+func TestGroupTargetsDuplicates(t *testing.T) {
+	group := targets.NewTargetGroup("web", "http", rules.Rule{})
+	group.AddTarget("127.0.0.1", 80)
+	group.AddServiceTarget(&url.URL{Scheme: "http", Host: "127.0.0.1"})
+	_, err := resolveGroup(group)
+	require.NotNil(t, err)
+
+	group.Targets = group.Targets[:1]
+	provider := &fakeProvider{
+		Initial: []targets.Target{
+			targets.NewTarget("127.0.0.1", 80, "http"),
+		},
+		Updates: make(chan []targets.Target),
+	}
+	group.Providers = append(group.Providers, provider)
+	_, err = resolveGroup(group)
+	require.NotNil(t, err)
+
+	provider.Initial = []targets.Target{
+		targets.NewTarget("127.0.0.2", 80, "http"),
+	}
+	group.MaxTargets = 2
+	g, err := resolveGroup(group)
+	require.Nil(t, err)
+
+	// Updates with too many targets are dropped, and duplicates are
+	// removed from updates
+	updated := make(chan []targets.Target, 1)
+	stop := g.Watch(func(ts []targets.Target) { updated <- ts })
+	defer stop()
+	provider.Updates <- []targets.Target{
+		targets.NewTarget("127.0.0.3", 80, "http"),
+		targets.NewTarget("127.0.0.4", 80, "http"),
+	}
+	provider.Updates <- []targets.Target{
+		targets.NewTarget("127.0.0.1", 80, "http"),
+		targets.NewTarget("127.0.0.3", 80, "http"),
+		targets.NewTarget("127.0.0.3", 80, "http"),
+	}
+	select {
+	case ts := <-updated:
+		require.Len(t, ts, 2)
+		require.Equal(t, "http://127.0.0.1:80", ts[0].URL())
+		require.Equal(t, "http://127.0.0.3:80", ts[1].URL())
+	case <-time.After(time.Second):
+		t.Fatal("targets were not updated")
+	}
+	require.Len(t, updated, 0)
+
+	// Targets of other paths are not duplicates
+	provider.Updates <- []targets.Target{
+		targets.NewServiceTarget(&url.URL{Scheme: "http",
+			Host: "127.0.0.1", Path: "/api"}),
+	}
+	select {
+	case ts := <-updated:
+		require.Len(t, ts, 2)
+		require.Equal(t, "/api", ts[1].Path())
+	case <-time.After(time.Second):
+		t.Fatal("targets were not updated")
+	}
+}
@@ -0,0 +1,277 @@
+package loadbalancers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/logging"
+	"github.com/crossedbot/simpleloadbalancer/pkg/networks"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+// DNS answers of DNS target groups (experimental)
+const (
+	DnsDefaultTTL     = 10 * time.Second // Answer TTL when none is set
+	DnsMaxMessageSize = 512              // Maximum UDP message size
+	DnsProtocol       = "dns"            // Listener protocol of DNS answers
+)
+
+// DNS message values; see RFC 1035
+const (
+	dnsHeaderSize = 12
+
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeAny  = 255
+	dnsClassIN  = 1
+	dnsClassAny = 255
+
+	dnsFlagResponse      = 0x8000
+	dnsFlagAuthoritative = 0x0400
+	dnsFlagTruncated     = 0x0200
+	dnsFlagRecursion     = 0x0100 // Recursion desired
+
+	dnsRcodeFormErr = 1
+	dnsRcodeNotImp  = 4
+	dnsRcodeRefused = 5
+)
+
+var (
+	ErrDnsGroupName   = errors.New("DNS target group is missing a name")
+	ErrDnsUnsupported = errors.New("DNS target groups are only supported by network load balancers")
+)
+
+// dnsGroup tracks a DNS target group; its targets are health checked by their
+// own pool, but never relayed to.
+type dnsGroup struct {
+	Group *groupTargets        // Target group and its current targets
+	Index uint64               // Next answer rotation
+	Pool  networks.NetworkPool // Health checked targets
+}
+
+// addDnsGroup adds the given DNS target group to the load balancer.
+func (nlb *netLoadBalancer) addDnsGroup(group *targets.TargetGroup) error {
+	name := dnsName(group.Dns.Name)
+	if name == "" {
+		return fmt.Errorf("%s - '%s'", ErrDnsGroupName, group.Name)
+	}
+	resolved, err := resolveGroup(group)
+	if err != nil {
+		return err
+	}
+	pool := networks.New()
+	pool.SetHealthChange(func(t targets.Target, wasAlive, alive bool) {
+		if nlb.HealthChange != nil {
+			nlb.HealthChange(group.Name, t, wasAlive, alive)
+		}
+	})
+	pool.SetHealthCheck(group.Health)
+	nlb.Lock.Lock()
+	pool.SetHealthCheckRetries(nlb.HealthRetry)
+	if nlb.RetryBackoff != nil {
+		pool.SetRetryBackoff(*nlb.RetryBackoff)
+	}
+	nlb.Lock.Unlock()
+	for _, t := range groupTimeouts(group, resolved.All()) {
+		if err := pool.AddTarget(t, nlb.Timeout); err != nil {
+			return err
+		}
+	}
+	nlb.Lock.Lock()
+	defer nlb.Lock.Unlock()
+	if nlb.DnsGroups == nil {
+		nlb.DnsGroups = make(map[string]*dnsGroup)
+	}
+	nlb.DnsGroups[name] = &dnsGroup{Group: resolved, Pool: pool}
+	return nil
+}
+
+// dnsGroups returns the load balancer's DNS target groups.
+func (nlb *netLoadBalancer) dnsGroups() []*dnsGroup {
+	nlb.Lock.Lock()
+	defer nlb.Lock.Unlock()
+	groups := []*dnsGroup{}
+	for _, g := range nlb.DnsGroups {
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// servesDns returns true if any DNS target group is bound to the given
+// listener.
+func (nlb *netLoadBalancer) servesDns(l Listener) bool {
+	for _, g := range nlb.dnsGroups() {
+		if l.Matches(g.Group.Group.Listener) {
+			return true
+		}
+	}
+	return false
+}
+
+// dnsGroup returns the DNS target group of the given name, and nil if there is
+// none.
+func (nlb *netLoadBalancer) dnsGroup(name string) *dnsGroup {
+	nlb.Lock.Lock()
+	defer nlb.Lock.Unlock()
+	return nlb.DnsGroups[dnsName(name)]
+}
+
+// serveDns starts answering DNS queries over UDP on the given local address. It
+// returns a stop function to close the listener.
+func (nlb *netLoadBalancer) serveDns(laddr string) (StopFn, error) {
+	conn, err := net.ListenPacket("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Error("Failed to read DNS query",
+						logging.Fields{logging.FieldError: err})
+				}
+				return
+			}
+			if resp := nlb.dnsAnswer(buf[:n]); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return func() { conn.Close() }, nil
+}
+
+// dnsAnswer returns the response to the given DNS query, and nil if the query
+// is malformed or a response itself. Queries for the name of a DNS target group
+// are answered with the addresses of its alive targets, rotated on each query;
+// the addresses that do not fit in a UDP message are left out and the response
+// is marked truncated. Queries for any other name are refused, since the load
+// balancer is not a resolver.
+func (nlb *netLoadBalancer) dnsAnswer(query []byte) []byte {
+	if len(query) < dnsHeaderSize {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(query[2:])
+	if flags&dnsFlagResponse != 0 {
+		return nil
+	}
+	opcode := (flags >> 11) & 0xf
+	if opcode != 0 {
+		return dnsResponse(query, nil, flags, dnsRcodeNotImp)
+	}
+	if binary.BigEndian.Uint16(query[4:]) != 1 {
+		return dnsResponse(query, nil, flags, dnsRcodeFormErr)
+	}
+	name, end, ok := dnsQuestionName(query)
+	if !ok || len(query) < end+4 {
+		return dnsResponse(query, nil, flags, dnsRcodeFormErr)
+	}
+	question := query[dnsHeaderSize : end+4]
+	g := nlb.dnsGroup(name)
+	if g == nil {
+		return dnsResponse(query, question, flags, dnsRcodeRefused)
+	}
+	qtype := binary.BigEndian.Uint16(query[end:])
+	qclass := binary.BigEndian.Uint16(query[end+2:])
+	resp := dnsResponse(query, question, flags, 0)
+	if qclass != dnsClassIN && qclass != dnsClassAny {
+		return resp
+	}
+	ttl := g.Group.Group.Dns.TTL
+	if ttl <= 0 {
+		ttl = DnsDefaultTTL
+	}
+	alive := g.Pool.AliveTargets()
+	start := 0
+	if len(alive) > 0 {
+		start = int((atomic.AddUint64(&g.Index, 1) - 1) %
+			uint64(len(alive)))
+	}
+	count := uint16(0)
+	for i := range alive {
+		ip := net.ParseIP(alive[(start+i)%len(alive)].Host())
+		rr := dnsRecord(qtype, ip, ttl)
+		if rr == nil {
+			continue
+		}
+		if len(resp)+len(rr) > DnsMaxMessageSize {
+			flags := binary.BigEndian.Uint16(resp[2:])
+			binary.BigEndian.PutUint16(resp[2:], flags|dnsFlagTruncated)
+			break
+		}
+		resp = append(resp, rr...)
+		count++
+	}
+	binary.BigEndian.PutUint16(resp[6:], count)
+	return resp
+}
+
+// dnsResponse returns the header and the given question section of the
+// response to the query; the answer count is left unset.
+func dnsResponse(query, question []byte, flags, rcode uint16) []byte {
+	resp := make([]byte, dnsHeaderSize, DnsMaxMessageSize)
+	copy(resp, query[:2])
+	flags = dnsFlagResponse | dnsFlagAuthoritative |
+		flags&(0xf<<11|dnsFlagRecursion) | rcode
+	binary.BigEndian.PutUint16(resp[2:], flags)
+	if question != nil {
+		binary.BigEndian.PutUint16(resp[4:], 1)
+		resp = append(resp, question...)
+	}
+	return resp
+}
+
+// dnsRecord returns the resource record answering the given query type with
+// the IP address, and nil if it does not; E.g. IPv6 addresses do not answer A
+// queries, and hostnames answer none. The record's name points to the question.
+func dnsRecord(qtype uint16, ip net.IP, ttl time.Duration) []byte {
+	if ip == nil {
+		return nil
+	}
+	rtype := uint16(dnsTypeAAAA)
+	rdata := []byte(ip.To16())
+	if v4 := ip.To4(); v4 != nil {
+		rtype, rdata = dnsTypeA, []byte(v4)
+	}
+	if qtype != rtype && qtype != dnsTypeAny {
+		return nil
+	}
+	rr := []byte{0xc0, dnsHeaderSize} // Name pointer
+	rr = binary.BigEndian.AppendUint16(rr, rtype)
+	rr = binary.BigEndian.AppendUint16(rr, dnsClassIN)
+	rr = binary.BigEndian.AppendUint32(rr, uint32(ttl/time.Second))
+	rr = binary.BigEndian.AppendUint16(rr, uint16(len(rdata)))
+	return append(rr, rdata...)
+}
+
+// dnsQuestionName returns the name of the given query's question and the offset
+// of the byte following it; false is returned if the name is malformed.
+// Compressed names are not expected in queries.
+func dnsQuestionName(query []byte) (string, int, bool) {
+	labels := []string{}
+	i := dnsHeaderSize
+	for i < len(query) {
+		n := int(query[i])
+		if n == 0 {
+			return strings.Join(labels, "."), i + 1, true
+		}
+		if n > 63 || i+1+n > len(query) {
+			return "", 0, false
+		}
+		labels = append(labels, string(query[i+1:i+1+n]))
+		i += 1 + n
+	}
+	return "", 0, false
+}
+
+// dnsName returns the canonical form of the given domain name; lowercase and
+// without the trailing dot.
+func dnsName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
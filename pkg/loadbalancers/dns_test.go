@@ -0,0 +1,188 @@
+package loadbalancers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+// dnsQuery returns a DNS query of the given ID for the name and type.
+func dnsQuery(id uint16, name string, qtype uint16) []byte {
+	q := binary.BigEndian.AppendUint16(nil, id)
+	q = append(q, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0) // RD, one question
+	for _, label := range strings.Split(name, ".") {
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	q = append(q, 0)
+	q = binary.BigEndian.AppendUint16(q, qtype)
+	return binary.BigEndian.AppendUint16(q, dnsClassIN)
+}
+
+// dnsAnswerIps returns the response code and answered addresses of the given
+// DNS response to the query.
+func dnsAnswerIps(t *testing.T, query, resp []byte) (int, []string) {
+	require.GreaterOrEqual(t, len(resp), len(query))
+	require.Equal(t, query[:2], resp[:2])
+	require.Equal(t, query[dnsHeaderSize:], resp[dnsHeaderSize:len(query)])
+	rcode := int(binary.BigEndian.Uint16(resp[2:]) & 0xf)
+	count := int(binary.BigEndian.Uint16(resp[6:]))
+	ips := []string{}
+	rr := resp[len(query):]
+	for i := 0; i < count; i++ {
+		require.GreaterOrEqual(t, len(rr), 12)
+		require.Equal(t, uint32(30), binary.BigEndian.Uint32(rr[6:]))
+		n := int(binary.BigEndian.Uint16(rr[10:]))
+		ips = append(ips, net.IP(rr[12:12+n]).String())
+		rr = rr[12+n:]
+	}
+	require.Empty(t, rr)
+	return rcode, ips
+}
+
+func TestNetLoadBalancerDnsAnswer(t *testing.T) {
+	group := targets.NewTargetGroup("api", "tcp", rules.Rule{})
+	group.AddTarget("10.0.0.1", 80)
+	group.AddTarget("10.0.0.2", 80)
+	group.AddTarget("10.0.0.3", 80)
+	group.AddTarget("2001:db8::1", 80)
+	group.AddTarget("api.internal", 80)
+	group.Targets[2].SetAlive(false)
+	group.Dns = &targets.DnsConfig{
+		Name: "API.example.com.",
+		TTL:  30 * time.Second,
+	}
+	lb := NewNetworkLoadBalancer(time.Second)
+	require.Nil(t, lb.AddTargetGroup(group))
+	nlb := lb.(*netLoadBalancer)
+
+	// Alive IPv4 targets are answered and rotated on each query
+	q := dnsQuery(1, "api.example.com", dnsTypeA)
+	resp := nlb.dnsAnswer(q)
+	rcode, ips := dnsAnswerIps(t, q, resp)
+	require.Equal(t, 0, rcode)
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, ips)
+	require.Zero(t, binary.BigEndian.Uint16(resp[2:])&dnsFlagTruncated)
+	q = dnsQuery(2, "api.example.com", dnsTypeA)
+	rcode, ips = dnsAnswerIps(t, q, nlb.dnsAnswer(q))
+	require.Equal(t, 0, rcode)
+	require.Equal(t, []string{"10.0.0.2", "10.0.0.1"}, ips)
+
+	q = dnsQuery(3, "api.example.com", dnsTypeAAAA)
+	rcode, ips = dnsAnswerIps(t, q, nlb.dnsAnswer(q))
+	require.Equal(t, 0, rcode)
+	require.Equal(t, []string{"2001:db8::1"}, ips)
+
+	// Other names are refused
+	q = dnsQuery(4, "www.example.com", dnsTypeA)
+	rcode, ips = dnsAnswerIps(t, q, nlb.dnsAnswer(q))
+	require.Equal(t, dnsRcodeRefused, rcode)
+	require.Empty(t, ips)
+
+	// Responses and truncated queries are dropped
+	resp = nlb.dnsAnswer(q)
+	require.Nil(t, nlb.dnsAnswer(resp))
+	require.Nil(t, nlb.dnsAnswer(q[:dnsHeaderSize-1]))
+	rcode, _ = dnsAnswerIps(t, q[:dnsHeaderSize],
+		nlb.dnsAnswer(q[:len(q)-1]))
+	require.Equal(t, dnsRcodeFormErr, rcode)
+}
+
+func TestNetLoadBalancerDnsAnswerTruncated(t *testing.T) {
+	group := targets.NewTargetGroup("api", "tcp", rules.Rule{})
+	for i := 1; i <= 50; i++ {
+		group.AddTarget(fmt.Sprintf("10.0.0.%d", i), 80)
+	}
+	group.Dns = &targets.DnsConfig{Name: "api.example.com", TTL: 30 * time.Second}
+	lb := NewNetworkLoadBalancer(time.Second)
+	require.Nil(t, lb.AddTargetGroup(group))
+	nlb := lb.(*netLoadBalancer)
+
+	// The addresses that do not fit are left out and the response is marked
+	// truncated
+	q := dnsQuery(1, "api.example.com", dnsTypeA)
+	resp := nlb.dnsAnswer(q)
+	require.LessOrEqual(t, len(resp), DnsMaxMessageSize)
+	rcode, ips := dnsAnswerIps(t, q, resp)
+	require.Equal(t, 0, rcode)
+	require.NotEmpty(t, ips)
+	require.Less(t, len(ips), 50)
+	require.NotZero(t, binary.BigEndian.Uint16(resp[2:])&dnsFlagTruncated)
+}
+
+func TestNetLoadBalancerServeDns(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	group := targets.NewTargetGroup("api", "tcp", rules.Rule{})
+	group.AddTarget("10.0.0.1", 80)
+	group.Dns = &targets.DnsConfig{Name: "api.example.com", TTL: 30 * time.Second}
+	lb := NewNetworkLoadBalancer(time.Second)
+	require.Nil(t, lb.AddTargetGroup(group))
+	stop, err := lb.Start(NewListener("dns", addr, DnsProtocol))
+	require.Nil(t, err)
+	defer stop()
+
+	conn, err := net.Dial("udp", addr)
+	require.Nil(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	q := dnsQuery(1, "api.example.com", dnsTypeA)
+	_, err = conn.Write(q)
+	require.Nil(t, err)
+	b := make([]byte, DnsMaxMessageSize)
+	n, err := conn.Read(b)
+	require.Nil(t, err)
+	rcode, ips := dnsAnswerIps(t, q, b[:n])
+	require.Equal(t, 0, rcode)
+	require.Equal(t, []string{"10.0.0.1"}, ips)
+}
+
+func TestNetLoadBalancerDnsListenerRelays(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	host, port, err := net.SplitHostPort(ln.Addr().String())
+	require.Nil(t, err)
+	p, err := strconv.Atoi(port)
+	require.Nil(t, err)
+
+	// Without DNS target groups, "dns" listeners relay connections
+	group := targets.NewTargetGroup("resolvers", "dns", rules.Rule{})
+	group.AddTarget(host, p)
+	lb := NewNetworkLoadBalancer(time.Second)
+	require.Nil(t, lb.AddTargetGroup(group))
+	addr := getFreeAddr(t)
+	stop, err := lb.Start(NewListener("dns", addr, DnsProtocol))
+	require.Nil(t, err)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+	conn.Close()
+}
+
+func TestDnsTargetGroupErrors(t *testing.T) {
+	group := targets.NewTargetGroup("api", "tcp", rules.Rule{})
+	group.AddTarget("10.0.0.1", 80)
+	group.Dns = &targets.DnsConfig{}
+	err := NewNetworkLoadBalancer(time.Second).AddTargetGroup(group)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrDnsGroupName.Error())
+
+	group.Dns.Name = "api.example.com"
+	alb := NewApplicationLoadBalancer(time.Second, 10)
+	err = alb.AddTargetGroup(group)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrDnsUnsupported.Error())
+}
@@ -0,0 +1,95 @@
+package loadbalancers_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/loadbalancers"
+	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+// This example builds an application load balancer in code and starts it on a
+// listener; the equivalent of a configuration file with a single target group.
+func Example() {
+	lb := loadbalancers.NewApplicationLoadBalancer(time.Second, 100,
+		loadbalancers.WithResponseFormat("json"),
+		loadbalancers.WithHealthPath("/lb-health"),
+		loadbalancers.WithTimeouts(loadbalancers.Timeouts{
+			Read:  10 * time.Second,
+			Write: 30 * time.Second,
+		}),
+	)
+
+	rule := rules.Rule{
+		Action: rules.RuleActionForward,
+		Conditions: [][]rules.Condition{
+			{"path-pattern = /api/*"},
+		},
+	}
+	group := targets.NewTargetGroup("api", "http", rule)
+	group.AddTarget("10.0.0.10", 8080).SetName("api-1")
+	group.AddTarget("10.0.0.11", 8080).SetName("api-2")
+	if err := lb.AddTargetGroup(group); err != nil {
+		panic(err)
+	}
+
+	stopHealthCheck := lb.HealthCheck(30 * time.Second)
+	defer stopHealthCheck()
+	stopGC := lb.GC()
+	defer stopGC()
+	stop, err := lb.Start(loadbalancers.NewListener("web", ":8080", "http"))
+	if err != nil {
+		panic(err)
+	}
+	defer stop()
+}
+
+// This example serves an application load balancer from an existing HTTP
+// server with an additional middleware, instead of starting its own listeners.
+func ExampleLoadBalancer_Handler() {
+	backend := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "hello from %s", r.URL.Path)
+		}),
+	)
+	defer backend.Close()
+	backendUrl, _ := url.Parse(backend.URL)
+
+	lb := loadbalancers.NewApplicationLoadBalancer(time.Second, 100,
+		loadbalancers.WithMiddleware(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Served-By", "example")
+				next.ServeHTTP(w, r)
+			})
+		}),
+	)
+	rule := rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	}
+	group := targets.NewTargetGroup("web", "http", rule)
+	group.AddServiceTarget(backendUrl)
+	if err := lb.AddTargetGroup(group); err != nil {
+		panic(err)
+	}
+
+	server := httptest.NewServer(
+		lb.Handler(loadbalancers.NewListener("", ":80", "http")))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/index.html")
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	fmt.Println(resp.StatusCode, resp.Header.Get("X-Served-By"))
+	fmt.Println(string(body))
+	// Output:
+	// 200 example
+	// hello from /index.html
+}
@@ -0,0 +1,62 @@
+package loadbalancers
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const (
+	// DefaultHealthzPath is the conventional path of the load balancer's
+	// own health endpoint.
+	DefaultHealthzPath = "/healthz"
+
+	// DefaultReadyzPath is the conventional path of the load balancer's
+	// readiness endpoint.
+	DefaultReadyzPath = "/readyz"
+
+	// VersionHeader is the header that the healthz handler reports the
+	// load balancer's version in.
+	VersionHeader = "X-LB-Version"
+)
+
+// Version is the build version of the load balancer reported by the healthz
+// handler; it is not reported if empty.
+var Version string
+
+// HealthzHandler returns a handler that reports the health of the given load
+// balancer itself, rather than of its targets; it responds 200 if the load
+// balancer is healthy, otherwise 503. Container platforms can probe it for
+// liveness.
+func HealthzHandler(lb LoadBalancer) http.Handler {
+	probe := probeHandler(lb.Healthy)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if Version != "" {
+			w.Header().Set(VersionHeader, Version)
+		}
+		probe.ServeHTTP(w, r)
+	})
+}
+
+// ReadyzHandler returns a handler that reports the readiness of the given load
+// balancer; it responds 200 if every target group it forwards to has an alive
+// target, otherwise 503.
+func ReadyzHandler(lb LoadBalancer) http.Handler {
+	return probeHandler(lb.Ready)
+}
+
+// probeHandler returns a handler that responds 200 if the given function
+// returns true, otherwise 503.
+func probeHandler(ok func() bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		if !ok() {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			fmt.Fprintln(w, http.StatusText(status))
+		}
+	})
+}
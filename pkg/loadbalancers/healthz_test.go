@@ -0,0 +1,64 @@
+package loadbalancers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+func TestAppLoadBalancerHealthz(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	rule := rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	}
+	group := targets.NewTargetGroup("web", "http", rule)
+	group.AddServiceTarget(targetUrl)
+	lb := NewApplicationLoadBalancer(time.Second, 100,
+		WithHealthzPath(DefaultHealthzPath))
+	require.Nil(t, lb.AddTargetGroup(group))
+	handler := lb.Handler(NewListener("", ":80", "http"))
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, DefaultHealthzPath, nil)
+	handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "OK\n", w.Body.String())
+	require.Equal(t, "", w.Header().Get(VersionHeader))
+
+	Version = "v1.2.3"
+	defer func() { Version = "" }()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, "v1.2.3", w.Header().Get(VersionHeader))
+
+	// Without any alive targets the load balancer is unhealthy
+	ts.Close()
+	lb.(*appLoadBalancer).checkHealth()
+	require.False(t, lb.Healthy())
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodHead, DefaultHealthzPath, nil)
+	handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, "", w.Body.String())
+}
+
+func TestNetLoadBalancerHealthy(t *testing.T) {
+	lb := NewNetworkLoadBalancer(time.Second)
+	require.False(t, lb.Healthy())
+	group := targets.NewTargetGroup("tcp", "tcp", rules.Rule{},
+		targets.NewTarget("127.0.0.1", 9000, "tcp"))
+	require.Nil(t, lb.AddTargetGroup(group))
+	require.True(t, lb.Healthy())
+}
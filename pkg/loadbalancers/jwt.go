@@ -0,0 +1,395 @@
+package loadbalancers
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/logging"
+	"github.com/crossedbot/simpleloadbalancer/pkg/services"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+const (
+	// DefaultJwtSubjectHeader is the header the subject of a validated token
+	// is passed to backends in when a target group does not set one.
+	DefaultJwtSubjectHeader = "X-Auth-Subject"
+
+	// JwksRefreshInterval is how long keys fetched from a JWKS URL are used
+	// before they are fetched again.
+	JwksRefreshInterval = 5 * time.Minute
+
+	// JwksMinRefreshInterval is the minimum time between fetches of a JWKS
+	// URL caused by tokens signed with an unknown key.
+	JwksMinRefreshInterval = 10 * time.Second
+
+	// JwksFetchTimeout is the timeout for fetching a JWKS URL.
+	JwksFetchTimeout = 10 * time.Second
+)
+
+var (
+	ErrInvalidJwt        = errors.New("Invalid JSON web token")
+	ErrInvalidJwtKey     = errors.New("Invalid JWT public key")
+	ErrJwtClaimMismatch  = errors.New("JSON web token is missing a required claim")
+	ErrJwtExpired        = errors.New("JSON web token has expired")
+	ErrJwtNotYetValid    = errors.New("JSON web token is not yet valid")
+	ErrJwtUnknownKey     = errors.New("JSON web token is signed with an unknown key")
+	ErrMissingBearer     = errors.New("Missing bearer token")
+	ErrNoJwtKey          = errors.New("JWT authentication requires a secret, public key, or JWKS URL")
+	ErrUnsupportedJwtAlg = errors.New("Unsupported JSON web token algorithm")
+)
+
+// jwtHeader represents the JOSE header of a JSON web token.
+type jwtHeader struct {
+	Alg string `json:"alg"` // Signing algorithm
+	Kid string `json:"kid"` // Signing key ID
+}
+
+// jsonWebKey represents a single key of a JSON web key set. Only RSA keys are
+// supported.
+type jsonWebKey struct {
+	Kty string `json:"kty"` // Key type
+	Kid string `json:"kid"` // Key ID
+	N   string `json:"n"`   // RSA modulus
+	E   string `json:"e"`   // RSA public exponent
+}
+
+// jwtValidator validates the JSON web tokens of requests to a target group.
+type jwtValidator struct {
+	Config    *targets.JwtConfig // JWT configuration
+	PublicKey *rsa.PublicKey     // Parsed RS256 public key
+	Client    *http.Client       // Client for fetching the JWKS URL
+
+	mu           sync.RWMutex
+	jwks         map[string]*rsa.PublicKey
+	jwksFetched  time.Time
+	jwksFetching chan struct{} // Closed when the current fetch is done
+}
+
+// newJwtValidator returns a new jwtValidator for the given configuration. An
+// error is returned if no key is configured or the public key is invalid.
+func newJwtValidator(c *targets.JwtConfig) (*jwtValidator, error) {
+	if c.Secret == "" && c.PublicKey == "" && c.JwksUrl == "" {
+		return nil, ErrNoJwtKey
+	}
+	v := &jwtValidator{
+		Config: c,
+		Client: &http.Client{Timeout: JwksFetchTimeout},
+	}
+	if c.PublicKey != "" {
+		key, err := parseRsaPublicKey([]byte(c.PublicKey))
+		if err != nil {
+			return nil, err
+		}
+		v.PublicKey = key
+	}
+	return v, nil
+}
+
+// SubjectHeader returns the header the subject of a validated token is passed
+// to backends in.
+func (v *jwtValidator) SubjectHeader() string {
+	if v.Config.SubjectHeader != "" {
+		return v.Config.SubjectHeader
+	}
+	return DefaultJwtSubjectHeader
+}
+
+// Validate validates the bearer token of the given request and returns the
+// token's subject.
+func (v *jwtValidator) Validate(r *http.Request) (string, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return "", ErrMissingBearer
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidJwt
+	}
+	var header jwtHeader
+	if err := decodeJwtSegment(parts[0], &header); err != nil {
+		return "", ErrInvalidJwt
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrInvalidJwt
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if err := v.verify(header, signed, sig); err != nil {
+		return "", err
+	}
+	var claims map[string]interface{}
+	if err := decodeJwtSegment(parts[1], &claims); err != nil {
+		return "", ErrInvalidJwt
+	}
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return "", err
+	}
+	sub, _ := claims["sub"].(string)
+	return sub, nil
+}
+
+// verify verifies the signature of the signed token parts for the algorithm
+// of the given header.
+func (v *jwtValidator) verify(h jwtHeader, signed, sig []byte) error {
+	switch h.Alg {
+	case "HS256":
+		if v.Config.Secret == "" {
+			return ErrUnsupportedJwtAlg
+		}
+		mac := hmac.New(sha256.New, []byte(v.Config.Secret))
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return ErrInvalidJwt
+		}
+		return nil
+	case "RS256":
+		key, err := v.rsaKey(h.Kid)
+		if err != nil {
+			return err
+		}
+		digest := sha256.Sum256(signed)
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+		if err != nil {
+			return ErrInvalidJwt
+		}
+		return nil
+	}
+	return ErrUnsupportedJwtAlg
+}
+
+// rsaKey returns the RSA public key for the given key ID. Keys from the JWKS URL
+// take precedence over the configured public key.
+func (v *jwtValidator) rsaKey(kid string) (*rsa.PublicKey, error) {
+	if v.Config.JwksUrl != "" {
+		if key := v.jwksKey(kid); key != nil {
+			return key, nil
+		}
+	}
+	if v.PublicKey != nil {
+		return v.PublicKey, nil
+	}
+	return nil, ErrJwtUnknownKey
+}
+
+// jwksKey returns the key with the given ID from the JWKS URL. The key set is
+// fetched again when it is stale, or when the key is unknown and the set has
+// not been fetched recently. Only one fetch is made at a time; requests for
+// unknown keys wait for it, while known keys are used until it is done. If
+// fetching fails, the last key set is used.
+func (v *jwtValidator) jwksKey(kid string) *rsa.PublicKey {
+	v.mu.RLock()
+	key, ok := v.jwks[kid]
+	fresh := !v.jwksStale(ok) && (ok || v.jwksFetching == nil)
+	v.mu.RUnlock()
+	if fresh {
+		return key
+	}
+	v.mu.Lock()
+	if done := v.jwksFetching; done != nil {
+		v.mu.Unlock()
+		if ok {
+			return key
+		}
+		<-done
+		v.mu.RLock()
+		defer v.mu.RUnlock()
+		return v.jwks[kid]
+	}
+	if !v.jwksStale(ok) {
+		defer v.mu.Unlock()
+		return v.jwks[kid]
+	}
+	done := make(chan struct{})
+	v.jwksFetching = done
+	v.jwksFetched = time.Now()
+	v.mu.Unlock()
+
+	keys, err := fetchJwks(v.Client, v.Config.JwksUrl)
+	if err != nil {
+		log.Error("Failed to fetch JWKS", logging.Fields{
+			"url":              v.Config.JwksUrl,
+			logging.FieldError: err,
+		})
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err == nil {
+		v.jwks = keys
+	}
+	v.jwksFetching = nil
+	close(done)
+	return v.jwks[kid]
+}
+
+// jwksStale returns true if the key set should be fetched again; sooner if the
+// wanted key is not known. The caller must hold the validator's lock.
+func (v *jwtValidator) jwksStale(known bool) bool {
+	age := time.Since(v.jwksFetched)
+	return age > JwksRefreshInterval ||
+		(!known && age > JwksMinRefreshInterval)
+}
+
+// checkClaims returns an error if the given claims are expired, not yet valid,
+// or do not contain the required claims at the given time.
+func (v *jwtValidator) checkClaims(claims map[string]interface{}, now time.Time) error {
+	unix := float64(now.Unix())
+	if exp, ok := claims["exp"].(float64); ok && unix >= exp {
+		return ErrJwtExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && unix < nbf {
+		return ErrJwtNotYetValid
+	}
+	for name, expected := range v.Config.Claims {
+		if !claimContains(claims[name], expected) {
+			return ErrJwtClaimMismatch
+		}
+	}
+	return nil
+}
+
+// jwtMiddleware returns a middleware that rejects requests without a valid
+// bearer token. The subject of a valid token is passed on in the validator's
+// subject header.
+func jwtMiddleware(v *jwtValidator, format services.ResponseFormat) services.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sub, err := v.Validate(r)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate",
+					jwtChallenge(err))
+				handleUnauthorized(w, format.Negotiate(r))
+				return
+			}
+			// Never trust a subject sent by the client
+			r.Header.Del(v.SubjectHeader())
+			if sub != "" {
+				r.Header.Set(v.SubjectHeader(), sub)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// jwtChallenge returns the WWW-Authenticate header value for the given
+// validation error.
+func jwtChallenge(err error) string {
+	if err == ErrMissingBearer {
+		return "Bearer"
+	}
+	return fmt.Sprintf("Bearer error=\"invalid_token\", error_description=%q",
+		err.Error())
+}
+
+// claimContains returns true if the given claim value equals the expected
+// value, or contains it if the claim is a list.
+func claimContains(claim interface{}, expected string) bool {
+	switch v := claim.(type) {
+	case nil:
+		return false
+	case string:
+		return v == expected
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok && s == expected {
+				return true
+			}
+		}
+		return false
+	}
+	return fmt.Sprint(claim) == expected
+}
+
+// bearerToken returns the bearer token of the given request's Authorization
+// header.
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	const prefix = "bearer "
+	if len(auth) <= len(prefix) ||
+		!strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(prefix):]), true
+}
+
+// decodeJwtSegment decodes the given base64url encoded JSON token segment into
+// v.
+func decodeJwtSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// fetchJwks fetches the JSON web key set at the given URL and returns its RSA
+// keys by key ID.
+func fetchJwks(client *http.Client, url string) (map[string]*rsa.PublicKey, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status code %d",
+			resp.StatusCode)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, ErrInvalidJwtKey
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, ErrInvalidJwtKey
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// parseRsaPublicKey parses the given PEM encoded RSA public key. Both PKIX and
+// PKCS #1 encodings are supported.
+func parseRsaPublicKey(b []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, ErrInvalidJwtKey
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, ErrInvalidJwtKey
+	}
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, ErrInvalidJwtKey
+	}
+	return key, nil
+}
@@ -0,0 +1,231 @@
+package loadbalancers
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+func TestJwtValidatorHS256(t *testing.T) {
+	_, err := newJwtValidator(&targets.JwtConfig{})
+	require.Equal(t, ErrNoJwtKey, err)
+
+	secret := "secret"
+	v, err := newJwtValidator(&targets.JwtConfig{
+		Secret: secret,
+		Claims: map[string]string{"aud": "api"},
+	})
+	require.Nil(t, err)
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+	_, err = v.Validate(req)
+	require.Equal(t, ErrMissingBearer, err)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	token := signHS256(t, secret, map[string]interface{}{
+		"sub": "alice",
+		"aud": []string{"web", "api"},
+		"exp": exp,
+	})
+	req.Header.Set("Authorization", "Bearer "+token)
+	sub, err := v.Validate(req)
+	require.Nil(t, err)
+	require.Equal(t, "alice", sub)
+
+	// Wrong secret
+	token = signHS256(t, "other", map[string]interface{}{"aud": "api"})
+	req.Header.Set("Authorization", "Bearer "+token)
+	_, err = v.Validate(req)
+	require.Equal(t, ErrInvalidJwt, err)
+
+	// Missing required claim
+	token = signHS256(t, secret, map[string]interface{}{"aud": "web"})
+	req.Header.Set("Authorization", "Bearer "+token)
+	_, err = v.Validate(req)
+	require.Equal(t, ErrJwtClaimMismatch, err)
+
+	// Expired
+	token = signHS256(t, secret, map[string]interface{}{
+		"aud": "api",
+		"exp": time.Now().Add(-time.Minute).Unix(),
+	})
+	req.Header.Set("Authorization", "Bearer "+token)
+	_, err = v.Validate(req)
+	require.Equal(t, ErrJwtExpired, err)
+
+	// Not yet valid
+	token = signHS256(t, secret, map[string]interface{}{
+		"aud": "api",
+		"nbf": time.Now().Add(time.Minute).Unix(),
+	})
+	req.Header.Set("Authorization", "Bearer "+token)
+	_, err = v.Validate(req)
+	require.Equal(t, ErrJwtNotYetValid, err)
+}
+
+func TestJwtValidatorRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.Nil(t, err)
+	pemKey := pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: der,
+	})
+	v, err := newJwtValidator(&targets.JwtConfig{PublicKey: string(pemKey)})
+	require.Nil(t, err)
+
+	token := signRS256(t, key, "", map[string]interface{}{"sub": "bob"})
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	sub, err := v.Validate(req)
+	require.Nil(t, err)
+	require.Equal(t, "bob", sub)
+
+	// HS256 tokens are rejected without a secret
+	token = signHS256(t, "secret", map[string]interface{}{"sub": "bob"})
+	req.Header.Set("Authorization", "Bearer "+token)
+	_, err = v.Validate(req)
+	require.Equal(t, ErrUnsupportedJwtAlg, err)
+
+	_, err = newJwtValidator(&targets.JwtConfig{PublicKey: "not a key"})
+	require.Equal(t, ErrInvalidJwtKey, err)
+}
+
+func TestJwtValidatorJwks(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	fetches := int32(0)
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&fetches, 1)
+			time.Sleep(20 * time.Millisecond)
+			e := big.NewInt(int64(key.PublicKey.E)).Bytes()
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"keys": []jsonWebKey{{
+					Kty: "RSA",
+					Kid: "k1",
+					N: base64.RawURLEncoding.EncodeToString(
+						key.PublicKey.N.Bytes()),
+					E: base64.RawURLEncoding.EncodeToString(e),
+				}},
+			})
+		}),
+	)
+	defer ts.Close()
+
+	v, err := newJwtValidator(&targets.JwtConfig{JwksUrl: ts.URL})
+	require.Nil(t, err)
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+	token := signRS256(t, key, "k1", map[string]interface{}{"sub": "carol"})
+	req.Header.Set("Authorization", "Bearer "+token)
+	sub, err := v.Validate(req)
+	require.Nil(t, err)
+	require.Equal(t, "carol", sub)
+	_, err = v.Validate(req)
+	require.Nil(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	// Unknown keys do not refetch the key set right away
+	token = signRS256(t, key, "k2", map[string]interface{}{"sub": "carol"})
+	req.Header.Set("Authorization", "Bearer "+token)
+	_, err = v.Validate(req)
+	require.Equal(t, ErrJwtUnknownKey, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	// Concurrent lookups share a single fetch
+	v, err = newJwtValidator(&targets.JwtConfig{JwksUrl: ts.URL})
+	require.Nil(t, err)
+	keys := make(chan *rsa.PublicKey, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(keys); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keys <- v.jwksKey("k1")
+		}()
+	}
+	wg.Wait()
+	close(keys)
+	for k := range keys {
+		require.NotNil(t, k)
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
+
+func TestBearerToken(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+	_, ok := bearerToken(req)
+	require.False(t, ok)
+	req.Header.Set("Authorization", "Basic abc")
+	_, ok = bearerToken(req)
+	require.False(t, ok)
+	req.Header.Set("Authorization", "bearer abc")
+	token, ok := bearerToken(req)
+	require.True(t, ok)
+	require.Equal(t, "abc", token)
+}
+
+func TestClaimContains(t *testing.T) {
+	require.True(t, claimContains("api", "api"))
+	require.False(t, claimContains("web", "api"))
+	require.True(t, claimContains([]interface{}{"web", "api"}, "api"))
+	require.False(t, claimContains([]interface{}{"web"}, "api"))
+	require.True(t, claimContains(true, "true"))
+	require.False(t, claimContains(nil, "api"))
+}
+
+func TestJwtChallenge(t *testing.T) {
+	require.Equal(t, "Bearer", jwtChallenge(ErrMissingBearer))
+	require.Equal(t,
+		`Bearer error="invalid_token", error_description="JSON web token has expired"`,
+		jwtChallenge(ErrJwtExpired))
+}
+
+// encodeJwt returns the signing input of a token with the given header and
+// claims.
+func encodeJwt(t *testing.T, header, claims interface{}) string {
+	h, err := json.Marshal(header)
+	require.Nil(t, err)
+	c, err := json.Marshal(claims)
+	require.Nil(t, err)
+	return base64.RawURLEncoding.EncodeToString(h) + "." +
+		base64.RawURLEncoding.EncodeToString(c)
+}
+
+// signHS256 returns a HS256 token for the given claims.
+func signHS256(t *testing.T, secret string, claims interface{}) string {
+	signed := encodeJwt(t, jwtHeader{Alg: "HS256"}, claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signRS256 returns a RS256 token for the given claims.
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims interface{}) string {
+	signed := encodeJwt(t, jwtHeader{Alg: "RS256", Kid: kid}, claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.Nil(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
@@ -1,3 +1,6 @@
+// Package loadbalancers implements application (HTTP) and network (TCP/UDP)
+// load balancers. A load balancer can be built and started entirely in code;
+// see the package examples.
 package loadbalancers
 
 import (
@@ -5,25 +8,51 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/crossedbot/common/golang/logger"
-
+	"github.com/crossedbot/simpleloadbalancer/pkg/logging"
 	"github.com/crossedbot/simpleloadbalancer/pkg/networks"
+	"github.com/crossedbot/simpleloadbalancer/pkg/ratelimit"
 	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
 	"github.com/crossedbot/simpleloadbalancer/pkg/services"
 	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
 	"github.com/crossedbot/simpleloadbalancer/pkg/templates"
 )
 
+// DefaultHealthCheckTimeout is the timeout of target health check probes when
+// none is set.
+const DefaultHealthCheckTimeout = 3 * time.Second
+
+// log is the logger of the loadbalancers package.
+var log = logging.New("loadbalancers")
+
 var (
-	ErrNoTargetsInGroup = errors.New("Target group must contain at least one target")
+	ErrNoListeners       = errors.New("Load balancer must have at least one listener")
+	ErrNoTargetsInGroup  = errors.New("Target group must contain at least one target")
+	ErrHealthBodyMatch   = errors.New("Invalid health check body pattern")
+	ErrUnknownGroup      = errors.New("Target group not found")
+	ErrUnknownTarget     = errors.New("Target not found")
+	ErrNlbRuleAction     = errors.New("Network load balancers only support the forward action")
+	ErrNlbRuleCondition  = errors.New("Network load balancers do not support HTTP rule conditions")
+	ErrNlbHealthCheck    = errors.New("Network load balancer target groups must share one health check")
+	ErrNlbStrategy       = errors.New("Network load balancer target groups must share one strategy")
+	ErrNlbCustomStrategy = errors.New("Network load balancers do not support custom strategies")
 )
 
 // StopFn is a prototype for a stop routine function.
 type StopFn func()
 
+// HealthChangeFn is a prototype for a function that is called when a health
+// check finds the alive state of a target in the named group changed.
+type HealthChangeFn func(group string, t targets.Target, wasAlive, alive bool)
+
 // LoadBalancer represents a common interface for all load balancer types.
 type LoadBalancer interface {
 	// AddTargetGroup adds the given target group to the load balancer. For
@@ -32,97 +61,406 @@ type LoadBalancer interface {
 	// targets to the existing group.
 	AddTargetGroup(group *targets.TargetGroup) error
 
+	// Handler returns the HTTP handler for requests received by the given
+	// listener; including the middleware chain. It allows the load
+	// balancer to be served by an existing server instead of Start. For
+	// network load balancers, nil is returned.
+	Handler(l Listener) http.Handler
+
 	// HealthCheck starts a routine to passively track the health of the
-	// each LB target. It returns a stop function to stop the health check
-	// each target's health check routine.
+	// each LB target at the given interval; probes time out after the
+	// health check timeout. It returns a stop function to stop the health
+	// check each target's health check routine.
 	HealthCheck(interval time.Duration) StopFn
 
+	// Healthy returns true if the load balancer can serve requests; I.E.
+	// any target group it forwards to has an alive target. It is the self
+	// health reported on the healthz path.
+	Healthy() bool
+
+	// OnHealthChange sets the function called when a health check finds a
+	// target's alive state changed; only on transitions. It must be set
+	// before the health check is started.
+	OnHealthChange(fn HealthChangeFn)
+
+	// SetGroupStrategy sets a custom strategy to pick the target of each
+	// request of the named target group, in place of its built-in
+	// strategy; E.g. to shard requests by a header. The group must already
+	// be added, or ErrUnknownGroup is returned, and it must be set before
+	// the load balancer is started. Network load balancers only support the
+	// built-in strategies, and return ErrNlbCustomStrategy.
+	SetGroupStrategy(group string, s services.Strategy) error
+
+	// SetHealthCheckRetries sets the number of times a failed probe of a
+	// target is retried, after a short delay, within a health check before
+	// the target is deemed unreachable; to tolerate lossy networks without
+	// lengthening the interval. It must be set before target groups are
+	// added.
+	SetHealthCheckRetries(n int)
+
+	// SetLatencyBuckets sets the upper bounds of the buckets of the
+	// histograms that track the response latency of each target; see
+	// services.DefaultLatencyBuckets. It must be set before target groups
+	// are added.
+	SetLatencyBuckets(bounds []time.Duration)
+
+	// Discover starts a routine for each target group with dynamic targets
+	// (E.g. SRV records) that resolves the group's targets at its refresh
+	// interval and updates the load balancer's pools. It returns a stop
+	// function to stop these routines.
+	Discover() StopFn
+
 	// GC starts the IP registry garbage collector for each LB target and
 	// returns a stop function to stop these routines.
 	GC() StopFn
 
-	// Start starts the load balancer on the given listening address and
-	// protocol. It returns a stop function to stop listening and exit the
-	// routine.
-	Start(laddr, protocol string) (StopFn, error)
+	// Start starts the load balancer on each of the given listeners. It
+	// returns a stop function to stop all of the listeners and exit their
+	// routines. If any listener fails to start, the listeners started
+	// before it are stopped and the error is returned. Multiple listeners
+	// must have unique names, or ErrListenerName is returned.
+	Start(listeners ...Listener) (StopFn, error)
+
+	// Ready returns true if every target group with targets to forward to
+	// has at least one alive target.
+	Ready() bool
+
+	// SetHealthzPath sets a reserved path that GET and HEAD requests are
+	// answered on with the load balancer's own health; 200 if it is
+	// healthy, otherwise 503. An empty path disables the healthz path.
+	SetHealthzPath(path string)
+
+	// SetHealthPath sets a reserved path that HEAD requests are answered on
+	// by the load balancer itself; without a backend round-trip. An empty
+	// path disables the health path.
+	SetHealthPath(path string)
 
-	// SetResponseFormat sets the response format for the load balancer.
+	// SetMaxHeaderBytes sets the maximum size in bytes of the request
+	// line and headers that listeners read; requests over it are answered
+	// with 431. Zero uses http.DefaultMaxHeaderBytes.
+	SetMaxHeaderBytes(n int)
+
+	// SetRequestIdHeader sets the name of the header that carries the ID
+	// of each request to backends, on responses and in logs. Defaults to
+	// services.DefaultRequestIdHeader.
+	SetRequestIdHeader(name string)
+
+	// SetResponseFormat sets the response format for the load balancer;
+	// "auto" picks the format of each error response from the request's
+	// Accept header.
 	SetResponseFormat(format string)
 
-	// SetTLS enables TLS connections and sets the certificate and private
-	// key to the given filenames.
+	// SetMiddleware sets the order of the request filters that run for
+	// each target group before its rule's action. Filters left out are
+	// disabled, and unknown filter names return an error.
+	SetMiddleware(names ...string) error
+
+	// SetReadinessGate enables the readiness gate; Start probes every
+	// target once before binding its listeners, and the health path
+	// answers 503 until the load balancer is ready.
+	SetReadinessGate(enabled bool)
+
+	// SetRewriteLocation sets whether redirects to a target's own URL are
+	// rewritten to the host and scheme the client used; for backends that
+	// redirect to their internal addresses. It applies to every target
+	// group, including those whose response headers do not rewrite
+	// locations.
+	SetRewriteLocation(enabled bool)
+
+	// SetRetryAllMethods sets whether failed requests of any method are
+	// retried; by default only idempotent requests are retried.
+	SetRetryAllMethods(enabled bool)
+
+	// SetRetryBackoff sets the exponential backoff, with jitter, between
+	// the retries of a failed target; E.g. a longer base delay to give a
+	// struggling backend time to recover. It must be set before target
+	// groups are added.
+	SetRetryBackoff(b targets.Backoff)
+
+	// SetRetryBudget sets the number of times a request may be served
+	// again after its first backend attempt fails; shared by retries of
+	// the same target and attempts of other targets.
+	SetRetryBudget(n int)
+
+	// SetServing sets whether the load balancer serves requests; while it
+	// does not, every request is answered with 503 Service Unavailable
+	// without reaching a target, and it recovers as soon as it is set
+	// back. It is enabled by default, and safe to call while serving; E.g.
+	// as a kill switch during an outage. Network load balancers always
+	// serve.
+	SetServing(enabled bool)
+
+	// Serving returns true if the load balancer serves requests.
+	Serving() bool
+
+	// SetSharedRateLimit sets whether the target groups share one rate
+	// limit budget per client, rather than each group limiting clients on
+	// its own; so a client's requests are limited across the load
+	// balancer. It must be set before target groups are added.
+	SetSharedRateLimit(enabled bool)
+
+	// SetStrategy sets the built-in strategy of the target groups that do
+	// not set their own; E.g. power of two choices for every group. It
+	// must be set before target groups are added.
+	SetStrategy(s targets.Strategy)
+
+	// SetRouteTrace sets the route trace of the load balancer; requests
+	// from the trace's allowed IPs that carry its header are answered with
+	// the target group that matched them. It must be set before the load
+	// balancer is started. Network load balancers do not trace routes.
+	SetRouteTrace(t RouteTrace)
+
+	// SetSlowRequestThreshold sets the time after which a request is
+	// logged as slow, along with its path, target and status; zero
+	// disables the slow request log.
+	SetSlowRequestThreshold(threshold time.Duration)
+
+	// SetTargetAlive marks the targets of the given URL alive or dead in
+	// every target group until their next health check; E.g. to put a
+	// recovered backend back into rotation without waiting for a probe.
+	// The URL is the target's as reported by Stats. ErrUnknownTarget is
+	// returned if no target has the URL.
+	SetTargetAlive(targetURL string, alive bool) error
+
+	// SetUpstreamHeaders sets whether responses name the backend and the
+	// target group that served them; for debugging routing. It is disabled
+	// by default, so the backend topology is not exposed.
+	SetUpstreamHeaders(enabled bool)
+
+	// SetTLS sets the default certificate and private key filenames for
+	// TLS enabled listeners that do not set their own.
 	SetTLS(certFile, keyFile string)
 
+	// SetTlsHeaders sets the headers that pass the scheme and TLS details
+	// of a client's connection to backends; E.g. the client certificate
+	// subject for backends that authorize by it.
+	SetTlsHeaders(h services.TlsHeaders)
+
+	// Stats returns the request counters and response latency percentiles
+	// of each target of the load balancer's target groups; they are
+	// reported on the stats path of the admin server. Network load
+	// balancers report none.
+	Stats() []TargetStats
+
+	// Rules returns the effective routing rules of the load balancer's
+	// target groups in the order requests are matched against them; they
+	// are reported on the rules path of the admin server. Network load
+	// balancers report none.
+	Rules() []RouteRule
+
 	// Type returns the string representation of the load balancer's type;
 	// this is the long name.
 	Type() string
+
+	// Use appends the given middleware to the chain that all requests
+	// received by the load balancer's listeners pass through in order.
+	Use(mw ...services.Middleware)
 }
 
 // appTarget is mapping of an ALB's service pool and other informational fields
 // like a name and targeting rules.
 type appTarget struct {
-	Name        string               // Target name
-	Rule        rules.Rule           // Listener rule
-	RedirectUrl string               // Redirect URL
-	Pool        services.ServicePool // Service pool
+	BasicAuth   *targets.BasicAuthConfig // Basic auth configuration
+	Cors        *targets.CorsConfig      // CORS configuration
+	Group       *targets.TargetGroup     // Target group
+	Jwt         *jwtValidator            // JWT validator
+	Name        string                   // Target name
+	Listener    string                   // Bound listener name or port
+	MirrorTo    string                   // Name of the target to mirror to
+	Rule        rules.Rule               // Listener rule
+	Redirect    *redirect                // Redirect templates
+	RedirectUrl string                   // Redirect URL
+	Pool        services.ServicePool     // Service pool
+	Proxy       http.HandlerFunc         // Pool handler for mirrored requests
+	RateLimit   services.RateLimiter     // Route rate limit
+	Resolved    *groupTargets            // Current targets of the group
+}
+
+// newAppTarget returns a new appTarget for the given target group. The target's
+// pool or redirect URL is left for the caller to set.
+func newAppTarget(group *targets.TargetGroup) appTarget {
+	return appTarget{
+		BasicAuth: group.BasicAuth,
+		Cors:      group.Cors,
+		Group:     group,
+		Name:      group.Name,
+		Listener:  group.Listener,
+		MirrorTo:  group.MirrorTo,
+		Rule:      group.Rule,
+	}
 }
 
 // appLoadBalancer implements the LoadBalancer interface as application load
 // balancer and manages an internal service pool. Application means HTTP
 // services.
 type appLoadBalancer struct {
-	Rate        int64                   // Request Rate
-	Capacity    int64                   // Request capacity
-	Targets     []appTarget             // Service targets
-	TlsEnabled  bool                    // Indicates TLS is enabled
-	TlsCertFile string                  // TLS certificate filename
-	TlsKeyFile  string                  // TLS private key filename
-	RespFormat  services.ResponseFormat // LB Response format
+	Chain        services.Chain          // Listener middleware chain
+	Disabled     int32                   // Set while not serving
+	HealthChange HealthChangeFn          // Health transition callback
+	HealthRetry  int                     // Failed probe retries
+	HealthPath   string                  // Reserved health path
+	HealthzPath  string                  // Reserved self health path
+	Latency      []time.Duration         // Latency histogram bounds
+	MaxHeader    int                     // Maximum request header bytes
+	Middleware   []string                // Ordered target filter names
+	ReadyGate    bool                    // Wait for alive targets
+	ReqIdHeader  string                  // Request ID header name
+	Rate         int64                   // Request Rate
+	Capacity     int64                   // Request capacity
+	Registry     ratelimit.IPRegistry    // Shared IP registry; nil per group
+	RetryAll     bool                    // Retry non-idempotent requests
+	RetryBackoff targets.Backoff         // Backoff between retries
+	RetryBudget  int                     // Re-serves allowed per request
+	RewriteLoc   bool                    // Rewrite redirects to targets
+	SlowReq      time.Duration           // Slow request log threshold
+	Strategy     targets.Strategy        // Default group strategy
+	Targets      []appTarget             // Service targets
+	Trace        RouteTrace              // Route trace settings
+	TlsCertFile  string                  // Default TLS certificate filename
+	TlsKeyFile   string                  // Default TLS private key filename
+	TlsHeaders   services.TlsHeaders     // Client connection headers
+	Timeouts     Timeouts                // Listener timeouts
+	Upstream     bool                    // Set upstream response headers
+	RespFormat   services.ResponseFormat // LB Response format
 }
 
 // NewApplicationLoadBalancer returns a new Load Balancer for targeted HTTP
-// services.
-func NewApplicationLoadBalancer(reqRate time.Duration, reqCap int64) LoadBalancer {
-	return &appLoadBalancer{
-		Rate:       int64(reqRate),
-		Capacity:   int64(reqCap),
-		RespFormat: services.DefaultResponseFormat,
+// services. Requests are rate limited per client IP to the given rate and
+// capacity, and any options are applied in order.
+func NewApplicationLoadBalancer(reqRate time.Duration, reqCap int64, opts ...Option) LoadBalancer {
+	o := newOptions(opts)
+	alb := &appLoadBalancer{
+		Rate:         int64(reqRate),
+		Capacity:     int64(reqCap),
+		ReqIdHeader:  services.DefaultRequestIdHeader,
+		RespFormat:   services.DefaultResponseFormat,
+		RetryBackoff: targets.DefaultBackoff,
+		RetryBudget:  services.DefaultRetryBudget,
+		Timeouts:     o.Timeouts,
 	}
+	o.apply(alb)
+	return alb
 }
 
 func (alb *appLoadBalancer) AddTargetGroup(group *targets.TargetGroup) error {
-	if len(group.Targets) == 0 {
+	if group.Dns != nil {
+		return fmt.Errorf("%s - '%s'", ErrDnsUnsupported, group.Name)
+	}
+	if hc := group.Health; hc != nil && hc.BodyMatch != "" {
+		if _, err := regexp.Compile(hc.BodyMatch); err != nil {
+			return fmt.Errorf("%s - '%s'", ErrHealthBodyMatch,
+				group.Name)
+		}
+	}
+	target := newAppTarget(group)
+	if group.Jwt != nil {
+		validator, err := newJwtValidator(group.Jwt)
+		if err != nil {
+			return err
+		}
+		target.Jwt = validator
+	}
+	if rl := group.RateLimit; rl != nil && rl.Rate > 0 {
+		target.RateLimit = services.NewRateLimiter(rl.Rate, rl.Capacity)
+		target.RateLimit.SetTrustedProxies(rl.TrustedProxies)
+	}
+	if group.Rule.Action == rules.RuleActionSplit {
+		// Split groups only refer to other target groups by name
+		alb.Targets = append(alb.Targets, target)
+		return nil
+	}
+	if group.Rule.Action == rules.RuleActionRedirect &&
+		group.Redirect != nil {
+		// Templated redirects do not need targets
+		rd, err := newRedirect(group.Redirect)
+		if err != nil {
+			return err
+		}
+		target.Redirect = rd
+		alb.Targets = append(alb.Targets, target)
+		return nil
+	}
+	resolved, err := resolveGroup(group)
+	if err != nil {
+		return err
+	}
+	ts := resolved.All()
+	if len(ts) == 0 {
 		return ErrNoTargetsInGroup
 	}
+	target.Resolved = resolved
 	if group.Rule.Action == rules.RuleActionRedirect {
-		alb.Targets = append(alb.Targets, appTarget{
-			Name:        group.Name,
-			Rule:        group.Rule,
-			RedirectUrl: group.Targets[0].URL(),
-		})
+		target.RedirectUrl = ts[0].URL()
+		alb.Targets = append(alb.Targets, target)
 		return nil
 	}
 	pool := services.New(alb.Rate, alb.Capacity)
+	pool.SetIPRegistry(alb.Registry)
+	pool.SetLatencyBuckets(alb.Latency)
 	pool.SetResponseFormat(alb.RespFormat)
-	for _, t := range group.Targets {
+	pool.SetRequestIdHeader(alb.ReqIdHeader)
+	pool.SetRequestTimeout(alb.Timeouts.Request)
+	pool.SetUpstreamHeaders(group.Name, alb.Upstream)
+	pool.SetRetryAllMethods(alb.RetryAll)
+	pool.SetRetryBackoff(alb.RetryBackoff)
+	pool.SetRetryBudget(alb.RetryBudget)
+	pool.SetRewriteLocation(alb.RewriteLoc)
+	pool.SetSlowRequestThreshold(alb.SlowReq)
+	pool.SetTlsHeaders(alb.TlsHeaders)
+	pool.SetHealthCheckRetries(alb.HealthRetry)
+	pool.SetHealthChange(func(t targets.Target, wasAlive, alive bool) {
+		if alb.HealthChange != nil {
+			alb.HealthChange(group.Name, t, wasAlive, alive)
+		}
+	})
+	if group.Cache != nil {
+		pool.SetCache(group.Cache.MaxEntries, group.Cache.TTL)
+	}
+	if group.Health != nil {
+		pool.SetHealthCheck(group.Health)
+	}
+	if group.Response != nil {
+		pool.SetResponseHeaders(group.Response)
+	}
+	strategy := group.Strategy
+	if strategy == targets.StrategyUnknown {
+		strategy = alb.Strategy
+	}
+	if strategy == targets.StrategyConsistentHash {
+		s := services.NewConsistentHashStrategy(group.HashHeader)
+		if group.HashLoad > 0 {
+			s = services.NewBoundedHashStrategy(group.HashHeader,
+				group.HashLoad)
+		}
+		pool.SetCustomStrategy(s)
+	} else if strategy != targets.StrategyUnknown {
+		pool.SetStrategy(strategy)
+	}
+	if group.Transport != nil {
+		pool.SetTransport(group.Transport)
+	}
+	for _, t := range ts {
 		if err := pool.AddService(t); err != nil {
 			return err
 		}
 	}
-	alb.Targets = append(alb.Targets, appTarget{
-		Name: group.Name,
-		Rule: group.Rule,
-		Pool: pool,
-	})
+	target.Pool = pool
+	target.Proxy = pool.Proxy()
+	alb.Targets = append(alb.Targets, target)
 	return nil
 }
 
+func (alb *appLoadBalancer) Handler(l Listener) http.Handler {
+	return alb.Chain.Then(alb.handler(l))
+}
+
 func (alb *appLoadBalancer) HealthCheck(interval time.Duration) StopFn {
 	stops := []StopFn{}
 	for _, t := range alb.Targets {
 		if t.Pool != nil {
 			stops = append(stops,
-				StopFn(t.Pool.HealthCheck(interval)))
+				StopFn(t.Pool.HealthCheck(interval,
+					healthCheckTimeout(alb.Timeouts))))
 		}
 	}
 	return func() {
@@ -132,12 +470,39 @@ func (alb *appLoadBalancer) HealthCheck(interval time.Duration) StopFn {
 	}
 }
 
+func (alb *appLoadBalancer) Discover() StopFn {
+	stops := []StopFn{}
+	for _, t := range alb.Targets {
+		if t.Pool == nil || !t.Group.IsDynamic() {
+			continue
+		}
+		name, pool := t.Name, t.Pool
+		stops = append(stops, t.Resolved.Watch(func(ts []targets.Target) {
+			if err := pool.SetTargets(ts); err != nil {
+				log.Error("Failed to update targets",
+					logging.Fields{
+						"group":            name,
+						logging.FieldError: err,
+					})
+			}
+		}))
+	}
+	return combineStopFns(stops)
+}
+
 func (alb *appLoadBalancer) GC() StopFn {
 	stops := []StopFn{}
+	// A shared registry is collected once for every pool
+	if alb.Registry != nil {
+		stops = append(stops, StopFn(alb.Registry.GC()))
+	}
 	for _, t := range alb.Targets {
-		if t.Pool != nil {
+		if t.Pool != nil && alb.Registry == nil {
 			stops = append(stops, StopFn(t.Pool.GC()))
 		}
+		if t.RateLimit != nil {
+			stops = append(stops, StopFn(t.RateLimit.GC()))
+		}
 	}
 	return func() {
 		for _, fn := range stops {
@@ -146,6 +511,36 @@ func (alb *appLoadBalancer) GC() StopFn {
 	}
 }
 
+// mirrorHandler returns the handler func that serves the requests mirrored by
+// the given target. Mirrored requests skip the mirror target's rate limits, so
+// they do not spend the client's budget. If the target does not mirror requests
+// or the mirror target can not be found, nil is returned.
+func (alb *appLoadBalancer) mirrorHandler(t appTarget) http.HandlerFunc {
+	if t.MirrorTo == "" || t.MirrorTo == t.Name {
+		return nil
+	}
+	for _, m := range alb.Targets {
+		if m.Name == t.MirrorTo {
+			return m.Proxy
+		}
+	}
+	return nil
+}
+
+// targetPool returns the service pool of the target with the given name. If
+// the target can not be found or has no pool, nil is returned.
+func (alb *appLoadBalancer) targetPool(name string) services.ServicePool {
+	if name == "" {
+		return nil
+	}
+	for _, t := range alb.Targets {
+		if t.Name == name {
+			return t.Pool
+		}
+	}
+	return nil
+}
+
 // Redirect sends a redirect to the given URL target with a status code of Moved
 // Permanently (HTTP 301). The request's path and query is appended to the URL.
 func (alb *appLoadBalancer) Redirect(w http.ResponseWriter, r *http.Request, url string) {
@@ -156,47 +551,306 @@ func (alb *appLoadBalancer) Redirect(w http.ResponseWriter, r *http.Request, url
 	http.Redirect(w, r, target, http.StatusMovedPermanently)
 }
 
-func (alb *appLoadBalancer) Start(laddr, protocol string) (StopFn, error) {
-	handler := func(w http.ResponseWriter, r *http.Request) {
-		matchFound := false
-		for _, t := range alb.Targets {
-			if t.Rule.Matches(r) {
-				switch t.Rule.Action {
-				case rules.RuleActionForward:
-					if t.Pool != nil {
-						t.Pool.LoadBalancer()(w, r)
-					}
-					matchFound = true
-				case rules.RuleActionRedirect:
-					alb.Redirect(w, r, t.RedirectUrl)
-					matchFound = true
-				}
-				if matchFound {
-					break
-				}
+func (alb *appLoadBalancer) Start(listeners ...Listener) (StopFn, error) {
+	if len(listeners) == 0 {
+		return nil, ErrNoListeners
+	}
+	if err := validListeners(listeners); err != nil {
+		return nil, err
+	}
+	if err := alb.validTls(listeners); err != nil {
+		return nil, err
+	}
+	if err := alb.validSplits(); err != nil {
+		return nil, err
+	}
+	if alb.ReadyGate {
+		alb.checkHealth()
+	}
+	stops := []StopFn{}
+	for _, l := range listeners {
+		stop, err := alb.listen(l)
+		if err != nil {
+			combineStopFns(stops)()
+			return nil, err
+		}
+		stops = append(stops, stop)
+	}
+	return combineStopFns(stops), nil
+}
+
+// validTls returns an error if a target's rule has TLS conditions but the
+// target is bound to one of the given listeners without TLS, or has client CN
+// conditions but the listener has no client CA; its conditions could not match
+// the requests of that listener.
+func (alb *appLoadBalancer) validTls(listeners []Listener) error {
+	for _, t := range alb.Targets {
+		for _, l := range listeners {
+			if !l.Matches(t.Listener) {
+				continue
+			}
+			if err := t.Rule.ValidTls(l.TlsEnabled); err != nil {
+				return fmt.Errorf("%s - '%s' on '%s'", err, t.Name,
+					l.Addr)
+			}
+			if l.TlsClientCaFile == "" && t.Rule.RequiresClientCa() {
+				return fmt.Errorf("%s - '%s' on '%s'",
+					rules.ErrClientCnCondition, t.Name, l.Addr)
+			}
+		}
+	}
+	return nil
+}
+
+// validSplits returns an error if a target's rule splits requests to a target
+// group that was not added, or that has no targets to forward to; its share of
+// the requests could not be served.
+func (alb *appLoadBalancer) validSplits() error {
+	for _, t := range alb.Targets {
+		if t.Rule.Action != rules.RuleActionSplit {
+			continue
+		}
+		for _, s := range t.Rule.Split {
+			if alb.targetPool(s.Name) == nil {
+				return fmt.Errorf("%s - '%s' of '%s'",
+					ErrUnknownGroup, s.Name, t.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkHealth probes the targets of every pool once.
+func (alb *appLoadBalancer) checkHealth() {
+	timeout := healthCheckTimeout(alb.Timeouts)
+	for _, t := range alb.Targets {
+		if t.Pool != nil {
+			t.Pool.CheckHealth(timeout)
+		}
+	}
+	if !alb.Ready() {
+		log.Warning("No alive targets in one or more target groups")
+	}
+}
+
+// action returns the handler for the action of the given target's rule. If the
+// action can not be served for the request, nil is returned instead.
+func (alb *appLoadBalancer) action(t appTarget, r *http.Request) http.Handler {
+	switch t.Rule.Action {
+	case rules.RuleActionForward:
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if shadow := alb.mirrorHandler(t); shadow != nil {
+				mirror(shadow, r)
+			}
+			if t.Pool != nil {
+				t.Pool.LoadBalancer()(w, r)
+			}
+		})
+	case rules.RuleActionRedirect:
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if t.Redirect != nil {
+				http.Redirect(w, r, t.Redirect.URL(r),
+					t.Redirect.StatusCode)
+				return
+			}
+			alb.Redirect(w, r, t.RedirectUrl)
+		})
+	case rules.RuleActionSplit:
+		pool := alb.targetPool(t.Rule.SelectSplit(r))
+		if pool == nil {
+			return nil
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if shadow := alb.mirrorHandler(t); shadow != nil {
+				mirror(shadow, r)
+			}
+			pool.LoadBalancer()(w, r)
+		})
+	}
+	return nil
+}
+
+// handler returns the handler func for requests received by the given listener.
+// Requests are matched against the rule of each target bound to the listener in
+// order and the first match is passed through the target's middleware chain to
+// its action.
+func (alb *appLoadBalancer) handler(l Listener) http.HandlerFunc {
+	names := alb.Middleware
+	if names == nil {
+		names = DefaultMiddleware
+	}
+	chains := make([]services.Chain, len(alb.Targets))
+	for i, t := range alb.Targets {
+		chains[i] = alb.targetChain(t, names)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !alb.Serving() {
+			handleServiceUnavailable(w, alb.RespFormat.Negotiate(r))
+			return
+		}
+		if !l.AllowsClient(r) {
+			handleForbidden(w, alb.RespFormat.Negotiate(r))
+			return
+		}
+		if alb.HealthPath != "" && r.Method == http.MethodHead &&
+			r.URL.Path == alb.HealthPath {
+			if alb.ReadyGate && !alb.Ready() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
 			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if alb.HealthzPath != "" && r.URL.Path == alb.HealthzPath &&
+			(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			HealthzHandler(alb).ServeHTTP(w, r)
+			return
+		}
+		if alb.Trace.Traces(r) {
+			alb.traceRoute(l, w, r)
 		}
-		if !matchFound {
-			handleForbidden(w, alb.RespFormat)
+		for i, t := range alb.Targets {
+			if !l.Matches(t.Listener) || !t.Rule.Matches(r) {
+				continue
+			}
+			if action := alb.action(t, r); action != nil {
+				chains[i].Then(action).ServeHTTP(w, r)
+				return
+			}
 		}
+		handleForbidden(w, alb.RespFormat.Negotiate(r))
+	}
+}
+
+// listen binds the given listener's address and serves requests on it in a
+// separate routine. It returns a stop function to shutdown the listener's
+// server.
+func (alb *appLoadBalancer) listen(l Listener) (StopFn, error) {
+	if err := l.ValidAppProtocol(); err != nil {
+		return nil, err
+	}
+	certFile, keyFile := l.TlsCertFile, l.TlsKeyFile
+	if certFile == "" && keyFile == "" {
+		certFile, keyFile = alb.TlsCertFile, alb.TlsKeyFile
+	}
+	if l.TlsEnabled && (certFile == "" || keyFile == "") {
+		return nil, fmt.Errorf("%s - '%s'", ErrMissingTlsCert, l.Addr)
+	}
+	tlsConfig, err := l.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", l.Addr)
+	if err != nil {
+		return nil, err
 	}
 	server := http.Server{
-		Addr:    laddr,
-		Handler: http.HandlerFunc(handler),
+		Addr:           l.Addr,
+		Handler:        alb.Handler(l),
+		TLSConfig:      tlsConfig,
+		ReadTimeout:    alb.Timeouts.Read,
+		WriteTimeout:   alb.Timeouts.Write,
+		IdleTimeout:    alb.Timeouts.Idle,
+		MaxHeaderBytes: alb.MaxHeader,
 	}
 	go func() {
 		var err error
-		if alb.TlsEnabled {
-			err = server.ListenAndServeTLS(alb.TlsCertFile,
-				alb.TlsKeyFile)
+		if l.TlsEnabled {
+			err = server.ServeTLS(ln, certFile, keyFile)
 		} else {
-			err = server.ListenAndServe()
+			err = server.Serve(ln)
 		}
 		if err != nil && err != http.ErrServerClosed {
-			logger.Error(err)
+			log.Error("Listener failed", logging.Fields{
+				"listener":         l.Addr,
+				logging.FieldError: err,
+			})
 		}
 	}()
-	return func() { server.Shutdown(context.Background()) }, nil
+	return func() {
+		server.Shutdown(context.Background())
+		// The listener is closed explicitly in case the server
+		// routine has not started serving yet.
+		ln.Close()
+	}, nil
+}
+
+func (alb *appLoadBalancer) Healthy() bool {
+	pools := 0
+	for _, t := range alb.Targets {
+		if t.Pool == nil || t.Rule.Action != rules.RuleActionForward {
+			continue
+		}
+		if t.Pool.Alive() > 0 {
+			return true
+		}
+		pools++
+	}
+	// Without pools, requests are answered by the load balancer itself
+	return pools == 0
+}
+
+func (alb *appLoadBalancer) Ready() bool {
+	for _, t := range alb.Targets {
+		// Only forwarded groups serve requests from their own pool
+		if t.Pool == nil || t.Rule.Action != rules.RuleActionForward {
+			continue
+		}
+		if t.Pool.Alive() == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (alb *appLoadBalancer) SetHealthPath(path string) {
+	alb.HealthPath = path
+}
+
+func (alb *appLoadBalancer) SetHealthzPath(path string) {
+	alb.HealthzPath = path
+}
+
+func (alb *appLoadBalancer) SetMaxHeaderBytes(n int) {
+	if n >= 0 {
+		alb.MaxHeader = n
+	}
+}
+
+func (alb *appLoadBalancer) OnHealthChange(fn HealthChangeFn) {
+	alb.HealthChange = fn
+}
+
+func (alb *appLoadBalancer) SetHealthCheckRetries(n int) {
+	if n >= 0 {
+		alb.HealthRetry = n
+	}
+}
+
+func (alb *appLoadBalancer) SetGroupStrategy(group string, s services.Strategy) error {
+	found := false
+	for _, t := range alb.Targets {
+		if t.Pool != nil && t.Group.Name == group {
+			t.Pool.SetCustomStrategy(s)
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s - '%s'", ErrUnknownGroup, group)
+	}
+	return nil
+}
+
+func (alb *appLoadBalancer) SetLatencyBuckets(bounds []time.Duration) {
+	alb.Latency = append([]time.Duration{}, bounds...)
+}
+
+func (alb *appLoadBalancer) SetReadinessGate(enabled bool) {
+	alb.ReadyGate = enabled
+}
+
+func (alb *appLoadBalancer) SetRequestIdHeader(name string) {
+	alb.ReqIdHeader = name
 }
 
 func (alb *appLoadBalancer) SetResponseFormat(format string) {
@@ -206,16 +860,152 @@ func (alb *appLoadBalancer) SetResponseFormat(format string) {
 	}
 }
 
+func (alb *appLoadBalancer) SetMiddleware(names ...string) error {
+	for _, name := range names {
+		if !validMiddleware(name) {
+			return fmt.Errorf("%s - '%s'", ErrUnknownMiddleware, name)
+		}
+	}
+	alb.Middleware = append([]string{}, names...)
+	return nil
+}
+
+func (alb *appLoadBalancer) SetRewriteLocation(enabled bool) {
+	alb.RewriteLoc = enabled
+}
+
+func (alb *appLoadBalancer) SetRetryAllMethods(enabled bool) {
+	alb.RetryAll = enabled
+}
+
+func (alb *appLoadBalancer) SetRetryBackoff(b targets.Backoff) {
+	alb.RetryBackoff = b
+}
+
+func (alb *appLoadBalancer) SetRetryBudget(n int) {
+	if n >= 0 {
+		alb.RetryBudget = n
+	}
+}
+
+func (alb *appLoadBalancer) SetRouteTrace(t RouteTrace) {
+	alb.Trace = t
+}
+
+func (alb *appLoadBalancer) SetSlowRequestThreshold(threshold time.Duration) {
+	if threshold >= 0 {
+		alb.SlowReq = threshold
+	}
+}
+
 func (alb *appLoadBalancer) SetTLS(certFile, keyFile string) {
-	alb.TlsEnabled = true
 	alb.TlsCertFile = certFile
 	alb.TlsKeyFile = keyFile
 }
 
+func (alb *appLoadBalancer) SetServing(enabled bool) {
+	disabled := int32(1)
+	if enabled {
+		disabled = 0
+	}
+	atomic.StoreInt32(&alb.Disabled, disabled)
+}
+
+func (alb *appLoadBalancer) Serving() bool {
+	return atomic.LoadInt32(&alb.Disabled) == 0
+}
+
+func (alb *appLoadBalancer) SetStrategy(s targets.Strategy) {
+	alb.Strategy = s
+}
+
+func (alb *appLoadBalancer) SetSharedRateLimit(enabled bool) {
+	alb.Registry = nil
+	if enabled {
+		alb.Registry = ratelimit.NewIPRegistry(time.Duration(alb.Rate))
+	}
+}
+
+func (alb *appLoadBalancer) SetTlsHeaders(h services.TlsHeaders) {
+	alb.TlsHeaders = h
+}
+
+func (alb *appLoadBalancer) SetUpstreamHeaders(enabled bool) {
+	alb.Upstream = enabled
+}
+
+func (alb *appLoadBalancer) SetTargetAlive(targetURL string, alive bool) error {
+	found := false
+	for _, t := range alb.Targets {
+		if t.Pool != nil && t.Pool.SetAlive(targetURL, alive) {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s - '%s'", ErrUnknownTarget, targetURL)
+	}
+	return nil
+}
+
+func (alb *appLoadBalancer) Stats() []TargetStats {
+	stats := []TargetStats{}
+	for _, t := range alb.Targets {
+		if t.Pool == nil {
+			continue
+		}
+		for _, s := range t.Pool.Stats() {
+			stats = append(stats, newTargetStats(t.Group.Name, s))
+		}
+	}
+	return stats
+}
+
+func (alb *appLoadBalancer) Rules() []RouteRule {
+	routes := make([]RouteRule, len(alb.Targets))
+	for i, t := range alb.Targets {
+		routes[i] = newRouteRule(i, t)
+	}
+	return routes
+}
+
 func (alb *appLoadBalancer) Type() string {
 	return LoadBalancerTypeApp.Long()
 }
 
+func (alb *appLoadBalancer) Use(mw ...services.Middleware) {
+	alb.Chain = append(alb.Chain, mw...)
+}
+
+// handleUnauthorized handles requests that are not authorized to access a
+// resource (HTTP code 401).
+func handleUnauthorized(w http.ResponseWriter, format services.ResponseFormat) {
+	contentType := ""
+	msg := ""
+	switch format {
+	case services.ResponseFormatHtml:
+		contentType = "text/html"
+		msg = templates.UnauthorizedPage()
+	case services.ResponseFormatJson:
+		b, err := json.Marshal(services.ResponseError{
+			Code:    http.StatusUnauthorized,
+			Message: "Unauthorized",
+		})
+		if err == nil {
+			contentType = "application/json"
+			msg = string(b)
+			break
+		}
+		fallthrough
+	default:
+		contentType = "text/plain"
+		msg = "Unauthorized\n"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprintf(w, "%s", msg)
+}
+
 // handleForbidden handles requests are forbidden from accessing a resource
 // (HTTP code 403). In context, this is likely done when an LoadBalancer is
 // unable to match any target rules.
@@ -247,52 +1037,441 @@ func handleForbidden(w http.ResponseWriter, format services.ResponseFormat) {
 	fmt.Fprintf(w, "%s", msg)
 }
 
+// handleServiceUnavailable handles the response for when the load balancer is
+// not serving requests (HTTP code 503).
+func handleServiceUnavailable(w http.ResponseWriter, format services.ResponseFormat) {
+	contentType := ""
+	msg := ""
+	switch format {
+	case services.ResponseFormatHtml:
+		contentType = "text/html"
+		msg = templates.ServiceUnavailablePage()
+	case services.ResponseFormatJson:
+		b, err := json.Marshal(services.ResponseError{
+			Code:    http.StatusServiceUnavailable,
+			Message: "Service not available",
+		})
+		if err == nil {
+			contentType = "application/json"
+			msg = string(b)
+			break
+		}
+		fallthrough
+	default:
+		contentType = "text/plain"
+		msg = "Service not available\n"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintf(w, "%s", msg)
+}
+
 // netLoadBalancer implements the LoadBalancer interface as a network (E.g. TCP,
 // UDP, etc.) load balancer and manages its own network pool.
 type netLoadBalancer struct {
-	Pool    networks.NetworkPool
-	Timeout time.Duration
+	DnsGroups    map[string]*dnsGroup // DNS target groups by name
+	Groups       []*groupTargets      // Target groups and their current targets
+	HealthChange HealthChangeFn       // Health transition callback
+	HealthRetry  int                  // Failed probe retries of DNS groups
+	Lock         sync.Mutex
+	Pool         networks.NetworkPool
+	ReadyGate    bool             // Wait for alive targets
+	RetryBackoff *targets.Backoff // Backoff between retries; nil for default
+	Timeout      time.Duration
+	Timeouts     Timeouts // Load balancer timeouts
 }
 
 // NewNetworkLoadBalancer returns a LoadBalancer for network-level targets. This
-// means services that expect TCP, UDP, whatever connections.
-func NewNetworkLoadBalancer(to time.Duration) LoadBalancer {
-	return &netLoadBalancer{
-		Pool:    networks.New(),
-		Timeout: to,
+// means services that expect TCP, UDP, whatever connections. The given timeout
+// is used to connect to targets unless a dial timeout option is set, and any
+// options are applied in order.
+func NewNetworkLoadBalancer(to time.Duration, opts ...Option) LoadBalancer {
+	o := newOptions(opts)
+	if o.Timeouts.Dial > 0 {
+		to = o.Timeouts.Dial
 	}
+	nlb := &netLoadBalancer{
+		Pool:     networks.New(),
+		Timeout:  to,
+		Timeouts: o.Timeouts,
+	}
+	nlb.Pool.SetHealthChange(nlb.healthChanged)
+	nlb.Pool.SetIdleTimeout(o.Timeouts.RelayIdle)
+	nlb.Pool.SetMaxConns(o.ConnLimits.Total)
+	nlb.Pool.SetMaxConnsPerIp(o.ConnLimits.PerIp)
+	o.apply(nlb)
+	return nlb
 }
 
 func (nlb *netLoadBalancer) AddTargetGroup(group *targets.TargetGroup) error {
-	for _, t := range group.Targets {
+	if group.Dns != nil {
+		return nlb.addDnsGroup(group)
+	}
+	if err := validNetworkRule(group.Rule); err != nil {
+		return fmt.Errorf("%s - '%s'", err, group.Name)
+	}
+	if err := nlb.sharedSettings(group); err != nil {
+		return err
+	}
+	resolved, err := resolveGroup(group)
+	if err != nil {
+		return err
+	}
+	if group.Health != nil {
+		// The groups share one pool and so its health check
+		nlb.Pool.SetHealthCheck(group.Health)
+	}
+	if group.Strategy != targets.StrategyUnknown {
+		nlb.Pool.SetStrategy(group.Strategy)
+	}
+	for _, t := range groupTimeouts(group, resolved.All()) {
 		if err := nlb.Pool.AddTarget(t, nlb.Timeout); err != nil {
 			return err
 		}
 	}
+	nlb.Lock.Lock()
+	nlb.Groups = append(nlb.Groups, resolved)
+	nlb.Lock.Unlock()
+	return nil
+}
+
+func (nlb *netLoadBalancer) Discover() StopFn {
+	stops := []StopFn{}
+	for _, g := range nlb.Groups {
+		if !g.Group.IsDynamic() {
+			continue
+		}
+		stops = append(stops, g.Watch(func([]targets.Target) {
+			if err := nlb.updateTargets(); err != nil {
+				log.Error("Failed to update targets",
+					logging.Fields{logging.FieldError: err})
+			}
+		}))
+	}
+	for _, g := range nlb.dnsGroups() {
+		if !g.Group.Group.IsDynamic() {
+			continue
+		}
+		group := g.Group.Group
+		pool := g.Pool
+		stops = append(stops, g.Group.Watch(func(ts []targets.Target) {
+			ts = groupTimeouts(group, ts)
+			if err := pool.SetTargets(ts, nlb.Timeout); err != nil {
+				log.Error("Failed to update targets",
+					logging.Fields{logging.FieldError: err})
+			}
+		}))
+	}
+	return combineStopFns(stops)
+}
+
+// sharedSettings returns an error if the given group sets a health check or
+// strategy other than one already set by another group; since the groups share
+// one pool.
+func (nlb *netLoadBalancer) sharedSettings(group *targets.TargetGroup) error {
+	nlb.Lock.Lock()
+	defer nlb.Lock.Unlock()
+	for _, g := range nlb.Groups {
+		if group.Health != nil && g.Group.Health != nil &&
+			!reflect.DeepEqual(group.Health, g.Group.Health) {
+			return fmt.Errorf("%s - '%s'", ErrNlbHealthCheck,
+				group.Name)
+		}
+		if group.Strategy != targets.StrategyUnknown &&
+			g.Group.Strategy != targets.StrategyUnknown &&
+			group.Strategy != g.Group.Strategy {
+			return fmt.Errorf("%s - '%s'", ErrNlbStrategy,
+				group.Name)
+		}
+	}
+	return nil
+}
+
+// updateTargets updates the pool with the current targets of all groups; since
+// the groups share one pool.
+func (nlb *netLoadBalancer) updateTargets() error {
+	nlb.Lock.Lock()
+	defer nlb.Lock.Unlock()
+	all := []targets.Target{}
+	for _, g := range nlb.Groups {
+		all = append(all, groupTimeouts(g.Group, g.All())...)
+	}
+	return nlb.Pool.SetTargets(all, nlb.Timeout)
+}
+
+// groupTimeouts sets the given group's connection timeouts on those of the
+// given targets that do not set their own, and returns the targets.
+func groupTimeouts(group *targets.TargetGroup, ts []targets.Target) []targets.Target {
+	if group.Timeouts == nil {
+		return ts
+	}
+	for _, t := range ts {
+		if t.DialTimeout() <= 0 {
+			t.SetDialTimeout(group.Timeouts.Dial)
+		}
+		if t.IdleTimeout() <= 0 {
+			t.SetIdleTimeout(group.Timeouts.Idle)
+		}
+	}
+	return ts
+}
+
+func (nlb *netLoadBalancer) Handler(l Listener) http.Handler {
+	// XXX NoOp
 	return nil
 }
 
 func (nlb *netLoadBalancer) HealthCheck(interval time.Duration) StopFn {
-	return StopFn(nlb.Pool.HealthCheck(interval))
+	to := healthCheckTimeout(nlb.Timeouts)
+	stops := []StopFn{StopFn(nlb.Pool.HealthCheck(interval, to))}
+	for _, g := range nlb.dnsGroups() {
+		stops = append(stops, StopFn(g.Pool.HealthCheck(interval, to)))
+	}
+	return combineStopFns(stops)
 }
 
 func (nlb *netLoadBalancer) GC() StopFn {
 	return StopFn(func() {})
 }
 
-func (nlb *netLoadBalancer) Start(laddr, protocol string) (StopFn, error) {
-	stopFn, err := nlb.Pool.LoadBalancer(laddr, protocol)
-	return StopFn(stopFn), err
+func (nlb *netLoadBalancer) Start(listeners ...Listener) (StopFn, error) {
+	if len(listeners) == 0 {
+		return nil, ErrNoListeners
+	}
+	if err := validListeners(listeners); err != nil {
+		return nil, err
+	}
+	if nlb.ReadyGate {
+		nlb.Pool.CheckHealth(healthCheckTimeout(nlb.Timeouts))
+		for _, g := range nlb.dnsGroups() {
+			g.Pool.CheckHealth(healthCheckTimeout(nlb.Timeouts))
+		}
+		if !nlb.Ready() {
+			log.Warning("No alive targets")
+		}
+	}
+	stops := []StopFn{}
+	for _, l := range listeners {
+		if strings.EqualFold(l.Protocol, DnsProtocol) && nlb.servesDns(l) {
+			stopFn, err := nlb.serveDns(l.Addr)
+			if err != nil {
+				combineStopFns(stops)()
+				return nil, err
+			}
+			stops = append(stops, stopFn)
+			continue
+		}
+		network, err := l.Network()
+		if err != nil {
+			combineStopFns(stops)()
+			return nil, err
+		}
+		stopFn, err := nlb.Pool.LoadBalancer(l.Addr, network)
+		if err != nil {
+			combineStopFns(stops)()
+			return nil, err
+		}
+		stops = append(stops, StopFn(stopFn))
+	}
+	return combineStopFns(stops), nil
+}
+
+func (nlb *netLoadBalancer) OnHealthChange(fn HealthChangeFn) {
+	nlb.HealthChange = fn
+}
+
+func (nlb *netLoadBalancer) SetGroupStrategy(group string, s services.Strategy) error {
+	return fmt.Errorf("%s - '%s'", ErrNlbCustomStrategy, group)
+}
+
+func (nlb *netLoadBalancer) SetHealthCheckRetries(n int) {
+	nlb.Pool.SetHealthCheckRetries(n)
+	nlb.Lock.Lock()
+	nlb.HealthRetry = n
+	nlb.Lock.Unlock()
+	for _, g := range nlb.dnsGroups() {
+		g.Pool.SetHealthCheckRetries(n)
+	}
+}
+
+func (nlb *netLoadBalancer) SetLatencyBuckets(bounds []time.Duration) {
+	// XXX NoOp
+}
+
+// validNetworkRule returns an error if the given rule uses features a network
+// load balancer cannot apply, since it does not inspect HTTP requests; E.g.
+// redirects or host-header conditions.
+func validNetworkRule(r rules.Rule) error {
+	if r.Action != rules.RuleActionUnknown &&
+		r.Action != rules.RuleActionForward {
+		return ErrNlbRuleAction
+	}
+	for _, cond := range r.Conditions {
+		for _, sub := range cond {
+			if rules.NewConditionKey(sub.Key()) !=
+				rules.ConditionKeyAlways {
+				return ErrNlbRuleCondition
+			}
+		}
+	}
+	return nil
+}
+
+// healthChanged calls the health change function with the name of the group
+// the given target belongs to.
+func (nlb *netLoadBalancer) healthChanged(t targets.Target, wasAlive, alive bool) {
+	if nlb.HealthChange != nil {
+		nlb.HealthChange(nlb.groupName(t), t, wasAlive, alive)
+	}
+}
+
+// groupName returns the name of the group the given target belongs to.
+func (nlb *netLoadBalancer) groupName(t targets.Target) string {
+	nlb.Lock.Lock()
+	defer nlb.Lock.Unlock()
+	for _, g := range nlb.Groups {
+		for _, gt := range g.All() {
+			if gt.URL() == t.URL() {
+				return g.Group.Name
+			}
+		}
+	}
+	return ""
+}
+
+func (nlb *netLoadBalancer) Healthy() bool {
+	return nlb.alive() > 0
+}
+
+func (nlb *netLoadBalancer) Ready() bool {
+	return nlb.alive() > 0
+}
+
+// alive returns the number of alive targets; relayed or answered.
+func (nlb *netLoadBalancer) alive() int {
+	alive := nlb.Pool.Alive()
+	for _, g := range nlb.dnsGroups() {
+		alive += g.Pool.Alive()
+	}
+	return alive
+}
+
+func (nlb *netLoadBalancer) SetHealthPath(path string) {
+	// XXX NoOp
+}
+
+func (nlb *netLoadBalancer) SetHealthzPath(path string) {
+	// XXX NoOp
+}
+
+func (nlb *netLoadBalancer) SetMaxHeaderBytes(n int) {
+	// XXX NoOp
+}
+
+func (nlb *netLoadBalancer) SetReadinessGate(enabled bool) {
+	nlb.ReadyGate = enabled
+}
+
+func (nlb *netLoadBalancer) SetRequestIdHeader(name string) {
+	// XXX NoOp
 }
 
 func (nlb *netLoadBalancer) SetResponseFormat(format string) {
 	// XXX NoOp
 }
 
+func (nlb *netLoadBalancer) SetMiddleware(names ...string) error {
+	// XXX NoOp
+	return nil
+}
+
+func (nlb *netLoadBalancer) SetRewriteLocation(enabled bool) {
+	// XXX NoOp
+}
+
+func (nlb *netLoadBalancer) SetRetryAllMethods(enabled bool) {
+	// XXX NoOp
+}
+
+func (nlb *netLoadBalancer) SetRetryBackoff(b targets.Backoff) {
+	nlb.Pool.SetRetryBackoff(b)
+	nlb.Lock.Lock()
+	nlb.RetryBackoff = &b
+	nlb.Lock.Unlock()
+	for _, g := range nlb.dnsGroups() {
+		g.Pool.SetRetryBackoff(b)
+	}
+}
+
+func (nlb *netLoadBalancer) SetRetryBudget(n int) {
+	// XXX NoOp
+}
+
+func (nlb *netLoadBalancer) SetRouteTrace(t RouteTrace) {
+	// XXX NoOp
+}
+
+func (nlb *netLoadBalancer) SetSlowRequestThreshold(threshold time.Duration) {
+	// XXX NoOp
+}
+
 func (nlb *netLoadBalancer) SetTLS(certFile, keyFile string) {
 	// XXX NoOp
 }
 
+func (nlb *netLoadBalancer) SetServing(enabled bool) {
+	// XXX NoOp
+}
+
+func (nlb *netLoadBalancer) Serving() bool {
+	return true
+}
+
+func (nlb *netLoadBalancer) SetSharedRateLimit(enabled bool) {
+	// XXX NoOp
+}
+
+func (nlb *netLoadBalancer) SetStrategy(s targets.Strategy) {
+	// Groups that set their own strategy replace it on the shared pool
+	nlb.Pool.SetStrategy(s)
+}
+
+func (nlb *netLoadBalancer) SetTlsHeaders(h services.TlsHeaders) {
+	// XXX NoOp
+}
+
+func (nlb *netLoadBalancer) SetUpstreamHeaders(enabled bool) {
+	// XXX NoOp
+}
+
+func (nlb *netLoadBalancer) SetTargetAlive(targetURL string, alive bool) error {
+	found := nlb.Pool.SetAlive(targetURL, alive)
+	for _, g := range nlb.dnsGroups() {
+		if g.Pool.SetAlive(targetURL, alive) {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s - '%s'", ErrUnknownTarget, targetURL)
+	}
+	return nil
+}
+
+func (nlb *netLoadBalancer) Stats() []TargetStats {
+	// XXX NoOp
+	return nil
+}
+
+func (nlb *netLoadBalancer) Rules() []RouteRule {
+	// XXX NoOp
+	return nil
+}
+
 func (nlb *netLoadBalancer) Type() string {
 	return LoadBalancerTypeNet.Long()
 }
+
+func (nlb *netLoadBalancer) Use(mw ...services.Middleware) {
+	// XXX NoOp
+}
@@ -2,17 +2,876 @@ package loadbalancers
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 
+	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
 	"github.com/crossedbot/simpleloadbalancer/pkg/services"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
 	"github.com/crossedbot/simpleloadbalancer/pkg/templates"
 )
 
+func TestAppLoadBalancerStart(t *testing.T) {
+	body := "{\"hello\": \"world\"}"
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "%s", body)
+		}),
+	)
+	defer ts.Close()
+
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	rule := rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	}
+	group := targets.NewTargetGroup("web", "http", rule)
+	group.AddServiceTarget(targetUrl)
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	require.Nil(t, lb.AddTargetGroup(group))
+
+	_, err = lb.Start()
+	require.Equal(t, ErrNoListeners, err)
+
+	listeners := []Listener{
+		NewListener("one", getFreeAddr(t), "http"),
+		NewListener("two", getFreeAddr(t), "http"),
+	}
+	stop, err := lb.Start(listeners...)
+	require.Nil(t, err)
+	for _, l := range listeners {
+		resp, err := http.Get("http://" + l.Addr)
+		require.Nil(t, err)
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, body, string(respBody))
+	}
+
+	stop()
+	for _, l := range listeners {
+		_, err := http.Get("http://" + l.Addr)
+		require.NotNil(t, err)
+	}
+}
+
+func TestAppLoadBalancerStartAddrInUse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	free := NewListener("free", getFreeAddr(t), "http")
+	taken := NewListener("taken", ln.Addr().String(), "http")
+	_, err = lb.Start(free, taken)
+	require.NotNil(t, err)
+
+	// The listener started before the failure should have been stopped
+	ln2, err := net.Listen("tcp", free.Addr)
+	require.Nil(t, err)
+	ln2.Close()
+}
+
+func TestAppLoadBalancerStartTlsConditions(t *testing.T) {
+	rule := rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"tls-sni=*.example.com"}},
+	}
+	group := targets.NewTargetGroup("tenants", "http", rule)
+	group.AddTarget("127.0.0.1", 8080)
+	group.Listener = "secure"
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	require.Nil(t, lb.AddTargetGroup(group))
+
+	// TLS conditions cannot match the requests of plain listeners
+	plain := NewListener("secure", getFreeAddr(t), "http")
+	_, err := lb.Start(plain)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), rules.ErrTlsCondition.Error())
+
+	// Listeners the group is not bound to are not checked
+	alb := lb.(*appLoadBalancer)
+	require.Nil(t, alb.validTls([]Listener{
+		NewListener("web", getFreeAddr(t), "http"),
+		NewListener("secure", getFreeAddr(t), "https"),
+	}))
+
+	// Client CN conditions only match certificates verified by a client CA
+	group = targets.NewTargetGroup("clients", "http", rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"tls-client-cn=tenant-a"}},
+	})
+	group.AddTarget("127.0.0.1", 8081)
+	group.Listener = "secure"
+	require.Nil(t, lb.AddTargetGroup(group))
+	secure := NewListener("secure", getFreeAddr(t), "https")
+	err = alb.validTls([]Listener{secure})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), rules.ErrClientCnCondition.Error())
+	secure.SetClientAuth("ca.pem")
+	require.Nil(t, alb.validTls([]Listener{secure}))
+}
+
+func TestAppLoadBalancerMaxHeaderBytes(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	rule := rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	}
+	group := targets.NewTargetGroup("web", "http", rule)
+	group.AddServiceTarget(targetUrl)
+	lb := NewApplicationLoadBalancer(time.Second, 100,
+		WithMaxHeaderBytes(1024))
+	require.Nil(t, lb.AddTargetGroup(group))
+	l := NewListener("", getFreeAddr(t), "http")
+	stop, err := lb.Start(l)
+	require.Nil(t, err)
+	defer stop()
+
+	// The server allows some slack over the limit for buffering, so the
+	// oversized header is well over it
+	req, err := http.NewRequest(http.MethodGet, "http://"+l.Addr, nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Large", strings.Repeat("a", 16*1024))
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusRequestHeaderFieldsTooLarge,
+		resp.StatusCode)
+
+	req.Header.Set("X-Large", "a")
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestAppLoadBalancerMiddleware(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	)
+	defer ts.Close()
+
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	rule := rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	}
+	group := targets.NewTargetGroup("web", "http", rule)
+	group.BasicAuth = &targets.BasicAuthConfig{}
+	group.AddServiceTarget(targetUrl)
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	require.Nil(t, lb.AddTargetGroup(group))
+	lb.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Middleware", "yes")
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	l := NewListener("", getFreeAddr(t), "http")
+	stop, err := lb.Start(l)
+	require.Nil(t, err)
+	resp, err := http.Get("http://" + l.Addr)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Equal(t, "yes", resp.Header.Get("X-Middleware"))
+	stop()
+
+	// Filters left out of the middleware list are disabled
+	require.NotNil(t, lb.SetMiddleware("not-a-filter"))
+	require.Nil(t, lb.SetMiddleware(MiddlewareCors))
+	l = NewListener("", getFreeAddr(t), "http")
+	stop, err = lb.Start(l)
+	require.Nil(t, err)
+	defer stop()
+	resp, err = http.Get("http://" + l.Addr)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestAppLoadBalancerHandlerListener(t *testing.T) {
+	targetUrl, err := url.Parse("https://example.com")
+	require.Nil(t, err)
+	rule := rules.Rule{
+		Action:     rules.RuleActionRedirect,
+		Conditions: [][]rules.Condition{{"always="}},
+	}
+	group := targets.NewTargetGroup("redirect", "https", rule)
+	group.Listener = "insecure"
+	group.AddServiceTarget(targetUrl)
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	require.Nil(t, lb.AddTargetGroup(group))
+	alb := lb.(*appLoadBalancer)
+
+	req, err := http.NewRequest(http.MethodGet, "/hello", nil)
+	require.Nil(t, err)
+
+	// Bound listener (by name) redirects
+	rr1 := httptest.NewRecorder()
+	alb.handler(NewListener("insecure", ":80", "http"))(rr1, req)
+	require.Equal(t, http.StatusMovedPermanently, rr1.Code)
+	require.Equal(t, "https://example.com:443/hello",
+		rr1.Header().Get("Location"))
+
+	// Any other listener does not evaluate the group's rule
+	rr2 := httptest.NewRecorder()
+	alb.handler(NewListener("secure", ":443", "https"))(rr2, req)
+	require.Equal(t, http.StatusForbidden, rr2.Code)
+
+	// Bound listener (by port) redirects
+	group.Listener = "80"
+	lb = NewApplicationLoadBalancer(time.Second, 100)
+	require.Nil(t, lb.AddTargetGroup(group))
+	alb = lb.(*appLoadBalancer)
+	rr3 := httptest.NewRecorder()
+	alb.handler(NewListener("", ":80", "http"))(rr3, req)
+	require.Equal(t, http.StatusMovedPermanently, rr3.Code)
+}
+
+func TestAppLoadBalancerHandlerMirror(t *testing.T) {
+	primaryBody := "primary"
+	primary := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "%s", primaryBody)
+		}),
+	)
+	defer primary.Close()
+	mirrored := make(chan string, 1)
+	shadow := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "%s", "shadow")
+			mirrored <- string(b)
+		}),
+	)
+	defer shadow.Close()
+
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	primaryUrl, err := url.Parse(primary.URL)
+	require.Nil(t, err)
+	rule := rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	}
+	group := targets.NewTargetGroup("primary", "http", rule)
+	group.MirrorTo = "shadow"
+	group.AddServiceTarget(primaryUrl)
+	require.Nil(t, lb.AddTargetGroup(group))
+	shadowUrl, err := url.Parse(shadow.URL)
+	require.Nil(t, err)
+	group = targets.NewTargetGroup("shadow", "http", rules.Rule{})
+	group.AddServiceTarget(shadowUrl)
+	require.Nil(t, lb.AddTargetGroup(group))
+	alb := lb.(*appLoadBalancer)
+
+	reqBody := "{\"hello\": \"world\"}"
+	req, err := http.NewRequest(http.MethodPost, "/",
+		strings.NewReader(reqBody))
+	require.Nil(t, err)
+	req.RemoteAddr = "127.0.0.1:12345"
+	rr := httptest.NewRecorder()
+	alb.handler(NewListener("", ":80", "http"))(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, primaryBody, rr.Body.String())
+	select {
+	case actual := <-mirrored:
+		require.Equal(t, reqBody, actual)
+	case <-time.After(3 * time.Second):
+		require.Fail(t, "request was not mirrored")
+	}
+}
+
+func TestAppLoadBalancerHandlerSplit(t *testing.T) {
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	for _, name := range []string{"stable", "canary"} {
+		body := name
+		ts := httptest.NewServer(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				fmt.Fprintf(w, "%s", body)
+			}),
+		)
+		defer ts.Close()
+		targetUrl, err := url.Parse(ts.URL)
+		require.Nil(t, err)
+		group := targets.NewTargetGroup(name, "http", rules.Rule{})
+		group.AddServiceTarget(targetUrl)
+		require.Nil(t, lb.AddTargetGroup(group))
+	}
+	rule := rules.Rule{
+		Action:     rules.RuleActionSplit,
+		Conditions: [][]rules.Condition{{"always="}},
+		Split: []rules.SplitTarget{
+			{Name: "stable", Weight: 1},
+			{Name: "canary", Weight: 1},
+		},
+	}
+	require.Nil(t, lb.AddTargetGroup(
+		targets.NewTargetGroup("split", "http", rule)))
+	alb := lb.(*appLoadBalancer)
+	handler := alb.handler(NewListener("", ":80", "http"))
+
+	seen := map[string]int{}
+	for i := 0; i < 20; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		req, err := http.NewRequest(http.MethodGet, "/", nil)
+		require.Nil(t, err)
+		req.RemoteAddr = net.JoinHostPort(ip, "8080")
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Equal(t, rule.SelectSplit(req), rr.Body.String())
+		seen[rr.Body.String()]++
+	}
+	require.Greater(t, seen["stable"], 0)
+	require.Greater(t, seen["canary"], 0)
+}
+
+func TestAppLoadBalancerStartUnknownSplit(t *testing.T) {
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	rule := rules.Rule{
+		Action:     rules.RuleActionSplit,
+		Conditions: [][]rules.Condition{{"always="}},
+		Split: []rules.SplitTarget{
+			{Name: "stable", Weight: 95},
+			{Name: "canary", Weight: 5},
+		},
+	}
+	require.Nil(t, lb.AddTargetGroup(
+		targets.NewTargetGroup("split", "http", rule)))
+	targetUrl, err := url.Parse("http://127.0.0.1:8080")
+	require.Nil(t, err)
+	group := targets.NewTargetGroup("stable", "http", rules.Rule{})
+	group.AddServiceTarget(targetUrl)
+	require.Nil(t, lb.AddTargetGroup(group))
+
+	stop, err := lb.Start(NewListener("", "127.0.0.1:0", "http"))
+	require.Nil(t, stop)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrUnknownGroup.Error())
+	require.Contains(t, err.Error(), "canary")
+}
+
+func TestAppLoadBalancerSetGroupStrategy(t *testing.T) {
+	rule := rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	}
+	group := targets.NewTargetGroup("web", "http", rule)
+	group.AddTarget("127.0.0.1", 8080)
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	require.NotNil(t, lb.SetGroupStrategy("web",
+		services.NewPowerOfTwoStrategy()))
+	require.Nil(t, lb.AddTargetGroup(group))
+	require.Nil(t, lb.SetGroupStrategy("web",
+		services.NewPowerOfTwoStrategy()))
+	require.NotNil(t, lb.SetGroupStrategy("api",
+		services.NewPowerOfTwoStrategy()))
+}
+
+func TestAppLoadBalancerSharedRateLimit(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	newHandler := func(opts ...Option) http.HandlerFunc {
+		// Clients get two requests a minute
+		lb := NewApplicationLoadBalancer(time.Minute, 0, opts...)
+		for _, name := range []string{"a", "b"} {
+			rule := rules.Rule{
+				Action: rules.RuleActionForward,
+				Conditions: [][]rules.Condition{
+					{rules.Condition("path-pattern = /" + name)},
+				},
+			}
+			group := targets.NewTargetGroup(name, "http", rule)
+			group.AddServiceTarget(targetUrl)
+			require.Nil(t, lb.AddTargetGroup(group))
+		}
+		return lb.(*appLoadBalancer).handler(NewListener("", ":80", "http"))
+	}
+	codes := func(handler http.HandlerFunc) []int {
+		codes := []int{}
+		for _, path := range []string{"/a", "/b", "/a"} {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+			codes = append(codes, rr.Code)
+		}
+		return codes
+	}
+
+	// Each group limits clients on its own by default
+	require.Equal(t, []int{200, 200, 200}, codes(newHandler()))
+	require.Equal(t, []int{200, 200, 429},
+		codes(newHandler(WithSharedRateLimit())))
+}
+
+func TestAppLoadBalancerSharedRateLimitMirror(t *testing.T) {
+	primary := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer primary.Close()
+	mirrored := make(chan struct{}, 1)
+	shadow := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mirrored <- struct{}{}
+		}),
+	)
+	defer shadow.Close()
+
+	// Clients get two requests a minute across all groups
+	lb := NewApplicationLoadBalancer(time.Minute, 0, WithSharedRateLimit())
+	primaryUrl, err := url.Parse(primary.URL)
+	require.Nil(t, err)
+	rule := rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	}
+	group := targets.NewTargetGroup("primary", "http", rule)
+	group.MirrorTo = "shadow"
+	group.AddServiceTarget(primaryUrl)
+	require.Nil(t, lb.AddTargetGroup(group))
+	shadowUrl, err := url.Parse(shadow.URL)
+	require.Nil(t, err)
+	group = targets.NewTargetGroup("shadow", "http", rules.Rule{})
+	group.AddServiceTarget(shadowUrl)
+	require.Nil(t, lb.AddTargetGroup(group))
+	handler := lb.(*appLoadBalancer).handler(NewListener("", ":80", "http"))
+
+	// Mirrored copies do not spend the client's requests
+	codes := []int{}
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		codes = append(codes, rr.Code)
+		select {
+		case <-mirrored:
+		case <-time.After(3 * time.Second):
+			require.Fail(t, "request was not mirrored")
+		}
+	}
+	require.Equal(t, []int{200, 200, 429}, codes)
+}
+
+func TestAppLoadBalancerHandlerIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback is not available")
+	}
+	ts := httptest.NewUnstartedServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "%s", r.URL.Path)
+		}),
+	)
+	ts.Listener.Close()
+	ts.Listener = ln
+	ts.Start()
+	defer ts.Close()
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	require.Nil(t, err)
+	portNum, err := strconv.Atoi(port)
+	require.Nil(t, err)
+
+	// Mirror how a configured target is added (host and port fields)
+	rule := rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	}
+	group := targets.NewTargetGroup("ipv6", "http", rule)
+	group.AddProtocolTarget("::1", portNum, "")
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	require.Nil(t, lb.AddTargetGroup(group))
+	alb := lb.(*appLoadBalancer)
+
+	req, err := http.NewRequest(http.MethodGet, "/hello", nil)
+	require.Nil(t, err)
+	req.RemoteAddr = "[::1]:51234"
+	rr := httptest.NewRecorder()
+	alb.handler(NewListener("", ":80", "http"))(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "/hello", rr.Body.String())
+}
+
+func TestAppLoadBalancerHandlerPreflight(t *testing.T) {
+	backendHits := 0
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			backendHits++
+			w.WriteHeader(http.StatusOK)
+		}),
+	)
+	defer ts.Close()
+
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	rule := rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	}
+	group := targets.NewTargetGroup("api", "http", rule)
+	group.Cors = &targets.CorsConfig{AllowOrigins: []string{"*"}}
+	group.AddServiceTarget(targetUrl)
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	require.Nil(t, lb.AddTargetGroup(group))
+	lb.SetHealthPath("/lb-health")
+	alb := lb.(*appLoadBalancer)
+	handler := alb.handler(NewListener("", ":80", "http"))
+
+	req, err := http.NewRequest(http.MethodOptions, "/", nil)
+	require.Nil(t, err)
+	req.RemoteAddr = "127.0.0.1:8080"
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	rr1 := httptest.NewRecorder()
+	handler(rr1, req)
+	require.Equal(t, http.StatusNoContent, rr1.Code)
+	require.Equal(t, 0, backendHits)
+
+	// Health path is answered without the backend
+	req, err = http.NewRequest(http.MethodHead, "/lb-health", nil)
+	require.Nil(t, err)
+	rr2 := httptest.NewRecorder()
+	handler(rr2, req)
+	require.Equal(t, http.StatusOK, rr2.Code)
+	require.Equal(t, 0, backendHits)
+
+	// Other requests still reach the backend
+	req, err = http.NewRequest(http.MethodGet, "/lb-health", nil)
+	require.Nil(t, err)
+	req.RemoteAddr = "127.0.0.1:8080"
+	rr3 := httptest.NewRecorder()
+	handler(rr3, req)
+	require.Equal(t, http.StatusOK, rr3.Code)
+	require.Equal(t, 1, backendHits)
+}
+
+func TestAppLoadBalancerReadinessGate(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	rule := rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	}
+	group := targets.NewTargetGroup("web", "http", rule)
+	group.AddServiceTarget(targetUrl)
+	lb := NewApplicationLoadBalancer(time.Second, 100,
+		WithHealthPath("/lb-health"), WithReadinessGate())
+	require.Nil(t, lb.AddTargetGroup(group))
+	require.True(t, lb.Ready())
+
+	// Start probes the targets before binding its listeners
+	ts.Close()
+	l := NewListener("", getFreeAddr(t), "http")
+	stop, err := lb.Start(l)
+	require.Nil(t, err)
+	defer stop()
+	require.False(t, lb.Ready())
+	req, err := http.NewRequest(http.MethodHead, "http://"+l.Addr+"/lb-health",
+		nil)
+	require.Nil(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestAppLoadBalancerHandlerBasicAuth(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	)
+	defer ts.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"),
+		bcrypt.MinCost)
+	require.Nil(t, err)
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	rule := rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	}
+	group := targets.NewTargetGroup("admin", "http", rule)
+	group.BasicAuth = &targets.BasicAuthConfig{
+		Realm:       "admin",
+		Credentials: map[string]string{"alice": string(hash)},
+	}
+	group.AddServiceTarget(targetUrl)
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	require.Nil(t, lb.AddTargetGroup(group))
+	alb := lb.(*appLoadBalancer)
+	handler := alb.handler(NewListener("", ":80", "http"))
+
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+	req.RemoteAddr = "127.0.0.1:8080"
+	rr1 := httptest.NewRecorder()
+	handler(rr1, req)
+	require.Equal(t, http.StatusUnauthorized, rr1.Code)
+	require.Equal(t, `Basic realm="admin", charset="UTF-8"`,
+		rr1.Header().Get("WWW-Authenticate"))
+
+	req.SetBasicAuth("alice", "secret")
+	rr2 := httptest.NewRecorder()
+	handler(rr2, req)
+	require.Equal(t, http.StatusOK, rr2.Code)
+}
+
+func TestAppLoadBalancerHandlerRateLimit(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	search := targets.NewTargetGroup("search", "http", rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"path-pattern = /search"}},
+	})
+	search.AddServiceTarget(targetUrl)
+	// Clients get two searches a minute
+	search.RateLimit = &targets.RateLimitConfig{Rate: time.Minute}
+	require.Nil(t, lb.AddTargetGroup(search))
+	web := targets.NewTargetGroup("web", "http", rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	})
+	web.AddServiceTarget(targetUrl)
+	require.Nil(t, lb.AddTargetGroup(web))
+	alb := lb.(*appLoadBalancer)
+	handler := alb.handler(NewListener("", ":80", "http"))
+	stop := lb.GC()
+	defer stop()
+
+	serve := func(path, ip string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = net.JoinHostPort(ip, "8080")
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr.Code
+	}
+	require.Equal(t, http.StatusOK, serve("/search", "10.0.0.1"))
+	require.Equal(t, http.StatusOK, serve("/search", "10.0.0.1"))
+	require.Equal(t, http.StatusTooManyRequests, serve("/search", "10.0.0.1"))
+
+	// Other routes and clients are not limited by it
+	require.Equal(t, http.StatusOK, serve("/", "10.0.0.1"))
+	require.Equal(t, http.StatusOK, serve("/search", "10.0.0.2"))
+}
+
+func TestAppLoadBalancerHandlerJwt(t *testing.T) {
+	subject := ""
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			subject = r.Header.Get(DefaultJwtSubjectHeader)
+			w.WriteHeader(http.StatusOK)
+		}),
+	)
+	defer ts.Close()
+
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	rule := rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	}
+	group := targets.NewTargetGroup("api", "http", rule)
+	group.Jwt = &targets.JwtConfig{Secret: "secret"}
+	group.AddServiceTarget(targetUrl)
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	require.Nil(t, lb.AddTargetGroup(group))
+	alb := lb.(*appLoadBalancer)
+	handler := alb.handler(NewListener("", ":80", "http"))
+
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+	req.RemoteAddr = "127.0.0.1:8080"
+	req.Header.Set(DefaultJwtSubjectHeader, "mallory")
+	rr1 := httptest.NewRecorder()
+	handler(rr1, req)
+	require.Equal(t, http.StatusUnauthorized, rr1.Code)
+	require.Equal(t, "Bearer", rr1.Header().Get("WWW-Authenticate"))
+
+	token := signHS256(t, "secret", map[string]interface{}{"sub": "alice"})
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr2 := httptest.NewRecorder()
+	handler(rr2, req)
+	require.Equal(t, http.StatusOK, rr2.Code)
+	require.Equal(t, "alice", subject)
+
+	group.Jwt = &targets.JwtConfig{}
+	require.Equal(t, ErrNoJwtKey, lb.AddTargetGroup(group))
+}
+
+func TestAppLoadBalancerHealthChange(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	group := targets.NewTargetGroup("web", "http", rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	})
+	group.AddServiceTarget(targetUrl)
+	changed := make(chan string, 1)
+	lb := NewApplicationLoadBalancer(time.Second, 100,
+		WithHealthChange(func(group string, t targets.Target, wasAlive, alive bool) {
+			changed <- fmt.Sprintf("%s %s %t %t", group, t.URL(),
+				wasAlive, alive)
+		}),
+	)
+	require.Nil(t, lb.AddTargetGroup(group))
+	stop := lb.HealthCheck(20 * time.Millisecond)
+	defer stop()
+	ts.Close()
+	select {
+	case change := <-changed:
+		require.Equal(t, "web "+ts.URL+" true false", change)
+	case <-time.After(time.Second):
+		t.Fatal("health change was not reported")
+	}
+}
+
+func TestNetLoadBalancerHealthChange(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	host, port, err := net.SplitHostPort(ln.Addr().String())
+	require.Nil(t, err)
+	p, err := strconv.Atoi(port)
+	require.Nil(t, err)
+	group := targets.NewTargetGroup("db", "tcp", rules.Rule{})
+	group.AddTarget(host, p)
+	changed := make(chan string, 1)
+	lb := NewNetworkLoadBalancer(time.Second,
+		WithHealthChange(func(group string, t targets.Target, wasAlive, alive bool) {
+			changed <- fmt.Sprintf("%s %t %t", group, wasAlive, alive)
+		}),
+	)
+	require.Nil(t, lb.AddTargetGroup(group))
+	stop := lb.HealthCheck(20 * time.Millisecond)
+	defer stop()
+	ln.Close()
+	select {
+	case change := <-changed:
+		require.Equal(t, "db true false", change)
+	case <-time.After(time.Second):
+		t.Fatal("health change was not reported")
+	}
+}
+
+func TestNetLoadBalancerAddTargetGroupRule(t *testing.T) {
+	lb := NewNetworkLoadBalancer(time.Second)
+	group := targets.NewTargetGroup("db", "tcp", rules.Rule{})
+	group.AddTarget("127.0.0.1", 5432)
+	require.Nil(t, lb.AddTargetGroup(group))
+	group.Rule = rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	}
+	require.Nil(t, lb.AddTargetGroup(group))
+
+	group.Rule = rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"source-ip = 10.0.0.0/8"}},
+	}
+	err := lb.AddTargetGroup(group)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrNlbRuleCondition.Error())
+	group.Rule = rules.Rule{Action: rules.RuleActionRedirect}
+	err = lb.AddTargetGroup(group)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrNlbRuleAction.Error())
+}
+
+func TestNetLoadBalancerAddTargetGroupHealth(t *testing.T) {
+	lb := NewNetworkLoadBalancer(time.Second)
+	db := targets.NewTargetGroup("db", "tcp", rules.Rule{})
+	db.AddTarget("127.0.0.1", 5432)
+	db.Health = &targets.HealthCheckConfig{Send: "PING"}
+	require.Nil(t, lb.AddTargetGroup(db))
+
+	// Groups may leave the health check unset or set the same one
+	cache := targets.NewTargetGroup("cache", "tcp", rules.Rule{})
+	cache.AddTarget("127.0.0.1", 6379)
+	require.Nil(t, lb.AddTargetGroup(cache))
+	cache.Health = &targets.HealthCheckConfig{Send: "PING"}
+	require.Nil(t, lb.AddTargetGroup(cache))
+
+	// but not another one, since the groups share one pool
+	cache.Health = &targets.HealthCheckConfig{Send: "INFO"}
+	err := lb.AddTargetGroup(cache)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrNlbHealthCheck.Error())
+}
+
+func TestNetLoadBalancerAddTargetGroupStrategy(t *testing.T) {
+	lb := NewNetworkLoadBalancer(time.Second)
+	db := targets.NewTargetGroup("db", "tcp", rules.Rule{})
+	db.AddTarget("127.0.0.1", 5432)
+	db.Strategy = targets.StrategyIpHash
+	require.Nil(t, lb.AddTargetGroup(db))
+
+	// Groups may leave the strategy unset or set the same one
+	cache := targets.NewTargetGroup("cache", "tcp", rules.Rule{})
+	cache.AddTarget("127.0.0.1", 6379)
+	require.Nil(t, lb.AddTargetGroup(cache))
+	cache.Strategy = targets.StrategyIpHash
+	require.Nil(t, lb.AddTargetGroup(cache))
+
+	// but not another one, since the groups share one pool
+	cache.Strategy = targets.StrategyPowerOfTwo
+	err := lb.AddTargetGroup(cache)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrNlbStrategy.Error())
+
+	// Custom strategies are not supported
+	err = lb.SetGroupStrategy("db", services.NewPowerOfTwoStrategy())
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrNlbCustomStrategy.Error())
+}
+
 func TestHandleForbidden(t *testing.T) {
 	rr1 := httptest.NewRecorder()
 	errFmt := services.ResponseFormatHtml
@@ -57,3 +916,11 @@ func TestHandleForbidden(t *testing.T) {
 	require.Equal(t, http.StatusForbidden, resp.StatusCode)
 	require.Equal(t, expected, string(actual))
 }
+
+// getFreeAddr returns a local address with a port that is free to listen on.
+func getFreeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
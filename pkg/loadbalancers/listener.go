@@ -0,0 +1,205 @@
+package loadbalancers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+var (
+	ErrMissingTlsCert       = errors.New("TLS listener is missing a certificate or private key")
+	ErrNoClientCAs          = errors.New("No certificates found in client CA file")
+	ErrClientCaWithoutTls   = errors.New("Client CA file is set on a listener without TLS")
+	ErrUnknownListenerProto = errors.New("Unknown listener protocol")
+	ErrUnsupportedNetwork   = errors.New("Listener network is not supported; only stream (TCP) listeners are")
+	ErrListenerName         = errors.New("Listeners must have unique names")
+)
+
+// Listener represents an address and protocol a load balancer accepts
+// connections on. A load balancer may be started with multiple listeners; E.g.
+// one to redirect HTTP traffic and another to serve HTTPS.
+type Listener struct {
+	Name        string // Listener name
+	Addr        string // Listening address ("<host>:<port>")
+	Protocol    string // Listener protocol
+	TlsEnabled  bool   // Indicates TLS is enabled
+	TlsCertFile string // TLS certificate filename
+	TlsKeyFile  string // TLS private key filename
+
+	// Client certificate verification (mutual TLS)
+	TlsClientCaFile string   // CA certificates filename
+	TlsClientNames  []string // Allowed certificate CNs and SANs
+}
+
+// NewListener returns a new Listener for the given name, listening address, and
+// protocol. The "https" protocol implies TLS; the load balancer's default
+// certificate and key are used unless the listener sets its own.
+func NewListener(name, laddr, protocol string) Listener {
+	return Listener{
+		Name:       name,
+		Addr:       laddr,
+		Protocol:   protocol,
+		TlsEnabled: strings.EqualFold(protocol, "https"),
+	}
+}
+
+// Network returns the network a network load balancer listens on for the
+// listener's protocol; E.g. "tcp" for "tcp", "http" or "" (the default). An
+// error is returned if the protocol is unknown, or only uses datagram (UDP)
+// transports which network load balancers do not relay.
+func (l Listener) Network() (string, error) {
+	switch proto := strings.ToLower(l.Protocol); proto {
+	case "":
+		return "tcp", nil
+	case "tcp", "tcp4", "tcp6":
+		return proto, nil
+	}
+	transports := targets.GetTransport(l.Protocol)
+	if len(transports) == 0 {
+		return "", fmt.Errorf("%s - '%s'", ErrUnknownListenerProto,
+			l.Protocol)
+	}
+	for _, t := range transports {
+		if t == "tcp" {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("%s - '%s'", ErrUnsupportedNetwork, l.Protocol)
+}
+
+// ValidAppProtocol returns an error if the listener's protocol is not one an
+// application load balancer serves; "http", "https", or "" (HTTP, unless TLS is
+// enabled).
+func (l Listener) ValidAppProtocol() error {
+	switch strings.ToLower(l.Protocol) {
+	case "", "http", "https":
+		return nil
+	}
+	return fmt.Errorf("%s - '%s'", ErrUnknownListenerProto, l.Protocol)
+}
+
+// SetTLS enables TLS connections for the listener and sets the certificate and
+// private key to the given filenames. If the filenames are empty, the load
+// balancer's default certificate and key are used instead.
+func (l *Listener) SetTLS(certFile, keyFile string) {
+	l.TlsEnabled = true
+	l.TlsCertFile = certFile
+	l.TlsKeyFile = keyFile
+}
+
+// SetClientAuth requires clients of the TLS enabled listener to present a
+// certificate signed by one of the CAs in the given PEM file; connections
+// without a valid certificate are rejected. If any names are given, requests
+// are forbidden unless the certificate's common name or one of its subject
+// alternative names is in the list. The verified identity can be passed to
+// backends with the client subject TLS header.
+func (l *Listener) SetClientAuth(caFile string, names ...string) {
+	l.TlsClientCaFile = caFile
+	l.TlsClientNames = append([]string{}, names...)
+}
+
+// tlsConfig returns the TLS configuration of the listener's server; nil is
+// returned if client certificates are not verified. An error is returned if a
+// client CA file is set without TLS, since its clients could not be verified.
+func (l Listener) tlsConfig() (*tls.Config, error) {
+	if l.TlsClientCaFile == "" {
+		return nil, nil
+	}
+	if !l.TlsEnabled {
+		return nil, fmt.Errorf("%s - '%s'", ErrClientCaWithoutTls, l.Addr)
+	}
+	b, err := ioutil.ReadFile(l.TlsClientCaFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s - '%s'", ErrNoClientCAs,
+			l.TlsClientCaFile)
+	}
+	return &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}, nil
+}
+
+// AllowsClient returns true if the listener has no allowed client names, or
+// the verified client certificate of the given request matches one of them.
+func (l Listener) AllowsClient(r *http.Request) bool {
+	if len(l.TlsClientNames) == 0 {
+		return true
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 ||
+		len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	cert := r.TLS.PeerCertificates[0]
+	ids := []string{cert.Subject.CommonName}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		ids = append(ids, uri.String())
+	}
+	for _, name := range l.TlsClientNames {
+		for _, id := range ids {
+			if id != "" && strings.EqualFold(id, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validListeners returns ErrListenerName if more than one listener is given and
+// any of them has no name, or two of them have the same name without regard to
+// case; target groups are bound to listeners by name. Otherwise, nil is
+// returned.
+func validListeners(listeners []Listener) error {
+	if len(listeners) < 2 {
+		return nil
+	}
+	names := make(map[string]bool, len(listeners))
+	for _, l := range listeners {
+		name := strings.ToLower(l.Name)
+		if name == "" {
+			return fmt.Errorf("%s - '%s' has no name", ErrListenerName,
+				l.Addr)
+		}
+		if names[name] {
+			return fmt.Errorf("%s - '%s'", ErrListenerName, l.Name)
+		}
+		names[name] = true
+	}
+	return nil
+}
+
+// Matches returns true if the given value is empty, the listener's name, or the
+// port of the listener's address. It is used to bind target groups to specific
+// listeners.
+func (l Listener) Matches(v string) bool {
+	if v == "" {
+		return true
+	}
+	if l.Name != "" && strings.EqualFold(l.Name, v) {
+		return true
+	}
+	_, port, err := net.SplitHostPort(l.Addr)
+	return err == nil && port == v
+}
+
+// combineStopFns returns a single stop function that calls each of the given
+// stop functions in order.
+func combineStopFns(stops []StopFn) StopFn {
+	return func() {
+		for _, fn := range stops {
+			fn()
+		}
+	}
+}
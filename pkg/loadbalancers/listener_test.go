@@ -0,0 +1,301 @@
+package loadbalancers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
+	"github.com/crossedbot/simpleloadbalancer/pkg/services"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+func TestNewListener(t *testing.T) {
+	l := NewListener("web", "127.0.0.1:8080", "http")
+	require.Equal(t, "web", l.Name)
+	require.Equal(t, "127.0.0.1:8080", l.Addr)
+	require.Equal(t, "http", l.Protocol)
+	require.False(t, l.TlsEnabled)
+}
+
+func TestNewListenerHttps(t *testing.T) {
+	// HTTPS implies TLS with the default certificate
+	l := NewListener("web", "127.0.0.1:8443", "HTTPS")
+	require.True(t, l.TlsEnabled)
+	require.Equal(t, "", l.TlsCertFile)
+
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	_, err := lb.Start(NewListener("web", getFreeAddr(t), "https"))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrMissingTlsCert.Error())
+	_, err = lb.Start(NewListener("web", getFreeAddr(t), "ftp"))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrUnknownListenerProto.Error())
+}
+
+func TestListenerNetwork(t *testing.T) {
+	tests := []struct {
+		Protocol string
+		Expected string
+		Err      error
+	}{
+		{"", "tcp", nil},
+		{"tcp6", "tcp6", nil},
+		{"http", "tcp", nil},
+		{"dns", "tcp", nil},
+		{"udp", "", ErrUnsupportedNetwork},
+		{"ntp", "", ErrUnsupportedNetwork},
+		{"gopher", "", ErrUnknownListenerProto},
+	}
+	for _, test := range tests {
+		network, err := NewListener("", ":53", test.Protocol).Network()
+		require.Equal(t, test.Expected, network, test.Protocol)
+		if test.Err == nil {
+			require.Nil(t, err)
+		} else {
+			require.Contains(t, err.Error(), test.Err.Error())
+		}
+	}
+}
+
+func TestListenerSetTLS(t *testing.T) {
+	l := NewListener("web", "127.0.0.1:8443", "https")
+	l.SetTLS("cert.pem", "key.pem")
+	require.True(t, l.TlsEnabled)
+	require.Equal(t, "cert.pem", l.TlsCertFile)
+	require.Equal(t, "key.pem", l.TlsKeyFile)
+}
+
+func TestValidListeners(t *testing.T) {
+	web := NewListener("web", "127.0.0.1:8080", "http")
+	api := NewListener("api", "127.0.0.1:8081", "http")
+	unnamed := NewListener("", "127.0.0.1:8082", "http")
+	require.Nil(t, validListeners([]Listener{web, api}))
+	// A sole listener needs no name
+	require.Nil(t, validListeners([]Listener{unnamed}))
+	require.Nil(t, validListeners(nil))
+
+	tests := [][]Listener{
+		{web, unnamed},
+		{web, NewListener("WEB", "127.0.0.1:8083", "http")},
+	}
+	for _, test := range tests {
+		err := validListeners(test)
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), ErrListenerName.Error())
+	}
+
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	_, err := lb.Start(web, web)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrListenerName.Error())
+	lb = NewNetworkLoadBalancer(time.Second)
+	_, err = lb.Start(NewListener("", "127.0.0.1:0", "tcp"),
+		NewListener("", "127.0.0.1:0", "tcp"))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrListenerName.Error())
+}
+
+func TestListenerMatches(t *testing.T) {
+	l := NewListener("web", "127.0.0.1:8080", "http")
+	require.True(t, l.Matches(""))
+	require.True(t, l.Matches("web"))
+	require.True(t, l.Matches("WEB"))
+	require.True(t, l.Matches("8080"))
+	require.False(t, l.Matches("8443"))
+	require.False(t, l.Matches("secure"))
+}
+
+func TestCombineStopFns(t *testing.T) {
+	calls := []int{}
+	stops := []StopFn{
+		func() { calls = append(calls, 1) },
+		func() { calls = append(calls, 2) },
+	}
+	combineStopFns(stops)()
+	require.Equal(t, []int{1, 2}, calls)
+}
+
+// testCert is a generated certificate and its PEM encoded files.
+type testCert struct {
+	Cert     *x509.Certificate
+	Key      *ecdsa.PrivateKey
+	CertFile string
+	KeyFile  string
+}
+
+// newTestCert returns a new certificate for the common name signed by the
+// given CA; it is self-signed if the CA is nil. The PEM files are written to
+// the directory.
+func newTestCert(t *testing.T, dir, cn string, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.Cert, ca.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent,
+		&key.PublicKey, signer)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	tc := &testCert{
+		Cert:     cert,
+		Key:      key,
+		CertFile: filepath.Join(dir, cn+".pem"),
+		KeyFile:  filepath.Join(dir, cn+"-key.pem"),
+	}
+	require.Nil(t, ioutil.WriteFile(tc.CertFile, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.Nil(t, ioutil.WriteFile(tc.KeyFile, pem.EncodeToMemory(
+		&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return tc
+}
+
+func TestListenerSetClientAuth(t *testing.T) {
+	l := NewListener("web", "127.0.0.1:8443", "https")
+	config, err := l.tlsConfig()
+	require.Nil(t, err)
+	require.Nil(t, config)
+
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil)
+	l.SetTLS("cert.pem", "key.pem")
+	l.SetClientAuth(ca.CertFile, "client-1")
+	require.Equal(t, ca.CertFile, l.TlsClientCaFile)
+	require.Equal(t, []string{"client-1"}, l.TlsClientNames)
+	config, err = l.tlsConfig()
+	require.Nil(t, err)
+	require.Equal(t, tls.RequireAndVerifyClientCert, config.ClientAuth)
+
+	l.SetClientAuth(ca.KeyFile)
+	_, err = l.tlsConfig()
+	require.NotNil(t, err)
+
+	// Client certificates cannot be verified without TLS
+	plain := NewListener("web", "127.0.0.1:8080", "http")
+	plain.SetClientAuth(ca.CertFile)
+	_, err = plain.tlsConfig()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrClientCaWithoutTls.Error())
+}
+
+func TestListenerAllowsClient(t *testing.T) {
+	l := NewListener("web", "127.0.0.1:8443", "https")
+	r := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	require.True(t, l.AllowsClient(r))
+
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "client-1"},
+		DNSNames: []string{"api.example.com"},
+	}
+	r.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+	l.SetClientAuth("ca.pem", "client-1")
+	require.True(t, l.AllowsClient(r))
+	l.SetClientAuth("ca.pem", "API.example.com")
+	require.True(t, l.AllowsClient(r))
+	l.SetClientAuth("ca.pem", "client-2")
+	require.False(t, l.AllowsClient(r))
+	r.TLS = nil
+	require.False(t, l.AllowsClient(r))
+}
+
+func TestAppLoadBalancerStartClientAuth(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Seen-Subject",
+				r.Header.Get("X-Client-Subject"))
+		}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil)
+	server := newTestCert(t, dir, "server", ca)
+	allowed := newTestCert(t, dir, "client-1", ca)
+	denied := newTestCert(t, dir, "client-2", ca)
+	lb := NewApplicationLoadBalancer(time.Second, 100,
+		WithTlsHeaders(services.TlsHeaders{
+			ClientSubject: "X-Client-Subject",
+		}))
+	group := targets.NewTargetGroup("web", "http", rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	})
+	group.AddServiceTarget(targetUrl)
+	require.Nil(t, lb.AddTargetGroup(group))
+	l := NewListener("", getFreeAddr(t), "https")
+	l.SetTLS(server.CertFile, server.KeyFile)
+	l.SetClientAuth(ca.CertFile, "client-1")
+	stop, err := lb.Start(l)
+	require.Nil(t, err)
+	defer stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	get := func(client *testCert) (*http.Response, error) {
+		config := &tls.Config{RootCAs: roots}
+		if client != nil {
+			config.Certificates = []tls.Certificate{{
+				Certificate: [][]byte{client.Cert.Raw},
+				PrivateKey:  client.Key,
+			}}
+		}
+		c := &http.Client{
+			Transport: &http.Transport{TLSClientConfig: config},
+		}
+		return c.Get("https://" + l.Addr)
+	}
+
+	// Connections without a client certificate are rejected
+	_, err = get(nil)
+	require.NotNil(t, err)
+
+	resp, err := get(denied)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, err = get(allowed)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "CN=client-1", resp.Header.Get("X-Seen-Subject"))
+}
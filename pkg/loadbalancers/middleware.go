@@ -0,0 +1,70 @@
+package loadbalancers
+
+import (
+	"errors"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/services"
+)
+
+// Names of the request filters an application load balancer can run for a
+// target group before its rule's action.
+const (
+	MiddlewareCors      = "cors"
+	MiddlewareBasicAuth = "basic_auth"
+	MiddlewareJwt       = "jwt"
+	MiddlewareRateLimit = "rate_limit"
+)
+
+// DefaultMiddleware is the default order of the request filters run for each
+// target group. A filter only runs for groups that configure it.
+var DefaultMiddleware = []string{
+	MiddlewareRateLimit,
+	MiddlewareCors,
+	MiddlewareBasicAuth,
+	MiddlewareJwt,
+}
+
+var (
+	ErrUnknownMiddleware = errors.New("Unknown middleware")
+)
+
+// validMiddleware returns true if the given name is a known request filter.
+func validMiddleware(name string) bool {
+	for _, v := range DefaultMiddleware {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// targetChain returns the middleware chain of the given target for the given
+// ordered filter names. Filters the target does not configure are left out.
+func (alb *appLoadBalancer) targetChain(t appTarget, names []string) services.Chain {
+	chain := services.Chain{}
+	for _, name := range names {
+		switch name {
+		case MiddlewareCors:
+			if t.Cors != nil {
+				chain = append(chain,
+					corsMiddleware(t.Cors, alb.RespFormat))
+			}
+		case MiddlewareBasicAuth:
+			if t.BasicAuth != nil {
+				chain = append(chain, basicAuthMiddleware(
+					t.BasicAuth, alb.RespFormat))
+			}
+		case MiddlewareJwt:
+			if t.Jwt != nil {
+				chain = append(chain,
+					jwtMiddleware(t.Jwt, alb.RespFormat))
+			}
+		case MiddlewareRateLimit:
+			if t.RateLimit != nil {
+				chain = append(chain,
+					t.RateLimit.Middleware(alb.RespFormat))
+			}
+		}
+	}
+	return chain
+}
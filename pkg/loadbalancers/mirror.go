@@ -0,0 +1,70 @@
+package loadbalancers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// MirrorMaxBodySize is the largest request body (in bytes) that is buffered to
+// mirror a request. Requests with larger bodies are not mirrored.
+const MirrorMaxBodySize = 1 << 20
+
+// discardResponseWriter implements a http.ResponseWriter that discards
+// everything written to it. It is used to serve mirrored requests.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(statusCode int) {}
+
+// cloneRequest returns a copy of the given request that can be served
+// independently of the original; I.E. after the original request has
+// completed. The request's body is buffered so that it can be read by both
+// requests. If the body is too large to buffer, nil is returned and the original
+// request is left readable.
+func cloneRequest(r *http.Request) *http.Request {
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		b, err := ioutil.ReadAll(
+			io.LimitReader(r.Body, MirrorMaxBodySize+1))
+		if err != nil || len(b) > MirrorMaxBodySize {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(b), r.Body), r.Body}
+			return nil
+		}
+		body = b
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	clone := r.Clone(context.Background())
+	clone.Body = http.NoBody
+	if body != nil {
+		clone.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return clone
+}
+
+// mirror serves a copy of the given request with the given handler in a
+// separate routine; discarding the response.
+func mirror(handler http.HandlerFunc, r *http.Request) {
+	clone := cloneRequest(r)
+	if clone == nil {
+		return
+	}
+	go handler(&discardResponseWriter{}, clone)
+}
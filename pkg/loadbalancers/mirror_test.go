@@ -0,0 +1,74 @@
+package loadbalancers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscardResponseWriter(t *testing.T) {
+	w := &discardResponseWriter{}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	n, err := w.Write([]byte("hello"))
+	require.Nil(t, err)
+	require.Equal(t, 5, n)
+	require.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+}
+
+func TestCloneRequest(t *testing.T) {
+	body := "hello world"
+	req, err := http.NewRequest(http.MethodPost, "/mirror",
+		strings.NewReader(body))
+	require.Nil(t, err)
+	req.Header.Set("X-Test", "yes")
+	clone := cloneRequest(req)
+	require.NotNil(t, clone)
+	require.Equal(t, req.URL.String(), clone.URL.String())
+	require.Equal(t, "yes", clone.Header.Get("X-Test"))
+
+	actual, err := ioutil.ReadAll(req.Body)
+	require.Nil(t, err)
+	require.Equal(t, body, string(actual))
+	actual, err = ioutil.ReadAll(clone.Body)
+	require.Nil(t, err)
+	require.Equal(t, body, string(actual))
+
+	// Too large bodies are not cloned, but remain readable
+	large := bytes.Repeat([]byte("a"), MirrorMaxBodySize+10)
+	req, err = http.NewRequest(http.MethodPost, "/mirror",
+		bytes.NewReader(large))
+	require.Nil(t, err)
+	require.Nil(t, cloneRequest(req))
+	actual, err = ioutil.ReadAll(req.Body)
+	require.Nil(t, err)
+	require.Equal(t, large, actual)
+}
+
+func TestMirror(t *testing.T) {
+	body := "hello world"
+	received := make(chan string, 1)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusTeapot)
+		received <- string(b)
+	}
+	req, err := http.NewRequest(http.MethodPost, "/mirror",
+		strings.NewReader(body))
+	require.Nil(t, err)
+	mirror(handler, req)
+	select {
+	case actual := <-received:
+		require.Equal(t, body, actual)
+	case <-time.After(time.Second):
+		require.Fail(t, "mirrored request was not served")
+	}
+	actual, err := ioutil.ReadAll(req.Body)
+	require.Nil(t, err)
+	require.Equal(t, body, string(actual))
+}
@@ -0,0 +1,337 @@
+package loadbalancers
+
+import (
+	"time"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/services"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+// Timeouts represents the timeouts of a load balancer. Timeouts that do not
+// apply to a load balancer's type are ignored, and zero means no timeout (or
+// the constructor's default).
+type Timeouts struct {
+	Dial  time.Duration // NLB target connection timeout
+	Read  time.Duration // ALB request read timeout
+	Write time.Duration // ALB response write timeout
+	Idle  time.Duration // ALB keep-alive idle timeout
+
+	// ALB total time of a request across its retries and attempts; after
+	// which it is answered with 504
+	Request time.Duration
+
+	// NLB relayed connection idle timeout; relays without data in either
+	// direction for this long are closed
+	RelayIdle time.Duration
+
+	// Target health check probe timeout; defaults to
+	// DefaultHealthCheckTimeout
+	HealthCheck time.Duration
+}
+
+// ConnLimits represents the connection limits of a network load balancer. Zero
+// means no limit.
+type ConnLimits struct {
+	Total int // Maximum open connections across all clients
+	PerIp int // Maximum open connections per source IP
+}
+
+// Option is a prototype for a function that sets an optional parameter of a
+// load balancer when it is created.
+type Option func(o *options)
+
+// options represents the optional parameters of a load balancer.
+type options struct {
+	ConnLimits   ConnLimits           // NLB connection limits
+	HealthChange HealthChangeFn       // Health transition callback
+	HealthPath   string               // Reserved health path
+	HealthRetry  int                  // Failed probe retries
+	HealthzPath  string               // Reserved self health path
+	Latency      []time.Duration      // Latency histogram bounds
+	MaxHeader    int                  // Maximum request header bytes
+	Middleware   services.Chain       // Listener middleware chain
+	ReadyGate    bool                 // Wait for alive targets
+	ReqIdHeader  string               // Request ID header name
+	RespFormat   string               // Response format
+	RetryAll     bool                 // Retry non-idempotent requests
+	RetryBackoff *targets.Backoff     // Backoff between retries
+	RetryBudget  *int                 // Re-serves allowed per request
+	RewriteLoc   bool                 // Rewrite redirects to targets
+	RouteTrace   *RouteTrace          // Route trace settings
+	SharedRate   bool                 // Share rate limits across groups
+	SlowReq      time.Duration        // Slow request log threshold
+	Strategy     targets.Strategy     // Default group strategy
+	Timeouts     Timeouts             // Load balancer timeouts
+	TlsCertFile  string               // Default TLS certificate filename
+	TlsKeyFile   string               // Default TLS private key filename
+	TlsHeaders   *services.TlsHeaders // Client connection headers
+	Upstream     bool                 // Set upstream response headers
+}
+
+// newOptions returns the options set by the given list of options.
+func newOptions(opts []Option) options {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// apply sets the options on the given load balancer.
+func (o options) apply(lb LoadBalancer) {
+	if o.HealthChange != nil {
+		lb.OnHealthChange(o.HealthChange)
+	}
+	if o.HealthRetry > 0 {
+		lb.SetHealthCheckRetries(o.HealthRetry)
+	}
+	if o.HealthPath != "" {
+		lb.SetHealthPath(o.HealthPath)
+	}
+	if o.HealthzPath != "" {
+		lb.SetHealthzPath(o.HealthzPath)
+	}
+	if len(o.Latency) > 0 {
+		lb.SetLatencyBuckets(o.Latency)
+	}
+	if o.MaxHeader > 0 {
+		lb.SetMaxHeaderBytes(o.MaxHeader)
+	}
+	if len(o.Middleware) > 0 {
+		lb.Use(o.Middleware...)
+	}
+	if o.ReadyGate {
+		lb.SetReadinessGate(true)
+	}
+	if o.ReqIdHeader != "" {
+		lb.SetRequestIdHeader(o.ReqIdHeader)
+	}
+	if o.RespFormat != "" {
+		lb.SetResponseFormat(o.RespFormat)
+	}
+	if o.RetryAll {
+		lb.SetRetryAllMethods(true)
+	}
+	if o.RetryBackoff != nil {
+		lb.SetRetryBackoff(*o.RetryBackoff)
+	}
+	if o.RetryBudget != nil {
+		lb.SetRetryBudget(*o.RetryBudget)
+	}
+	if o.RewriteLoc {
+		lb.SetRewriteLocation(true)
+	}
+	if o.RouteTrace != nil {
+		lb.SetRouteTrace(*o.RouteTrace)
+	}
+	if o.SharedRate {
+		lb.SetSharedRateLimit(true)
+	}
+	if o.SlowReq > 0 {
+		lb.SetSlowRequestThreshold(o.SlowReq)
+	}
+	if o.Strategy != targets.StrategyUnknown {
+		lb.SetStrategy(o.Strategy)
+	}
+	if o.TlsCertFile != "" || o.TlsKeyFile != "" {
+		lb.SetTLS(o.TlsCertFile, o.TlsKeyFile)
+	}
+	if o.TlsHeaders != nil {
+		lb.SetTlsHeaders(*o.TlsHeaders)
+	}
+	if o.Upstream {
+		lb.SetUpstreamHeaders(true)
+	}
+}
+
+// WithConnLimits sets the connection limits of a network load balancer.
+func WithConnLimits(l ConnLimits) Option {
+	return func(o *options) {
+		o.ConnLimits = l
+	}
+}
+
+// WithHealthChange sets the function called when a health check finds a
+// target's alive state changed.
+func WithHealthChange(fn HealthChangeFn) Option {
+	return func(o *options) {
+		o.HealthChange = fn
+	}
+}
+
+// WithHealthCheckRetries sets the number of times a failed health check probe
+// of a target is retried before the target is deemed unreachable.
+func WithHealthCheckRetries(n int) Option {
+	return func(o *options) {
+		o.HealthRetry = n
+	}
+}
+
+// WithHealthPath sets the reserved path that HEAD requests are answered on by
+// the load balancer itself.
+func WithHealthPath(path string) Option {
+	return func(o *options) {
+		o.HealthPath = path
+	}
+}
+
+// WithHealthzPath sets the reserved path that the load balancer's own health is
+// answered on; E.g. DefaultHealthzPath.
+func WithHealthzPath(path string) Option {
+	return func(o *options) {
+		o.HealthzPath = path
+	}
+}
+
+// WithLatencyBuckets sets the upper bounds of the buckets of the histograms
+// that track the response latency of each target.
+func WithLatencyBuckets(bounds ...time.Duration) Option {
+	return func(o *options) {
+		o.Latency = bounds
+	}
+}
+
+// WithMaxHeaderBytes sets the maximum size in bytes of a request's headers;
+// larger requests are answered with 431.
+func WithMaxHeaderBytes(n int) Option {
+	return func(o *options) {
+		o.MaxHeader = n
+	}
+}
+
+// WithMiddleware appends the given middleware to the chain that all requests
+// received by the load balancer's listeners pass through.
+func WithMiddleware(mw ...services.Middleware) Option {
+	return func(o *options) {
+		o.Middleware = append(o.Middleware, mw...)
+	}
+}
+
+// WithReadinessGate enables the readiness gate of the load balancer; it probes
+// every target before starting, and its health path answers 503 until every
+// target group has an alive target.
+func WithReadinessGate() Option {
+	return func(o *options) {
+		o.ReadyGate = true
+	}
+}
+
+// WithRequestIdHeader sets the name of the header that carries the ID of each
+// request; E.g. "X-Correlation-ID".
+func WithRequestIdHeader(name string) Option {
+	return func(o *options) {
+		o.ReqIdHeader = name
+	}
+}
+
+// WithResponseFormat sets the response format of the load balancer; E.g.
+// "html", "json", or "plain".
+func WithResponseFormat(format string) Option {
+	return func(o *options) {
+		o.RespFormat = format
+	}
+}
+
+// WithRetryAllMethods retries failed requests of any method; for backends whose
+// non-idempotent requests are safe to send again.
+func WithRetryAllMethods() Option {
+	return func(o *options) {
+		o.RetryAll = true
+	}
+}
+
+// WithRetryBackoff sets the exponential backoff, with jitter, between the
+// retries of a failed target.
+func WithRetryBackoff(b targets.Backoff) Option {
+	return func(o *options) {
+		o.RetryBackoff = &b
+	}
+}
+
+// WithRetryBudget sets the number of times a request may be served again after
+// its first backend attempt fails.
+func WithRetryBudget(n int) Option {
+	return func(o *options) {
+		o.RetryBudget = &n
+	}
+}
+
+// WithRewriteLocation rewrites the Location headers of redirects to a target's
+// own URL to the host and scheme the client used.
+func WithRewriteLocation() Option {
+	return func(o *options) {
+		o.RewriteLoc = true
+	}
+}
+
+// WithSharedRateLimit limits the requests of each client across all target
+// groups, rather than per group.
+func WithSharedRateLimit() Option {
+	return func(o *options) {
+		o.SharedRate = true
+	}
+}
+
+// WithRouteTrace sets the route trace of an application load balancer.
+func WithRouteTrace(t RouteTrace) Option {
+	return func(o *options) {
+		o.RouteTrace = &t
+	}
+}
+
+// WithSlowRequestThreshold logs requests that take longer than the given
+// threshold as slow.
+func WithSlowRequestThreshold(threshold time.Duration) Option {
+	return func(o *options) {
+		o.SlowReq = threshold
+	}
+}
+
+// WithStrategy sets the built-in strategy of the target groups that do not set
+// their own.
+func WithStrategy(s targets.Strategy) Option {
+	return func(o *options) {
+		o.Strategy = s
+	}
+}
+
+// WithTimeouts sets the timeouts of the load balancer.
+func WithTimeouts(t Timeouts) Option {
+	return func(o *options) {
+		o.Timeouts = t
+	}
+}
+
+// WithTLS sets the default certificate and private key filenames for TLS
+// enabled listeners that do not set their own.
+func WithTLS(certFile, keyFile string) Option {
+	return func(o *options) {
+		o.TlsCertFile = certFile
+		o.TlsKeyFile = keyFile
+	}
+}
+
+// WithTlsHeaders sets the headers that pass the scheme and TLS details of a
+// client's connection to backends.
+func WithTlsHeaders(h services.TlsHeaders) Option {
+	return func(o *options) {
+		o.TlsHeaders = &h
+	}
+}
+
+// WithUpstreamHeaders sets response headers naming the backend and the target
+// group that served each response.
+func WithUpstreamHeaders() Option {
+	return func(o *options) {
+		o.Upstream = true
+	}
+}
+
+// healthCheckTimeout returns the health check timeout of the given timeouts, or
+// the default if it is not set.
+func healthCheckTimeout(t Timeouts) time.Duration {
+	if t.HealthCheck > 0 {
+		return t.HealthCheck
+	}
+	return DefaultHealthCheckTimeout
+}
@@ -0,0 +1,80 @@
+package loadbalancers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/services"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+func TestNewApplicationLoadBalancerOptions(t *testing.T) {
+	mw := func(next http.Handler) http.Handler { return next }
+	timeouts := Timeouts{Read: time.Second, Idle: time.Minute}
+	lb := NewApplicationLoadBalancer(time.Second, 100,
+		WithHealthCheckRetries(2),
+		WithHealthPath("/health"),
+		WithLatencyBuckets(time.Millisecond, time.Second),
+		WithMaxHeaderBytes(4096),
+		WithMiddleware(mw, mw),
+		WithRequestIdHeader("X-Trace-Id"),
+		WithResponseFormat("json"),
+		WithRetryAllMethods(),
+		WithRetryBudget(0),
+		WithRewriteLocation(),
+		WithSharedRateLimit(),
+		WithSlowRequestThreshold(time.Second),
+		WithStrategy(targets.StrategyPowerOfTwo),
+		WithTimeouts(timeouts),
+		WithTLS("cert.pem", "key.pem"),
+		WithTlsHeaders(services.TlsHeaders{Proto: "X-Forwarded-Proto"}),
+		WithUpstreamHeaders(),
+	)
+	alb := lb.(*appLoadBalancer)
+	require.Equal(t, 2, alb.HealthRetry)
+	require.Equal(t, "/health", alb.HealthPath)
+	require.Equal(t, []time.Duration{time.Millisecond, time.Second},
+		alb.Latency)
+	require.Equal(t, 4096, alb.MaxHeader)
+	require.Len(t, alb.Chain, 2)
+	require.Equal(t, "X-Trace-Id", alb.ReqIdHeader)
+	require.Equal(t, services.ResponseFormatJson, alb.RespFormat)
+	require.True(t, alb.RetryAll)
+	require.Equal(t, 0, alb.RetryBudget)
+	require.True(t, alb.RewriteLoc)
+	require.NotNil(t, alb.Registry)
+	require.Equal(t, time.Second, alb.SlowReq)
+	require.Equal(t, targets.StrategyPowerOfTwo, alb.Strategy)
+	require.Equal(t, timeouts, alb.Timeouts)
+	require.Equal(t, "cert.pem", alb.TlsCertFile)
+	require.Equal(t, "key.pem", alb.TlsKeyFile)
+	require.Equal(t, "X-Forwarded-Proto", alb.TlsHeaders.Proto)
+	require.True(t, alb.Upstream)
+
+	// Without options the defaults are kept
+	alb = NewApplicationLoadBalancer(time.Second, 100).(*appLoadBalancer)
+	require.Equal(t, "", alb.HealthPath)
+	require.Len(t, alb.Chain, 0)
+	require.Equal(t, services.DefaultResponseFormat, alb.RespFormat)
+	require.Equal(t, services.DefaultRetryBudget, alb.RetryBudget)
+	require.Equal(t, services.DefaultRequestIdHeader, alb.ReqIdHeader)
+	require.Nil(t, alb.Registry)
+	require.Equal(t, targets.StrategyUnknown, alb.Strategy)
+}
+
+func TestNewNetworkLoadBalancerOptions(t *testing.T) {
+	nlb := NewNetworkLoadBalancer(time.Second).(*netLoadBalancer)
+	require.Equal(t, time.Second, nlb.Timeout)
+	nlb = NewNetworkLoadBalancer(time.Second,
+		WithTimeouts(Timeouts{Dial: 3 * time.Second})).(*netLoadBalancer)
+	require.Equal(t, 3*time.Second, nlb.Timeout)
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	require.Equal(t, DefaultHealthCheckTimeout, healthCheckTimeout(Timeouts{}))
+	require.Equal(t, time.Second,
+		healthCheckTimeout(Timeouts{HealthCheck: time.Second}))
+}
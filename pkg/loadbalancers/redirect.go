@@ -0,0 +1,191 @@
+package loadbalancers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+var (
+	ErrInvalidRedirectStatus   = errors.New("Redirect status code must be 301, 302, 303, 307, or 308")
+	ErrInvalidRedirectTemplate = errors.New("Invalid redirect template")
+)
+
+// redirectPlaceholders is the list of placeholders that redirect templates may
+// contain.
+var redirectPlaceholders = []string{"scheme", "host", "port", "path", "query"}
+
+// redirectTemplate represents a parsed redirect template; a list of literal
+// text and placeholder parts.
+type redirectTemplate []templatePart
+
+// templatePart represents a part of a redirect template.
+type templatePart struct {
+	Text        string // Literal text
+	Placeholder string // Placeholder name; set instead of text
+}
+
+// parseRedirectTemplate parses the given template. An error is returned if the
+// template contains an unknown placeholder or unbalanced braces.
+func parseRedirectTemplate(s string) (redirectTemplate, error) {
+	tmpl := redirectTemplate{}
+	for len(s) > 0 {
+		start := strings.IndexAny(s, "{}")
+		if start < 0 {
+			tmpl = append(tmpl, templatePart{Text: s})
+			break
+		}
+		if s[start] == '}' {
+			return nil, fmt.Errorf("%s - '%s'",
+				ErrInvalidRedirectTemplate, s)
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("%s - '%s'",
+				ErrInvalidRedirectTemplate, s)
+		}
+		name := s[start+1 : start+end]
+		if !isRedirectPlaceholder(name) {
+			return nil, fmt.Errorf("%s - unknown placeholder '%s'",
+				ErrInvalidRedirectTemplate, name)
+		}
+		if start > 0 {
+			tmpl = append(tmpl, templatePart{Text: s[:start]})
+		}
+		tmpl = append(tmpl, templatePart{Placeholder: name})
+		s = s[start+end+1:]
+	}
+	return tmpl, nil
+}
+
+// isRedirectPlaceholder returns true if the given name is a known placeholder.
+func isRedirectPlaceholder(name string) bool {
+	for _, p := range redirectPlaceholders {
+		if name == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand returns the template with its placeholders replaced by the given
+// values.
+func (tmpl redirectTemplate) Expand(values map[string]string) string {
+	var b strings.Builder
+	for _, part := range tmpl {
+		if part.Placeholder != "" {
+			b.WriteString(values[part.Placeholder])
+		} else {
+			b.WriteString(part.Text)
+		}
+	}
+	return b.String()
+}
+
+// redirect builds the redirect URLs of a target group from its templates.
+type redirect struct {
+	Scheme      redirectTemplate // Scheme template
+	Host        redirectTemplate // Host template
+	Path        redirectTemplate // Path template
+	Query       redirectTemplate // Query template
+	StripPrefix string           // Prefix to strip from request paths
+	StatusCode  int              // Redirect status code
+}
+
+// newRedirect returns a new redirect for the given configuration. An error is
+// returned if any template or the status code is invalid.
+func newRedirect(c *targets.RedirectConfig) (*redirect, error) {
+	rd := &redirect{
+		StripPrefix: c.StripPrefix,
+		StatusCode:  c.StatusCode,
+	}
+	switch rd.StatusCode {
+	case 0:
+		rd.StatusCode = http.StatusMovedPermanently
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusSeeOther, http.StatusTemporaryRedirect,
+		http.StatusPermanentRedirect:
+	default:
+		return nil, ErrInvalidRedirectStatus
+	}
+	parts := []struct {
+		Tmpl     *redirectTemplate
+		Value    string
+		Fallback string
+	}{
+		{&rd.Scheme, c.Scheme, "{scheme}"},
+		{&rd.Host, c.Host, "{host}{port}"},
+		{&rd.Path, c.Path, "{path}"},
+		{&rd.Query, c.Query, "{query}"},
+	}
+	for _, part := range parts {
+		v := part.Value
+		if v == "" {
+			v = part.Fallback
+		}
+		tmpl, err := parseRedirectTemplate(v)
+		if err != nil {
+			return nil, err
+		}
+		*part.Tmpl = tmpl
+	}
+	return rd, nil
+}
+
+// URL returns the redirect URL for the given request.
+func (rd *redirect) URL(r *http.Request) string {
+	values := redirectValues(r)
+	values["path"] = stripPrefix(values["path"], rd.StripPrefix)
+	if !strings.HasPrefix(values["path"], "/") {
+		values["path"] = "/" + values["path"]
+	}
+	u := rd.Scheme.Expand(values) + "://" + rd.Host.Expand(values) +
+		rd.Path.Expand(values)
+	if query := rd.Query.Expand(values); query != "" {
+		u += "?" + strings.TrimPrefix(query, "?")
+	}
+	return u
+}
+
+// stripPrefix returns the given path without the given prefix, if the path is
+// the prefix or continues it with a new segment; E.g. "/legacy" is stripped from
+// "/legacy/users" but not from "/legacyusers".
+func stripPrefix(path, prefix string) string {
+	if prefix == "" || !strings.HasPrefix(path, prefix) {
+		return path
+	}
+	rest := path[len(prefix):]
+	if rest == "" || strings.HasSuffix(prefix, "/") ||
+		strings.HasPrefix(rest, "/") {
+		return rest
+	}
+	return path
+}
+
+// redirectValues returns the placeholder values of the given request. The port
+// includes its leading colon, so "{host}{port}" is the request's host.
+func redirectValues(r *http.Request) map[string]string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host, port := r.Host, ""
+	if h, p, err := net.SplitHostPort(r.Host); err == nil {
+		host, port = h, ":"+p
+		if strings.Contains(h, ":") {
+			// Keep IPv6 addresses bracketed
+			host = "[" + h + "]"
+		}
+	}
+	return map[string]string{
+		"scheme": scheme,
+		"host":   host,
+		"port":   port,
+		"path":   r.URL.Path,
+		"query":  r.URL.RawQuery,
+	}
+}
@@ -0,0 +1,100 @@
+package loadbalancers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+func TestParseRedirectTemplate(t *testing.T) {
+	tmpl, err := parseRedirectTemplate("/v2{path}")
+	require.Nil(t, err)
+	require.Equal(t, redirectTemplate{
+		{Text: "/v2"},
+		{Placeholder: "path"},
+	}, tmpl)
+	require.Equal(t, "/v2/foo",
+		tmpl.Expand(map[string]string{"path": "/foo"}))
+
+	_, err = parseRedirectTemplate("/{unknown}")
+	require.NotNil(t, err)
+	_, err = parseRedirectTemplate("/{path")
+	require.NotNil(t, err)
+	_, err = parseRedirectTemplate("/path}")
+	require.NotNil(t, err)
+}
+
+func TestRedirectURL(t *testing.T) {
+	rd, err := newRedirect(&targets.RedirectConfig{
+		Host: "new.example.com",
+		Path: "/v2{path}",
+	})
+	require.Nil(t, err)
+	require.Equal(t, http.StatusMovedPermanently, rd.StatusCode)
+	req := httptest.NewRequest(http.MethodGet,
+		"http://old.example.com/foo?a=b", nil)
+	require.Equal(t, "http://new.example.com/v2/foo?a=b", rd.URL(req))
+
+	// Strip a prefix and keep the host and port
+	rd, err = newRedirect(&targets.RedirectConfig{
+		Scheme:      "https",
+		StripPrefix: "/legacy",
+		Query:       "{query}&moved=1",
+		StatusCode:  http.StatusTemporaryRedirect,
+	})
+	require.Nil(t, err)
+	req = httptest.NewRequest(http.MethodGet,
+		"http://example.com:8080/legacy/users?id=1", nil)
+	require.Equal(t, "https://example.com:8080/users?id=1&moved=1",
+		rd.URL(req))
+
+	// Only whole path segments are stripped
+	paths := map[string]string{
+		"/legacy":      "/",
+		"/legacy/":     "/",
+		"/legacyusers": "/legacyusers",
+		"/legacy-v1/a": "/legacy-v1/a",
+		"/other":       "/other",
+	}
+	for path, expected := range paths {
+		req = httptest.NewRequest(http.MethodGet,
+			"http://example.com"+path+"?id=1", nil)
+		require.Equal(t, "https://example.com"+expected+"?id=1&moved=1",
+			rd.URL(req), path)
+	}
+
+	_, err = newRedirect(&targets.RedirectConfig{StatusCode: 200})
+	require.Equal(t, ErrInvalidRedirectStatus, err)
+	_, err = newRedirect(&targets.RedirectConfig{Host: "{hots}"})
+	require.NotNil(t, err)
+}
+
+func TestAppLoadBalancerHandlerRedirectTemplate(t *testing.T) {
+	group := targets.NewTargetGroup("old", "http", rules.Rule{
+		Action:     rules.RuleActionRedirect,
+		Conditions: [][]rules.Condition{{"host-header = old.example.com"}},
+	})
+	group.Redirect = &targets.RedirectConfig{
+		Host: "new.example.com",
+		Path: "/v2{path}",
+	}
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	require.Nil(t, lb.AddTargetGroup(group))
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://old.example.com/foo",
+		nil)
+	lb.Handler(NewListener("", ":80", "http")).ServeHTTP(w, req)
+	require.Equal(t, http.StatusMovedPermanently, w.Code)
+	require.Equal(t, "http://new.example.com/v2/foo",
+		w.Header().Get("Location"))
+
+	group.Redirect.Path = "{oops}"
+	require.NotNil(t, lb.AddTargetGroup(group))
+}
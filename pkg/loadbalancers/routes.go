@@ -0,0 +1,94 @@
+package loadbalancers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
+)
+
+// DefaultRulesPath is the conventional path of the load balancer's routing
+// rules endpoint.
+const DefaultRulesPath = "/rules"
+
+// RouteRule represents the effective routing rule of a target group. Requests
+// are matched against the rules in order, and the first rule whose conditions
+// match and whose action can serve the request routes it; E.g. a split rule
+// whose picked group has no pool is skipped. Each condition lists the
+// alternatives of which one must match.
+type RouteRule struct {
+	Order      int          `json:"order"`
+	Group      string       `json:"group"`
+	Listener   string       `json:"listener,omitempty"`
+	Action     string       `json:"action"`
+	Conditions [][]string   `json:"conditions"`
+	Path       RoutePath    `json:"path"`
+	Split      []RouteSplit `json:"split,omitempty"`
+	SplitKey   string       `json:"split_key,omitempty"`
+	MirrorTo   string       `json:"mirror_to,omitempty"`
+}
+
+// RoutePath represents how a routing rule canonicalizes request paths before
+// matching its path patterns.
+type RoutePath struct {
+	IgnoreCase          bool `json:"ignore_case"`
+	IgnoreTrailingSlash bool `json:"ignore_trailing_slash"`
+	IncludeQuery        bool `json:"include_query"`
+}
+
+// RouteSplit represents a weighted target group of a split routing rule.
+type RouteSplit struct {
+	Group  string `json:"group"`
+	Weight int    `json:"weight"`
+}
+
+// newRouteRule returns the routing rule of the given target at the given match
+// order.
+func newRouteRule(order int, t appTarget) RouteRule {
+	rule := RouteRule{
+		Order:      order,
+		Group:      t.Name,
+		Listener:   t.Listener,
+		Action:     t.Rule.Action.String(),
+		Conditions: make([][]string, len(t.Rule.Conditions)),
+		Path: RoutePath{
+			IgnoreCase:          t.Rule.Path.IgnoreCase,
+			IgnoreTrailingSlash: t.Rule.Path.IgnoreTrailingSlash,
+			IncludeQuery:        t.Rule.Path.IncludeQuery,
+		},
+		MirrorTo: t.MirrorTo,
+	}
+	for i, cond := range t.Rule.Conditions {
+		rule.Conditions[i] = make([]string, len(cond))
+		for j, sub := range cond {
+			rule.Conditions[i][j] = string(sub)
+		}
+	}
+	if t.Rule.Action == rules.RuleActionSplit {
+		rule.SplitKey = t.Rule.SplitKey
+		for _, s := range t.Rule.Split {
+			rule.Split = append(rule.Split, RouteSplit{
+				Group:  s.Name,
+				Weight: s.Weight,
+			})
+		}
+	}
+	return rule
+}
+
+// RulesHandler returns a handler that reports the given load balancer's
+// routing rules as JSON, in match order; E.g. to tell why a request was routed
+// to a target group.
+func RulesHandler(lb LoadBalancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes := lb.Rules()
+		if routes == nil {
+			routes = []RouteRule{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct {
+			Rules []RouteRule `json:"rules"`
+		}{routes})
+	})
+}
@@ -0,0 +1,89 @@
+package loadbalancers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+func TestRulesHandler(t *testing.T) {
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	api := targets.NewTargetGroup("api", "http", rules.Rule{
+		Action: rules.RuleActionForward,
+		Conditions: [][]rules.Condition{
+			{"path-pattern=/api/*", "path-pattern=/v1/*"},
+			{"http-request-method=GET"},
+		},
+		Path: rules.PathOptions{IgnoreCase: true},
+	})
+	api.AddTarget("127.0.0.1", 8080)
+	api.Listener = "public"
+	api.MirrorTo = "web"
+	require.Nil(t, lb.AddTargetGroup(api))
+	web := targets.NewTargetGroup("web", "http", rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	})
+	web.AddTarget("127.0.0.2", 8080)
+	require.Nil(t, lb.AddTargetGroup(web))
+	split := targets.NewTargetGroup("canary", "http", rules.Rule{
+		Action:     rules.RuleActionSplit,
+		Conditions: [][]rules.Condition{{"always="}},
+		Split: []rules.SplitTarget{
+			{Name: "api", Weight: 9},
+			{Name: "web", Weight: 1},
+		},
+		SplitKey: "X-User",
+	})
+	require.Nil(t, lb.AddTargetGroup(split))
+
+	w := httptest.NewRecorder()
+	RulesHandler(lb).ServeHTTP(w,
+		httptest.NewRequest(http.MethodGet, DefaultRulesPath, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var body struct {
+		Rules []RouteRule `json:"rules"`
+	}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+	require.Equal(t, []RouteRule{{
+		Order:    0,
+		Group:    "api",
+		Listener: "public",
+		Action:   "forward",
+		Conditions: [][]string{
+			{"path-pattern=/api/*", "path-pattern=/v1/*"},
+			{"http-request-method=GET"},
+		},
+		Path:     RoutePath{IgnoreCase: true},
+		MirrorTo: "web",
+	}, {
+		Order:      1,
+		Group:      "web",
+		Action:     "forward",
+		Conditions: [][]string{{"always="}},
+	}, {
+		Order:      2,
+		Group:      "canary",
+		Action:     "split",
+		Conditions: [][]string{{"always="}},
+		Split: []RouteSplit{
+			{Group: "api", Weight: 9},
+			{Group: "web", Weight: 1},
+		},
+		SplitKey: "X-User",
+	}}, body.Rules)
+
+	// Network load balancers report no rules
+	w = httptest.NewRecorder()
+	RulesHandler(NewNetworkLoadBalancer(time.Second)).ServeHTTP(w,
+		httptest.NewRequest(http.MethodGet, DefaultRulesPath, nil))
+	require.JSONEq(t, `{"rules":[]}`, w.Body.String())
+}
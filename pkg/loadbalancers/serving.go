@@ -0,0 +1,54 @@
+package loadbalancers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/logging"
+)
+
+// DefaultServingPath is the conventional admin path of the load balancer's
+// serving switch.
+const DefaultServingPath = "/serving"
+
+// servingState is the JSON body of the serving switch's requests and
+// responses.
+type servingState struct {
+	Serving bool `json:"serving"`
+}
+
+// ServingHandler returns a handler of the given load balancer's serving switch;
+// a kill switch for incident response. GET reports whether the load balancer
+// serves requests, and PUT sets it from a JSON body; E.g. {"serving": false}
+// answers every request with 503 until it is set back. It changes the load
+// balancer's state, so it should be registered as a mutating admin route.
+func ServingHandler(lb LoadBalancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodPut:
+			var state servingState
+			if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+				http.Error(w, "Invalid serving state",
+					http.StatusBadRequest)
+				return
+			}
+			if state.Serving != lb.Serving() {
+				log.Warning("Serving switched", logging.Fields{
+					"serving": state.Serving,
+				})
+			}
+			lb.SetServing(state.Serving)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+				http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method != http.MethodHead {
+			json.NewEncoder(w).Encode(servingState{lb.Serving()})
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package loadbalancers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+func TestServingHandler(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	rule := rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	}
+	group := targets.NewTargetGroup("web", "http", rule)
+	group.AddServiceTarget(targetUrl)
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	require.Nil(t, lb.AddTargetGroup(group))
+	require.True(t, lb.Serving())
+	handler := lb.Handler(NewListener("", ":80", "http"))
+	serving := ServingHandler(lb)
+	send := func(method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		serving.ServeHTTP(w, httptest.NewRequest(method,
+			DefaultServingPath, strings.NewReader(body)))
+		return w
+	}
+
+	w := send(http.MethodGet, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	require.JSONEq(t, `{"serving":true}`, w.Body.String())
+
+	// Disabled, every request is answered with 503
+	w = send(http.MethodPut, `{"serving":false}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"serving":false}`, w.Body.String())
+	require.False(t, lb.Serving())
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	// Re-enabled, requests reach the target again
+	w = send(http.MethodPut, `{"serving":true}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.True(t, lb.Serving())
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	// Invalid bodies and methods leave the switch as is
+	require.Equal(t, http.StatusBadRequest,
+		send(http.MethodPut, "off").Code)
+	w = send(http.MethodPost, `{"serving":false}`)
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	require.Equal(t, "GET, HEAD, PUT", w.Header().Get("Allow"))
+	require.True(t, lb.Serving())
+
+	// Network load balancers always serve
+	nlb := NewNetworkLoadBalancer(time.Second)
+	nlb.SetServing(false)
+	require.True(t, nlb.Serving())
+}
@@ -0,0 +1,74 @@
+package loadbalancers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/services"
+)
+
+// DefaultStatsPath is the conventional path of the load balancer's target
+// statistics endpoint.
+const DefaultStatsPath = "/stats"
+
+// TargetStats represents the request counters and response latency percentiles
+// of a target of a target group. Latencies are in milliseconds.
+type TargetStats struct {
+	Group    string       `json:"group"`
+	Target   string       `json:"target"`
+	Alive    bool         `json:"alive"`
+	InFlight int64        `json:"in_flight"`
+	Total    int64        `json:"total"`
+	Errors   int64        `json:"errors"`
+	Latency  LatencyStats `json:"latency"`
+}
+
+// LatencyStats represents the estimated response latency percentiles of a
+// target in milliseconds.
+type LatencyStats struct {
+	Count int64   `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+}
+
+// newTargetStats returns the target statistics of the given service's stats in
+// the named group.
+func newTargetStats(group string, s services.ServiceStats) TargetStats {
+	return TargetStats{
+		Group:    group,
+		Target:   s.Target.URL(),
+		Alive:    s.Target.IsAlive(),
+		InFlight: s.InFlight,
+		Total:    s.Total,
+		Errors:   s.Errors,
+		Latency: LatencyStats{
+			Count: s.Latency.Count,
+			P50:   milliseconds(s.Latency.P50),
+			P90:   milliseconds(s.Latency.P90),
+			P99:   milliseconds(s.Latency.P99),
+		},
+	}
+}
+
+// StatsHandler returns a handler that reports the statistics of the given load
+// balancer's targets as JSON; E.g. to monitor their latency percentiles.
+func StatsHandler(lb LoadBalancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := lb.Stats()
+		if stats == nil {
+			stats = []TargetStats{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct {
+			Targets []TargetStats `json:"targets"`
+		}{stats})
+	})
+}
+
+// milliseconds returns the given duration in milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,65 @@
+package loadbalancers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+func TestStatsHandler(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(2 * time.Millisecond)
+		}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	rule := rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	}
+	group := targets.NewTargetGroup("web", "http", rule)
+	group.AddServiceTarget(targetUrl)
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	require.Nil(t, lb.AddTargetGroup(group))
+	handler := lb.Handler(NewListener("", ":80", "http"))
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	StatsHandler(lb).ServeHTTP(w,
+		httptest.NewRequest(http.MethodGet, DefaultStatsPath, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var body struct {
+		Targets []TargetStats `json:"targets"`
+	}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+	require.Len(t, body.Targets, 1)
+	stats := body.Targets[0]
+	require.Equal(t, "web", stats.Group)
+	require.Equal(t, ts.URL, stats.Target)
+	require.True(t, stats.Alive)
+	require.Equal(t, int64(5), stats.Total)
+	require.Equal(t, int64(5), stats.Latency.Count)
+	require.GreaterOrEqual(t, stats.Latency.P50, 1.0)
+	require.GreaterOrEqual(t, stats.Latency.P99, stats.Latency.P50)
+
+	// Network load balancers report no targets
+	w = httptest.NewRecorder()
+	StatsHandler(NewNetworkLoadBalancer(time.Second)).ServeHTTP(w,
+		httptest.NewRequest(http.MethodGet, DefaultStatsPath, nil))
+	require.JSONEq(t, `{"targets":[]}`, w.Body.String())
+}
@@ -0,0 +1,56 @@
+package loadbalancers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/logging"
+)
+
+// DefaultTargetHealthPath is the conventional admin path of the load balancer's
+// target health override.
+const DefaultTargetHealthPath = "/targets/health"
+
+// targetHealth is the JSON body of the target health override's requests and
+// responses.
+type targetHealth struct {
+	Target string `json:"target"`
+	Alive  bool   `json:"alive"`
+}
+
+// TargetHealthHandler returns a handler that marks a target of the given load
+// balancer alive or dead until its next health check; E.g. to put a recovered
+// backend back into rotation during an incident. PUT takes the target's URL, as
+// reported by the stats endpoint, and its alive state as a JSON body; E.g.
+// {"target": "http://10.0.0.1:8080", "alive": true}. It changes the load
+// balancer's state, so it should be registered as a mutating admin route.
+func TargetHealthHandler(lb LoadBalancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.Header().Set("Allow", http.MethodPut)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+				http.StatusMethodNotAllowed)
+			return
+		}
+		var health targetHealth
+		err := json.NewDecoder(r.Body).Decode(&health)
+		if err != nil || health.Target == "" {
+			http.Error(w, "Invalid target health",
+				http.StatusBadRequest)
+			return
+		}
+		err = lb.SetTargetAlive(health.Target, health.Alive)
+		if err != nil {
+			// The target is not in any of the load balancer's groups
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Warning("Target health overridden", logging.Fields{
+			logging.FieldTarget: health.Target,
+			"alive":             health.Alive,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(health)
+	})
+}
@@ -0,0 +1,65 @@
+package loadbalancers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+func TestTargetHealthHandler(t *testing.T) {
+	targetUrl, err := url.Parse("http://127.0.0.1:8080")
+	require.Nil(t, err)
+	rule := rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	}
+	group := targets.NewTargetGroup("web", "http", rule)
+	target := group.AddServiceTarget(targetUrl)
+	lb := NewApplicationLoadBalancer(time.Second, 100)
+	require.Nil(t, lb.AddTargetGroup(group))
+	changes := 0
+	lb.OnHealthChange(func(group string, t targets.Target, wasAlive, alive bool) {
+		changes++
+	})
+	handler := TargetHealthHandler(lb)
+	send := func(method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method,
+			DefaultTargetHealthPath, strings.NewReader(body)))
+		return w
+	}
+
+	w := send(http.MethodPut,
+		`{"target":"http://127.0.0.1:8080","alive":false}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"target":"http://127.0.0.1:8080","alive":false}`,
+		w.Body.String())
+	require.False(t, target.IsAlive())
+	require.Equal(t, 1, changes)
+
+	w = send(http.MethodPut,
+		`{"target":"http://127.0.0.1:8080","alive":true}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.True(t, target.IsAlive())
+	require.Equal(t, 2, changes)
+
+	// Unknown targets, invalid bodies, and other methods are rejected
+	w = send(http.MethodPut, `{"target":"http://127.0.0.1:9090"}`)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Equal(t, http.StatusBadRequest,
+		send(http.MethodPut, `{"alive":false}`).Code)
+	require.Equal(t, http.StatusBadRequest,
+		send(http.MethodPut, "dead").Code)
+	w = send(http.MethodGet, "")
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	require.Equal(t, http.MethodPut, w.Header().Get("Allow"))
+	require.True(t, target.IsAlive())
+}
@@ -0,0 +1,95 @@
+package loadbalancers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/logging"
+	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
+)
+
+// DefaultTraceHeader is the conventional request header that asks the load
+// balancer to trace how it routed the request.
+const DefaultTraceHeader = "X-LB-Trace"
+
+// RouteTrace represents the settings of the route trace of an application load
+// balancer. A request that carries the trace header with a value of "1" or
+// "true", from one of the allowed source IPs, is answered with the trace header
+// naming the target group that matched it and the conditions that matched;
+// E.g. "group=api; rule=0; matched=path-pattern=/api/*". The evaluation of each
+// group's rule up to the match is logged. The source IP is taken from the
+// connection only, since forwarding headers can be set by anyone; and no
+// request is traced without allowed IPs.
+type RouteTrace struct {
+	Header   string   // Trace header; DefaultTraceHeader if empty
+	AllowIps []string // Allowed source IPs and CIDR ranges
+}
+
+// header returns the route trace's header.
+func (t RouteTrace) header() string {
+	if t.Header == "" {
+		return DefaultTraceHeader
+	}
+	return t.Header
+}
+
+// Traces returns true if the given request asks to be traced and is allowed to.
+func (t RouteTrace) Traces(r *http.Request) bool {
+	if len(t.AllowIps) == 0 {
+		return false
+	}
+	v := strings.ToLower(strings.TrimSpace(r.Header.Get(t.header())))
+	if v != "1" && v != "true" {
+		return false
+	}
+	return rules.ContainsIP(t.AllowIps, remoteIp(r))
+}
+
+// traceRoute evaluates the rules of the load balancer's targets bound to the
+// given listener against the given request in order, like the handler, and
+// reports the first that matches on the response's trace header. Unlike the
+// handler, a matching rule whose action cannot serve the request (E.g. a split
+// to a group without a pool) is still reported.
+func (alb *appLoadBalancer) traceRoute(l Listener, w http.ResponseWriter, r *http.Request) {
+	evaluated := []string{}
+	result := "group=; matched=none"
+	for i, t := range alb.Targets {
+		if !l.Matches(t.Listener) {
+			evaluated = append(evaluated, fmt.Sprintf(
+				"%s: bound to listener %s", t.Name, t.Listener))
+			continue
+		}
+		matched, traces := t.Rule.Trace(r)
+		if !matched {
+			failed := traces[len(traces)-1].Condition
+			evaluated = append(evaluated, fmt.Sprintf(
+				"%s: failed %s", t.Name, joinConditions(failed)))
+			continue
+		}
+		conds := make([]rules.Condition, len(traces))
+		for j, trace := range traces {
+			conds[j] = trace.Matched
+		}
+		result = fmt.Sprintf("group=%s; rule=%d; matched=%s", t.Name, i,
+			joinConditions(conds))
+		evaluated = append(evaluated, fmt.Sprintf("%s: matched %s",
+			t.Name, joinConditions(conds)))
+		break
+	}
+	w.Header().Set(alb.Trace.header(), result)
+	log.Info("Route traced", logging.Fields{
+		"path":      r.URL.Path,
+		"route":     result,
+		"evaluated": evaluated,
+	})
+}
+
+// joinConditions returns the given conditions joined by commas.
+func joinConditions(conds []rules.Condition) string {
+	s := make([]string, len(conds))
+	for i, c := range conds {
+		s[i] = string(c)
+	}
+	return strings.Join(s, ",")
+}
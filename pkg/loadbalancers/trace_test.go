@@ -0,0 +1,79 @@
+package loadbalancers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+func TestRouteTrace(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	lb := NewApplicationLoadBalancer(time.Second, 100,
+		WithRouteTrace(RouteTrace{AllowIps: []string{"192.0.2.0/24"}}))
+	api := targets.NewTargetGroup("api", "http", rules.Rule{
+		Action: rules.RuleActionForward,
+		Conditions: [][]rules.Condition{
+			{"path-pattern=/api/*"},
+			{"http-request-method=POST", "http-request-method=GET"},
+		},
+	})
+	api.AddServiceTarget(targetUrl)
+	require.Nil(t, lb.AddTargetGroup(api))
+	web := targets.NewTargetGroup("web", "http", rules.Rule{
+		Action:     rules.RuleActionForward,
+		Conditions: [][]rules.Condition{{"always="}},
+	})
+	web.AddServiceTarget(targetUrl)
+	require.Nil(t, lb.AddTargetGroup(web))
+	handler := lb.Handler(NewListener("", ":80", "http"))
+
+	tests := []struct {
+		Path     string
+		Trace    string
+		Remote   string
+		Expected string
+	}{
+		{"/api/users", "1", "192.0.2.1:1234",
+			"group=api; rule=0; matched=path-pattern=/api/*,http-request-method=GET"},
+		{"/index.html", "true", "192.0.2.1:1234",
+			"group=web; rule=1; matched=always="},
+		// Requests must ask to be traced from an allowed IP
+		{"/api/users", "", "192.0.2.1:1234", ""},
+		{"/api/users", "0", "192.0.2.1:1234", ""},
+		{"/api/users", "1", "198.51.100.1:1234", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.Path, nil)
+		r.RemoteAddr = test.Remote
+		if test.Trace != "" {
+			r.Header.Set(DefaultTraceHeader, test.Trace)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, test.Expected,
+			w.Header().Get(DefaultTraceHeader), test.Path)
+	}
+
+	// No request is traced without allowed IPs
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(DefaultTraceHeader, "1")
+	require.False(t, RouteTrace{}.Traces(r))
+	require.True(t, RouteTrace{AllowIps: []string{"192.0.2.1"}}.Traces(r))
+	r.Header.Set("X-Debug", "1")
+	require.False(t, RouteTrace{
+		Header:   "X-Debug",
+		AllowIps: []string{"10.0.0.0/8"},
+	}.Traces(r))
+}
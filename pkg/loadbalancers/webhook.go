@@ -0,0 +1,134 @@
+package loadbalancers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/logging"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+const (
+	// WebhookMaxAttempts is the maximum number of times a health event is
+	// sent to a webhook before it is dropped.
+	WebhookMaxAttempts = 5
+
+	// WebhookQueueSize is the maximum number of health events waiting to
+	// be sent to a webhook; further events are dropped.
+	WebhookQueueSize = 64
+
+	// WebhookTimeout is the timeout of each webhook request.
+	WebhookTimeout = 10 * time.Second
+)
+
+// webhookRetryInterval is the wait before the first retry of a failed webhook
+// request; it doubles with each retry. It is replaced in tests.
+var webhookRetryInterval = time.Second
+
+// HealthEvent represents the JSON body sent to a webhook when a target's alive
+// state changes.
+type HealthEvent struct {
+	Group     string    `json:"group"`     // Target group name
+	Target    string    `json:"target"`    // Target URL
+	Name      string    `json:"name"`      // Target name
+	Alive     bool      `json:"alive"`     // New alive state
+	Timestamp time.Time `json:"timestamp"` // Time of the change
+}
+
+// NewHealthWebhook returns a health change function that POSTs a HealthEvent to
+// the given URL for each change, and a stop function to stop sending events.
+// Events are sent in order by a single routine; so a slow webhook does not
+// block health checks. Failed requests are retried with backoff.
+func NewHealthWebhook(url string) (HealthChangeFn, StopFn) {
+	events := make(chan HealthEvent, WebhookQueueSize)
+	// Cancelling the context also cancels a pending request
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	client := &http.Client{Timeout: WebhookTimeout}
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev := <-events:
+				sendHealthEvent(ctx, client, url, ev)
+			}
+		}
+	}()
+	fn := func(group string, t targets.Target, wasAlive, alive bool) {
+		ev := HealthEvent{
+			Group:     group,
+			Target:    t.URL(),
+			Name:      t.Name(),
+			Alive:     alive,
+			Timestamp: time.Now().UTC(),
+		}
+		select {
+		case events <- ev:
+		default:
+			log.Error("Webhook queue is full; dropped event",
+				logging.Fields{logging.FieldTarget: ev.Target})
+		}
+	}
+	stop := func() {
+		cancel()
+		<-stopped
+	}
+	return fn, stop
+}
+
+// sendHealthEvent POSTs the given event to the URL; retrying failed requests
+// with backoff until the maximum attempts are made or the context is done.
+func sendHealthEvent(ctx context.Context, client *http.Client, url string, ev HealthEvent) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		log.Error("Failed to encode webhook event",
+			logging.Fields{logging.FieldError: err})
+		return
+	}
+	wait := webhookRetryInterval
+	for attempt := 1; ; attempt++ {
+		err = postJson(ctx, client, url, b)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		if attempt >= WebhookMaxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+	log.Error("Failed to send webhook event", logging.Fields{
+		logging.FieldTarget: ev.Target,
+		logging.FieldError:  err,
+	})
+}
+
+// postJson POSTs the given JSON body to the URL and returns an error if the
+// request fails or the response status is not 2xx.
+func postJson(ctx context.Context, client *http.Client, url string, b []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url,
+		bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package loadbalancers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+func TestNewHealthWebhook(t *testing.T) {
+	defer func(d time.Duration) {
+		webhookRetryInterval = d
+	}(webhookRetryInterval)
+	webhookRetryInterval = 10 * time.Millisecond
+
+	var requests int32
+	received := make(chan HealthEvent, 1)
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Fail the first request to test retries
+			if atomic.AddInt32(&requests, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			var ev HealthEvent
+			require.Nil(t, json.NewDecoder(r.Body).Decode(&ev))
+			received <- ev
+		}),
+	)
+	defer ts.Close()
+
+	fn, stop := NewHealthWebhook(ts.URL)
+	defer stop()
+	target := targets.NewTarget("10.0.0.1", 8080, "http")
+	target.SetName("web-1")
+	fn("web", target, true, false)
+	select {
+	case ev := <-received:
+		require.Equal(t, "web", ev.Group)
+		require.Equal(t, "http://10.0.0.1:8080", ev.Target)
+		require.Equal(t, "web-1", ev.Name)
+		require.False(t, ev.Alive)
+		require.False(t, ev.Timestamp.IsZero())
+	case <-time.After(time.Second):
+		t.Fatal("webhook event was not received")
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestNewHealthWebhookNonBlocking(t *testing.T) {
+	blocked := make(chan struct{})
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-blocked
+		}),
+	)
+	defer ts.Close()
+	defer close(blocked)
+
+	fn, stop := NewHealthWebhook(ts.URL)
+	defer stop()
+	target := targets.NewTarget("10.0.0.1", 8080, "http")
+	start := time.Now()
+	for i := 0; i < WebhookQueueSize*2; i++ {
+		fn("web", target, true, false)
+	}
+	require.Less(t, time.Since(start), time.Second)
+}
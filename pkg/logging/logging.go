@@ -0,0 +1,109 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/crossedbot/common/golang/logger"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Log formats
+	FormatText = "text"
+	FormatJson = "json"
+
+	// Common field names
+	FieldComponent = "component"
+	FieldDuration  = "duration"
+	FieldError     = "error"
+	FieldPath      = "path"
+	FieldStatus    = "status"
+	FieldTarget    = "target"
+)
+
+var (
+	ErrUnknownFormat = errors.New("Unknown log format")
+	ErrUnknownLevel  = errors.New("Unknown log level")
+)
+
+// Fields represents the structured fields of a log entry.
+type Fields map[string]interface{}
+
+// Logger represents a logger for a component of the load balancer; each entry
+// it logs carries the component's name in the "component" field.
+type Logger struct {
+	Component string // Component name; E.g. "services"
+}
+
+// New returns a new Logger for the named component.
+func New(component string) Logger {
+	return Logger{Component: component}
+}
+
+// Debug logs the given message and fields at the debug level.
+func (l Logger) Debug(msg string, fields ...Fields) {
+	l.entry(fields).Debug(msg)
+}
+
+// DebugEnabled returns true if debug entries are logged; so callers can skip
+// the work of building them otherwise.
+func (l Logger) DebugEnabled() bool {
+	return logger.Log.IsLevelEnabled(logrus.DebugLevel)
+}
+
+// Info logs the given message and fields at the info level.
+func (l Logger) Info(msg string, fields ...Fields) {
+	l.entry(fields).Info(msg)
+}
+
+// Warning logs the given message and fields at the warning level.
+func (l Logger) Warning(msg string, fields ...Fields) {
+	l.entry(fields).Warning(msg)
+}
+
+// Error logs the given message and fields at the error level.
+func (l Logger) Error(msg string, fields ...Fields) {
+	l.entry(fields).Error(msg)
+}
+
+// entry returns a log entry with the logger's component and the given fields.
+func (l Logger) entry(fields []Fields) *logrus.Entry {
+	e := logger.Log.WithField(FieldComponent, l.Component)
+	for _, f := range fields {
+		e = e.WithFields(logrus.Fields(f))
+	}
+	return e
+}
+
+// SetFormat sets the output format of all log entries; "text" or "json". JSON
+// entries carry the "level", "ts", and "msg" fields along with their own.
+func SetFormat(format string) error {
+	switch strings.ToLower(format) {
+	case FormatText:
+		logger.Log.SetFormatter(&logrus.TextFormatter{
+			DisableColors: true,
+		})
+	case FormatJson:
+		logger.Log.SetFormatter(&logrus.JSONFormatter{
+			FieldMap: logrus.FieldMap{
+				logrus.FieldKeyTime: "ts",
+			},
+		})
+	default:
+		return fmt.Errorf("%s - '%s'", ErrUnknownFormat, format)
+	}
+	return nil
+}
+
+// SetLevel sets the lowest level of the entries that are logged; E.g. "debug",
+// "info", "warning", or "error".
+func SetLevel(level string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("%s - '%s'", ErrUnknownLevel, level)
+	}
+	logger.Log.SetLevel(lvl)
+	return nil
+}
@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/crossedbot/common/golang/logger"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// captureLogs returns a buffer that log entries are written to until the
+// returned function is called.
+func captureLogs() (*bytes.Buffer, func()) {
+	buf := &bytes.Buffer{}
+	out, formatter, level := logger.Log.Out, logger.Log.Formatter,
+		logger.Log.GetLevel()
+	logger.Log.SetOutput(buf)
+	return buf, func() {
+		logger.Log.SetOutput(out)
+		logger.Log.SetFormatter(formatter)
+		logger.Log.SetLevel(level)
+	}
+}
+
+func TestLoggerJson(t *testing.T) {
+	buf, restore := captureLogs()
+	defer restore()
+	require.Nil(t, SetFormat("json"))
+
+	New("services").Error("Failed to proxy request", Fields{
+		FieldTarget: "http://10.0.0.1:80",
+		FieldError:  errors.New("connection refused"),
+	})
+	entry := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.Equal(t, "error", entry["level"])
+	require.Equal(t, "services", entry[FieldComponent])
+	require.Equal(t, "http://10.0.0.1:80", entry[FieldTarget])
+	require.Equal(t, "connection refused", entry[FieldError])
+	require.Equal(t, "Failed to proxy request", entry["msg"])
+	require.Contains(t, entry, "ts")
+}
+
+func TestSetFormat(t *testing.T) {
+	buf, restore := captureLogs()
+	defer restore()
+	require.Nil(t, SetFormat("TEXT"))
+	New("networks").Info("Relay closed")
+	require.Contains(t, buf.String(), "component=networks")
+	require.Contains(t, buf.String(), "msg=\"Relay closed\"")
+
+	require.NotNil(t, SetFormat("xml"))
+}
+
+func TestSetLevel(t *testing.T) {
+	buf, restore := captureLogs()
+	defer restore()
+	require.Nil(t, SetLevel("warning"))
+	require.Equal(t, logrus.WarnLevel, logger.Log.GetLevel())
+	New("lb").Info("Hidden")
+	require.Equal(t, 0, buf.Len())
+	require.False(t, New("lb").DebugEnabled())
+	require.Nil(t, SetLevel("debug"))
+	require.True(t, New("lb").DebugEnabled())
+
+	require.NotNil(t, SetLevel("loud"))
+}
@@ -0,0 +1,99 @@
+package networks
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/grpchealth"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+// checkTargets probes the pool's targets concurrently with the given timeout,
+// at most TargetHealthCheckWorkers at a time, and sets whether they are alive.
+// It returns once every target is probed.
+func (pool *networkPool) checkTargets(to time.Duration) {
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, TargetHealthCheckWorkers)
+	for _, target := range pool.targets() {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(t targets.Target) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			alive := targets.Probe(pool.HealthRetries, func() bool {
+				return pool.isHealthy(t, to)
+			})
+			wasAlive := pool.setAlive(t, alive)
+			if alive != wasAlive && pool.HealthChange != nil {
+				pool.HealthChange(t, wasAlive, alive)
+			}
+		}(target.Target)
+	}
+	wg.Wait()
+}
+
+// isHealthy returns true if the given target passes the pool's health check
+// within the given timeout. Without a send or expect payload, or a gRPC health
+// check, the target only needs to accept connections.
+func (pool *networkPool) isHealthy(t targets.Target, to time.Duration) bool {
+	c := pool.Health
+	if c == nil || (!c.IsGrpc() && c.Send == "" && c.Expect == "") {
+		return t.IsAvailable(to)
+	}
+	hostPort := net.JoinHostPort(t.Host(), strconv.Itoa(t.HealthPort()))
+	for _, network := range targets.GetTransport(t.Protocol()) {
+		if c.IsGrpc() {
+			if grpchealth.Check(network, hostPort, to,
+				targets.IsTLS(t.Protocol()), c.Service) {
+				return true
+			}
+			continue
+		}
+		if probeTarget(network, hostPort, to, targets.IsTLS(t.Protocol()),
+			[]byte(c.Send), []byte(c.Expect)) {
+			return true
+		}
+	}
+	return false
+}
+
+// probeTarget connects to the address using the given network protocol, writes
+// the send payload, and returns true if the response starts with the expected
+// payload; all within the given timeout.
+func probeTarget(network, addr string, to time.Duration, useTls bool, send, expect []byte) bool {
+	dialer := &net.Dialer{Timeout: to}
+	var conn net.Conn
+	var err error
+	if useTls {
+		// Like the connection checks, the cert's validity is skipped
+		config := &tls.Config{InsecureSkipVerify: true}
+		conn, err = tls.DialWithDialer(dialer, network, addr, config)
+	} else {
+		conn, err = dialer.Dial(network, addr)
+	}
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(to))
+	if len(send) > 0 {
+		if _, err := conn.Write(send); err != nil {
+			return false
+		}
+	}
+	if len(expect) == 0 {
+		return true
+	}
+	b := make([]byte, len(expect))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return false
+	}
+	return bytes.Equal(b, expect)
+}
@@ -0,0 +1,61 @@
+package networks
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+// newPingServer returns a TCP listener that answers each "PING" line with the
+// given reply.
+func newPingServer(t *testing.T, reply string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err == nil && line == "PING\r\n" {
+					conn.Write([]byte(reply))
+				}
+			}(conn)
+		}
+	}()
+	return ln
+}
+
+func TestNetworkPoolIsHealthy(t *testing.T) {
+	ln := newPingServer(t, "PONG\r\n")
+	defer ln.Close()
+	addr := ln.Addr().(*net.TCPAddr)
+	target := targets.NewTarget("127.0.0.1", addr.Port, "tcp")
+
+	// Without a send/expect payload, accepting connections is enough
+	pool := &networkPool{}
+	require.True(t, pool.isHealthy(target, time.Second))
+
+	health := &targets.HealthCheckConfig{Send: "PING\r\n", Expect: "PONG"}
+	pool.SetHealthCheck(health)
+	require.True(t, pool.isHealthy(target, time.Second))
+
+	// The port is open but the service does not respond as expected
+	health.Expect = "PANG"
+	require.False(t, pool.isHealthy(target, time.Second))
+	health.Send = "HELLO\r\n"
+	health.Expect = "PONG"
+	require.False(t, pool.isHealthy(target, 100*time.Millisecond))
+
+	ln.Close()
+	health.Send = "PING\r\n"
+	require.False(t, pool.isHealthy(target, time.Second))
+}
@@ -0,0 +1,70 @@
+package networks
+
+import (
+	"net"
+	"sync"
+)
+
+// connLimiter limits the number of open connections per source IP. A maximum
+// of zero or less means no limit.
+type connLimiter struct {
+	Counts map[string]int // Open connections by source IP
+	Lock   sync.Mutex     // Guards the counts
+	Max    int            // Maximum open connections per source IP
+}
+
+// Acquire counts a new connection from the given IP and returns true, unless
+// the IP is already at the limit.
+func (l *connLimiter) Acquire(ip string) bool {
+	l.Lock.Lock()
+	defer l.Lock.Unlock()
+	if l.Max <= 0 {
+		return true
+	}
+	if l.Counts[ip] >= l.Max {
+		return false
+	}
+	if l.Counts == nil {
+		l.Counts = make(map[string]int)
+	}
+	l.Counts[ip]++
+	return true
+}
+
+// Release uncounts a closed connection from the given IP.
+func (l *connLimiter) Release(ip string) {
+	l.Lock.Lock()
+	defer l.Lock.Unlock()
+	if n, ok := l.Counts[ip]; ok {
+		if n <= 1 {
+			delete(l.Counts, ip)
+		} else {
+			l.Counts[ip] = n - 1
+		}
+	}
+}
+
+// limitedConn is a connection that calls its release function once when it is
+// closed; E.g. to uncount it from a limit.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+// Close closes the connection and releases it.
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// connIp returns the source IP of the given connection, or its remote address
+// if it has no port.
+func connIp(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,129 @@
+package networks
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+// newEchoServer returns a TCP listener that echoes its connections until they
+// are closed.
+func newEchoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}(conn)
+		}
+	}()
+	return ln
+}
+
+// echo writes the given message to the connection and returns the echoed
+// response.
+func echo(conn net.Conn, msg string) (string, error) {
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return "", err
+	}
+	b := make([]byte, len(msg))
+	_, err := io.ReadFull(conn, b)
+	return string(b), err
+}
+
+func TestConnLimiter(t *testing.T) {
+	l := &connLimiter{}
+	for i := 0; i < 3; i++ {
+		require.True(t, l.Acquire("10.0.0.1"))
+	}
+	l.Max = 2
+	l.Counts = nil
+	require.True(t, l.Acquire("10.0.0.1"))
+	require.True(t, l.Acquire("10.0.0.1"))
+	require.False(t, l.Acquire("10.0.0.1"))
+	require.True(t, l.Acquire("10.0.0.2"))
+	l.Release("10.0.0.1")
+	require.True(t, l.Acquire("10.0.0.1"))
+	l.Release("10.0.0.2")
+	_, ok := l.Counts["10.0.0.2"]
+	require.False(t, ok)
+}
+
+func TestNetworkPoolMaxConnsPerIp(t *testing.T) {
+	backend := newEchoServer(t)
+	defer backend.Close()
+	addr := backend.Addr().(*net.TCPAddr)
+	pool := &networkPool{}
+	pool.SetMaxConnsPerIp(1)
+	require.Nil(t, pool.AddTarget(
+		targets.NewTarget("127.0.0.1", addr.Port, "tcp"), time.Second))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	laddr := ln.Addr().String()
+	require.Nil(t, ln.Close())
+	stop, err := pool.LoadBalancer(laddr, "tcp")
+	require.Nil(t, err)
+	defer stop()
+
+	c1, err := net.Dial("tcp", laddr)
+	require.Nil(t, err)
+	resp, err := echo(c1, "one")
+	require.Nil(t, err)
+	require.Equal(t, "one", resp)
+
+	// The IP is at its limit, so the connection is closed
+	c2, err := net.Dial("tcp", laddr)
+	require.Nil(t, err)
+	defer c2.Close()
+	_, err = echo(c2, "two")
+	require.NotNil(t, err)
+
+	// Closing a connection releases it
+	c1.Close()
+	require.Eventually(t, func() bool {
+		pool.IpConns.Lock.Lock()
+		defer pool.IpConns.Lock.Unlock()
+		return len(pool.IpConns.Counts) == 0
+	}, time.Second, 10*time.Millisecond)
+	c3, err := net.Dial("tcp", laddr)
+	require.Nil(t, err)
+	defer c3.Close()
+	resp, err = echo(c3, "three")
+	require.Nil(t, err)
+	require.Equal(t, "three", resp)
+}
+
+func TestNetworkPoolMaxConns(t *testing.T) {
+	pool := &networkPool{}
+	pool.SetMaxConns(2)
+	require.True(t, pool.acquireConn())
+	require.True(t, pool.acquireConn())
+	require.False(t, pool.acquireConn())
+	require.Equal(t, int32(2), pool.Conns)
+	require.Equal(t, int32(1), pool.ConnsCapped)
+	pool.releaseConn()
+	require.Equal(t, int32(0), pool.ConnsCapped)
+	require.True(t, pool.acquireConn())
+
+	// Connections over the limit are closed immediately
+	client, server := net.Pipe()
+	defer client.Close()
+	pool.HandleConnection(context.Background(), server)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := client.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, int32(2), pool.Conns)
+}
@@ -3,14 +3,14 @@ package networks
 import (
 	"context"
 	"errors"
-	"fmt"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/crossedbot/common/golang/logger"
-
+	"github.com/crossedbot/simpleloadbalancer/pkg/logging"
 	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
 )
 
@@ -18,13 +18,20 @@ const (
 	// Target constants
 	TargetMaxAttempts   = 3
 	TargetMaxRetries    = 3
-	TargetRetryInterval = 100 * time.Millisecond
+	TargetRetryInterval = targets.DefaultBackoffBase // First retry delay
 
 	// Context keys
 	TargetContextAttemptKey = iota + 1
 	TargetContextRetryKey
 )
 
+// TargetHealthCheckWorkers is the maximum number of targets probed at once by a
+// health check.
+const TargetHealthCheckWorkers = 16
+
+// log is the logger of the networks package.
+var log = logging.New("networks")
+
 var (
 	// Errors
 	ErrUnsupportedProtocol = errors.New("Protocol not supported")
@@ -47,72 +54,202 @@ type networkTarget struct {
 // UDP, etc.
 type NetworkPool interface {
 	// AddTarget adds a given target to the pool and sets the connection
-	// timeout.
+	// timeout, unless the target sets its own dial timeout.
 	AddTarget(target targets.Target, to time.Duration) error
 
+	// Alive returns the number of alive targets in the pool.
+	Alive() int
+
+	// AliveTargets returns the pool's alive targets.
+	AliveTargets() []targets.Target
+
+	// CheckHealth probes the pool's targets once with the given timeout
+	// and returns once every target is probed.
+	CheckHealth(timeout time.Duration)
+
 	// HandleConnection acts like http.ServeHTTP and handles new connections
-	// accepted by a listener.
-	HandleConnection(conn net.Conn)
+	// accepted by a listener. The connection is relayed until it ends or the
+	// given context is done.
+	HandleConnection(ctx context.Context, conn net.Conn)
 
-	// HealthCheck starts a service health check routine and returns a stop
-	// function that can be called to exit this routine.
-	HealthCheck(interval time.Duration) StopFn
+	// HealthCheck starts a service health check routine that probes the
+	// targets at the given interval with the given timeout; skipping a tick
+	// if the previous probes are still running. It returns a stop function
+	// that can be called to exit this routine.
+	HealthCheck(interval, timeout time.Duration) StopFn
 
 	// LoadBalancer starts a listener on the given local address and network
 	// protocol and forwards any connections to the backend targets. It uses
-	// a Round Robin routing strategy and returns a stop function to stop
+	// the pool's routing strategy and returns a stop function to stop
 	// the listener routine.
 	LoadBalancer(laddr, network string) (StopFn, error)
+
+	// SetAlive marks the pool's targets of the given URL alive or dead
+	// until their next health check; E.g. to put a recovered backend back
+	// into rotation at once. Returns false if no target has the URL.
+	SetAlive(targetURL string, alive bool) bool
+
+	// SetHealthChange sets the function called when a health check finds
+	// a target's alive state changed. It must be set before the health
+	// check is started.
+	SetHealthChange(fn targets.HealthChangeFn)
+
+	// SetHealthCheck sets the send/expect health check of the pool's
+	// targets. Without one, targets are only checked for accepting
+	// connections.
+	SetHealthCheck(c *targets.HealthCheckConfig)
+
+	// SetHealthCheckRetries sets the number of times a failed probe of a
+	// target is retried within a health check before the target is deemed
+	// unreachable. Negative values are ignored.
+	SetHealthCheckRetries(n int)
+
+	// SetIdleTimeout sets how long relayed connections of new targets may
+	// go without data before they are closed, unless a target sets its own
+	// idle timeout. Zero disables it.
+	SetIdleTimeout(d time.Duration)
+
+	// SetMaxConns sets the maximum number of open connections across all
+	// clients; new connections are closed immediately while the pool is at
+	// the limit. Zero means no limit.
+	SetMaxConns(n int)
+
+	// SetMaxConnsPerIp sets the maximum number of open connections per
+	// source IP; new connections from an IP at the limit are closed
+	// immediately. Zero means no limit.
+	SetMaxConnsPerIp(n int)
+
+	// SetRetryBackoff sets the backoff between the retries of a failed
+	// target; the delays grow exponentially with jitter, so retries of
+	// concurrent connections do not synchronize under backend stress.
+	SetRetryBackoff(b targets.Backoff)
+
+	// SetStrategy sets the strategy used to pick the target of each new
+	// connection; E.g. IP hash to pin clients to a target, or weighted
+	// random to pick targets in proportion to their weights. Unknown
+	// strategies, and strategies of application pools, are ignored.
+	SetStrategy(s targets.Strategy)
+
+	// SetTargets replaces the pool's targets with the given targets and
+	// sets the connection timeout of new targets that do not set their
+	// own. Targets already in the pool are kept, along with their health
+	// and timeouts; only their name, weight, backup and health port
+	// attributes are updated.
+	SetTargets(ts []targets.Target, to time.Duration) error
 }
 
 // networkPool implements the NetworkPool service and tracks the backend targets
 // and the index of the current targeted service.
 type networkPool struct {
-	Index   uint64
-	Targets []*networkTarget
+	Conns         int32                      // Open connections
+	ConnsCapped   int32                      // Set while at the connection limit
+	MaxConns      int32                      // Maximum open connections
+	Health        *targets.HealthCheckConfig // Send/expect health check
+	HealthChange  targets.HealthChangeFn     // Health transition callback
+	HealthRetries int                        // Failed probe retries
+	IdleTimeout   time.Duration              // Relay idle timeout
+	Current       uint64                     // Last picked target index
+	Index         uint64                     // Next round robin turn
+	IpConns       connLimiter                // Open connections per source IP
+	Lock          sync.RWMutex
+	RetryBackoff  targets.Backoff  // Backoff between retries
+	Strategy      targets.Strategy // Balancing strategy
+	Targets       []*networkTarget
+	Version       uint64                // State version; see stateChanged
+	Weighted      targets.WeightedCache // Weighted random tables
 }
 
 // New returns a new NetworkPool.
 func New() NetworkPool {
-	return &networkPool{}
+	return &networkPool{
+		RetryBackoff: targets.DefaultBackoff,
+		Strategy:     targets.DefaultStrategy,
+	}
 }
 
 func (pool *networkPool) AddTarget(target targets.Target, to time.Duration) error {
+	nt, err := pool.newTarget(target, to)
+	if err != nil {
+		return err
+	}
+	pool.Lock.Lock()
+	pool.Targets = append(pool.Targets, nt)
+	pool.Lock.Unlock()
+	return nil
+}
+
+func (pool *networkPool) Alive() int {
+	alive := 0
+	for _, t := range pool.targets() {
+		if t.Target.IsAlive() {
+			alive++
+		}
+	}
+	return alive
+}
+
+func (pool *networkPool) AliveTargets() []targets.Target {
+	alive := []targets.Target{}
+	for _, t := range pool.targets() {
+		if t.Target.IsAlive() {
+			alive = append(alive, t.Target)
+		}
+	}
+	return alive
+}
+
+func (pool *networkPool) CheckHealth(timeout time.Duration) {
+	pool.checkTargets(timeout)
+}
+
+// newTarget returns a new network target that proxies connections to the given
+// target with the given connection timeout and the pool's idle timeout; either
+// is overridden by the target's own.
+func (pool *networkPool) newTarget(target targets.Target, to time.Duration) (*networkTarget, error) {
 	proto := getTargetProtocol(target)
 	if proto == "" {
-		return ErrUnsupportedProtocol
+		return nil, ErrUnsupportedProtocol
 	}
-	host := target.Get("host")
+	host := target.Host()
 	if host == "" {
-		return ErrTargetMissingHost
+		return nil, ErrTargetMissingHost
+	}
+	port := target.Port()
+	if port <= 0 {
+		return nil, ErrTargetMissingPort
 	}
-	port := target.Get("port")
-	if port == "" {
-		return ErrTargetMissingPort
+	hostPort := net.JoinHostPort(host, strconv.Itoa(port))
+	if d := target.DialTimeout(); d > 0 {
+		to = d
+	}
+	idle := pool.IdleTimeout
+	if d := target.IdleTimeout(); d > 0 {
+		idle = d
 	}
-	hostPort := net.JoinHostPort(host, port)
 	rproxy := NewReverseNetworkProxy(proto, hostPort, to)
+	rproxy.SetIdleTimeout(idle)
 	rproxy.SetErrorHandler(
 		func(ctx context.Context, conn net.Conn, err error) {
-			logger.Error(fmt.Sprintf("%s (%s)",
-				err, conn.RemoteAddr().String()))
+			log.Error("Failed to relay connection", logging.Fields{
+				"client":            conn.RemoteAddr().String(),
+				logging.FieldTarget: target.URL(),
+				logging.FieldError:  err,
+			})
 			alive := pool.RetryTarget(ctx, conn)
-			target.SetAlive(alive)
+			pool.setAlive(target, alive)
 			if !alive && !pool.AttemptNextTarget(ctx, conn) {
-				logger.Error(fmt.Sprintf("%s (%s)",
-					ErrExhaustedTargets.Error(),
-					conn.RemoteAddr().String()))
-				_, cancelCtx := context.WithCancel(ctx)
-				cancelCtx()
+				log.Error(ErrExhaustedTargets.Error(),
+					logging.Fields{
+						"client": conn.RemoteAddr().String(),
+					})
 				conn.Close()
 			}
 		},
 	)
-	pool.Targets = append(pool.Targets, &networkTarget{
+	return &networkTarget{
 		Target:       target,
 		NetworkProxy: rproxy,
-	})
-	return nil
+	}, nil
 }
 
 // AttemptNextTarget attempts the next target to fullfil the given connection
@@ -121,7 +258,7 @@ func (pool *networkPool) AddTarget(target targets.Target, to time.Duration) erro
 func (pool *networkPool) AttemptNextTarget(ctx context.Context, conn net.Conn) bool {
 	attempts := getAttemptsFromContext(ctx)
 	if attempts < TargetMaxAttempts {
-		target := pool.NextTarget()
+		target := pool.nextTargetFor(conn)
 		if target == nil {
 			return false
 		}
@@ -133,36 +270,92 @@ func (pool *networkPool) AttemptNextTarget(ctx context.Context, conn net.Conn) b
 	return false
 }
 
-// CurrentTarget returns the target at the pool's current index.
+// CurrentTarget returns the target last picked by the pool.
 func (pool *networkPool) CurrentTarget() *networkTarget {
-	idx := int(pool.Index) % len(pool.Targets)
-	return pool.Targets[idx]
+	ts := pool.targets()
+	if len(ts) == 0 {
+		return nil
+	}
+	idx := int(atomic.LoadUint64(&pool.Current) % uint64(len(ts)))
+	return ts[idx]
 }
 
-func (pool *networkPool) HandleConnection(conn net.Conn) {
-	ctx := context.Background()
+func (pool *networkPool) HandleConnection(ctx context.Context, conn net.Conn) {
+	if !pool.acquireConn() {
+		conn.Close()
+		return
+	}
+	ip := connIp(conn)
+	if !pool.IpConns.Acquire(ip) {
+		pool.releaseConn()
+		conn.Close()
+		return
+	}
+	conn = &limitedConn{
+		Conn: conn,
+		release: func() {
+			pool.IpConns.Release(ip)
+			pool.releaseConn()
+		},
+	}
 	if !pool.AttemptNextTarget(ctx, conn) {
 		conn.Close()
 	}
 }
 
-func (pool *networkPool) HealthCheck(interval time.Duration) StopFn {
+// acquireConn counts a new connection and returns true, unless the pool is at
+// its connection limit. Reaching the limit is logged once until the pool drops
+// below it again.
+func (pool *networkPool) acquireConn() bool {
+	max := atomic.LoadInt32(&pool.MaxConns)
+	n := atomic.AddInt32(&pool.Conns, 1)
+	if max > 0 && n > max {
+		atomic.AddInt32(&pool.Conns, -1)
+		if atomic.CompareAndSwapInt32(&pool.ConnsCapped, 0, 1) {
+			log.Warning("Connection limit reached",
+				logging.Fields{"max_connections": max})
+		}
+		return false
+	}
+	return true
+}
+
+// releaseConn uncounts a closed connection.
+func (pool *networkPool) releaseConn() {
+	n := atomic.AddInt32(&pool.Conns, -1)
+	if n < atomic.LoadInt32(&pool.MaxConns) {
+		atomic.StoreInt32(&pool.ConnsCapped, 0)
+	}
+}
+
+func (pool *networkPool) HealthCheck(interval, timeout time.Duration) StopFn {
 	quit := make(chan struct{})
 	stopped := make(chan struct{})
+	done := make(chan struct{})
 	t := time.NewTicker(interval)
 	go func() {
 		defer close(stopped)
+		checking := false
 		for {
 			select {
 			case <-quit:
 				t.Stop()
+				if checking {
+					<-done
+				}
 				return
+			case <-done:
+				checking = false
 			case <-t.C:
-				for _, target := range pool.Targets {
-					alive := target.Target.IsAvailable(
-						3 * time.Second)
-					target.Target.SetAlive(alive)
+				if checking {
+					// The previous probes are still running
+					continue
 				}
+				checking = true
+				go func() {
+					pool.checkTargets(timeout)
+					done <- struct{}{}
+				}()
 			}
 		}
 	}()
@@ -179,6 +372,8 @@ func (pool *networkPool) LoadBalancer(laddr, network string) (StopFn, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Relayed connections are closed once the load balancer is stopped
+	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		defer close(stopped)
 		for {
@@ -191,11 +386,14 @@ func (pool *networkPool) LoadBalancer(laddr, network string) (StopFn, error) {
 					if !isErrNetClosed(err) {
 						// Only log the error if it is
 						// unexpected
-						logger.Error(err)
+						log.Error("Failed to accept connection",
+							logging.Fields{
+								logging.FieldError: err,
+							})
 					}
 					continue
 				}
-				go pool.HandleConnection(conn)
+				go pool.HandleConnection(ctx, conn)
 			}
 		}
 	}()
@@ -203,39 +401,235 @@ func (pool *networkPool) LoadBalancer(laddr, network string) (StopFn, error) {
 		close(quit)
 		listener.Close()
 		<-stopped
+		cancel()
 	}, nil
 }
 
-// NextIndex returns the next index for the pool; setting what is returned as
-// the current index in the process.
+// NextIndex returns the index of the pool's next round robin turn, and advances
+// the pool past it; starting from the first target.
 func (pool *networkPool) NextIndex() int {
-	return int(atomic.AddUint64(&pool.Index, uint64(1)) %
-		uint64(len(pool.Targets)))
+	n := len(pool.targets())
+	if n == 0 {
+		return 0
+	}
+	return int((atomic.AddUint64(&pool.Index, 1) - 1) % uint64(n))
+}
+
+// HashTarget returns the target that the given source IP hashes to, so a client
+// keeps connecting to the same target while the pool's targets are unchanged.
+// If the target is down or draining, the next available target is returned;
+// backup targets are only returned if no primary target is available.
+func (pool *networkPool) HashTarget(ip string) *networkTarget {
+	ts := pool.targets()
+	if len(ts) == 0 {
+		return nil
+	}
+	start := targets.HashIndex(ip, len(ts))
+	for _, backup := range []bool{false, true} {
+		for i := start; i < start+len(ts); i++ {
+			t := ts[i%len(ts)]
+			if available(t.Target, backup) {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// available returns true if the given target may be given new connections; it
+// is alive, not draining, and a backup only if backups are being picked.
+func available(t targets.Target, backup bool) bool {
+	return t.IsAlive() && !t.IsDraining() && t.IsBackup() == backup
+}
+
+// nextTargetFor returns the target for the given connection by the pool's
+// strategy.
+func (pool *networkPool) nextTargetFor(conn net.Conn) *networkTarget {
+	switch pool.Strategy {
+	case targets.StrategyIpHash:
+		return pool.HashTarget(connIp(conn))
+	case targets.StrategyWeightedRandom:
+		return pool.RandomTarget()
+	}
+	return pool.NextTarget()
+}
+
+// RandomTarget returns a network target that is alive and not draining, picked
+// at random by weight, and sets it as the current target. Backup targets are
+// only picked if no primary target is available. The pool's weight tables are
+// only rebuilt once its state version changes; a stale pick, or none, falls back
+// to weighing the targets again.
+func (pool *networkPool) RandomTarget() *networkTarget {
+	version := atomic.LoadUint64(&pool.Version)
+	ts := pool.targets()
+	weight := func(i int, backup bool) int {
+		if available(ts[i].Target, backup) {
+			return ts[i].Target.Weight()
+		}
+		return 0
+	}
+	for _, backup := range []bool{false, true} {
+		idx := pool.Weighted.Index(version, len(ts), backup, weight)
+		if idx < 0 || !available(ts[idx].Target, backup) {
+			weights := make([]int, len(ts))
+			for i := range ts {
+				weights[i] = weight(i, backup)
+			}
+			idx = targets.WeightedIndex(weights)
+		}
+		if idx >= 0 {
+			atomic.StoreUint64(&pool.Current, uint64(idx))
+			return ts[idx]
+		}
+	}
+	return nil
 }
 
 // NextTarget returns the next network target and sets it as the current target.
+// Backup targets are only picked if no primary target is available.
 func (pool *networkPool) NextTarget() *networkTarget {
-	next := pool.NextIndex()
-	cycle := len(pool.Targets) + next
-	for i := next; i < cycle; i++ {
-		idx := i % len(pool.Targets)
-		if pool.Targets[idx].Target.IsAlive() {
-			if i != next {
-				atomic.StoreUint64(&pool.Index, uint64(idx))
-			}
-			return pool.Targets[idx]
+	ts := pool.targets()
+	if len(ts) == 0 {
+		return nil
+	}
+	for _, backup := range []bool{false, true} {
+		idx := targets.RoundRobinIndex(&pool.Index, len(ts),
+			func(i int) bool {
+				return available(ts[i].Target, backup)
+			})
+		if idx >= 0 {
+			atomic.StoreUint64(&pool.Current, uint64(idx))
+			return ts[idx]
 		}
 	}
 	return nil
 }
 
+func (pool *networkPool) SetAlive(targetURL string, alive bool) bool {
+	found := false
+	for _, nt := range pool.targets() {
+		if nt.Target.URL() != targetURL {
+			continue
+		}
+		found = true
+		wasAlive := pool.setAlive(nt.Target, alive)
+		if alive != wasAlive && pool.HealthChange != nil {
+			pool.HealthChange(nt.Target, wasAlive, alive)
+		}
+	}
+	return found
+}
+
+func (pool *networkPool) SetHealthChange(fn targets.HealthChangeFn) {
+	pool.HealthChange = fn
+}
+
+func (pool *networkPool) SetHealthCheck(c *targets.HealthCheckConfig) {
+	pool.Health = c
+}
+
+func (pool *networkPool) SetHealthCheckRetries(n int) {
+	if n >= 0 {
+		pool.HealthRetries = n
+	}
+}
+
+func (pool *networkPool) SetIdleTimeout(d time.Duration) {
+	pool.IdleTimeout = d
+}
+
+func (pool *networkPool) SetMaxConns(n int) {
+	atomic.StoreInt32(&pool.MaxConns, int32(n))
+}
+
+func (pool *networkPool) SetMaxConnsPerIp(n int) {
+	pool.IpConns.Lock.Lock()
+	pool.IpConns.Max = n
+	pool.IpConns.Lock.Unlock()
+}
+
+func (pool *networkPool) SetRetryBackoff(b targets.Backoff) {
+	pool.Lock.Lock()
+	pool.RetryBackoff = b
+	pool.Lock.Unlock()
+}
+
+// retryBackoff returns the pool's backoff between retries; it may be set while
+// connections are retried.
+func (pool *networkPool) retryBackoff() targets.Backoff {
+	pool.Lock.RLock()
+	defer pool.Lock.RUnlock()
+	return pool.RetryBackoff
+}
+
+func (pool *networkPool) SetStrategy(s targets.Strategy) {
+	switch s {
+	case targets.StrategyRoundRobin, targets.StrategyIpHash,
+		targets.StrategyWeightedRandom:
+		pool.Strategy = s
+	}
+}
+
+func (pool *networkPool) SetTargets(ts []targets.Target, to time.Duration) error {
+	current := make(map[string]*networkTarget)
+	for _, nt := range pool.targets() {
+		current[nt.Target.URL()] = nt
+	}
+	nts := make([]*networkTarget, 0, len(ts))
+	for _, t := range ts {
+		if nt, ok := current[t.URL()]; ok {
+			nt.Target.SetName(t.Name())
+			nt.Target.SetWeight(t.Weight())
+			nt.Target.SetBackup(t.IsBackup())
+			nt.Target.SetHealthPort(t.HealthPort())
+			nts = append(nts, nt)
+			continue
+		}
+		nt, err := pool.newTarget(t, to)
+		if err != nil {
+			return err
+		}
+		nts = append(nts, nt)
+	}
+	pool.Lock.Lock()
+	pool.Targets = nts
+	pool.Lock.Unlock()
+	pool.stateChanged()
+	return nil
+}
+
+// setAlive sets whether the given target of the pool is alive, and returns
+// whether it was alive before. A change bumps the pool's state version.
+func (pool *networkPool) setAlive(t targets.Target, alive bool) bool {
+	wasAlive := t.IsAlive()
+	t.SetAlive(alive)
+	if alive != wasAlive {
+		pool.stateChanged()
+	}
+	return wasAlive
+}
+
+// stateChanged records a change to the state of the pool's targets that
+// decides their weighted picks; its list of targets or their health.
+func (pool *networkPool) stateChanged() {
+	atomic.AddUint64(&pool.Version, 1)
+}
+
+// targets returns the pool's current list of targets. The list is replaced
+// rather than modified by SetTargets, so it is safe to range over.
+func (pool *networkPool) targets() []*networkTarget {
+	pool.Lock.RLock()
+	defer pool.Lock.RUnlock()
+	return pool.Targets
+}
+
 // RetryTarget retries the current network target TargetMaxRetries number of
-// times. If the target was retried, true is returned. Otherwise, false is
-// returned indicating that the max retries has been reached or the current
-// target is not set.
+// times, after the pool's backoff delay. If the target was retried, true is
+// returned. Otherwise, false is returned indicating that the max retries has
+// been reached or the current target is not set.
 func (pool *networkPool) RetryTarget(ctx context.Context, conn net.Conn) bool {
 	retries := getRetriesFromContext(ctx)
-	after := time.After(TargetRetryInterval)
+	after := time.After(pool.retryBackoff().Delay(retries))
 	for retries < TargetMaxRetries {
 		select {
 		case <-after:
@@ -276,7 +670,7 @@ func getRetriesFromContext(ctx context.Context) int {
 // protocol can not be matched, an empty string is returned instead.
 func getTargetProtocol(target targets.Target) string {
 	proto := ""
-	targetProto := target.Get("protocol")
+	targetProto := target.Protocol()
 	for _, v := range []string{"tcp", "udp"} {
 		if strings.EqualFold(targetProto, v) {
 			proto = targetProto
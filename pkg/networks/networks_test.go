@@ -3,11 +3,13 @@ package networks
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
 	"testing"
 	"time"
 
@@ -66,6 +68,24 @@ func TestNetworkPoolAddTarget(t *testing.T) {
 	require.Equal(t, target.Summary(), tgt.Target.Summary())
 }
 
+func TestNetworkPoolAddTargetTimeouts(t *testing.T) {
+	pool := &networkPool{IdleTimeout: time.Minute}
+	pool.AddTarget(targets.NewTarget("127.0.0.1", 8080, "tcp"), time.Second)
+	slow := targets.NewTarget("127.0.0.1", 8081, "tcp")
+	slow.SetDialTimeout(10 * time.Second)
+	slow.SetIdleTimeout(time.Hour)
+	pool.AddTarget(slow, time.Second)
+	require.Equal(t, 2, len(pool.Targets))
+
+	// The pool's timeouts, unless the target overrides them
+	rproxy := pool.Targets[0].NetworkProxy.(*reverseNetworkProxy)
+	require.Equal(t, time.Second, rproxy.DialTimeout)
+	require.Equal(t, time.Minute, rproxy.IdleTimeout)
+	rproxy = pool.Targets[1].NetworkProxy.(*reverseNetworkProxy)
+	require.Equal(t, 10*time.Second, rproxy.DialTimeout)
+	require.Equal(t, time.Hour, rproxy.IdleTimeout)
+}
+
 func TestNetworkPoolCurrentTarget(t *testing.T) {
 	pool := &networkPool{}
 	target := targets.NewTarget("127.0.0.1", 8080, "tcp")
@@ -95,7 +115,7 @@ func TestNetworkPoolHealthCheck(t *testing.T) {
 	tgt := pool.CurrentTarget()
 	require.NotNil(t, tgt)
 	interval := 100 * time.Millisecond
-	stopHealthCheck := pool.HealthCheck(interval)
+	stopHealthCheck := pool.HealthCheck(interval, time.Second)
 	defer stopHealthCheck()
 
 	time.Sleep(interval)
@@ -139,15 +159,43 @@ func TestNetworkPoolLoadBalancer(t *testing.T) {
 	require.Equal(t, body, string(respBody))
 }
 
+func TestNetworkPoolLoadBalancerStop(t *testing.T) {
+	backend := newEchoServer(t)
+	defer backend.Close()
+	addr := backend.Addr().(*net.TCPAddr)
+	pool := &networkPool{}
+	require.Nil(t, pool.AddTarget(
+		targets.NewTarget("127.0.0.1", addr.Port, "tcp"), time.Second))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	laddr := l.Addr().String()
+	require.Nil(t, l.Close())
+	stopLb, err := pool.LoadBalancer(laddr, "tcp")
+	require.Nil(t, err)
+
+	conn, err := net.Dial("tcp", laddr)
+	require.Nil(t, err)
+	defer conn.Close()
+	resp, err := echo(conn, "hello")
+	require.Nil(t, err)
+	require.Equal(t, "hello", resp)
+
+	// Stopping the load balancer closes the open relay
+	stopLb()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+}
+
 func TestNetworkPoolNextIndex(t *testing.T) {
 	pool := &networkPool{}
 	target1 := targets.NewTarget("127.0.0.1", 8080, "tcp")
 	target2 := targets.NewTarget("127.0.0.1", 8081, "tcp")
 	pool.AddTarget(target1, 0)
 	pool.AddTarget(target2, 0)
-	expected := 1
-	actual := pool.NextIndex()
-	require.Equal(t, expected, actual)
+	require.Equal(t, 0, pool.NextIndex())
+	require.Equal(t, 1, pool.NextIndex())
+	require.Equal(t, 0, pool.NextIndex())
 }
 
 func TestNetworkPoolNextTarget(t *testing.T) {
@@ -158,9 +206,232 @@ func TestNetworkPoolNextTarget(t *testing.T) {
 	pool.AddTarget(target2, 0)
 	actual := pool.NextTarget()
 	require.NotNil(t, actual)
+	require.Equal(t, target1.Summary(), actual.Target.Summary())
+	require.Equal(t, actual, pool.CurrentTarget())
+	actual = pool.NextTarget()
+	require.NotNil(t, actual)
+	require.Equal(t, target2.Summary(), actual.Target.Summary())
+	require.Equal(t, actual, pool.CurrentTarget())
+
+	// Draining targets are skipped
+	target1.SetDraining(true)
+	actual = pool.NextTarget()
+	require.NotNil(t, actual)
 	require.Equal(t, target2.Summary(), actual.Target.Summary())
 }
 
+func TestNetworkPoolNextTargetConcurrent(t *testing.T) {
+	pool := &networkPool{}
+	ts := []targets.Target{}
+	for port := 8080; port < 8084; port++ {
+		target := targets.NewTarget("127.0.0.1", port, "tcp")
+		require.Nil(t, pool.AddTarget(target, 0))
+		ts = append(ts, target)
+	}
+	pick := func(workers, picks int) map[int]int {
+		var lock sync.Mutex
+		var wg sync.WaitGroup
+		counts := map[int]int{}
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < picks; j++ {
+					port := 0
+					if nt := pool.NextTarget(); nt != nil {
+						port = nt.Target.Port()
+					}
+					lock.Lock()
+					counts[port]++
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		return counts
+	}
+
+	// Every concurrent pick is a different turn
+	counts := pick(50, 200)
+	for _, target := range ts {
+		require.Equal(t, 2500, counts[target.Port()])
+	}
+
+	// A pick that skips a dead target takes the turns it skipped; so the
+	// available targets still share the picks evenly
+	ts[1].SetAlive(false)
+	counts = pick(50, 300)
+	require.Equal(t, 0, counts[8081])
+	for _, port := range []int{8080, 8082, 8083} {
+		require.Equal(t, 5000, counts[port])
+	}
+}
+
+func TestNetworkPoolHashTarget(t *testing.T) {
+	pool := &networkPool{}
+	require.Nil(t, pool.HashTarget("10.0.0.1"))
+	for port := 8080; port < 8083; port++ {
+		target := targets.NewTarget("127.0.0.1", port, "tcp")
+		require.Nil(t, pool.AddTarget(target, time.Second))
+	}
+
+	// The same client IP keeps getting the same target
+	first := pool.HashTarget("10.0.0.1")
+	require.NotNil(t, first)
+	for i := 0; i < 5; i++ {
+		require.Equal(t, first, pool.HashTarget("10.0.0.1"))
+	}
+
+	// Unless the target is down
+	first.Target.SetAlive(false)
+	next := pool.HashTarget("10.0.0.1")
+	require.NotNil(t, next)
+	require.NotEqual(t, first, next)
+
+	pool.SetStrategy(targets.StrategyIpHash)
+	require.Equal(t, targets.StrategyIpHash, pool.Strategy)
+	pool.SetStrategy(targets.StrategyUnknown)
+	require.Equal(t, targets.StrategyIpHash, pool.Strategy)
+}
+
+func TestNetworkPoolRandomTarget(t *testing.T) {
+	pool := &networkPool{}
+	require.Nil(t, pool.RandomTarget())
+	target1 := targets.NewTarget("127.0.0.1", 8080, "tcp")
+	target2 := targets.NewTarget("127.0.0.1", 8081, "tcp")
+	target2.SetWeight(3)
+	pool.AddTarget(target1, 0)
+	pool.AddTarget(target2, 0)
+	seen := map[int]int{}
+	for i := 0; i < 100; i++ {
+		actual := pool.RandomTarget()
+		require.NotNil(t, actual)
+		seen[actual.Target.Port()]++
+	}
+	require.Greater(t, seen[8081], seen[8080])
+
+	// Draining targets are skipped
+	target2.SetDraining(true)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, target1.Summary(),
+			pool.RandomTarget().Target.Summary())
+	}
+}
+
+func TestNetworkPoolBackupTarget(t *testing.T) {
+	newServer := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, "%s", body)
+			}))
+	}
+	primary := newServer("primary")
+	defer primary.Close()
+	backup := newServer("backup")
+	defer backup.Close()
+
+	pool := &networkPool{}
+	for _, ts := range []*httptest.Server{backup, primary} {
+		targetUrl, err := url.Parse(ts.URL)
+		require.Nil(t, err)
+		target := targets.NewServiceTarget(targetUrl)
+		target.SetBackup(ts == backup)
+		require.Nil(t, pool.AddTarget(target, time.Second))
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	laddr := l.Addr().String()
+	require.Nil(t, l.Close())
+	stopLb, err := pool.LoadBalancer(laddr, "tcp")
+	require.Nil(t, err)
+	defer stopLb()
+
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	get := func() string {
+		resp, err := client.Get("http://" + laddr)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return string(body)
+	}
+
+	// The backup is only used once the primaries are exhausted
+	for i := 0; i < 3; i++ {
+		require.Equal(t, "primary", get())
+	}
+	primaryTarget := pool.Targets[1].Target
+	primaryTarget.SetDraining(true)
+	require.Equal(t, "backup", get())
+	primaryTarget.SetDraining(false)
+	primaryTarget.SetAlive(false)
+	require.Equal(t, "backup", get())
+	require.Equal(t, pool.Targets[0], pool.HashTarget("10.0.0.1"))
+	require.Equal(t, pool.Targets[0], pool.RandomTarget())
+	primaryTarget.SetAlive(true)
+	require.Equal(t, "primary", get())
+	require.Equal(t, pool.Targets[1], pool.HashTarget("10.0.0.1"))
+	require.Equal(t, pool.Targets[1], pool.RandomTarget())
+}
+
+func TestNetworkPoolSetTargets(t *testing.T) {
+	pool := &networkPool{}
+	target1 := targets.NewTarget("127.0.0.1", 8080, "tcp")
+	target2 := targets.NewTarget("127.0.0.1", 8081, "tcp")
+	require.Nil(t, pool.AddTarget(target1, 0))
+	target1.SetAlive(false)
+
+	// Existing targets are kept along with their health
+	update := targets.NewTarget("127.0.0.1", 8080, "tcp")
+	require.Nil(t, pool.SetTargets([]targets.Target{update, target2}, 0))
+	require.Len(t, pool.Targets, 2)
+	require.Equal(t, target1, pool.Targets[0].Target)
+	require.False(t, pool.Targets[0].Target.IsAlive())
+	require.Equal(t, target2, pool.Targets[1].Target)
+
+	require.Nil(t, pool.SetTargets(nil, 0))
+	require.Nil(t, pool.NextTarget())
+	require.Nil(t, pool.CurrentTarget())
+}
+
+func TestNetworkPoolSetAlive(t *testing.T) {
+	pool := &networkPool{}
+	target := targets.NewTarget("127.0.0.1", 8080, "tcp")
+	require.Nil(t, pool.AddTarget(target, 0))
+	changes := 0
+	pool.SetHealthChange(func(t targets.Target, wasAlive, alive bool) {
+		changes++
+	})
+	require.True(t, pool.SetAlive(target.URL(), false))
+	require.False(t, target.IsAlive())
+	require.True(t, pool.SetAlive(target.URL(), false))
+	require.Equal(t, 1, changes)
+	require.True(t, pool.SetAlive(target.URL(), true))
+	require.True(t, target.IsAlive())
+	require.Equal(t, 2, changes)
+	require.False(t, pool.SetAlive("tcp://127.0.0.1:9090", true))
+}
+
+func TestNetworkPoolStateVersion(t *testing.T) {
+	pool := &networkPool{}
+	other := &networkPool{}
+	target := targets.NewTarget("127.0.0.1", 8080, "tcp")
+	require.Nil(t, pool.AddTarget(target, 0))
+	require.Nil(t, other.AddTarget(targets.NewTarget("127.0.0.1", 8081,
+		"tcp"), 0))
+
+	// Health changes and new targets only bump the version of their pool
+	require.True(t, pool.SetAlive(target.URL(), false))
+	require.Equal(t, uint64(1), pool.Version)
+	require.True(t, pool.SetAlive(target.URL(), false))
+	require.Equal(t, uint64(1), pool.Version)
+	require.Nil(t, pool.SetTargets([]targets.Target{target}, 0))
+	require.Equal(t, uint64(2), pool.Version)
+	require.Equal(t, uint64(0), other.Version)
+}
+
 func TestNetworkPoolAttemptNextTarget(t *testing.T) {
 	body := "{\"hello\": \"world\"}"
 	ts := httptest.NewServer(
@@ -218,7 +489,7 @@ func TestNetworkPoolHandleConnection(t *testing.T) {
 	defer l.Close()
 	go func() {
 		conn, _ := l.Accept()
-		pool.HandleConnection(conn)
+		pool.HandleConnection(context.Background(), conn)
 	}()
 
 	resp, err := http.Get("http://" + l.Addr().String())
@@ -230,6 +501,24 @@ func TestNetworkPoolHandleConnection(t *testing.T) {
 	require.Equal(t, body, string(respBody))
 }
 
+func TestNetworkPoolSetRetryBackoff(t *testing.T) {
+	pool := New().(*networkPool)
+	require.Equal(t, targets.DefaultBackoff, pool.retryBackoff())
+
+	// The backoff may be set while connections are retried
+	b := targets.Backoff{Base: time.Millisecond, Max: time.Second,
+		Multiplier: 2}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pool.SetRetryBackoff(b)
+	}()
+	pool.retryBackoff()
+	wg.Wait()
+	require.Equal(t, b, pool.retryBackoff())
+}
+
 func TestNetworkPoolRetryTarget(t *testing.T) {
 	body := "{\"hello\": \"world\"}"
 	ts := httptest.NewServer(
@@ -2,13 +2,12 @@ package networks
 
 import (
 	"context"
-	"fmt"
 	"io"
 	"net"
 	"os"
 	"time"
 
-	"github.com/crossedbot/common/golang/logger"
+	"github.com/crossedbot/simpleloadbalancer/pkg/logging"
 )
 
 // ErrorHandlerFunc is a prototype for network proxy error handler.
@@ -17,36 +16,46 @@ type ErrorHandlerFunc func(context.Context, net.Conn, error)
 // ReverseNetworkProxy represents an interface to a network-level reverse proxy
 // to forward TCP, UDP, etc. connections.
 type ReverseNetworkProxy interface {
-	// Proxy forwards the given connection to the targeted service.
+	// Proxy forwards the given connection to the targeted service. The
+	// relay ends, closing both connections, when either side closes or the
+	// given context is done.
 	Proxy(ctx context.Context, conn net.Conn)
 
 	// SetDebug sets the debugging attribute to print things like the
 	// forwarded/reversed packets during the lifetime of the connection.
 	SetDebug(v bool)
 
+	// SetDialTimeout sets the timeout of connecting to the target service.
+	SetDialTimeout(d time.Duration)
+
 	// SetErrorHandler sets the proxy's error handler. For example, when
 	// connecting to the target service fails, an error handler may be
 	// useful for retrying the connection.
 	SetErrorHandler(fn ErrorHandlerFunc)
+
+	// SetIdleTimeout sets how long a relay may go without data in either
+	// direction before its connections are closed. Zero disables it.
+	SetIdleTimeout(d time.Duration)
 }
 
 // reverseNetworkProxy implements the ReverseNetworkProxy and manages target and
 // connection related attributes.
 type reverseNetworkProxy struct {
 	HandleError ErrorHandlerFunc
+	DialTimeout time.Duration // Timeout of connecting to the target
+	IdleTimeout time.Duration // Relay idle timeout
 	Network     string
 	Target      string
-	Timeout     time.Duration
 	Debug       bool
 }
 
 // NewReverseNetworkProxy returns a new network proxy that targets the given
-// host (target) stirng for a given network protocol and connection timeout.
+// host (target) stirng for a given network protocol and dial timeout.
 func NewReverseNetworkProxy(network, target string, to time.Duration) ReverseNetworkProxy {
 	return &reverseNetworkProxy{
-		Network: network,
-		Target:  target,
-		Timeout: to,
+		DialTimeout: to,
+		Network:     network,
+		Target:      target,
 	}
 }
 
@@ -54,37 +63,99 @@ func (p *reverseNetworkProxy) SetDebug(v bool) {
 	p.Debug = v
 }
 
+func (p *reverseNetworkProxy) SetDialTimeout(d time.Duration) {
+	p.DialTimeout = d
+}
+
 func (p *reverseNetworkProxy) SetErrorHandler(fn ErrorHandlerFunc) {
 	p.HandleError = fn
 }
 
+func (p *reverseNetworkProxy) SetIdleTimeout(d time.Duration) {
+	p.IdleTimeout = d
+}
+
 func (p *reverseNetworkProxy) Proxy(ctx context.Context, conn net.Conn) {
 	go func() {
 		if p.Debug {
-			logger.Info(fmt.Sprintf(
-				"Connected: %s", conn.RemoteAddr()))
+			log.Debug("Connected", logging.Fields{
+				"client": conn.RemoteAddr().String(),
+			})
 		}
 		remoteConn, err := net.DialTimeout(p.Network, p.Target,
-			p.Timeout)
+			p.DialTimeout)
 		if err != nil {
 			p.HandleError(ctx, conn, err)
 			return
 		}
-		defer remoteConn.Close()
-		_, cancelCtx := context.WithCancel(ctx)
-		defer cancelCtx()
-		defer conn.Close()
-		wait := make(chan struct{}, 2)
-		go copyConn(wait, conn, remoteConn, p.Debug)
-		go copyConn(wait, remoteConn, conn, p.Debug)
-		<-wait
+		if p.IdleTimeout > 0 {
+			conn, remoteConn = newIdleConns(conn, remoteConn,
+				p.IdleTimeout)
+		}
+		relay(ctx, conn, remoteConn, p.Debug)
 		if p.Debug {
-			logger.Info(fmt.Sprintf(
-				"Closed: %s", conn.RemoteAddr()))
+			log.Debug("Closed", logging.Fields{
+				"client": conn.RemoteAddr().String(),
+			})
 		}
 	}()
 }
 
+// relay copies data between the given connections in both directions until
+// either direction ends or the context is done; E.g. on shutdown. Both
+// connections are then closed, so the remaining copies end too, and it returns
+// once both copies have exited.
+func relay(ctx context.Context, conn, remoteConn net.Conn, debug bool) {
+	wait := make(chan struct{}, 2)
+	go copyConn(wait, conn, remoteConn, debug)
+	go copyConn(wait, remoteConn, conn, debug)
+	remaining := 2
+	select {
+	case <-wait:
+		remaining--
+	case <-ctx.Done():
+	}
+	conn.Close()
+	remoteConn.Close()
+	for ; remaining > 0; remaining-- {
+		<-wait
+	}
+}
+
+// idleConn is a relayed connection whose deadlines are reset on activity. Data
+// read from either connection of a relay extends both of their read deadlines,
+// so a one-way transfer does not time out the quiet side.
+type idleConn struct {
+	net.Conn
+	Peer    net.Conn      // The other connection of the relay
+	Timeout time.Duration // Idle timeout
+}
+
+// newIdleConns returns the given relay connections wrapped to close after the
+// idle timeout.
+func newIdleConns(conn, remoteConn net.Conn, to time.Duration) (net.Conn, net.Conn) {
+	return &idleConn{Conn: conn, Peer: remoteConn, Timeout: to},
+		&idleConn{Conn: remoteConn, Peer: conn, Timeout: to}
+}
+
+// Read reads from the connection and extends the read deadlines of the relay on
+// activity.
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.Peer.SetReadDeadline(time.Now().Add(c.Timeout))
+	}
+	return n, err
+}
+
+// Write writes to the connection; failing if the write stalls for longer than
+// the idle timeout.
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	return c.Conn.Write(b)
+}
+
 func copyConn(closer chan struct{}, src io.Reader, dst io.Writer, debug bool) {
 	if debug {
 		_, _ = io.Copy(os.Stdout, io.TeeReader(src, dst))
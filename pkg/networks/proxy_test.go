@@ -3,11 +3,13 @@ package networks
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"runtime"
 	"testing"
 	"time"
 
@@ -46,3 +48,134 @@ func TestReverseNetworkProxyProxy(t *testing.T) {
 	require.Equal(t, http.StatusOK, resp.StatusCode)
 	require.Equal(t, body, string(respBody))
 }
+
+func TestReverseNetworkProxyProxyClosesBothConns(t *testing.T) {
+	// The backend never writes, so only the client's disconnect can end
+	// the relay
+	backendClosed := make(chan struct{})
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+		close(backendClosed)
+	}()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	before := runtime.NumGoroutine()
+
+	rproxy := NewReverseNetworkProxy("tcp", backend.Addr().String(),
+		time.Second)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			rproxy.Proxy(context.Background(), conn)
+		}
+	}()
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+	_, err = client.Write([]byte("hello"))
+	require.Nil(t, err)
+	client.Close()
+
+	select {
+	case <-backendClosed:
+	case <-time.After(time.Second):
+		t.Fatal("backend connection was not closed")
+	}
+	// Both copy routines exit, along with the backend's routine
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before-1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.LessOrEqual(t, runtime.NumGoroutine(), before-1)
+}
+
+func TestReverseNetworkProxyProxyContextDone(t *testing.T) {
+	backendClosed := make(chan struct{})
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+		close(backendClosed)
+	}()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rproxy := NewReverseNetworkProxy("tcp", backend.Addr().String(),
+		time.Second)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			rproxy.Proxy(ctx, conn)
+		}
+	}()
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("hello"))
+	require.Nil(t, err)
+
+	// Neither side closes, so only the cancel can end the relay
+	cancel()
+	select {
+	case <-backendClosed:
+	case <-time.After(time.Second):
+		t.Fatal("backend connection was not closed")
+	}
+	// The client's connection is closed (or reset) rather than timing out
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	require.NotNil(t, err)
+	netErr, ok := err.(net.Error)
+	require.False(t, ok && netErr.Timeout())
+}
+
+func TestReverseNetworkProxyIdleTimeout(t *testing.T) {
+	backend := newEchoServer(t)
+	defer backend.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	rproxy := NewReverseNetworkProxy("tcp", backend.Addr().String(),
+		time.Second)
+	rproxy.SetIdleTimeout(100 * time.Millisecond)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			rproxy.Proxy(context.Background(), conn)
+		}
+	}()
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+	defer client.Close()
+
+	// Activity keeps the relay open past the idle timeout
+	for i := 0; i < 5; i++ {
+		resp, err := echo(client, "ping")
+		require.Nil(t, err)
+		require.Equal(t, "ping", resp)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// An idle relay is closed
+	start := time.Now()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+}
@@ -59,3 +59,22 @@ func IsCIDR(s string) bool {
 	_, _, err := net.ParseCIDR(s)
 	return err == nil
 }
+
+// ContainsIP returns true if the given IP address equals one of the listed IP
+// addresses or is contained in one of the listed CIDR ranges.
+func ContainsIP(list []string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, s := range list {
+		if IsCIDR(s) {
+			_, n, err := net.ParseCIDR(s)
+			if err == nil && NetworkContains(*n, ip) {
+				return true
+			}
+		} else if other := net.ParseIP(s); other != nil && other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -56,3 +56,23 @@ func TestIsCIDR(t *testing.T) {
 		require.Equal(t, test.Expected, IsCIDR(test.Network))
 	}
 }
+
+func TestContainsIP(t *testing.T) {
+	list := []string{"10.0.0.1", "192.168.0.0/24", "2a02:ff0::/32"}
+	tests := []struct {
+		IP       string
+		Expected bool
+	}{
+		{"10.0.0.1", true},
+		{"10.0.0.2", false},
+		{"192.168.0.25", true},
+		{"192.168.1.25", false},
+		{"2a02:ff0:2f9:b707::1", true},
+		{"::1", false},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.Expected,
+			ContainsIP(list, net.ParseIP(test.IP)))
+	}
+	require.False(t, ContainsIP(list, nil))
+}
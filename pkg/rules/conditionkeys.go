@@ -16,6 +16,9 @@ const (
 	ConditionKeyPath
 	ConditionKeySourceIp
 	ConditionKeyAlways
+	ConditionKeyContentType
+	ConditionKeyTlsSni
+	ConditionKeyTlsClientCn
 )
 
 // ConditionKeyStrings is a list of string representations for condition keys.
@@ -26,6 +29,9 @@ var ConditionKeyStrings = []string{
 	"path-pattern",
 	"source-ip",
 	"always",
+	"content-type",
+	"tls-sni",
+	"tls-client-cn",
 }
 
 // NewConditionKey returns the ConditionKey for a given string. If the string
@@ -39,6 +45,12 @@ func NewConditionKey(v string) ConditionKey {
 	return ConditionKeyUnknown
 }
 
+// IsTls returns true if the condition key matches the TLS connection of a
+// request; so it only applies to requests received by TLS listeners.
+func (k ConditionKey) IsTls() bool {
+	return k == ConditionKeyTlsSni || k == ConditionKeyTlsClientCn
+}
+
 // String returns the string representation for the given condition key.
 func (k ConditionKey) String() string {
 	i := int(k)
@@ -43,39 +43,58 @@ func (op ConditionOp) String() string {
 	return ""
 }
 
+// IsNegated returns true if the condition operator is a negation; I.E. not
+// equal or does not contain.
+func (op ConditionOp) IsNegated() bool {
+	return op == ConditionOpNotEqualInsensitive ||
+		op == ConditionOpNotEqual ||
+		op == ConditionOpNotContain
+}
+
 // Condition represents a rule's condition string.
 type Condition string
 
 // Key returns the key part of the condition statement.
 func (c Condition) Key() string {
-	for _, opStr := range ConditionOpStrings[1:] {
-		if idx := strings.Index(string(c), opStr); idx > -1 {
-			return strings.TrimSpace(string(c[:idx]))
-		}
+	if idx, _ := c.find(); idx > -1 {
+		return strings.TrimSpace(string(c[:idx]))
 	}
 	return ""
 }
 
 // Value returns the value part of the condition statement.
 func (c Condition) Value() string {
-	for _, opStr := range ConditionOpStrings[1:] {
-		if idx := strings.Index(string(c), opStr); idx > -1 {
-			s := string(c[idx:])
-			s = strings.TrimPrefix(s, opStr)
-			return strings.TrimSpace(s)
-		}
+	if idx, op := c.find(); idx > -1 {
+		s := string(c[idx+len(op.String()):])
+		return strings.TrimSpace(s)
 	}
 	return ""
 }
 
-// Operator returns the condition operator of the condition statement.
+// Operator returns the condition operator of the condition statement; the
+// leftmost and longest operator found.
 func (c Condition) Operator() ConditionOp {
-	for op, opStr := range ConditionOpStrings[1:] {
-		if idx := strings.Index(string(c), opStr); idx > -1 {
-			return ConditionOp(op + 1)
+	_, op := c.find()
+	return op
+}
+
+// find returns the index and operator of the condition statement's operator.
+// This is the leftmost operator, so operators in the value are ignored; and
+// the longest operator at that index, so "=~" is not mistaken for "=". If no
+// operator is found, -1 and ConditionOpUnknown are returned.
+func (c Condition) find() (int, ConditionOp) {
+	idx, op := -1, ConditionOpUnknown
+	for i, opStr := range ConditionOpStrings[1:] {
+		j := strings.Index(string(c), opStr)
+		if j < 0 {
+			continue
+		}
+		if idx < 0 || j < idx ||
+			(j == idx && len(opStr) > len(op.String())) {
+			idx, op = j, ConditionOp(i+1)
 		}
 	}
-	return ConditionOpUnknown
+	return idx, op
 }
 
 // Contains returns true if the given list 'a' contains element 'b'.
@@ -24,6 +24,14 @@ func TestConditionOpString(t *testing.T) {
 	require.Equal(t, expected, actual)
 }
 
+func TestConditionOpIsNegated(t *testing.T) {
+	require.True(t, ConditionOpNotEqual.IsNegated())
+	require.True(t, ConditionOpNotEqualInsensitive.IsNegated())
+	require.True(t, ConditionOpNotContain.IsNegated())
+	require.False(t, ConditionOpEqual.IsNegated())
+	require.False(t, ConditionOpContain.IsNegated())
+}
+
 func TestConditionKey(t *testing.T) {
 	expected := "my_key"
 	condition := Condition(fmt.Sprintf("%s=~some_value", expected))
@@ -46,6 +54,30 @@ func TestConditionValue(t *testing.T) {
 	require.Equal(t, expected, actual)
 }
 
+func TestConditionKeyValueOperatorInValue(t *testing.T) {
+	tests := []struct {
+		Condition Condition
+		Key       string
+		Value     string
+	}{
+		{"path-pattern = /a=b", "path-pattern", "/a=b"},
+		{"path-pattern=/a!=b", "path-pattern", "/a!=b"},
+		{"host-header = a=~b.example.com", "host-header", "a=~b.example.com"},
+		{"path-pattern contains /x=y", "path-pattern", "/x=y"},
+		{"path-pattern = /contains", "path-pattern", "/contains"},
+		{"path-pattern !contains /a;b", "path-pattern", "/a;b"},
+		{"path-pattern =~ /A!=B", "path-pattern", "/A!=B"},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.Key, test.Condition.Key(),
+			string(test.Condition))
+		require.Equal(t, test.Value, test.Condition.Value(),
+			string(test.Condition))
+	}
+	require.Equal(t, "", Condition("no operator").Key())
+	require.Equal(t, "", Condition("no operator").Value())
+}
+
 func TestConditionOperator(t *testing.T) {
 	expected := ConditionOpEqualInsensitive
 	condition := Condition(fmt.Sprintf("my_key%ssome_value", expected))
@@ -57,6 +89,26 @@ func TestConditionOperator(t *testing.T) {
 	require.Equal(t, expected, actual)
 }
 
+func TestConditionOperatorLongest(t *testing.T) {
+	tests := map[Condition]ConditionOp{
+		"my_key=~value":          ConditionOpEqualInsensitive,
+		"my_key !~ value":        ConditionOpNotEqualInsensitive,
+		"my_key!=value":          ConditionOpNotEqual,
+		"my_key = value":         ConditionOpEqual,
+		"my_key !contains value": ConditionOpNotContain,
+		"my_key contains value":  ConditionOpContain,
+		"my_key;":                ConditionNoOp,
+		"my_key = a!=b":          ConditionOpEqual,
+		"my_key = a=~b":          ConditionOpEqual,
+		"my_key contains a=b":    ConditionOpContain,
+		"my_key !~ !contains":    ConditionOpNotEqualInsensitive,
+		"my_key value":           ConditionOpUnknown,
+	}
+	for cond, expected := range tests {
+		require.Equal(t, expected, cond.Operator(), string(cond))
+	}
+}
+
 func TestAreEqual(t *testing.T) {
 	i1 := 2
 	i2 := 3
@@ -12,6 +12,7 @@ const (
 	RuleActionUnknown RuleAction = iota
 	RuleActionForward
 	RuleActionRedirect
+	RuleActionSplit
 )
 
 // RuleActionStrings is a list of the string representations of the rule
@@ -20,6 +21,7 @@ var RuleActionStrings = []string{
 	"unknown",
 	"forward",
 	"redirect",
+	"split",
 }
 
 // NewRuleAction returns the RuleAction for a given string. If the string does
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 )
 
@@ -13,22 +15,117 @@ var (
 	// Errors
 	ErrUnknownRuleAction = errors.New("Unknown rule action")
 	ErrInvalidCondition  = errors.New("Invalid rule condition")
+	ErrTlsCondition      = errors.New("TLS rule conditions require a TLS listener")
+	ErrClientCnCondition = errors.New("Client CN rule conditions require a listener with a client CA")
 )
 
-// Rule contains a listener ruler's action and conditions.
+// Rule contains a listener ruler's action and conditions. Rules with the split
+// action also contain the weighted target groups to split requests across and
+// the key used to keep clients on the same target group. The path options set
+// how the request path is canonicalized before it is matched.
 type Rule struct {
 	Action     RuleAction
 	Conditions [][]Condition
+	Path       PathOptions
+	Split      []SplitTarget
+	SplitKey   string
 }
 
-// Valid returns nil if the rule is valid. Otherwise, an error is returned.
+// PathOptions represents how a rule canonicalizes the request path and its path
+// patterns before matching them; E.g. so "/foo" and "/Foo/" match one pattern,
+// rather than a rule per variant. Path patterns only match the path of the
+// request, without its query, unless IncludeQuery is set; then the first '?' of
+// a pattern separates a path pattern from a query pattern, matched against the
+// request's path and raw query respectively. E.g. "/search?type=a" matches a
+// search of type "a" only. Patterns without a '?' match the path, a '?', and
+// the raw query, so "/search*" still matches every search. Query patterns are
+// not canonicalized beyond case.
+type PathOptions struct {
+	IgnoreCase          bool // Match paths without regard to case
+	IgnoreTrailingSlash bool // Match paths with and without a trailing slash
+	IncludeQuery        bool // Match the raw query along with the path
+}
+
+// canonical returns the given path or path pattern canonicalized by the
+// options. The root path keeps its slash.
+func (o PathOptions) canonical(path string) string {
+	if o.IgnoreCase {
+		path = strings.ToLower(path)
+	}
+	if o.IgnoreTrailingSlash && len(path) > 1 {
+		if trimmed := strings.TrimRight(path, "/"); trimmed != "" {
+			return trimmed
+		}
+		return "/"
+	}
+	return path
+}
+
+// canonicalQuery returns the given raw query or query pattern canonicalized by
+// the options.
+func (o PathOptions) canonicalQuery(query string) string {
+	if o.IgnoreCase {
+		return strings.ToLower(query)
+	}
+	return query
+}
+
+// requestPath returns the path of the given URL to match path patterns against;
+// canonicalized by the options, and followed by its raw query if it is
+// included.
+func (o PathOptions) requestPath(u *url.URL) string {
+	path := o.canonical(u.Path)
+	if !o.IncludeQuery || u.RawQuery == "" {
+		return path
+	}
+	return path + "?" + o.canonicalQuery(u.RawQuery)
+}
+
+// matchPath returns true if the given URL matches the path pattern for the
+// operator. If the query is included, a pattern with a '?' matches the URL's
+// path and raw query separately, so the '?' is not taken as a wildcard.
+func (o PathOptions) matchPath(pattern string, u *url.URL, op ConditionOp) bool {
+	path, query, ok := strings.Cut(pattern, "?")
+	if !o.IncludeQuery || !ok ||
+		op == ConditionOpContain || op == ConditionOpNotContain {
+		return matchPath(o.canonical(pattern), o.requestPath(u), op)
+	}
+	expected := []string{o.canonical(path), o.canonicalQuery(query)}
+	actual := []string{o.canonical(u.Path), o.canonicalQuery(u.RawQuery)}
+	if op == ConditionOpEqualInsensitive ||
+		op == ConditionOpNotEqualInsensitive {
+		for i := range expected {
+			expected[i] = strings.ToLower(expected[i])
+			actual[i] = strings.ToLower(actual[i])
+		}
+	}
+	matches := matchStrings(expected[0], actual[0]) &&
+		matchStrings(expected[1], actual[1])
+	return match("true", fmt.Sprintf("%t", matches), op)
+}
+
+// Valid returns nil if the rule is valid. Otherwise, an error is returned. The
+// always condition matches every request, so a rule combining it with other
+// conditions is invalid; the other conditions would be silently ignored.
 func (r Rule) Valid() error {
 	if r.Action == RuleActionUnknown {
 		return ErrUnknownRuleAction
 	}
+	if r.Action == RuleActionSplit {
+		if err := validSplit(r.Split, r.SplitKey); err != nil {
+			return err
+		}
+	}
+	always, others := 0, 0
 	for i, cond := range r.Conditions {
 		for _, sub := range cond {
-			if NewConditionKey(sub.Key()) == ConditionKeyUnknown {
+			key := NewConditionKey(sub.Key())
+			if key == ConditionKeyAlways {
+				always++
+			} else {
+				others++
+			}
+			if key == ConditionKeyUnknown {
 				return fmt.Errorf(
 					"%s - invalid key '%s' (%d)",
 					ErrInvalidCondition, sub, i,
@@ -42,6 +139,51 @@ func (r Rule) Valid() error {
 			}
 		}
 	}
+	if always > 0 && others > 0 {
+		return fmt.Errorf(
+			"%s - '%s' cannot be combined with other conditions",
+			ErrInvalidCondition, ConditionKeyAlways,
+		)
+	}
+	return nil
+}
+
+// RequiresTls returns true if any of the rule's conditions match the TLS
+// connection of a request; E.g. "tls-sni". Such a rule should only be applied to
+// requests of TLS listeners, see ValidTls.
+func (r Rule) RequiresTls() bool {
+	for _, cond := range r.Conditions {
+		for _, sub := range cond {
+			if NewConditionKey(sub.Key()).IsTls() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RequiresClientCa returns true if any of the rule's conditions match the
+// client certificate of a request; I.E. "tls-client-cn". Such a rule should
+// only be applied to requests of TLS listeners that verify client
+// certificates against a client CA, since unverified certificates never match.
+func (r Rule) RequiresClientCa() bool {
+	for _, cond := range r.Conditions {
+		for _, sub := range cond {
+			if NewConditionKey(sub.Key()) == ConditionKeyTlsClientCn {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ValidTls returns ErrTlsCondition if the rule has TLS conditions but is applied
+// to a listener without TLS, given whether it has TLS. Otherwise, nil is
+// returned.
+func (r Rule) ValidTls(tls bool) error {
+	if !tls && r.RequiresTls() {
+		return ErrTlsCondition
+	}
 	return nil
 }
 
@@ -51,7 +193,7 @@ func (r Rule) Matches(req *http.Request) bool {
 	for _, cond := range r.Conditions {
 		good := false
 		for _, sub := range cond {
-			if good = matchRequest(sub, req); good {
+			if good = matchRequestPath(sub, req, r.Path); good {
 				break
 			}
 		}
@@ -63,8 +205,40 @@ func (r Rule) Matches(req *http.Request) bool {
 	return true
 }
 
+// ConditionTrace represents the evaluation of a rule's condition against a
+// request; the alternative sub-conditions, and the one that matched if any.
+type ConditionTrace struct {
+	Condition []Condition // Alternative sub-conditions
+	Matched   Condition   // Matching sub-condition; empty if none matched
+}
+
+// Trace returns true if the given request matches the rule's conditions, like
+// Matches, along with the evaluation of each condition; E.g. to tell why a
+// request was or was not routed by the rule. Like Matches, the evaluation
+// stops at the first condition that fails, which is the last one traced.
+func (r Rule) Trace(req *http.Request) (bool, []ConditionTrace) {
+	traces := make([]ConditionTrace, 0, len(r.Conditions))
+	for _, cond := range r.Conditions {
+		trace := ConditionTrace{Condition: cond}
+		for _, sub := range cond {
+			if matchRequestPath(sub, req, r.Path) {
+				trace.Matched = sub
+				break
+			}
+		}
+		traces = append(traces, trace)
+		if trace.Matched == "" {
+			return false, traces
+		}
+	}
+	return true, traces
+}
+
+// GetIpFromRequest returns the IP address of the client from given request. If
+// an IP address could not be extracted, nil is returned instead.
+//
 // XXX this was copied from pkg/services and should be shared commonly.
-func getIpFromRequest(r *http.Request) net.IP {
+func GetIpFromRequest(r *http.Request) net.IP {
 	v := r.Header.Get("X-REAL-IP")
 	if ip := net.ParseIP(v); ip != nil {
 		return ip
@@ -85,6 +259,55 @@ func getIpFromRequest(r *http.Request) net.IP {
 	return nil
 }
 
+// requestHost returns the host of the given request without its port. Hostnames
+// are case-insensitive, so callers should compare it without regard to case.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if host == "" {
+		host = r.Header.Get("Host")
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	// IPv6 addresses without a port are bracketed
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// requestServerName returns the server name that the client of the given
+// request indicated in its TLS handshake (SNI); empty if the request was not
+// received over TLS or no name was indicated.
+func requestServerName(r *http.Request) string {
+	if r.TLS == nil {
+		return ""
+	}
+	return r.TLS.ServerName
+}
+
+// requestClientCn returns the common name of the subject of the certificate
+// that the client of the given request presented in its TLS handshake; empty if
+// the request was not received over TLS or the certificate was not verified.
+// Certificates are only verified by listeners with a client CA, so a client
+// can not claim any name with a self-signed certificate.
+func requestClientCn(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 ||
+		len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// requestContentType returns the media type of the given request's
+// Content-Type header, without its parameters; E.g. "application/json" for
+// "application/json; charset=utf-8".
+func requestContentType(r *http.Request) string {
+	ct := r.Header.Get("Content-Type")
+	if mt, _, err := mime.ParseMediaType(ct); err == nil {
+		return mt
+	}
+	mt, _, _ := strings.Cut(ct, ";")
+	return strings.ToLower(strings.TrimSpace(mt))
+}
+
 // match returns true if the actual string matches the expected string depending
 // on the operation.
 func match(expected, actual string, op ConditionOp) bool {
@@ -109,6 +332,28 @@ func match(expected, actual string, op ConditionOp) bool {
 	return false
 }
 
+// matchAlternatives splits the expected value on '|' into a set of alternatives
+// and matches each with the given function. For negated operators, every
+// alternative must match; I.E. the actual value is none of the alternatives.
+// Otherwise, any alternative matching is enough.
+func matchAlternatives(expected string, op ConditionOp, fn func(expected string) bool) bool {
+	alts := strings.Split(expected, "|")
+	if op.IsNegated() {
+		for _, alt := range alts {
+			if !fn(strings.TrimSpace(alt)) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, alt := range alts {
+		if fn(strings.TrimSpace(alt)) {
+			return true
+		}
+	}
+	return false
+}
+
 // matchCIDR returns true if the IP address string is contained or not contained
 // in the given network range string depending on the operation.
 func matchCIDR(netStr, ipStr string, op ConditionOp) bool {
@@ -121,6 +366,15 @@ func matchCIDR(netStr, ipStr string, op ConditionOp) bool {
 	return match("true", contains, op)
 }
 
+// matchHost returns true if the expected host pattern matches the actual given
+// host depending on the operation. Hosts are compared without regard to case,
+// and the pattern may contain wildcards like path patterns; E.g.
+// "*.example.com" matches any subdomain but not "example.com" itself, which
+// "*example.com" also matches.
+func matchHost(expected, actual string, op ConditionOp) bool {
+	return matchPath(strings.ToLower(expected), strings.ToLower(actual), op)
+}
+
 // matchPath returns true if the expected path pattern matches the actual given
 // path depending on the operation.
 func matchPath(expected, actual string, op ConditionOp) bool {
@@ -137,29 +391,60 @@ func matchPath(expected, actual string, op ConditionOp) bool {
 }
 
 // matchRequest returns true if the given request matches the given condition.
+// The condition's value may list alternatives separated by '|'; E.g.
+// "http-request-method = GET|POST".
 func matchRequest(cond Condition, req *http.Request) bool {
-	actual := ""
-	expected := cond.Value()
+	return matchRequestPath(cond, req, PathOptions{})
+}
+
+// matchRequestPath returns true if the given request matches the given
+// condition, like matchRequest. Paths are canonicalized by the given path
+// options before they are matched.
+func matchRequestPath(cond Condition, req *http.Request, opts PathOptions) bool {
 	op := cond.Operator()
 	switch NewConditionKey(cond.Key()) {
 	case ConditionKeyHost:
-		actual = req.Header.Get("Host")
-		return match(expected, actual, op)
+		actual := requestHost(req)
+		return matchAlternatives(cond.Value(), op, func(expected string) bool {
+			return matchHost(expected, actual, op)
+		})
 	case ConditionKeyMethod:
-		actual = req.Method
-		return match(expected, actual, op)
+		actual := req.Method
+		return matchAlternatives(cond.Value(), op, func(expected string) bool {
+			return match(expected, actual, op)
+		})
 	case ConditionKeyPath:
-		actual = req.URL.Path
-		return matchPath(expected, actual, op)
+		return matchAlternatives(cond.Value(), op, func(expected string) bool {
+			return opts.matchPath(expected, req.URL, op)
+		})
 	case ConditionKeySourceIp:
-		actual = getIpFromRequest(req).String()
-		if IsCIDR(expected) {
-			return matchCIDR(expected, actual, op)
-		} else {
+		actual := GetIpFromRequest(req).String()
+		return matchAlternatives(cond.Value(), op, func(expected string) bool {
+			if IsCIDR(expected) {
+				return matchCIDR(expected, actual, op)
+			}
 			return match(expected, actual, op)
-		}
+		})
+	case ConditionKeyTlsSni:
+		// Server names are hostnames, and are matched like hosts
+		actual := requestServerName(req)
+		return matchAlternatives(cond.Value(), op, func(expected string) bool {
+			return matchHost(expected, actual, op)
+		})
+	case ConditionKeyTlsClientCn:
+		actual := requestClientCn(req)
+		return matchAlternatives(cond.Value(), op, func(expected string) bool {
+			return matchPath(expected, actual, op)
+		})
 	case ConditionKeyAlways:
 		return true
+	case ConditionKeyContentType:
+		// Media types are case-insensitive, and may be patterns like
+		// paths; E.g. "application/grpc*" also matches gRPC subtypes.
+		actual := requestContentType(req)
+		return matchAlternatives(cond.Value(), op, func(expected string) bool {
+			return matchPath(strings.ToLower(expected), actual, op)
+		})
 	}
 	return false
 }
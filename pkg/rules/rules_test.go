@@ -1,6 +1,9 @@
 package rules
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"net"
 	"net/http"
@@ -127,6 +130,157 @@ func TestMatchRequest(t *testing.T) {
 	require.True(t, matchRequest(cond, req))
 }
 
+func TestMatchRequestHost(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+
+	cond := Condition("host-header = example.com")
+	req.Host = "Example.COM"
+	require.True(t, matchRequest(cond, req))
+	req.Host = "example.com:443"
+	require.True(t, matchRequest(cond, req))
+	req.Host = "EXAMPLE.com:8080"
+	require.True(t, matchRequest(cond, req))
+	req.Host = "www.example.com"
+	require.False(t, matchRequest(cond, req))
+	cond = Condition("host-header != Example.com")
+	require.True(t, matchRequest(cond, req))
+	req.Host = "example.com:443"
+	require.False(t, matchRequest(cond, req))
+
+	cond = Condition("host-header = ::1")
+	req.Host = "[::1]:8080"
+	require.True(t, matchRequest(cond, req))
+	req.Host = "[::1]"
+	require.True(t, matchRequest(cond, req))
+}
+
+func TestMatchRequestContentType(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, "/", nil)
+	require.Nil(t, err)
+
+	cond := Condition("content-type = application/grpc*")
+	req.Header.Set("Content-Type", "application/grpc")
+	require.True(t, matchRequest(cond, req))
+	req.Header.Set("Content-Type", "Application/GRPC+proto")
+	require.True(t, matchRequest(cond, req))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	require.False(t, matchRequest(cond, req))
+	cond = Condition("content-type = application/json|text/plain")
+	require.True(t, matchRequest(cond, req))
+	cond = Condition("content-type != application/grpc*")
+	require.True(t, matchRequest(cond, req))
+
+	// Parameters are ignored even if the header is malformed
+	req.Header.Set("Content-Type", "text/plain;;")
+	cond = Condition("content-type = text/plain")
+	require.True(t, matchRequest(cond, req))
+	req.Header.Del("Content-Type")
+	require.False(t, matchRequest(cond, req))
+}
+
+func TestMatchRequestTls(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+	sni := Condition("tls-sni = *.tenants.example.com")
+	cn := Condition("tls-client-cn = tenant-?")
+
+	// Requests without TLS have no server name or client certificate
+	require.False(t, matchRequest(sni, req))
+	require.False(t, matchRequest(cn, req))
+
+	req.TLS = &tls.ConnectionState{ServerName: "a.Tenants.example.com"}
+	require.True(t, matchRequest(sni, req))
+	require.False(t, matchRequest(cn, req))
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "tenant-a"}}
+	req.TLS.PeerCertificates = []*x509.Certificate{cert}
+	// Unverified certificates do not match
+	require.False(t, matchRequest(cn, req))
+	req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	require.True(t, matchRequest(cn, req))
+	cn = Condition("tls-client-cn = tenant-b|tenant-c")
+	require.False(t, matchRequest(cn, req))
+	cn = Condition("tls-client-cn =~ TENANT-A")
+	require.True(t, matchRequest(cn, req))
+	req.TLS.ServerName = "example.com"
+	require.False(t, matchRequest(sni, req))
+	sni = Condition("tls-sni != *.tenants.example.com")
+	require.True(t, matchRequest(sni, req))
+}
+
+func TestRuleValidTls(t *testing.T) {
+	rule := Rule{
+		Action:     RuleActionForward,
+		Conditions: [][]Condition{{"path-pattern=/api/*"}},
+	}
+	require.False(t, rule.RequiresTls())
+	require.Nil(t, rule.ValidTls(false))
+	rule.Conditions = append(rule.Conditions,
+		[]Condition{"host-header=example.com", "tls-client-cn=tenant-a"})
+	require.True(t, rule.RequiresTls())
+	require.Nil(t, rule.Valid())
+	require.Nil(t, rule.ValidTls(true))
+	require.Equal(t, ErrTlsCondition, rule.ValidTls(false))
+
+	// Only client CN conditions require a client CA
+	require.True(t, rule.RequiresClientCa())
+	rule.Conditions = [][]Condition{{"tls-sni=example.com"}}
+	require.True(t, rule.RequiresTls())
+	require.False(t, rule.RequiresClientCa())
+}
+
+func TestMatchHost(t *testing.T) {
+	require.True(t, matchHost("example.com", "Example.com", ConditionOpEqual))
+	require.False(t, matchHost("example.com", "www.example.com",
+		ConditionOpEqual))
+	require.True(t, matchHost("*.example.com", "www.example.com",
+		ConditionOpEqual))
+	require.True(t, matchHost("*.example.com", "a.b.Example.com",
+		ConditionOpEqual))
+	require.False(t, matchHost("*.example.com", "example.com",
+		ConditionOpEqual))
+	require.True(t, matchHost("*example.com", "example.com",
+		ConditionOpEqual))
+	require.False(t, matchHost("*.example.com", "www.example.org",
+		ConditionOpEqual))
+	require.True(t, matchHost("*.example.com", "example.com",
+		ConditionOpNotEqual))
+	require.True(t, matchHost("api-?.example.com", "api-1.example.com",
+		ConditionOpEqual))
+}
+
+func TestMatchRequestAlternatives(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, "/", nil)
+	require.Nil(t, err)
+
+	cond := Condition("http-request-method = GET|POST")
+	require.True(t, matchRequest(cond, req))
+	req.Method = http.MethodDelete
+	require.False(t, matchRequest(cond, req))
+	cond = Condition("http-request-method != GET | POST")
+	require.True(t, matchRequest(cond, req))
+	req.Method = http.MethodGet
+	require.False(t, matchRequest(cond, req))
+
+	cond = Condition("path-pattern = /api/*|/static/*")
+	req.URL.Path = "/static/app.js"
+	require.True(t, matchRequest(cond, req))
+	req.URL.Path = "/admin"
+	require.False(t, matchRequest(cond, req))
+	cond = Condition("path-pattern !contains /admin|/internal")
+	require.False(t, matchRequest(cond, req))
+	req.URL.Path = "/api/users"
+	require.True(t, matchRequest(cond, req))
+
+	cond = Condition("source-ip = 10.0.0.0/8|127.0.0.1")
+	req.RemoteAddr = net.JoinHostPort("127.0.0.1", "8080")
+	require.True(t, matchRequest(cond, req))
+	req.RemoteAddr = net.JoinHostPort("10.1.2.3", "8080")
+	require.True(t, matchRequest(cond, req))
+	req.RemoteAddr = net.JoinHostPort("192.168.0.10", "8080")
+	require.False(t, matchRequest(cond, req))
+}
+
 func TestMatchStrings(t *testing.T) {
 	tests := []struct {
 		Patt     string
@@ -194,6 +348,37 @@ func TestRuleValid(t *testing.T) {
 		},
 	}
 	require.NotNil(t, rule.Valid())
+
+	rule = Rule{
+		Action:     RuleActionForward,
+		Conditions: [][]Condition{{Condition("always=")}},
+	}
+	require.Nil(t, rule.Valid())
+
+	// Mixing always with other conditions would ignore them
+	rule = Rule{
+		Action: RuleActionForward,
+		Conditions: [][]Condition{
+			{Condition("always=")},
+			{Condition("source-ip=127.0.0.1")},
+		},
+	}
+	require.NotNil(t, rule.Valid())
+	rule = Rule{
+		Action: RuleActionForward,
+		Conditions: [][]Condition{
+			{
+				Condition("path-pattern=/admin/*"),
+				Condition("always="),
+			},
+		},
+	}
+	require.NotNil(t, rule.Valid())
+
+	rule = Rule{Action: RuleActionSplit}
+	require.Equal(t, ErrInvalidSplit, rule.Valid())
+	rule.Split = []SplitTarget{{Name: "stable", Weight: 1}}
+	require.Nil(t, rule.Valid())
 }
 
 func TestRuleMatches(t *testing.T) {
@@ -240,6 +425,135 @@ func TestRuleMatches(t *testing.T) {
 	require.False(t, rule.Matches(req))
 }
 
+func TestRuleMatchesPathOptions(t *testing.T) {
+	rule := Rule{
+		Action: RuleActionForward,
+		Conditions: [][]Condition{
+			{Condition("path-pattern = /users/login|/api/")},
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+	paths := []string{"/users/login/", "/Users/Login", "/USERS/LOGIN//",
+		"/api", "/API/"}
+	for _, path := range paths {
+		req.URL.Path = path
+		require.False(t, rule.Matches(req))
+	}
+
+	rule.Path = PathOptions{IgnoreCase: true, IgnoreTrailingSlash: true}
+	for _, path := range paths {
+		req.URL.Path = path
+		require.True(t, rule.Matches(req))
+	}
+	req.URL.Path = "/users/logout"
+	require.False(t, rule.Matches(req))
+
+	// Each option applies on its own
+	rule.Path = PathOptions{IgnoreTrailingSlash: true}
+	req.URL.Path = "/users/login/"
+	require.True(t, rule.Matches(req))
+	req.URL.Path = "/Users/Login"
+	require.False(t, rule.Matches(req))
+	rule.Path = PathOptions{IgnoreCase: true}
+	require.True(t, rule.Matches(req))
+	req.URL.Path = "/users/login/"
+	require.False(t, rule.Matches(req))
+}
+
+func TestRuleMatchesQuery(t *testing.T) {
+	rule := Rule{
+		Action: RuleActionForward,
+		Conditions: [][]Condition{
+			{Condition("path-pattern = /search?type=a|/search")},
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, "/search?type=b", nil)
+	require.Nil(t, err)
+
+	// Path patterns exclude the query by default
+	require.True(t, rule.Matches(req))
+	rule.Conditions = [][]Condition{
+		{Condition("path-pattern = /search?type=a")},
+	}
+	require.False(t, rule.Matches(req))
+	req.URL.RawQuery = "type=a"
+	require.False(t, rule.Matches(req))
+
+	// and include it if set, so queries may be told apart
+	rule.Path = PathOptions{IncludeQuery: true}
+	require.True(t, rule.Matches(req))
+	req.URL.RawQuery = "type=b"
+	require.False(t, rule.Matches(req))
+
+	// The pattern's '?' separates the query, rather than being a wildcard
+	req.URL.RawQuery = ""
+	req.URL.Path = "/search/type=a"
+	require.False(t, rule.Matches(req))
+	req.URL.Path = "/searchXtype=a"
+	require.False(t, rule.Matches(req))
+	req.URL.Path = "/search"
+	req.URL.RawQuery = ""
+	require.False(t, rule.Matches(req))
+	rule.Conditions = [][]Condition{{Condition("path-pattern = /search*")}}
+	req.URL.RawQuery = "type=b"
+	require.True(t, rule.Matches(req))
+
+	// Queries are matched along with the path's other options
+	rule.Conditions = [][]Condition{
+		{Condition("path-pattern = /search/?type=a")},
+	}
+	rule.Path = PathOptions{
+		IgnoreCase:          true,
+		IgnoreTrailingSlash: true,
+		IncludeQuery:        true,
+	}
+	req.URL.Path = "/Search"
+	req.URL.RawQuery = "TYPE=A"
+	require.True(t, rule.Matches(req))
+}
+
+func TestPathOptionsCanonical(t *testing.T) {
+	opts := PathOptions{IgnoreCase: true, IgnoreTrailingSlash: true}
+	require.Equal(t, "/", opts.canonical("/"))
+	require.Equal(t, "/", opts.canonical("//"))
+	require.Equal(t, "", opts.canonical(""))
+	require.Equal(t, "/foo", opts.canonical("/FOO/"))
+	require.Equal(t, "/foo/*", opts.canonical("/Foo/*"))
+	require.Equal(t, "/Foo/", PathOptions{}.canonical("/Foo/"))
+}
+
+func TestRuleTrace(t *testing.T) {
+	rule := Rule{
+		Action: RuleActionForward,
+		Conditions: [][]Condition{
+			{"http-request-method=POST", "http-request-method=GET"},
+			{"path-pattern=/api/*"},
+			{"host-header=example.com"},
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, "/api/users", nil)
+	require.Nil(t, err)
+	req.Host = "example.com"
+	matched, traces := rule.Trace(req)
+	require.True(t, matched)
+	require.Equal(t, rule.Matches(req), matched)
+	require.Equal(t, []ConditionTrace{
+		{Condition: rule.Conditions[0], Matched: "http-request-method=GET"},
+		{Condition: rule.Conditions[1], Matched: "path-pattern=/api/*"},
+		{Condition: rule.Conditions[2], Matched: "host-header=example.com"},
+	}, traces)
+
+	// The trace stops at the first condition that fails
+	req.URL.Path = "/web"
+	matched, traces = rule.Trace(req)
+	require.False(t, matched)
+	require.Equal(t, rule.Matches(req), matched)
+	require.Len(t, traces, 2)
+	require.Equal(t, Condition(""), traces[1].Matched)
+	require.Equal(t, rule.Conditions[1], traces[1].Condition)
+}
+
 func TestRuleMatchesCIDR(t *testing.T) {
 	req, err := http.NewRequest(http.MethodGet, "/", nil)
 	require.Nil(t, err)
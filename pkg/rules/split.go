@@ -0,0 +1,99 @@
+package rules
+
+import (
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+const (
+	// Split keys
+	SplitKeySourceIp     = "source-ip"
+	SplitKeyCookiePrefix = "cookie:"
+)
+
+var (
+	// Errors
+	ErrInvalidSplit = errors.New("Invalid rule split")
+)
+
+// SplitTarget represents a target group that receives a weighted share of the
+// requests matching a rule with the split action.
+type SplitTarget struct {
+	Name   string // Target group name
+	Weight int    // Relative weight of the target group
+}
+
+// validSplit returns nil if the given split targets can be used to split
+// requests. Otherwise, an error is returned.
+func validSplit(targets []SplitTarget, key string) error {
+	if len(targets) == 0 {
+		return ErrInvalidSplit
+	}
+	for _, t := range targets {
+		if t.Name == "" || t.Weight < 0 {
+			return ErrInvalidSplit
+		}
+	}
+	if totalWeight(targets) == 0 {
+		return ErrInvalidSplit
+	}
+	if key != "" && !strings.EqualFold(key, SplitKeySourceIp) &&
+		!strings.HasPrefix(strings.ToLower(key), SplitKeyCookiePrefix) {
+		return ErrInvalidSplit
+	}
+	return nil
+}
+
+// SelectSplit returns the name of the split target the given request belongs
+// to. Requests are assigned deterministically by hashing the rule's split key,
+// so a given client always lands on the same target while the weights remain
+// unchanged. If the rule has no split targets, an empty string is returned.
+func (r Rule) SelectSplit(req *http.Request) string {
+	total := totalWeight(r.Split)
+	if total == 0 {
+		return ""
+	}
+	h := fnv.New32a()
+	h.Write([]byte(splitKeyValue(r.SplitKey, req)))
+	n := int(h.Sum32() % uint32(total))
+	for _, t := range r.Split {
+		if t.Weight <= 0 {
+			continue
+		}
+		if n < t.Weight {
+			return t.Name
+		}
+		n -= t.Weight
+	}
+	return ""
+}
+
+// splitKeyValue returns the value of the given split key for the request. The
+// key is either "source-ip" or "cookie:<name>"; if the cookie is not set, the
+// request's source IP is used instead.
+func splitKeyValue(key string, req *http.Request) string {
+	if strings.HasPrefix(strings.ToLower(key), SplitKeyCookiePrefix) {
+		name := key[len(SplitKeyCookiePrefix):]
+		if c, err := req.Cookie(name); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	if ip := GetIpFromRequest(req); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// totalWeight returns the sum of the positive weights of the given split
+// targets.
+func totalWeight(targets []SplitTarget) int {
+	total := 0
+	for _, t := range targets {
+		if t.Weight > 0 {
+			total += t.Weight
+		}
+	}
+	return total
+}
@@ -0,0 +1,105 @@
+package rules
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidSplit(t *testing.T) {
+	stable := SplitTarget{Name: "stable", Weight: 95}
+	canary := SplitTarget{Name: "canary", Weight: 5}
+	tests := []struct {
+		Targets  []SplitTarget
+		Key      string
+		Expected error
+	}{
+		{[]SplitTarget{stable, canary}, "", nil},
+		{[]SplitTarget{stable, canary}, "source-ip", nil},
+		{[]SplitTarget{stable, canary}, "cookie:session", nil},
+		{[]SplitTarget{stable, canary}, "header:x", ErrInvalidSplit},
+		{nil, "", ErrInvalidSplit},
+		{[]SplitTarget{{Name: "", Weight: 1}}, "", ErrInvalidSplit},
+		{[]SplitTarget{{Name: "a", Weight: -1}}, "", ErrInvalidSplit},
+		{[]SplitTarget{{Name: "a", Weight: 0}}, "", ErrInvalidSplit},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.Expected, validSplit(test.Targets, test.Key))
+	}
+}
+
+func TestRuleSelectSplit(t *testing.T) {
+	rule := Rule{
+		Action: RuleActionSplit,
+		Split: []SplitTarget{
+			{Name: "stable", Weight: 90},
+			{Name: "canary", Weight: 10},
+		},
+	}
+	counts := map[string]int{}
+	total := 10000
+	for i := 0; i < total; i++ {
+		req, err := http.NewRequest(http.MethodGet, "/", nil)
+		require.Nil(t, err)
+		ip := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+		req.RemoteAddr = net.JoinHostPort(ip.String(), "8080")
+		name := rule.SelectSplit(req)
+		counts[name]++
+
+		// The same client always selects the same target
+		require.Equal(t, name, rule.SelectSplit(req))
+	}
+	require.Equal(t, total, counts["stable"]+counts["canary"])
+	require.InDelta(t, 0.1, float64(counts["canary"])/float64(total), 0.02)
+
+	require.Equal(t, "", Rule{}.SelectSplit(&http.Request{}))
+}
+
+func TestRuleSelectSplitCookie(t *testing.T) {
+	rule := Rule{
+		Action:   RuleActionSplit,
+		SplitKey: "cookie:session",
+		Split: []SplitTarget{
+			{Name: "blue", Weight: 50},
+			{Name: "green", Weight: 50},
+		},
+	}
+	// Requests from the same session stick to a target regardless of the
+	// client's address
+	for i := 0; i < 100; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		req1, err := http.NewRequest(http.MethodGet, "/", nil)
+		require.Nil(t, err)
+		req1.AddCookie(&http.Cookie{Name: "session", Value: session})
+		req1.RemoteAddr = "10.0.0.1:8080"
+		req2, err := http.NewRequest(http.MethodGet, "/", nil)
+		require.Nil(t, err)
+		req2.AddCookie(&http.Cookie{Name: "session", Value: session})
+		req2.RemoteAddr = "10.0.0.2:8080"
+		require.Equal(t, rule.SelectSplit(req1), rule.SelectSplit(req2))
+	}
+}
+
+func TestSplitKeyValue(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+	req.RemoteAddr = "10.0.0.1:8080"
+	require.Equal(t, "10.0.0.1", splitKeyValue("", req))
+	require.Equal(t, "10.0.0.1", splitKeyValue("source-ip", req))
+	require.Equal(t, "10.0.0.1", splitKeyValue("cookie:session", req))
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	require.Equal(t, "abc", splitKeyValue("cookie:session", req))
+}
+
+func TestTotalWeight(t *testing.T) {
+	targets := []SplitTarget{
+		{Name: "a", Weight: 3},
+		{Name: "b", Weight: -1},
+		{Name: "c", Weight: 2},
+	}
+	require.Equal(t, 5, totalWeight(targets))
+	require.Equal(t, 0, totalWeight(nil))
+}
@@ -0,0 +1,300 @@
+package services
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Cache defaults
+	DefaultCacheMaxEntries = 1024
+	DefaultCacheTTL        = time.Minute
+
+	// CacheMaxBodySize is the largest response body (in bytes) that will be
+	// cached.
+	CacheMaxBodySize = 1 << 20
+)
+
+// cachedResponse represents a cached backend response.
+type cachedResponse struct {
+	Key        string      // Cache key
+	StatusCode int         // Response status code
+	Header     http.Header // Response headers
+	Body       []byte      // Response body
+	Vary       http.Header // Request headers the response varies by
+	Created    time.Time   // Time the response was cached
+	Expires    time.Time   // Time the response expires
+}
+
+// Matches returns true if the given request has the same values of the headers
+// the cached response varies by as the request it answered.
+func (cr *cachedResponse) Matches(r *http.Request) bool {
+	for name, values := range cr.Vary {
+		if strings.Join(r.Header.Values(name), ",") !=
+			strings.Join(values, ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// Write writes the cached response to the given response writer.
+func (cr *cachedResponse) Write(w http.ResponseWriter) {
+	for k, vv := range cr.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	age := int(time.Since(cr.Created).Seconds())
+	w.Header().Set("Age", strconv.Itoa(age))
+	w.WriteHeader(cr.StatusCode)
+	w.Write(cr.Body)
+}
+
+// responseCache is an in-memory cache of backend responses. Entries are
+// evicted once expired or when the cache is full, the least recently used
+// entry is evicted.
+type responseCache struct {
+	Entries    map[string]*list.Element // Cached responses by key
+	Order      *list.List               // Keys ordered by recent use
+	Lock       *sync.Mutex              // Lock for concurrency
+	MaxEntries int                      // Maximum number of entries
+	TTL        time.Duration            // Maximum entry time-to-live
+}
+
+// newResponseCache returns a new response cache that stores at most the given
+// number of entries for no longer than the given time-to-live.
+func newResponseCache(maxEntries int, ttl time.Duration) *responseCache {
+	if maxEntries < 1 {
+		maxEntries = DefaultCacheMaxEntries
+	}
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	return &responseCache{
+		Entries:    make(map[string]*list.Element),
+		Order:      list.New(),
+		Lock:       new(sync.Mutex),
+		MaxEntries: maxEntries,
+		TTL:        ttl,
+	}
+}
+
+// Get returns the cached response for the given key. If the key is not cached
+// or its entry has expired, nil is returned.
+func (c *responseCache) Get(key string) *cachedResponse {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	elem, ok := c.Entries[key]
+	if !ok {
+		return nil
+	}
+	cr := elem.Value.(*cachedResponse)
+	if time.Now().After(cr.Expires) {
+		c.remove(elem)
+		return nil
+	}
+	c.Order.MoveToFront(elem)
+	return cr
+}
+
+// Set adds the given response to the cache; evicting the least recently used
+// entry if the cache is full.
+func (c *responseCache) Set(cr *cachedResponse) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	if elem, ok := c.Entries[cr.Key]; ok {
+		elem.Value = cr
+		c.Order.MoveToFront(elem)
+		return
+	}
+	for c.Order.Len() >= c.MaxEntries {
+		c.remove(c.Order.Back())
+	}
+	c.Entries[cr.Key] = c.Order.PushFront(cr)
+}
+
+// Len returns the number of cached entries.
+func (c *responseCache) Len() int {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	return c.Order.Len()
+}
+
+// remove removes the given element from the cache. The cache's lock must be
+// held by the caller.
+func (c *responseCache) remove(elem *list.Element) {
+	cr := elem.Value.(*cachedResponse)
+	delete(c.Entries, cr.Key)
+	c.Order.Remove(elem)
+}
+
+// Store reads the given response's body and caches the response if it is
+// cacheable. The response body is replaced so it can still be read by the
+// client. A response that varies by request headers is cached along with the
+// request's values of them; only one variant of a key is cached at a time.
+func (c *responseCache) Store(key string, resp *http.Response) error {
+	ttl, ok := responseTTL(resp, c.TTL)
+	if !ok || resp.ContentLength > CacheMaxBodySize {
+		return nil
+	}
+	vary, ok := varyHeaders(resp)
+	if !ok {
+		return nil
+	}
+	body, err := ioutil.ReadAll(
+		io.LimitReader(resp.Body, CacheMaxBodySize+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > CacheMaxBodySize {
+		// Too large to cache, stitch the body back together and pass
+		// it along
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	now := time.Now()
+	c.Set(&cachedResponse{
+		Key:        key,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header.Clone(),
+		Body:       body,
+		Vary:       vary,
+		Created:    now,
+		Expires:    now.Add(ttl),
+	})
+	return nil
+}
+
+// cacheKey returns the cache key for the given request; made of the method,
+// host, path and query.
+func cacheKey(r *http.Request) string {
+	return fmt.Sprintf("%s %s%s", r.Method, r.Host, r.URL.RequestURI())
+}
+
+// varyHeaders returns the values of the headers the given response varies by,
+// from the request it answered; false is returned if they are unknown.
+func varyHeaders(resp *http.Response) (http.Header, bool) {
+	vary := http.Header{}
+	for _, v := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if resp.Request == nil {
+				return nil, false
+			}
+			vary[name] = resp.Request.Header.Values(name)
+		}
+	}
+	return vary, true
+}
+
+// isCacheableRequest returns true if the given request's response may be
+// served from or stored in the cache.
+func isCacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" {
+		return false
+	}
+	directives := parseCacheControl(r.Header.Get("Cache-Control"))
+	_, noCache := directives["no-cache"]
+	_, noStore := directives["no-store"]
+	return !noCache && !noStore
+}
+
+// responseTTL returns the time-to-live of the given response and whether the
+// response may be cached at all. Only responses that are explicitly marked
+// cacheable are cached; I.E. by the "s-maxage" or "max-age" Cache-Control
+// directives, an Expires header, or the "public" directive. The TTL is set by
+// the first of these that is present, but never beyond the given maximum TTL.
+func responseTTL(resp *http.Response, max time.Duration) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusOK {
+		return 0, false
+	}
+	if resp.Header.Get("Set-Cookie") != "" ||
+		resp.Header.Get("Vary") == "*" {
+		return 0, false
+	}
+	directives := parseCacheControl(resp.Header.Get("Cache-Control"))
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[d]; ok {
+			return 0, false
+		}
+	}
+	ttl, marked := time.Duration(0), false
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := directives[d]; ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil {
+				return 0, false
+			}
+			ttl, marked = time.Duration(secs)*time.Second, true
+			break
+		}
+	}
+	if v := resp.Header.Get("Expires"); v != "" && !marked {
+		ttl, marked = expiresTTL(resp, v), true
+	}
+	if _, ok := directives["public"]; ok && !marked {
+		ttl, marked = max, true
+	}
+	if !marked || ttl <= 0 {
+		// Not marked cacheable or already stale
+		return 0, false
+	}
+	if ttl > max {
+		ttl = max
+	}
+	return ttl, true
+}
+
+// expiresTTL returns the time-to-live of the given response according to the
+// given Expires header value; relative to the response's Date header if set.
+// Invalid dates mean the response is already expired.
+func expiresTTL(resp *http.Response, v string) time.Duration {
+	expires, err := http.ParseTime(v)
+	if err != nil {
+		return 0
+	}
+	date := time.Now()
+	if d, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		date = d
+	}
+	return expires.Sub(date)
+}
+
+// parseCacheControl returns the directives of the given Cache-Control header
+// value mapped to their (optional) values.
+func parseCacheControl(v string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value := part, ""
+		if idx := strings.Index(part, "="); idx > -1 {
+			key = part[:idx]
+			value = strings.Trim(part[idx+1:], "\"")
+		}
+		directives[strings.ToLower(key)] = value
+	}
+	return directives
+}
@@ -0,0 +1,235 @@
+package services
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedResponseWrite(t *testing.T) {
+	cr := &cachedResponse{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       []byte("hello"),
+		Created:    time.Now(),
+	}
+	rr := httptest.NewRecorder()
+	cr.Write(rr)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "text/plain", rr.Header().Get("Content-Type"))
+	require.Equal(t, "0", rr.Header().Get("Age"))
+	require.Equal(t, "hello", rr.Body.String())
+}
+
+func TestResponseCacheGetSet(t *testing.T) {
+	cache := newResponseCache(2, time.Minute)
+	require.Nil(t, cache.Get("a"))
+
+	now := time.Now()
+	for _, key := range []string{"a", "b"} {
+		cache.Set(&cachedResponse{
+			Key:     key,
+			Created: now,
+			Expires: now.Add(time.Minute),
+		})
+	}
+	require.Equal(t, 2, cache.Len())
+	require.NotNil(t, cache.Get("a"))
+
+	// "b" is the least recently used entry and is evicted
+	cache.Set(&cachedResponse{
+		Key:     "c",
+		Created: now,
+		Expires: now.Add(time.Minute),
+	})
+	require.Equal(t, 2, cache.Len())
+	require.Nil(t, cache.Get("b"))
+	require.NotNil(t, cache.Get("a"))
+	require.NotNil(t, cache.Get("c"))
+
+	// Expired entries are removed when retrieved
+	cache.Set(&cachedResponse{
+		Key:     "a",
+		Created: now,
+		Expires: now.Add(-time.Second),
+	})
+	require.Nil(t, cache.Get("a"))
+	require.Equal(t, 1, cache.Len())
+}
+
+func TestResponseCacheStore(t *testing.T) {
+	cache := newResponseCache(10, time.Minute)
+	body := "hello"
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Cache-Control": {"max-age=10"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+	require.Nil(t, cache.Store("key", resp))
+	actual, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, body, string(actual))
+	cr := cache.Get("key")
+	require.NotNil(t, cr)
+	require.Equal(t, body, string(cr.Body))
+	require.WithinDuration(t, time.Now().Add(10*time.Second), cr.Expires,
+		time.Second)
+
+	// Bodies that are too large are passed along but not cached
+	large := bytes.Repeat([]byte("a"), CacheMaxBodySize+10)
+	resp = &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Cache-Control": {"max-age=10"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(large)),
+		ContentLength: -1,
+	}
+	require.Nil(t, cache.Store("large", resp))
+	actual, err = ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, large, actual)
+	require.Nil(t, cache.Get("large"))
+
+	// Responses that vary by request headers only match requests with the
+	// same values of them
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp = &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Cache-Control": {"public"},
+			"Vary":          {"accept-encoding, Origin"},
+		},
+		Body:    ioutil.NopCloser(strings.NewReader(body)),
+		Request: req,
+	}
+	require.Nil(t, cache.Store("vary", resp))
+	cr = cache.Get("vary")
+	require.NotNil(t, cr)
+	require.True(t, cr.Matches(req))
+	other := req.Clone(req.Context())
+	other.Header.Set("Accept-Encoding", "br")
+	require.False(t, cr.Matches(other))
+	other.Header.Del("Accept-Encoding")
+	require.False(t, cr.Matches(other))
+	other.Header.Set("Accept-Encoding", "gzip")
+	other.Header.Set("Origin", "https://example.com")
+	require.False(t, cr.Matches(other))
+
+	// and are not cached if the request is unknown
+	resp.Request = nil
+	resp.Body = ioutil.NopCloser(strings.NewReader(body))
+	require.Nil(t, cache.Store("unknown", resp))
+	require.Nil(t, cache.Get("unknown"))
+}
+
+func TestCacheKey(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet,
+		"http://example.com/path?q=1", nil)
+	require.Nil(t, err)
+	require.Equal(t, "GET example.com/path?q=1", cacheKey(req))
+}
+
+func TestIsCacheableRequest(t *testing.T) {
+	tests := []struct {
+		Method   string
+		Header   http.Header
+		Expected bool
+	}{
+		{http.MethodGet, http.Header{}, true},
+		{http.MethodPost, http.Header{}, false},
+		{http.MethodHead, http.Header{}, false},
+		{http.MethodGet, http.Header{"Authorization": {"x"}}, false},
+		{http.MethodGet, http.Header{"Cache-Control": {"no-cache"}}, false},
+		{http.MethodGet, http.Header{"Cache-Control": {"no-store"}}, false},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.Method, "/", nil)
+		require.Nil(t, err)
+		req.Header = test.Header
+		require.Equal(t, test.Expected, isCacheableRequest(req))
+	}
+}
+
+func TestResponseTTL(t *testing.T) {
+	def := time.Minute
+	tests := []struct {
+		Status      int
+		Header      http.Header
+		ExpectedTTL time.Duration
+		ExpectedOk  bool
+	}{
+		{http.StatusOK, http.Header{}, 0, false},
+		{http.StatusNotFound, http.Header{"Cache-Control": {"public"}}, 0,
+			false},
+		{http.StatusOK, http.Header{"Set-Cookie": {"a=b"}}, 0, false},
+		{http.StatusOK, http.Header{"Vary": {"*"}}, 0, false},
+		{http.StatusOK, http.Header{"Cache-Control": {"no-store"}}, 0, false},
+		{http.StatusOK, http.Header{"Cache-Control": {"private"}}, 0, false},
+		{http.StatusOK, http.Header{"Cache-Control": {"max-age=0"}}, 0, false},
+		{http.StatusOK, http.Header{"Cache-Control": {"public"}}, def, true},
+		{
+			http.StatusOK,
+			http.Header{
+				"Date":    {"Sun, 18 Oct 2026 10:00:00 GMT"},
+				"Expires": {"Sun, 18 Oct 2026 10:00:30 GMT"},
+			},
+			30 * time.Second,
+			true,
+		},
+		{
+			http.StatusOK,
+			http.Header{
+				"Cache-Control": {"public"},
+				"Expires":       {"Sun, 18 Oct 2020 10:00:00 GMT"},
+			},
+			0,
+			false,
+		},
+		{http.StatusOK, http.Header{"Expires": {"0"}}, 0, false},
+		{
+			http.StatusOK,
+			http.Header{"Cache-Control": {"public, max-age=30"}},
+			30 * time.Second,
+			true,
+		},
+		{
+			http.StatusOK,
+			http.Header{"Cache-Control": {"max-age=30, s-maxage=5"}},
+			5 * time.Second,
+			true,
+		},
+		{
+			http.StatusOK,
+			http.Header{"Cache-Control": {"max-age=3600"}},
+			def,
+			true,
+		},
+	}
+	for _, test := range tests {
+		resp := &http.Response{
+			StatusCode: test.Status,
+			Header:     test.Header,
+		}
+		ttl, ok := responseTTL(resp, def)
+		require.Equal(t, test.ExpectedOk, ok)
+		require.Equal(t, test.ExpectedTTL, ttl)
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	actual := parseCacheControl("Public, max-age=\"60\", no-transform")
+	expected := map[string]string{
+		"public":       "",
+		"max-age":      "60",
+		"no-transform": "",
+	}
+	require.Equal(t, expected, actual)
+	require.Equal(t, map[string]string{}, parseCacheControl(""))
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/grpchealth"
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+// healthCheckClient is the client used to probe targets; it does not follow
+// redirects, since a redirect is considered healthy, and skips verifying
+// certificates like the connection checks do.
+var healthCheckClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+	Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	},
+}
+
+// checkServices probes the pool's services concurrently with the given timeout,
+// at most ServiceHealthCheckWorkers at a time, and sets whether they are alive.
+// It returns once every service is probed.
+func (pool *servicePool) checkServices(to time.Duration) {
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, ServiceHealthCheckWorkers)
+	for _, svc := range pool.services() {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(t targets.Target) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			alive := targets.Probe(pool.HealthRetries, func() bool {
+				return pool.isHealthy(t, to)
+			})
+			wasAlive := pool.setAlive(t, alive)
+			if alive != wasAlive && pool.HealthChange != nil {
+				pool.HealthChange(t, wasAlive, alive)
+			}
+		}(svc.Target)
+	}
+	wg.Wait()
+}
+
+// isHealthy returns true if the given target passes the pool's health check
+// within the given timeout. Without a health check, the target only needs to
+// accept connections.
+func (pool *servicePool) isHealthy(t targets.Target, to time.Duration) bool {
+	if pool.Health == nil {
+		return t.IsAvailable(to)
+	}
+	if pool.Health.IsGrpc() {
+		hostPort := net.JoinHostPort(t.Host(), strconv.Itoa(t.HealthPort()))
+		return grpchealth.Check("tcp", hostPort, to,
+			targets.IsTLS(t.Protocol()), pool.Health.Service)
+	}
+	req, err := newHealthCheckRequest(t, pool.Health)
+	if err != nil {
+		return false
+	}
+	client := *healthCheckClient
+	client.Timeout = to
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return false
+	}
+	if pool.Health.BodyMatch == "" {
+		io.Copy(ioutil.Discard, resp.Body)
+		return true
+	}
+	return pool.matchesBody(resp.Body)
+}
+
+// matchesBody returns true if the first HealthCheckMaxBody bytes of the given
+// health check response body match the pool's body pattern. Without a valid
+// pattern, the body never matches.
+func (pool *servicePool) matchesBody(body io.Reader) bool {
+	if pool.HealthMatch == nil {
+		return false
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(body, HealthCheckMaxBody))
+	if err != nil {
+		return false
+	}
+	return pool.HealthMatch.Match(b)
+}
+
+// newHealthCheckRequest returns the health check request for the given target
+// and configuration.
+func newHealthCheckRequest(t targets.Target, c *targets.HealthCheckConfig) (*http.Request, error) {
+	method := c.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	path := c.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	var body io.Reader
+	if c.Body != "" {
+		body = strings.NewReader(c.Body)
+	}
+	req, err := http.NewRequest(method, t.HealthURL()+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+	if c.Host != "" {
+		req.Host = c.Host
+	}
+	return req, nil
+}
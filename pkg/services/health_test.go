@@ -0,0 +1,241 @@
+package services
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+func TestServicePoolIsHealthy(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			if r.Method != http.MethodPost ||
+				r.URL.Path != "/health" ||
+				r.Host != "api.example.com" ||
+				r.Header.Get("Authorization") != "Bearer token" ||
+				r.Header.Get("Content-Type") != "application/json" ||
+				string(body) != `{"deep": true}` {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	target := targets.NewServiceTarget(targetUrl)
+
+	// Without an HTTP health check, accepting connections is enough
+	pool := &servicePool{}
+	require.True(t, pool.isHealthy(target, time.Second))
+
+	health := &targets.HealthCheckConfig{
+		Path:   "health",
+		Method: http.MethodPost,
+		Headers: map[string]string{
+			"Authorization": "Bearer token",
+			"Content-Type":  "application/json",
+		},
+		Body: `{"deep": true}`,
+		Host: "api.example.com",
+	}
+	pool.SetHealthCheck(health)
+	require.True(t, pool.isHealthy(target, time.Second))
+
+	health.Headers["Authorization"] = "Bearer wrong"
+	require.False(t, pool.isHealthy(target, time.Second))
+
+	ts.Close()
+	health.Headers["Authorization"] = "Bearer token"
+	require.False(t, pool.isHealthy(target, time.Second))
+}
+
+func TestServicePoolHealthCheckBodyMatch(t *testing.T) {
+	pad, status := "", "ok"
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `%s{"status": "%s"}`, pad, status)
+		}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	target := targets.NewServiceTarget(targetUrl)
+	pool := &servicePool{}
+	pool.SetHealthCheck(&targets.HealthCheckConfig{
+		Path:      "/health",
+		BodyMatch: `"status":\s*"ok"`,
+	})
+	require.True(t, pool.isHealthy(target, time.Second))
+
+	// A degraded target still responds 200
+	status = "degraded"
+	require.False(t, pool.isHealthy(target, time.Second))
+
+	// Only the start of the body is matched
+	status = "ok"
+	pad = strings.Repeat(" ", HealthCheckMaxBody)
+	require.False(t, pool.isHealthy(target, time.Second))
+	pad = ""
+	require.True(t, pool.isHealthy(target, time.Second))
+
+	// An invalid pattern never matches
+	pool.SetHealthCheck(&targets.HealthCheckConfig{BodyMatch: "("})
+	require.Nil(t, pool.HealthMatch)
+	require.False(t, pool.isHealthy(target, time.Second))
+}
+
+func TestServicePoolHealthCheckTimeout(t *testing.T) {
+	var probes int32
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&probes, 1)
+			time.Sleep(200 * time.Millisecond)
+		}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	pool := &servicePool{}
+	pool.SetHealthCheck(&targets.HealthCheckConfig{Path: "/health"})
+	require.Nil(t, pool.AddService(targets.NewServiceTarget(targetUrl)))
+	svc := pool.CurrentService()
+
+	// Probes slower than the interval are not stacked
+	stop := pool.HealthCheck(20*time.Millisecond, time.Second)
+	time.Sleep(300 * time.Millisecond)
+	stop()
+	require.True(t, svc.Target.IsAlive())
+	require.LessOrEqual(t, atomic.LoadInt32(&probes), int32(2))
+
+	// Probes slower than the timeout fail
+	stop = pool.HealthCheck(20*time.Millisecond, 50*time.Millisecond)
+	time.Sleep(150 * time.Millisecond)
+	stop()
+	require.False(t, svc.Target.IsAlive())
+}
+
+func TestServicePoolCheckServicesConcurrently(t *testing.T) {
+	pool := &servicePool{}
+	pool.SetHealthCheck(&targets.HealthCheckConfig{Path: "/health"})
+	for i := 0; i < 5; i++ {
+		ts := httptest.NewServer(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(200 * time.Millisecond)
+			}),
+		)
+		defer ts.Close()
+		targetUrl, err := url.Parse(ts.URL)
+		require.Nil(t, err)
+		target := targets.NewServiceTarget(targetUrl)
+		target.SetAlive(false)
+		require.Nil(t, pool.AddService(target))
+	}
+
+	// Probing sequentially would take at least a second
+	start := time.Now()
+	pool.checkServices(time.Second)
+	require.Less(t, time.Since(start), 600*time.Millisecond)
+	for _, svc := range pool.services() {
+		require.True(t, svc.Target.IsAlive())
+	}
+}
+
+func TestServicePoolHealthChange(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	pool := &servicePool{}
+	require.Nil(t, pool.AddService(targets.NewServiceTarget(targetUrl)))
+	type change struct{ wasAlive, alive bool }
+	changes := []change{}
+	pool.SetHealthChange(func(t targets.Target, wasAlive, alive bool) {
+		changes = append(changes, change{wasAlive, alive})
+	})
+
+	// Only transitions are reported
+	pool.checkServices(time.Second)
+	require.Len(t, changes, 0)
+	ts.Close()
+	pool.checkServices(time.Second)
+	pool.checkServices(time.Second)
+	require.Equal(t, []change{{true, false}}, changes)
+}
+
+func TestServicePoolHealthCheckRetries(t *testing.T) {
+	var probes int32
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The first probes are dropped
+			if atomic.AddInt32(&probes, 1) <= 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	target := targets.NewServiceTarget(targetUrl)
+	pool := &servicePool{}
+	pool.SetHealthCheck(&targets.HealthCheckConfig{Path: "/health"})
+	require.Nil(t, pool.AddService(target))
+
+	pool.CheckHealth(time.Second)
+	require.False(t, target.IsAlive())
+	require.Equal(t, int32(1), atomic.LoadInt32(&probes))
+
+	pool.SetHealthCheckRetries(-1)
+	require.Equal(t, 0, pool.HealthRetries)
+	pool.SetHealthCheckRetries(2)
+	pool.CheckHealth(time.Second)
+	require.True(t, target.IsAlive())
+	require.Equal(t, int32(4), atomic.LoadInt32(&probes))
+}
+
+func TestServicePoolHealthCheckPort(t *testing.T) {
+	health := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/health" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer health.Close()
+	healthUrl, err := url.Parse(health.URL)
+	require.Nil(t, err)
+	healthPort, err := strconv.Atoi(healthUrl.Port())
+	require.Nil(t, err)
+
+	// The service itself has no health path
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	target := targets.NewServiceTarget(targetUrl)
+	pool := &servicePool{}
+	pool.SetHealthCheck(&targets.HealthCheckConfig{Path: "/health"})
+	require.Nil(t, pool.AddService(target))
+	require.False(t, pool.isHealthy(target, time.Second))
+
+	target.SetHealthPort(healthPort)
+	require.True(t, pool.isHealthy(target, time.Second))
+}
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds of the latency histogram buckets
+// of each service when none are set; from 1ms to a minute, each about a quarter
+// wider than the last. Percentiles are estimated within a bucket, so they are
+// accurate to within its width.
+var DefaultLatencyBuckets = exponentialBuckets(time.Millisecond, time.Minute, 1.25)
+
+// LatencyStats represents the estimated latency percentiles of the requests
+// served by a service.
+type LatencyStats struct {
+	Count int64         // Requests measured
+	P50   time.Duration // Median latency
+	P90   time.Duration // 90th percentile latency
+	P99   time.Duration // 99th percentile latency
+}
+
+// latencyHistogram is a streaming histogram of request latencies; each latency
+// is counted in the first bucket whose bound it does not exceed, and those past
+// the last bound in an overflow bucket. It is safe for concurrent use.
+type latencyHistogram struct {
+	Bounds []time.Duration // Sorted bucket upper bounds
+	Counts []int64         // Bucket counts; one more than the bounds
+}
+
+// newLatencyHistogram returns a new latency histogram of the given bucket
+// bounds, and of the default buckets if none are valid.
+func newLatencyHistogram(bounds []time.Duration) *latencyHistogram {
+	if !validLatencyBuckets(bounds) {
+		bounds = DefaultLatencyBuckets
+	}
+	return &latencyHistogram{
+		Bounds: bounds,
+		Counts: make([]int64, len(bounds)+1),
+	}
+}
+
+// Observe counts the given latency in its bucket.
+func (h *latencyHistogram) Observe(d time.Duration) {
+	idx := sort.Search(len(h.Bounds), func(i int) bool {
+		return d <= h.Bounds[i]
+	})
+	atomic.AddInt64(&h.Counts[idx], 1)
+}
+
+// Stats returns the estimated percentiles of the latencies observed so far.
+func (h *latencyHistogram) Stats() LatencyStats {
+	counts := make([]int64, len(h.Counts))
+	var total int64
+	for i := range h.Counts {
+		counts[i] = atomic.LoadInt64(&h.Counts[i])
+		total += counts[i]
+	}
+	return LatencyStats{
+		Count: total,
+		P50:   h.percentile(counts, total, 0.5),
+		P90:   h.percentile(counts, total, 0.9),
+		P99:   h.percentile(counts, total, 0.99),
+	}
+}
+
+// percentile returns the latency under which the given fraction of the counted
+// latencies fall, interpolated linearly within its bucket. Latencies past the
+// last bound are reported as the last bound; zero is returned if none are
+// counted.
+func (h *latencyHistogram) percentile(counts []int64, total int64, q float64) time.Duration {
+	if total == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	var seen int64
+	for i, n := range counts {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		if i == len(h.Bounds) {
+			break
+		}
+		lower := time.Duration(0)
+		if i > 0 {
+			lower = h.Bounds[i-1]
+		}
+		frac := (rank - float64(seen)) / float64(n)
+		return lower + time.Duration(frac*float64(h.Bounds[i]-lower))
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// validLatencyBuckets returns true if the given bucket bounds are positive and
+// strictly increasing.
+func validLatencyBuckets(bounds []time.Duration) bool {
+	if len(bounds) == 0 {
+		return false
+	}
+	for i, b := range bounds {
+		if b <= 0 || (i > 0 && b <= bounds[i-1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// exponentialBuckets returns the bucket bounds from min to at least max, each
+// the given factor wider than the last.
+func exponentialBuckets(min, max time.Duration, factor float64) []time.Duration {
+	bounds := []time.Duration{}
+	for b := float64(min); ; b *= factor {
+		bounds = append(bounds, time.Duration(b).Round(time.Microsecond))
+		if time.Duration(b) >= max {
+			return bounds
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	h := newLatencyHistogram([]time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		100 * time.Millisecond,
+	})
+	require.Equal(t, LatencyStats{}, h.Stats())
+
+	// 80 fast, 15 medium, and 5 slow requests
+	for i := 0; i < 80; i++ {
+		h.Observe(5 * time.Millisecond)
+	}
+	for i := 0; i < 15; i++ {
+		h.Observe(15 * time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		h.Observe(50 * time.Millisecond)
+	}
+	stats := h.Stats()
+	require.Equal(t, int64(100), stats.Count)
+	require.Equal(t, 6250*time.Microsecond, stats.P50)
+	require.Equal(t, 10*time.Millisecond+6666666*time.Nanosecond, stats.P90)
+	require.Equal(t, 84*time.Millisecond, stats.P99)
+
+	// Latencies past the last bound are reported as it
+	for i := 0; i < 1000; i++ {
+		h.Observe(time.Second)
+	}
+	require.Equal(t, 100*time.Millisecond, h.Stats().P50)
+}
+
+func TestNewLatencyHistogramDefaults(t *testing.T) {
+	invalid := [][]time.Duration{
+		nil,
+		{0, time.Millisecond},
+		{2 * time.Millisecond, time.Millisecond},
+	}
+	for _, bounds := range invalid {
+		require.Equal(t, DefaultLatencyBuckets,
+			newLatencyHistogram(bounds).Bounds)
+	}
+	require.Equal(t, time.Millisecond, DefaultLatencyBuckets[0])
+	require.GreaterOrEqual(t,
+		DefaultLatencyBuckets[len(DefaultLatencyBuckets)-1], time.Minute)
+	require.True(t, validLatencyBuckets(DefaultLatencyBuckets))
+}
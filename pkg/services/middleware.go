@@ -0,0 +1,24 @@
+package services
+
+import (
+	"net/http"
+)
+
+// Middleware is a prototype for a function that wraps a handler; typically to
+// filter or decorate requests before passing them on to the wrapped handler.
+type Middleware func(http.Handler) http.Handler
+
+// Chain is an ordered list of middleware. The first middleware in the chain is
+// the first to receive a request.
+type Chain []Middleware
+
+// Then returns the given handler wrapped by each middleware in the chain. Nil
+// middleware are skipped.
+func (c Chain) Then(h http.Handler) http.Handler {
+	for i := len(c) - 1; i >= 0; i-- {
+		if c[i] != nil {
+			h = c[i](h)
+		}
+	}
+	return h
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/ratelimit"
+	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
+)
+
+// RateLimiter represents a rate limit of the requests of each client IP that
+// applies in addition to the rate limit of the pool serving them; E.g. to limit
+// the requests of an expensive route more tightly.
+type RateLimiter interface {
+	// GC starts the garbage collector of the clients' rate limiters and
+	// returns a stop function to stop it.
+	GC() StopFn
+
+	// Middleware returns a middleware that answers the requests of clients
+	// past their rate limit with 429 Too Many Requests, in the given
+	// response format.
+	Middleware(format ResponseFormat) Middleware
+
+	// SetTrustedProxies sets the IP addresses and CIDR ranges of the
+	// proxies whose forwarding headers are trusted. Clients are keyed by
+	// their connection's address, unless it is a trusted proxy; then by the
+	// address the proxy forwarded.
+	SetTrustedProxies(proxies []string)
+}
+
+// rateLimiter implements the RateLimiter interface.
+type rateLimiter struct {
+	Capacity       int64                // Capacity of requests in a queue
+	IPRegistry     ratelimit.IPRegistry // Rate limiters per client IP
+	Rate           time.Duration        // Request rate
+	TrustedProxies []string             // Proxies trusted to forward client IPs
+}
+
+// NewRateLimiter returns a new RateLimiter that allows each client a request
+// per the given rate, with the given capacity of queued requests.
+func NewRateLimiter(rate time.Duration, capacity int64) RateLimiter {
+	return &rateLimiter{
+		Capacity:   capacity,
+		IPRegistry: ratelimit.NewIPRegistry(rate),
+		Rate:       rate,
+	}
+}
+
+func (rl *rateLimiter) GC() StopFn {
+	return StopFn(rl.IPRegistry.GC())
+}
+
+func (rl *rateLimiter) Middleware(format ResponseFormat) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := rl.clientIp(r)
+			if ip == nil {
+				// Left to the pool, which does not serve it either
+				next.ServeHTTP(w, r)
+				return
+			}
+			limiter := rl.IPRegistry.Get(ip)
+			if limiter == nil {
+				limiter = ratelimit.NewLeakyBucket(rl.Capacity,
+					int64(rl.Rate))
+				rl.IPRegistry.Set(ip, limiter)
+			}
+			wait, err := limiter.Next()
+			if err == ratelimit.ErrLimiterMaxCapacity {
+				handleTooManyRequests(w, format.Negotiate(r), wait)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (rl *rateLimiter) SetTrustedProxies(proxies []string) {
+	rl.TrustedProxies = append([]string{}, proxies...)
+}
+
+// clientIp returns the IP address of the given request's client; the address
+// of its connection, unless the connection is from a trusted proxy.
+func (rl *rateLimiter) clientIp(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && rules.ContainsIP(rl.TrustedProxies, ip) {
+		return getIpFromRequest(r)
+	}
+	return ip
+}
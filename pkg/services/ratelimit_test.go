@@ -0,0 +1,43 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	// Clients get two requests a minute
+	rl := NewRateLimiter(time.Minute, 0)
+	stop := rl.GC()
+	defer stop()
+	handler := rl.Middleware(ResponseFormatJson)(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/search", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-Real-IP", "10.9.9.9")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, serve("10.0.0.1:1234").Code)
+	require.Equal(t, http.StatusOK, serve("10.0.0.1:1234").Code)
+	w := serve("10.0.0.1:1234")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	// Other clients have their own limit, despite the forwarding header
+	require.Equal(t, http.StatusOK, serve("10.0.0.2:1234").Code)
+
+	// which is only trusted from the given proxies
+	rl.SetTrustedProxies([]string{"192.168.0.0/16"})
+	require.Equal(t, http.StatusOK, serve("192.168.0.1:1234").Code)
+	require.Equal(t, http.StatusOK, serve("192.168.0.2:1234").Code)
+	require.Equal(t, http.StatusTooManyRequests,
+		serve("192.168.0.3:1234").Code)
+}
@@ -0,0 +1,51 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const (
+	// DefaultRequestIdHeader is the default name of the header that
+	// carries a request's ID.
+	DefaultRequestIdHeader = "X-Request-ID"
+
+	// RequestIdMaxLength is the longest request ID honored from a client;
+	// longer IDs are replaced.
+	RequestIdMaxLength = 128
+)
+
+// requestId returns the ID of the given request from the named header, if the
+// client sent a valid one, otherwise a new ID is returned.
+func requestId(r *http.Request, header string) string {
+	id := r.Header.Get(header)
+	if isValidRequestId(id) {
+		return id
+	}
+	return newRequestId()
+}
+
+// newRequestId returns a new random request ID.
+func newRequestId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// isValidRequestId returns true if the given request ID is not empty, is no
+// longer than RequestIdMaxLength, and is made of printable ASCII characters;
+// so a client can not forge log lines with it.
+func isValidRequestId(id string) bool {
+	if id == "" || len(id) > RequestIdMaxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
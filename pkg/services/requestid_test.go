@@ -0,0 +1,65 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+func TestRequestId(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	id := requestId(r, DefaultRequestIdHeader)
+	require.Len(t, id, 32)
+	require.NotEqual(t, id, requestId(r, DefaultRequestIdHeader))
+
+	r.Header.Set(DefaultRequestIdHeader, "abc-123")
+	require.Equal(t, "abc-123", requestId(r, DefaultRequestIdHeader))
+
+	// Invalid IDs are replaced
+	for _, v := range []string{
+		"abc 123",
+		"abc\n123",
+		strings.Repeat("a", RequestIdMaxLength+1),
+	} {
+		r.Header.Set(DefaultRequestIdHeader, v)
+		require.NotEqual(t, v, requestId(r, DefaultRequestIdHeader))
+	}
+}
+
+func TestServicePoolRequestId(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Seen-Id", r.Header.Get("X-Trace-Id"))
+			// Backends can not replace the ID
+			w.Header().Set("X-Trace-Id", "backend")
+		}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	pool := New(int64(time.Millisecond), 100)
+	require.Nil(t, pool.AddService(targets.NewServiceTarget(targetUrl)))
+	pool.SetRequestIdHeader("X-Trace-Id")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	pool.LoadBalancer().ServeHTTP(w, r)
+	id := w.Header().Get("X-Trace-Id")
+	require.Len(t, id, 32)
+	require.Equal(t, id, w.Header().Get("X-Seen-Id"))
+	require.Equal(t, []string{id}, w.Header().Values("X-Trace-Id"))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Trace-Id", "client-1")
+	pool.LoadBalancer().ServeHTTP(w, r)
+	require.Equal(t, "client-1", w.Header().Get("X-Trace-Id"))
+	require.Equal(t, "client-1", w.Header().Get("X-Seen-Id"))
+}
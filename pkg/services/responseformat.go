@@ -1,6 +1,9 @@
 package services
 
 import (
+	"mime"
+	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -19,6 +22,7 @@ const (
 	ResponseFormatHtml
 	ResponseFormatJson
 	ResponseFormatPlain
+	ResponseFormatAuto
 )
 
 const DefaultResponseFormat = ResponseFormatPlain
@@ -30,6 +34,15 @@ var ResponseFormatStrings = []string{
 	"html",
 	"json",
 	"plain",
+	"auto",
+}
+
+// acceptFormats maps the media types of Accept headers to the response formats
+// negotiated for them.
+var acceptFormats = map[string]ResponseFormat{
+	"application/json": ResponseFormatJson,
+	"text/html":        ResponseFormatHtml,
+	"text/plain":       ResponseFormatPlain,
 }
 
 // ToResponseFormat returns the ResponseFormat for a given string. If a match
@@ -43,12 +56,54 @@ func ToResponseFormat(v string) ResponseFormat {
 	return ResponseFormatUnknown
 }
 
+// Normalize returns the response format if it is known, otherwise
+// ResponseFormatUnknown is returned. This guards against out-of-range values;
+// E.g. an integer read from a configuration file.
+func (f ResponseFormat) Normalize() ResponseFormat {
+	if int(f) >= len(ResponseFormatStrings) {
+		return ResponseFormatUnknown
+	}
+	return f
+}
+
+// Negotiate returns the response format of the given request. The auto format
+// follows the request's Accept header; the accepted media type with the highest
+// quality among JSON, HTML, and plain text is used, or else the default format.
+// E.g. browsers get HTML and API clients asking for JSON get JSON. Other
+// formats are returned as is.
+func (f ResponseFormat) Negotiate(r *http.Request) ResponseFormat {
+	if f != ResponseFormatAuto {
+		return f
+	}
+	best, bestQ := DefaultResponseFormat, 0.0
+	if r == nil {
+		return best
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mt, params, err := mime.ParseMediaType(part)
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if v, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(v, 64); err != nil {
+					continue
+				}
+			}
+			format, ok := acceptFormats[mt]
+			if !ok || q <= bestQ {
+				continue
+			}
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
 // String returns the string representation for a given response format. If the
 // response format is not known the string representation of
 // RepsonseFormatUnknown is returned instead.
 func (f ResponseFormat) String() string {
-	if f > ResponseFormat(len(ResponseFormatStrings)) {
-		f = ResponseFormatUnknown
-	}
-	return ResponseFormatStrings[int(f)]
+	return ResponseFormatStrings[int(f.Normalize())]
 }
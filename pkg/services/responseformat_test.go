@@ -1,6 +1,8 @@
 package services
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -15,6 +17,7 @@ func TestToResponseFormat(t *testing.T) {
 		{"hTmL", ResponseFormatHtml},
 		{"JSON", ResponseFormatJson},
 		{"plain", ResponseFormatPlain},
+		{"Auto", ResponseFormatAuto},
 		{"wat", ResponseFormatUnknown},
 	}
 	for _, test := range tests {
@@ -22,6 +25,23 @@ func TestToResponseFormat(t *testing.T) {
 	}
 }
 
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		Fmt      ResponseFormat
+		Expected ResponseFormat
+	}{
+		{ResponseFormatUnknown, ResponseFormatUnknown},
+		{ResponseFormatHtml, ResponseFormatHtml},
+		{ResponseFormatJson, ResponseFormatJson},
+		{ResponseFormatPlain, ResponseFormatPlain},
+		{ResponseFormat(len(ResponseFormatStrings)), ResponseFormatUnknown},
+		{ResponseFormat(1000), ResponseFormatUnknown},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.Expected, test.Fmt.Normalize())
+	}
+}
+
 func TestString(t *testing.T) {
 	tests := []struct {
 		Fmt      ResponseFormat
@@ -31,6 +51,7 @@ func TestString(t *testing.T) {
 		{ResponseFormatHtml, "html"},
 		{ResponseFormatJson, "json"},
 		{ResponseFormatPlain, "plain"},
+		{ResponseFormat(len(ResponseFormatStrings)), "unknown"},
 		{ResponseFormat(1000), "unknown"},
 	}
 	for _, test := range tests {
@@ -38,3 +59,29 @@ func TestString(t *testing.T) {
 	}
 
 }
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		Fmt      ResponseFormat
+		Accept   string
+		Expected ResponseFormat
+	}{
+		{ResponseFormatJson, "text/html", ResponseFormatJson},
+		{ResponseFormatAuto, "", DefaultResponseFormat},
+		{ResponseFormatAuto, "*/*", DefaultResponseFormat},
+		{ResponseFormatAuto, "application/json", ResponseFormatJson},
+		{ResponseFormatAuto, "text/plain, application/json;q=0.5", ResponseFormatPlain},
+		{ResponseFormatAuto, "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", ResponseFormatHtml},
+		{ResponseFormatAuto, "text/html;q=0.2, application/json;q=0.9", ResponseFormatJson},
+		{ResponseFormatAuto, "application/json;q=0", DefaultResponseFormat},
+		{ResponseFormatAuto, "application/json;q=x", DefaultResponseFormat},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if test.Accept != "" {
+			r.Header.Set("Accept", test.Accept)
+		}
+		require.Equal(t, test.Expected, test.Fmt.Negotiate(r), test.Accept)
+	}
+	require.Equal(t, DefaultResponseFormat, ResponseFormatAuto.Negotiate(nil))
+}
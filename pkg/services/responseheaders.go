@@ -0,0 +1,78 @@
+package services
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+// rewriteResponseHeaders applies the given response header rules to the
+// response; the Location header is rewritten separately, see rewriteLocation.
+func rewriteResponseHeaders(resp *http.Response, c *targets.ResponseHeadersConfig) {
+	if c == nil {
+		return
+	}
+	for _, name := range c.Remove {
+		resp.Header.Del(name)
+	}
+	for name, value := range c.Set {
+		resp.Header.Set(name, value)
+	}
+}
+
+// rewriteLocation rewrites the Location header of the given redirect response
+// to the host and scheme the client used, if it points to the target. Relative
+// locations and locations of other hosts are left as is.
+func rewriteLocation(resp *http.Response, target targets.Target) {
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 {
+		return
+	}
+	if loc := resp.Header.Get("Location"); loc != "" {
+		resp.Header.Set("Location",
+			publicLocation(loc, resp.Request, target))
+	}
+}
+
+// publicLocation returns the given location rewritten to the host and scheme the
+// client used for the request, if it points to the target; else it is returned
+// as is. The target's base path is stripped, since requests are proxied under
+// it.
+func publicLocation(loc string, r *http.Request, target targets.Target) string {
+	u, err := url.Parse(loc)
+	if err != nil || r == nil || r.Host == "" || !u.IsAbs() {
+		return loc
+	}
+	targetUrl, err := url.Parse(target.URL())
+	if err != nil || !sameHost(u, targetUrl) {
+		return loc
+	}
+	u.Scheme = "http"
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	u.Host = r.Host
+	if base := strings.TrimSuffix(target.Path(), "/"); base != "" &&
+		(u.Path == base || strings.HasPrefix(u.Path, base+"/")) {
+		u.Path = "/" + strings.TrimPrefix(u.Path[len(base):], "/")
+		u.RawPath = ""
+	}
+	return u.String()
+}
+
+// sameHost returns true if the given URLs have the same host and port; missing
+// ports default to those of their schemes.
+func sameHost(a, b *url.URL) bool {
+	return strings.EqualFold(a.Hostname(), b.Hostname()) &&
+		urlPort(a) == urlPort(b)
+}
+
+// urlPort returns the port of the given URL, or else the port of its scheme.
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	return strconv.Itoa(targets.GetPort(u.Scheme))
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+func TestPublicLocation(t *testing.T) {
+	target := targets.NewTarget("10.0.0.1", 8080, "http")
+	baseUrl, err := url.Parse("http://10.0.0.1:8080/base")
+	require.Nil(t, err)
+	base := targets.NewServiceTarget(baseUrl)
+	plain := httptest.NewRequest(http.MethodGet, "http://api.example.com/", nil)
+	secure := httptest.NewRequest(http.MethodGet, "https://api.example.com/", nil)
+	secure.TLS = &tls.ConnectionState{}
+	tests := []struct {
+		Location string
+		Request  *http.Request
+		Target   targets.Target
+		Expected string
+	}{
+		{"http://10.0.0.1:8080/login?next=%2F", plain, target, "http://api.example.com/login?next=%2F"},
+		{"http://10.0.0.1:8080/login", secure, target, "https://api.example.com/login"},
+		{"https://10.0.0.1:8080/login", plain, target, "http://api.example.com/login"},
+		{"http://10.0.0.1:8080/base/login", plain, base, "http://api.example.com/login"},
+		{"http://10.0.0.1:8080/base", plain, base, "http://api.example.com/"},
+		{"http://10.0.0.1:8080/basement", plain, base, "http://api.example.com/basement"},
+		// Other hosts and relative locations are kept
+		{"http://10.0.0.1:9090/login", plain, target, "http://10.0.0.1:9090/login"},
+		{"http://example.org/login", plain, target, "http://example.org/login"},
+		{"/login", plain, target, "/login"},
+	}
+	for _, test := range tests {
+		actual := publicLocation(test.Location, test.Request, test.Target)
+		require.Equal(t, test.Expected, actual, test.Location)
+	}
+}
+
+func TestServicePoolSetResponseHeaders(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Server", "internal/1.0")
+			w.Header().Set("X-Frame-Options", "ALLOW")
+			w.Header().Set("Location", ts.URL+"/base/login")
+			w.WriteHeader(http.StatusFound)
+		}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL + "/base")
+	require.Nil(t, err)
+	pool := New(int64(time.Millisecond), 100)
+	require.Nil(t, pool.AddService(targets.NewServiceTarget(targetUrl)))
+
+	// Responses are passed through by default
+	r := httptest.NewRequest(http.MethodGet, "http://api.example.com/", nil)
+	w := httptest.NewRecorder()
+	pool.LoadBalancer().ServeHTTP(w, r)
+	require.Equal(t, http.StatusFound, w.Code)
+	require.Equal(t, "internal/1.0", w.Header().Get("Server"))
+	require.Equal(t, ts.URL+"/base/login", w.Header().Get("Location"))
+
+	pool.SetResponseHeaders(&targets.ResponseHeadersConfig{
+		Remove:          []string{"Server"},
+		Set:             map[string]string{"X-Frame-Options": "DENY"},
+		RewriteLocation: true,
+	})
+	w = httptest.NewRecorder()
+	pool.LoadBalancer().ServeHTTP(w, r)
+	require.Equal(t, http.StatusFound, w.Code)
+	require.Equal(t, "", w.Header().Get("Server"))
+	require.Equal(t, "DENY", w.Header().Get("X-Frame-Options"))
+	require.Equal(t, "http://api.example.com/login",
+		w.Header().Get("Location"))
+}
+
+func TestServicePoolSetRewriteLocation(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/created":
+				w.Header().Set("Location", ts.URL+"/items/1")
+				w.WriteHeader(http.StatusCreated)
+			case "/relative":
+				w.Header().Set("Location", "/login")
+				w.WriteHeader(http.StatusFound)
+			default:
+				w.Header().Set("Location", ts.URL+"/login")
+				w.WriteHeader(http.StatusMovedPermanently)
+			}
+		}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	pool := New(int64(time.Millisecond), 100)
+	require.Nil(t, pool.AddService(targets.NewServiceTarget(targetUrl)))
+	pool.SetRewriteLocation(true)
+
+	tests := []struct {
+		Path     string
+		Tls      bool
+		Expected string
+	}{
+		{"/", false, "http://api.example.com/login"},
+		{"/", true, "https://api.example.com/login"},
+		{"/relative", false, "/login"},
+		// Only redirects are rewritten
+		{"/created", false, ts.URL + "/items/1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet,
+			"http://api.example.com"+test.Path, nil)
+		if test.Tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		pool.LoadBalancer().ServeHTTP(w, r)
+		require.Equal(t, test.Expected, w.Header().Get("Location"))
+	}
+
+	// Either the pool's option or its response headers rewrite locations,
+	// and they are rewritten once if both are set
+	r := httptest.NewRequest(http.MethodGet, "http://api.example.com/", nil)
+	for _, enabled := range [][2]bool{{true, true}, {false, true},
+		{true, false}, {false, false}} {
+		pool.SetRewriteLocation(enabled[0])
+		pool.SetResponseHeaders(&targets.ResponseHeadersConfig{
+			RewriteLocation: enabled[1],
+		})
+		w := httptest.NewRecorder()
+		pool.LoadBalancer().ServeHTTP(w, r)
+		expected := ts.URL + "/login"
+		if enabled[0] || enabled[1] {
+			expected = "http://api.example.com/login"
+		}
+		require.Equal(t, expected, w.Header().Get("Location"))
+	}
+}
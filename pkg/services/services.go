@@ -2,18 +2,21 @@ package services
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"regexp"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/crossedbot/common/golang/logger"
-
+	"github.com/crossedbot/simpleloadbalancer/pkg/logging"
 	"github.com/crossedbot/simpleloadbalancer/pkg/ratelimit"
 	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
 	"github.com/crossedbot/simpleloadbalancer/pkg/templates"
@@ -23,20 +26,93 @@ const (
 	// Service constants
 	ServiceMaxAttempts   = 3
 	ServiceMaxRetries    = 3
-	ServiceRetryInterval = time.Millisecond * 100
+	ServiceRetryInterval = targets.DefaultBackoffBase // First retry delay
+)
 
-	// Context keys
-	ServiceContextAttemptKey = iota + 1
+// serviceContextKey is the type of the context keys set by service pools, so
+// they can not collide with the keys of other packages.
+type serviceContextKey int
+
+// Context keys
+const (
+	ServiceContextAttemptKey serviceContextKey = iota + 1
 	ServiceContextRetryKey
+	ServiceContextCacheKey
+	ServiceContextTriesKey   // Times the request was served to a backend
+	ServiceContextServiceKey // Service serving the request; to retry on it
+	ServiceContextStartKey   // Time the request was sent; to measure latency
+)
+
+// DefaultRetryBudget is the default number of times a request is served again
+// after its first backend attempt fails; across both retries and attempts of
+// other services.
+const DefaultRetryBudget = 3
+
+// Upstream headers; set on responses to name the backend that served them
+const (
+	UpstreamHeader      = "X-LB-Upstream"
+	UpstreamGroupHeader = "X-LB-Group"
 )
 
+// ServiceHealthCheckWorkers is the maximum number of services probed at once by
+// a health check.
+const ServiceHealthCheckWorkers = 16
+
+// HealthCheckMaxBody is the maximum number of bytes of a health check response
+// body that are matched against the health check's body pattern; the rest is
+// ignored, so a huge body does not stall the check.
+const HealthCheckMaxBody = 64 << 10
+
+// log is the logger of the services package.
+var log = logging.New("services")
+
 // StopFn is a prototype for a stop routine function.
 type StopFn func()
 
 // service represents a HTTP service.
 type service struct {
-	Target targets.Target         // Target service URL
-	Proxy  *httputil.ReverseProxy // Proxy to forward requests
+	Errors   int64                  // Requests that failed to be proxied
+	InFlight int64                  // Requests being served
+	Total    int64                  // Requests served
+	Latency  *latencyHistogram      // Response latencies
+	Target   targets.Target         // Target service URL
+	Proxy    *httputil.ReverseProxy // Proxy to forward requests
+}
+
+// ServiceStats represents a snapshot of the request counters of a service.
+// Each attempt of a request on the service is counted; so a retried request is
+// counted again.
+type ServiceStats struct {
+	Target   targets.Target // Service target
+	InFlight int64          // Requests being served
+	Total    int64          // Requests served, including in flight
+	Errors   int64          // Requests that failed to be proxied
+	Latency  LatencyStats   // Response latency percentiles
+}
+
+// serve proxies the given request to the service, and counts it in flight
+// until it is served.
+func (svc *service) serve(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&svc.Total, 1)
+	atomic.AddInt64(&svc.InFlight, 1)
+	defer atomic.AddInt64(&svc.InFlight, -1)
+	if rw, ok := w.(*responseWriter); ok {
+		rw.Target = svc.Target.URL()
+	}
+	ctx := context.WithValue(r.Context(), ServiceContextServiceKey, svc)
+	ctx = context.WithValue(ctx, ServiceContextStartKey, time.Now())
+	svc.Proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// stats returns a snapshot of the service's request counters.
+func (svc *service) stats() ServiceStats {
+	return ServiceStats{
+		Target:   svc.Target,
+		InFlight: atomic.LoadInt64(&svc.InFlight),
+		Total:    atomic.LoadInt64(&svc.Total),
+		Errors:   atomic.LoadInt64(&svc.Errors),
+		Latency:  svc.Latency.Stats(),
+	}
 }
 
 // ServicePool represents a pool of services for tracking and balancing requests
@@ -45,35 +121,198 @@ type ServicePool interface {
 	// AddService adds a new service to the pool for the given target URL.
 	AddService(target targets.Target) error
 
+	// Alive returns the number of alive services in the pool.
+	Alive() int
+
+	// CheckHealth probes the pool's services once with the given timeout
+	// and returns once every service is probed.
+	CheckHealth(timeout time.Duration)
+
 	// GC starts the IP registry garbage collector and returns a stop
 	// function to exit garbage collection loop; effectively stopping the
 	// routine.
 	GC() StopFn
 
 	// HealthCheck starts a routine to passively track the health of the
-	// targeted services. It returns a function that can be called to stop
-	// the health checking routine.
-	HealthCheck(interval time.Duration) StopFn
+	// targeted services; probing them at the given interval with the given
+	// timeout. A tick is skipped if the previous probes are still running.
+	// It returns a function that can be called to stop the health checking
+	// routine.
+	HealthCheck(interval, timeout time.Duration) StopFn
 
 	// LoadBalancer returns a handler func that will balance requests across
 	// the targeted services using the Round Robin strategy. Further,
 	// requests are rate limited by IP address.
 	LoadBalancer() http.HandlerFunc
 
+	// Proxy returns a handler func that balances requests across the
+	// targeted services like LoadBalancer, but skips the pool's rate
+	// limiting, cache and middleware; E.g. to serve mirrored requests
+	// without spending the client's budget.
+	Proxy() http.HandlerFunc
+
+	// SetCache enables caching of GET responses for the service pool. At
+	// most maxEntries responses are cached, each for no longer than the
+	// given time-to-live.
+	SetCache(maxEntries int, ttl time.Duration)
+
+	// SetAlive marks the pool's services of the given target URL alive or
+	// dead until their next health check; E.g. to put a recovered backend
+	// back into rotation at once. Returns false if no service has the URL.
+	SetAlive(targetURL string, alive bool) bool
+
+	// SetHealthChange sets the function called when a health check finds
+	// a service's alive state changed. It must be set before the health
+	// check is started.
+	SetHealthChange(fn targets.HealthChangeFn)
+
+	// SetHealthCheck sets the HTTP health check of the pool's services.
+	// Without one, services are only checked for accepting connections.
+	SetHealthCheck(c *targets.HealthCheckConfig)
+
+	// SetHealthCheckRetries sets the number of times a failed probe of a
+	// service is retried within a health check before the service is
+	// deemed unreachable. Negative values are ignored.
+	SetHealthCheckRetries(n int)
+
+	// SetIPRegistry sets the registry of the clients' rate limiters; E.g.
+	// to share one registry, and so one rate limit budget per client,
+	// across pools. By default each pool has its own registry.
+	SetIPRegistry(reg ratelimit.IPRegistry)
+
+	// SetLatencyBuckets sets the upper bounds of the buckets of the
+	// histograms that track the response latency of each service; they
+	// must be positive and increasing, else DefaultLatencyBuckets are
+	// used. It must be set before services are added.
+	SetLatencyBuckets(bounds []time.Duration)
+
+	// SetRequestTimeout sets the time a request may take across all of its
+	// retries and attempts; after which it is cancelled and answered with
+	// 504. A zero timeout disables it.
+	SetRequestTimeout(timeout time.Duration)
+
+	// SetRequestIdHeader sets the name of the header that carries the ID
+	// of each request; it is taken from the client or generated, passed to
+	// the service, set on the response and logged. Defaults to
+	// DefaultRequestIdHeader, and an empty name disables request IDs.
+	SetRequestIdHeader(name string)
+
 	// SetResponseFormat sets the error response formatting for the service
 	// pool.
 	SetResponseFormat(errFmt ResponseFormat)
+
+	// SetResponseHeaders sets the rules applied to the headers of the
+	// services' responses before they reach clients; E.g. to strip a
+	// Server header or rewrite redirects to a service's own URL.
+	SetResponseHeaders(c *targets.ResponseHeadersConfig)
+
+	// SetRewriteLocation sets whether the Location headers of redirects to
+	// a service's own URL are rewritten to the host and scheme the client
+	// used; so clients are not sent to internal addresses. Relative
+	// locations are left as is. The response headers' RewriteLocation
+	// enables it as well; either one is enough.
+	SetRewriteLocation(enabled bool)
+
+	// SetRetryAllMethods sets whether failed requests of any method are
+	// retried. By default only requests of idempotent methods are retried;
+	// E.g. a failed POST is not sent again.
+	SetRetryAllMethods(enabled bool)
+
+	// SetRetryBackoff sets the backoff between the retries of a failed
+	// service; the delays grow exponentially with jitter, so retries of
+	// concurrent requests do not synchronize under backend stress.
+	SetRetryBackoff(b targets.Backoff)
+
+	// SetRetryBudget sets the number of times a request may be served
+	// again after its first backend attempt fails. The budget is shared by
+	// retries and attempts of other services; so a request is sent to
+	// backends at most n+1 times. Negative values are ignored.
+	SetRetryBudget(n int)
+
+	// SetSlowRequestThreshold sets the time after which a request is
+	// logged as slow at the warning level, along with its path, service and
+	// status; zero disables the slow request log.
+	SetSlowRequestThreshold(threshold time.Duration)
+
+	// SetStrategy sets the strategy used to pick the service of each
+	// request; round robin (default), weighted random, which picks a
+	// service with a probability proportional to its weight, or power of
+	// two, which picks the service with fewer requests in flight of two
+	// random services. Other strategies are ignored.
+	SetStrategy(s targets.Strategy)
+
+	// SetCustomStrategy sets a custom strategy to pick the service of each
+	// request in place of the built-in strategy set by SetStrategy; E.g. to
+	// shard requests by a header. Nil restores the built-in strategy. It
+	// must be set before the pool serves requests.
+	SetCustomStrategy(s Strategy)
+
+	// SetTargets replaces the pool's services with services for the given
+	// targets. Services of targets already in the pool are kept, along
+	// with their health; only their name, weight, backup and health port
+	// attributes are updated. Services whose TLS server name changed are
+	// replaced, since their connections verify the previous name.
+	SetTargets(ts []targets.Target) error
+
+	// SetTlsHeaders sets the headers that pass the details of a client's
+	// connection to the pool's services.
+	SetTlsHeaders(h TlsHeaders)
+
+	// SetUpstreamHeaders sets whether responses name the service and the
+	// target group that served them; in the UpstreamHeader and
+	// UpstreamGroupHeader headers. It is disabled by default, so the
+	// backend topology is not exposed.
+	SetUpstreamHeaders(group string, enabled bool)
+
+	// SetTransport sets the settings of the connections made to the pool's
+	// services; a nil config uses http.DefaultTransport.
+	SetTransport(c *targets.TransportConfig)
+
+	// Stats returns a snapshot of the request counters and response
+	// latency percentiles of each of the pool's services; in the pool's
+	// order. Counters of services kept by SetTargets carry over. The
+	// latency of a response is measured until its headers are received.
+	Stats() []ServiceStats
+
+	// Use appends the given middleware to the pool's chain. Requests pass
+	// through the chain in order before being balanced.
+	Use(mw ...Middleware)
 }
 
 // servicePool implements a ServicePool to track and balance client requests to
 // backend services.
 type servicePool struct {
-	Index        uint64               // Current service index
-	IPRegistry   ratelimit.IPRegistry // IP registry for rate limiting
-	Rate         int64                // Request rate in Nanoseconds
-	RateCapacity int64                // Capacity of requests in a queue
-	RespFormat   ResponseFormat       // Service response format
-	Services     []*service           // List of backend services
+	Cache          *responseCache                 // Response cache
+	Current        uint64                         // Last picked service index
+	ExposeUpstream bool                           // Set upstream headers
+	Group          string                         // Target group name
+	Health         *targets.HealthCheckConfig     // HTTP health check
+	HealthMatch    *regexp.Regexp                 // Health check body pattern
+	HealthChange   targets.HealthChangeFn         // Health transition callback
+	HealthRetries  int                            // Failed probe retries
+	Index          uint64                         // Next round robin turn
+	Custom         Strategy                       // Custom balancing strategy
+	IPRegistry     ratelimit.IPRegistry           // IP registry for rate limiting
+	LatencyBuckets []time.Duration                // Latency histogram bounds
+	Lock           sync.RWMutex                   // Guards the list of services
+	Middleware     Chain                          // Request middleware chain
+	Rate           int64                          // Request rate in Nanoseconds
+	RateCapacity   int64                          // Capacity of requests in a queue
+	ReqIdHeader    string                         // Request ID header name
+	ReqTimeout     time.Duration                  // Total request timeout
+	RespFormat     ResponseFormat                 // Service response format
+	RespHeaders    *targets.ResponseHeadersConfig // Response header rules
+	RetryAll       bool                           // Retry non-idempotent requests
+	RetryBackoff   targets.Backoff                // Backoff between retries
+	RetryBudget    int                            // Re-serves allowed per request
+	RewriteLoc     bool                           // Rewrite redirects to services
+	Services       []*service                     // List of backend services
+	SlowThreshold  time.Duration                  // Slow request log threshold
+	Selector       Strategy                       // Strategy picking services; round robin if nil
+	Strategy       targets.Strategy               // Balancing strategy
+	TlsHeaders     TlsHeaders                     // Client connection headers
+	Transport      http.RoundTripper              // Service connections
+	Version        uint64                         // State version; see stateChanged
 }
 
 func New(rate int64, rateCap int64) ServicePool {
@@ -81,23 +320,50 @@ func New(rate int64, rateCap int64) ServicePool {
 		IPRegistry:   ratelimit.NewIPRegistry(time.Duration(rate)),
 		Rate:         rate,
 		RateCapacity: rateCap,
+		ReqIdHeader:  DefaultRequestIdHeader,
 		RespFormat:   DefaultResponseFormat,
+		RetryBackoff: targets.DefaultBackoff,
+		RetryBudget:  DefaultRetryBudget,
+		Strategy:     targets.DefaultStrategy,
 	}
 }
 
 func (pool *servicePool) AddService(target targets.Target) error {
-	proto := target.Get("protocol")
-	host := target.Get("host")
-	if port := target.Get("port"); port != "" {
-		host = net.JoinHostPort(host, port)
-	}
-	urlStr := fmt.Sprintf("%s://%s", proto, host)
-	targetUrl, err := url.Parse(urlStr)
+	svc, err := pool.newService(target)
 	if err != nil {
 		return err
 	}
+	pool.Lock.Lock()
+	pool.Services = append(pool.Services, svc)
+	pool.Lock.Unlock()
+	return nil
+}
+
+func (pool *servicePool) Alive() int {
+	alive := 0
+	for _, svc := range pool.services() {
+		if svc.Target.IsAlive() {
+			alive++
+		}
+	}
+	return alive
+}
+
+func (pool *servicePool) CheckHealth(timeout time.Duration) {
+	pool.checkServices(timeout)
+}
+
+// newService returns a new service that proxies requests to the given target.
+func (pool *servicePool) newService(target targets.Target) (*service, error) {
+	targetUrl, err := url.Parse(target.URL())
+	if err != nil {
+		return nil, err
+	}
+	// Requests are proxied under the target's base path
+	targetUrl.Path = target.Path()
 	svc := &service{
-		Target: target,
+		Latency: newLatencyHistogram(pool.LatencyBuckets),
+		Target:  target,
 		// XXX Targets that use self-signed certs won't work without
 		// turning off verification or importing the cert. The former
 		// can be done via Transport in a custom net.Dialer, the latter
@@ -105,32 +371,98 @@ func (pool *servicePool) AddService(target targets.Target) error {
 		// something like update-ca-certificates).
 		Proxy: httputil.NewSingleHostReverseProxy(targetUrl),
 	}
+	svc.Proxy.Transport = pool.transport(target)
+	director := svc.Proxy.Director
+	svc.Proxy.Director = func(r *http.Request) {
+		director(r)
+		pool.TlsHeaders.Set(r)
+	}
 	svc.Proxy.ErrorHandler =
 		func(w http.ResponseWriter, r *http.Request, err error) {
+			atomic.AddInt64(&svc.Errors, 1)
+			// Once the client has part of the response it can not
+			// be sent again; the partial response is all it gets.
+			if responseStarted(w) {
+				log.Error("Failed to complete response",
+					logging.Fields{
+						logging.FieldTarget: svc.Target.URL(),
+						logging.FieldError:  err,
+					})
+				return
+			}
+			// Requests out of time are not retried, and their
+			// failure says nothing of the service's health.
+			if requestTimedOut(r) {
+				handleGatewayTimeout(w,
+					pool.RespFormat.Negotiate(r))
+				return
+			}
+			// Non-idempotent requests may have reached the
+			// service; so they are not sent again.
+			if !pool.RetryAll && !isIdempotent(r.Method) {
+				pool.handleProxyError(w, r, err)
+				return
+			}
 			// Handle service failures by retrying the service, if
 			// that fails attempt another service.
 			alive := pool.RetryService(w, r)
-			svc.Target.SetAlive(alive)
+			if !alive && requestTimedOut(r) {
+				handleGatewayTimeout(w,
+					pool.RespFormat.Negotiate(r))
+				return
+			}
+			pool.setAlive(svc.Target, alive)
+			// Retries and attempts of other services are answered
+			// by their own error handlers; so the error is only
+			// answered here if it is of the last service tried.
 			if !alive && !pool.AttemptNextService(w, r) {
-				handleServiceUnavailable(w, pool.RespFormat)
+				pool.handleProxyError(w, r, err)
 			}
 		}
-	pool.Services = append(pool.Services, svc)
-	return nil
+	svc.Proxy.ModifyResponse = func(resp *http.Response) error {
+		if start, ok := resp.Request.Context().Value(
+			ServiceContextStartKey).(time.Time); ok {
+			svc.Latency.Observe(time.Since(start))
+		}
+		// The request ID was set on the response before proxying
+		if pool.ReqIdHeader != "" {
+			resp.Header.Del(pool.ReqIdHeader)
+		}
+		rewriteResponseHeaders(resp, pool.RespHeaders)
+		if pool.rewritesLocation() {
+			rewriteLocation(resp, svc.Target)
+		}
+		if err := pool.modifyResponse(resp); err != nil {
+			return err
+		}
+		// Set after caching; so cached responses are not attributed
+		// to a backend
+		if pool.ExposeUpstream {
+			resp.Header.Set(UpstreamHeader, svc.Target.URL())
+			resp.Header.Set(UpstreamGroupHeader, pool.Group)
+		}
+		return nil
+	}
+	return svc, nil
 }
 
 // AttemptNextService attempts the next service at pool.Index + 1 and tracks the
 // attempts in the request's context. If the attempts exceed the maximum number
-// of service attempts, the request is canceled. Returns true if attempt is
-// made, otherwise false returns indicating the request was canceled.
+// of service attempts or the request's retry budget is spent, the request is
+// canceled. Returns true if attempt is made, otherwise false returns indicating
+// the request was canceled.
 func (pool *servicePool) AttemptNextService(w http.ResponseWriter, r *http.Request) bool {
 	attempts := getAttemptsFromContext(r)
 	if attempts < ServiceMaxAttempts {
-		svc := pool.NextService()
+		r, ok := pool.spendTry(r)
+		if !ok {
+			return false
+		}
+		svc := pool.NextService(r)
 		if svc != nil {
 			ctx := context.WithValue(r.Context(),
 				ServiceContextAttemptKey, attempts+1)
-			svc.Proxy.ServeHTTP(w, r.WithContext(ctx))
+			svc.serve(w, r.WithContext(ctx))
 			return true
 		}
 	}
@@ -138,8 +470,12 @@ func (pool *servicePool) AttemptNextService(w http.ResponseWriter, r *http.Reque
 }
 
 func (pool *servicePool) CurrentService() *service {
-	idx := int(pool.Index) % len(pool.Services)
-	return pool.Services[idx]
+	svcs := pool.services()
+	if len(svcs) == 0 {
+		return nil
+	}
+	idx := int(atomic.LoadUint64(&pool.Current) % uint64(len(svcs)))
+	return svcs[idx]
 }
 
 func (pool *servicePool) GC() StopFn {
@@ -158,23 +494,34 @@ func (pool *servicePool) GetOrCreateLimiter(ip net.IP) ratelimit.LeakyBucketLimi
 	return limiter
 }
 
-func (pool *servicePool) HealthCheck(interval time.Duration) StopFn {
+func (pool *servicePool) HealthCheck(interval, timeout time.Duration) StopFn {
 	quit := make(chan struct{})
 	stopped := make(chan struct{})
+	done := make(chan struct{})
 	t := time.NewTicker(interval)
 	go func() {
 		defer close(stopped)
+		checking := false
 		for {
 			select {
 			case <-quit:
 				t.Stop()
+				if checking {
+					<-done
+				}
 				return
+			case <-done:
+				checking = false
 			case <-t.C:
-				for _, svc := range pool.Services {
-					alive := svc.Target.IsAvailable(
-						time.Second * 3)
-					svc.Target.SetAlive(alive)
+				if checking {
+					// The previous probes are still running
+					continue
 				}
+				checking = true
+				go func() {
+					pool.checkServices(timeout)
+					done <- struct{}{}
+				}()
 			}
 		}
 	}()
@@ -185,13 +532,45 @@ func (pool *servicePool) HealthCheck(interval time.Duration) StopFn {
 }
 
 func (pool *servicePool) LoadBalancer() http.HandlerFunc {
+	handler := pool.balance()
+	if len(pool.Middleware) == 0 {
+		return handler
+	}
+	return pool.Middleware.Then(handler).ServeHTTP
+}
+
+// balance returns the handler func that rate limits and balances requests
+// across the pool's services.
+func (pool *servicePool) balance() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		defer prExTim(r.URL.RequestURI())()
+		// Track the response, so it is not retried once started
+		rw := newResponseWriter(w)
+		w = rw
+		path := r.URL.RequestURI()
+		name := path
+		if pool.ReqIdHeader != "" {
+			id := requestId(r, pool.ReqIdHeader)
+			r.Header.Set(pool.ReqIdHeader, id)
+			w.Header().Set(pool.ReqIdHeader, id)
+			name = fmt.Sprintf("%s (request %s)", name, id)
+		}
+		defer prExTim(name, pool.SlowThreshold, func(took time.Duration) {
+			status := rw.Status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			log.Warning("Slow request", logging.Fields{
+				logging.FieldPath:     path,
+				logging.FieldTarget:   rw.Target,
+				logging.FieldStatus:   status,
+				logging.FieldDuration: took.String(),
+			})
+		})()
 
 		ip := getIpFromRequest(r)
 		if ip == nil {
 			// Just return because it doesn't know who you are
-			logger.Info("Failed to parse IP address")
+			log.Info("Failed to parse IP address")
 			return
 		}
 		// Retrieve or create the rate limiter for the extracted IP and
@@ -199,68 +578,422 @@ func (pool *servicePool) LoadBalancer() http.HandlerFunc {
 		limiter := pool.GetOrCreateLimiter(ip)
 		next, err := limiter.Next()
 		if err == ratelimit.ErrLimiterMaxCapacity {
-			handleTooManyRequests(w, pool.RespFormat, next)
+			handleTooManyRequests(w, pool.RespFormat.Negotiate(r),
+				next)
 
 			return
 		}
+		// Serve cacheable requests from the cache when possible, and
+		// mark them so their responses are stored otherwise.
+		if pool.Cache != nil && isCacheableRequest(r) {
+			key := cacheKey(r)
+			cr := pool.Cache.Get(key)
+			if cr != nil && cr.Matches(r) {
+				cr.Write(w)
+				return
+			}
+			ctx := context.WithValue(r.Context(),
+				ServiceContextCacheKey, key)
+			r = r.WithContext(ctx)
+		}
+		if pool.ReqTimeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(),
+				pool.ReqTimeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
 		// Service the request
 		if !pool.AttemptNextService(w, r) {
-			handleServiceUnavailable(w, pool.RespFormat)
+			handleServiceUnavailable(w, pool.RespFormat.Negotiate(r))
 			return
 		}
 	}
 }
 
+func (pool *servicePool) Proxy() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Track the response, so it is not retried once started
+		w = newResponseWriter(w)
+		if pool.ReqTimeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(),
+				pool.ReqTimeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		if !pool.AttemptNextService(w, r) {
+			handleServiceUnavailable(w, pool.RespFormat.Negotiate(r))
+		}
+	}
+}
+
+func (pool *servicePool) SetCache(maxEntries int, ttl time.Duration) {
+	pool.Cache = newResponseCache(maxEntries, ttl)
+}
+
+func (pool *servicePool) SetAlive(targetURL string, alive bool) bool {
+	found := false
+	for _, svc := range pool.services() {
+		if svc.Target.URL() != targetURL {
+			continue
+		}
+		found = true
+		wasAlive := pool.setAlive(svc.Target, alive)
+		if alive != wasAlive && pool.HealthChange != nil {
+			pool.HealthChange(svc.Target, wasAlive, alive)
+		}
+	}
+	return found
+}
+
+func (pool *servicePool) SetHealthChange(fn targets.HealthChangeFn) {
+	pool.HealthChange = fn
+}
+
+func (pool *servicePool) SetHealthCheck(c *targets.HealthCheckConfig) {
+	pool.Health = c
+	pool.HealthMatch = nil
+	if c == nil || c.BodyMatch == "" {
+		return
+	}
+	re, err := regexp.Compile(c.BodyMatch)
+	if err != nil {
+		// Targets fail the check rather than skip the match
+		log.Error("Invalid health check body pattern", logging.Fields{
+			logging.FieldError: err,
+		})
+		return
+	}
+	pool.HealthMatch = re
+}
+
+func (pool *servicePool) SetHealthCheckRetries(n int) {
+	if n >= 0 {
+		pool.HealthRetries = n
+	}
+}
+
+func (pool *servicePool) SetIPRegistry(reg ratelimit.IPRegistry) {
+	if reg != nil {
+		pool.IPRegistry = reg
+	}
+}
+
+func (pool *servicePool) SetLatencyBuckets(bounds []time.Duration) {
+	if validLatencyBuckets(bounds) {
+		pool.LatencyBuckets = append([]time.Duration{}, bounds...)
+	}
+}
+
+func (pool *servicePool) SetRequestIdHeader(name string) {
+	pool.ReqIdHeader = name
+}
+
+func (pool *servicePool) SetRequestTimeout(timeout time.Duration) {
+	pool.ReqTimeout = timeout
+}
+
 func (pool *servicePool) SetResponseFormat(format ResponseFormat) {
-	if format.String() != ResponseFormatUnknown.String() {
+	if format = format.Normalize(); format != ResponseFormatUnknown {
 		pool.RespFormat = format
 	}
 }
 
-func (pool *servicePool) NextIndex() int {
-	return int(atomic.AddUint64(&pool.Index, uint64(1)) %
-		uint64(len(pool.Services)))
-}
-
-func (pool *servicePool) NextService() *service {
-	next := pool.NextIndex()
-	cycle := len(pool.Services) + next
-	for i := next; i < cycle; i++ {
-		idx := i % len(pool.Services)
-		if pool.Services[idx].Target.IsAlive() {
-			if i != next {
-				atomic.StoreUint64(&pool.Index, uint64(idx))
-			}
-			return pool.Services[idx]
+func (pool *servicePool) SetResponseHeaders(c *targets.ResponseHeadersConfig) {
+	pool.RespHeaders = c
+}
+
+func (pool *servicePool) SetRewriteLocation(enabled bool) {
+	pool.RewriteLoc = enabled
+}
+
+// rewritesLocation returns true if the Location headers of redirects to the
+// pool's services are rewritten; by the pool's option or its response headers.
+func (pool *servicePool) rewritesLocation() bool {
+	return pool.RewriteLoc ||
+		(pool.RespHeaders != nil && pool.RespHeaders.RewriteLocation)
+}
+
+func (pool *servicePool) SetRetryAllMethods(enabled bool) {
+	pool.RetryAll = enabled
+}
+
+func (pool *servicePool) SetRetryBackoff(b targets.Backoff) {
+	pool.RetryBackoff = b
+}
+
+func (pool *servicePool) SetRetryBudget(n int) {
+	if n >= 0 {
+		pool.RetryBudget = n
+	}
+}
+
+func (pool *servicePool) SetSlowRequestThreshold(threshold time.Duration) {
+	if threshold >= 0 {
+		pool.SlowThreshold = threshold
+	}
+}
+
+func (pool *servicePool) SetCustomStrategy(s Strategy) {
+	pool.Custom = s
+	pool.Selector = s
+	if s == nil {
+		pool.Selector = NewStrategy(pool.Strategy)
+	}
+}
+
+func (pool *servicePool) SetStrategy(s targets.Strategy) {
+	switch s {
+	case targets.StrategyRoundRobin, targets.StrategyWeightedRandom,
+		targets.StrategyPowerOfTwo:
+		pool.Strategy = s
+		if pool.Custom == nil {
+			pool.Selector = NewStrategy(s)
+		}
+	}
+}
+
+func (pool *servicePool) SetTargets(ts []targets.Target) error {
+	current := make(map[string]*service)
+	for _, svc := range pool.services() {
+		current[svc.Target.URL()] = svc
+	}
+	svcs := make([]*service, 0, len(ts))
+	for _, t := range ts {
+		svc, ok := current[t.URL()]
+		if ok && svc.Target.TlsServerName() == t.TlsServerName() {
+			svc.Target.SetName(t.Name())
+			svc.Target.SetWeight(t.Weight())
+			svc.Target.SetBackup(t.IsBackup())
+			svc.Target.SetHealthPort(t.HealthPort())
+			svcs = append(svcs, svc)
+			continue
 		}
+		svc, err := pool.newService(t)
+		if err != nil {
+			return err
+		}
+		svcs = append(svcs, svc)
 	}
+	pool.Lock.Lock()
+	pool.Services = svcs
+	pool.Lock.Unlock()
+	pool.stateChanged()
 	return nil
 }
 
-// RetryService retries the current service at a set interval and tracks the
-// number of retries attempted in the request's context. If the number retries
-// exceed the maxmimum number of retries, the request is canceled for the
-// current service backend. Returns true if a retry was attempted, otherwise
-// false is returned to indicate the request was canceled.
+// setAlive sets whether the given target of the pool is alive, and returns
+// whether it was alive before. A change bumps the pool's state version.
+func (pool *servicePool) setAlive(t targets.Target, alive bool) bool {
+	wasAlive := t.IsAlive()
+	t.SetAlive(alive)
+	if alive != wasAlive {
+		pool.stateChanged()
+	}
+	return wasAlive
+}
+
+// stateChanged records a change to the state of the pool's services that
+// decides their picks; its list of services or their health.
+func (pool *servicePool) stateChanged() {
+	atomic.AddUint64(&pool.Version, 1)
+}
+
+func (pool *servicePool) SetTlsHeaders(h TlsHeaders) {
+	pool.TlsHeaders = h
+}
+
+func (pool *servicePool) SetTransport(c *targets.TransportConfig) {
+	var transport http.RoundTripper
+	if c != nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.DisableKeepAlives = c.DisableKeepAlives
+		if c.IdleConnTimeout > 0 {
+			t.IdleConnTimeout = c.IdleConnTimeout
+		}
+		if c.MaxConnsPerHost > 0 {
+			t.MaxConnsPerHost = c.MaxConnsPerHost
+		}
+		transport = t
+	}
+	pool.Lock.Lock()
+	defer pool.Lock.Unlock()
+	pool.Transport = transport
+	for _, svc := range pool.Services {
+		svc.Proxy.Transport = pool.transport(svc.Target)
+	}
+}
+
+// transport returns the transport of the service for the given target; the
+// pool's transport, with the target's TLS server name if it sets one.
+func (pool *servicePool) transport(target targets.Target) http.RoundTripper {
+	name := target.TlsServerName()
+	if name == "" {
+		return pool.Transport
+	}
+	base, ok := pool.Transport.(*http.Transport)
+	if !ok {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	t := base.Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.ServerName = name
+	return t
+}
+
+func (pool *servicePool) SetUpstreamHeaders(group string, enabled bool) {
+	pool.Group = group
+	pool.ExposeUpstream = enabled
+}
+
+func (pool *servicePool) Stats() []ServiceStats {
+	svcs := pool.services()
+	stats := make([]ServiceStats, 0, len(svcs))
+	for _, svc := range svcs {
+		stats = append(stats, svc.stats())
+	}
+	return stats
+}
+
+func (pool *servicePool) Use(mw ...Middleware) {
+	pool.Middleware = append(pool.Middleware, mw...)
+}
+
+func (pool *servicePool) NextIndex() int {
+	n := len(pool.services())
+	if n == 0 {
+		return 0
+	}
+	return int((atomic.AddUint64(&pool.Index, 1) - 1) % uint64(n))
+}
+
+// NextService returns the service of the given request by the pool's strategy
+// and sets it as the current service. The strategy picks from the available
+// primary services, or from the available backup services if no primary is
+// available. The request may be nil if the pick is not for a request.
+func (pool *servicePool) NextService(r *http.Request) *service {
+	// The version is read first, so state cached by the strategy at it is
+	// never newer than the candidates it was built from
+	version := atomic.LoadUint64(&pool.Version)
+	svcs := pool.services()
+	var candidates []Candidate
+	for _, backup := range []bool{false, true} {
+		candidates = candidatesOf(svcs, backup, version)
+		if len(candidates) > 0 {
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	idx := -1
+	if pool.Selector != nil {
+		idx = pool.Selector.Select(candidates, r)
+	} else {
+		idx = nextTurn(&pool.Index, len(candidates))
+	}
+	if idx < 0 || idx >= len(candidates) {
+		return nil
+	}
+	i := candidates[idx].index
+	atomic.StoreUint64(&pool.Current, uint64(i))
+	return svcs[i]
+}
+
+// candidatesOf returns the strategy candidates of the given services that are
+// available, and either backups or primaries, taken at the given state version.
+func candidatesOf(svcs []*service, backup bool, version uint64) []Candidate {
+	candidates := []Candidate{}
+	for i, svc := range svcs {
+		if available(svc.Target, backup) {
+			candidates = append(candidates, Candidate{
+				Target:   svc.Target,
+				InFlight: atomic.LoadInt64(&svc.InFlight),
+				index:    i,
+				version:  version,
+			})
+		}
+	}
+	return candidates
+}
+
+// available returns true if the given target may be given new requests; it is
+// alive, not draining, and a backup only if backups are being picked.
+func available(t targets.Target, backup bool) bool {
+	return t.IsAlive() && !t.IsDraining() && t.IsBackup() == backup
+}
+
+// services returns the pool's current list of services. The list is replaced
+// rather than modified by SetTargets, so it is safe to range over.
+func (pool *servicePool) services() []*service {
+	pool.Lock.RLock()
+	defer pool.Lock.RUnlock()
+	return pool.Services
+}
+
+// modifyResponse modifies the backend response before it is returned to the
+// client. Cacheable responses are stored in the pool's cache.
+func (pool *servicePool) modifyResponse(resp *http.Response) error {
+	if pool.Cache == nil || resp.Request == nil {
+		return nil
+	}
+	key, ok := resp.Request.Context().Value(ServiceContextCacheKey).(string)
+	if !ok {
+		return nil
+	}
+	return pool.Cache.Store(key, resp)
+}
+
+// RetryService retries the request's service, or the current service if it has
+// none, after the pool's backoff delay and tracks the number of retries
+// attempted in the request's context. If the number retries exceed the
+// maxmimum number of retries or the request's retry budget is spent, the
+// request is canceled for the service backend. Returns true if a retry was
+// attempted, otherwise false is returned to indicate the request was canceled.
 func (pool *servicePool) RetryService(w http.ResponseWriter, r *http.Request) bool {
 	retries := getRetriesFromContext(r)
-	after := time.After(ServiceRetryInterval)
+	if retries >= ServiceMaxRetries {
+		return false
+	}
+	r, ok := pool.spendTry(r)
+	if !ok {
+		return false
+	}
+	after := time.After(pool.RetryBackoff.Delay(retries))
 	for retries < ServiceMaxRetries {
 		select {
+		case <-r.Context().Done():
+			return false
 		case <-after:
-			svc := pool.CurrentService()
+			svc := getServiceFromContext(r)
+			if svc == nil {
+				svc = pool.CurrentService()
+			}
 			if svc == nil {
 				return false
 			}
 			ctx := context.WithValue(r.Context(),
 				ServiceContextRetryKey, retries+1)
-			svc.Proxy.ServeHTTP(w, r.WithContext(ctx))
+			svc.serve(w, r.WithContext(ctx))
 			return true
 		}
 	}
 	return false
 }
 
+// spendTry returns the given request with its number of backend tries counted,
+// and false if the request has spent the pool's retry budget. The first try
+// of a request is not counted against the budget.
+func (pool *servicePool) spendTry(r *http.Request) (*http.Request, bool) {
+	tries := getTriesFromContext(r)
+	if tries > pool.RetryBudget {
+		return r, false
+	}
+	ctx := context.WithValue(r.Context(), ServiceContextTriesKey, tries+1)
+	return r.WithContext(ctx), true
+}
+
 // getAttemptsFromContext returns the number of attempts tracked in the given
 // request.
 func getAttemptsFromContext(r *http.Request) int {
@@ -306,6 +1039,98 @@ func getRetriesFromContext(r *http.Request) int {
 	return 0
 }
 
+// getServiceFromContext returns the service the given request is being served
+// by; nil if it is not set.
+func getServiceFromContext(r *http.Request) *service {
+	svc, ok := r.Context().Value(ServiceContextServiceKey).(*service)
+	if ok {
+		return svc
+	}
+	return nil
+}
+
+// getTriesFromContext returns the number of backend tries tracked in the given
+// request.
+func getTriesFromContext(r *http.Request) int {
+	tries, ok := r.Context().Value(ServiceContextTriesKey).(int)
+	if ok {
+		return tries
+	}
+	return 0
+}
+
+// isIdempotent returns true if requests of the given method can be sent more
+// than once with the same effect; see RFC 7231 section 4.2.2.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions,
+		http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// handleProxyError handles the response for when the last service tried for a
+// request failed with the given error. Services that accepted the request but
+// did not answer in time are answered with 504, otherwise no service was
+// available and 503 is answered.
+func (pool *servicePool) handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	format := pool.RespFormat.Negotiate(r)
+	if isGatewayTimeout(err) {
+		handleGatewayTimeout(w, format)
+		return
+	}
+	handleServiceUnavailable(w, format)
+}
+
+// isGatewayTimeout returns true if the given proxy error is a timeout waiting
+// on a connected service; timeouts connecting to a service are not.
+func isGatewayTimeout(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// requestTimedOut returns true if the given request's deadline has passed.
+func requestTimedOut(r *http.Request) bool {
+	return r.Context().Err() == context.DeadlineExceeded
+}
+
+// handleGatewayTimeout handles the response for when services do not complete
+// a request in time.
+func handleGatewayTimeout(w http.ResponseWriter, format ResponseFormat) {
+	contentType := ""
+	msg := ""
+	switch format {
+	case ResponseFormatHtml:
+		contentType = "text/html"
+		msg = templates.GatewayTimeoutPage()
+	case ResponseFormatJson:
+		b, err := json.Marshal(ResponseError{
+			Code:    http.StatusGatewayTimeout,
+			Message: "Gateway timeout",
+		})
+		if err == nil {
+			contentType = "application/json"
+			msg = string(b)
+			break
+		}
+		fallthrough
+	default:
+		contentType = "text/plain"
+		msg = "Gateway timeout\n"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusGatewayTimeout)
+	fmt.Fprintf(w, "%s", msg)
+}
+
 // handleServiceUnavailable handles the response for when services are
 // unavailable (HTTP code 503).
 func handleServiceUnavailable(w http.ResponseWriter, format ResponseFormat) {
@@ -370,10 +1195,22 @@ func handleTooManyRequests(w http.ResponseWriter, format ResponseFormat, to time
 	fmt.Fprintf(w, "%s", msg)
 }
 
-// prExTim logs the execution time for a given routine name.
-func prExTim(name string) func() {
+// prExTim logs the execution time for a given routine name at the debug level,
+// and passes it to the given slow func if it exceeds the threshold; nothing is
+// timed unless debug entries are logged or a threshold is set.
+func prExTim(name string, threshold time.Duration, slow func(took time.Duration)) func() {
+	debug := log.DebugEnabled()
+	if !debug && threshold <= 0 {
+		return func() {}
+	}
 	now := time.Now()
 	return func() {
-		logger.Info(fmt.Sprintf("%s took %s", name, time.Since(now)))
+		took := time.Since(now)
+		if debug {
+			log.Debug(fmt.Sprintf("%s took %s", name, took))
+		}
+		if threshold > 0 && took > threshold && slow != nil {
+			slow(took)
+		}
 	}
 }
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -9,11 +10,18 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/crossedbot/common/golang/logger"
 	"github.com/stretchr/testify/require"
 
+	"github.com/crossedbot/simpleloadbalancer/pkg/logging"
 	"github.com/crossedbot/simpleloadbalancer/pkg/ratelimit"
 	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
 	"github.com/crossedbot/simpleloadbalancer/pkg/templates"
@@ -67,6 +75,43 @@ func TestGetRetriesFromContext(t *testing.T) {
 	require.Equal(t, expected, actual)
 }
 
+func TestGetTriesFromContext(t *testing.T) {
+	r, err := http.NewRequest(http.MethodGet, "localhost:8080", nil)
+	require.Nil(t, err)
+
+	actual := getTriesFromContext(r)
+	require.Equal(t, 0, actual)
+
+	expected := 2
+	ctx := r.Context()
+	ctx = context.WithValue(ctx, ServiceContextTriesKey, expected)
+	actual = getTriesFromContext(r.WithContext(ctx))
+	require.Equal(t, expected, actual)
+}
+
+func TestHandleGatewayTimeout(t *testing.T) {
+	rr1 := httptest.NewRecorder()
+	handleGatewayTimeout(rr1, ResponseFormatHtml)
+	require.Equal(t, http.StatusGatewayTimeout, rr1.Code)
+	require.Equal(t, templates.GatewayTimeoutPage(), rr1.Body.String())
+
+	expected := "Gateway timeout\n"
+	b, err := json.Marshal(ResponseError{
+		Code:    http.StatusGatewayTimeout,
+		Message: expected[:len(expected)-1],
+	})
+	require.Nil(t, err)
+	rr2 := httptest.NewRecorder()
+	handleGatewayTimeout(rr2, ResponseFormatJson)
+	require.Equal(t, http.StatusGatewayTimeout, rr2.Code)
+	require.Equal(t, string(b), rr2.Body.String())
+
+	rr3 := httptest.NewRecorder()
+	handleGatewayTimeout(rr3, ResponseFormatPlain)
+	require.Equal(t, http.StatusGatewayTimeout, rr3.Code)
+	require.Equal(t, expected, rr3.Body.String())
+}
+
 func TestHandleServiceUnavailable(t *testing.T) {
 	rr1 := httptest.NewRecorder()
 	errFmt := ResponseFormatHtml
@@ -160,6 +205,69 @@ func TestHandleTooManyRequests(t *testing.T) {
 	require.Equal(t, expected, string(actual))
 }
 
+func TestPrExTim(t *testing.T) {
+	buf := &bytes.Buffer{}
+	out, level := logger.Log.Out, logger.Log.GetLevel()
+	logger.Log.SetOutput(buf)
+	defer func() {
+		logger.Log.SetOutput(out)
+		logger.Log.SetLevel(level)
+	}()
+
+	// Timings are only logged at the debug level
+	require.Nil(t, logging.SetLevel("info"))
+	prExTim("/foo", 0, nil)()
+	require.Equal(t, 0, buf.Len())
+
+	require.Nil(t, logging.SetLevel("debug"))
+	prExTim("/foo", 0, nil)()
+	require.Contains(t, buf.String(), "/foo took")
+}
+
+func TestServicePoolSlowRequestThreshold(t *testing.T) {
+	buf := &bytes.Buffer{}
+	out, level := logger.Log.Out, logger.Log.GetLevel()
+	logger.Log.SetOutput(buf)
+	defer func() {
+		logger.Log.SetOutput(out)
+		logger.Log.SetLevel(level)
+	}()
+	require.Nil(t, logging.SetLevel("info"))
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				time.Sleep(50 * time.Millisecond)
+			}
+			w.WriteHeader(http.StatusAccepted)
+		}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	pool := New(int64(time.Millisecond), 100)
+	require.Nil(t, pool.AddService(targets.NewServiceTarget(targetUrl)))
+	pool.SetSlowRequestThreshold(20 * time.Millisecond)
+
+	// Only requests over the threshold are logged
+	for _, path := range []string{"/fast", "/slow?q=1"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		pool.LoadBalancer().ServeHTTP(w, r)
+		require.Equal(t, http.StatusAccepted, w.Code)
+	}
+	logs := buf.String()
+	require.Equal(t, 1, strings.Count(logs, "Slow request"))
+	require.NotContains(t, logs, "/fast")
+	require.Contains(t, logs, "path=\"/slow?q=1\"")
+	require.Contains(t, logs, "status=202")
+	require.Contains(t, logs, "target=\""+ts.URL+"\"")
+
+	// Negative thresholds are ignored
+	pool.SetSlowRequestThreshold(-1)
+	require.Equal(t, 20*time.Millisecond,
+		pool.(*servicePool).SlowThreshold)
+}
+
 func TestServicePoolAddService(t *testing.T) {
 	pool := &servicePool{}
 	targetUrl, err := url.Parse("localhost:8080")
@@ -220,6 +328,27 @@ func TestServicePoolAttemptNextService(t *testing.T) {
 	require.Equal(t, errBody, string(respBody))
 }
 
+func TestServicePoolResponseFormatAuto(t *testing.T) {
+	pool := New(int64(time.Millisecond), 100)
+	pool.SetResponseFormat(ResponseFormatAuto)
+	tests := []struct {
+		Accept      string
+		ContentType string
+	}{
+		{"application/json", "application/json"},
+		{"text/html,*/*;q=0.8", "text/html"},
+		{"*/*", "text/plain"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", test.Accept)
+		w := httptest.NewRecorder()
+		pool.LoadBalancer().ServeHTTP(w, r)
+		require.Equal(t, http.StatusServiceUnavailable, w.Code)
+		require.Equal(t, test.ContentType, w.Header().Get("Content-Type"))
+	}
+}
+
 func TestServicePoolCurrentService(t *testing.T) {
 	pool := &servicePool{}
 	targetUrl, err := url.Parse("localhost:8080")
@@ -268,7 +397,7 @@ func TestServicePoolHealthCheck(t *testing.T) {
 	svc := pool.CurrentService()
 	require.NotNil(t, svc)
 	interval := time.Millisecond * 100
-	stopHealthCheck := pool.HealthCheck(interval)
+	stopHealthCheck := pool.HealthCheck(interval, time.Second)
 	defer stopHealthCheck()
 
 	time.Sleep(interval)
@@ -325,11 +454,565 @@ func TestServicePoolLoadBalancer(t *testing.T) {
 	require.Equal(t, errBody, string(respBody))
 }
 
+func TestServicePoolLoadBalancerCache(t *testing.T) {
+	rate := time.Second * 3
+	capacity := int64(100)
+	body := "{\"hello\": \"world\"}"
+	hits := 0
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits++
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "%s", body)
+		}),
+	)
+	defer ts.Close()
+
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	target := targets.NewServiceTarget(targetUrl)
+	pool := &servicePool{
+		RateCapacity: capacity,
+		IPRegistry:   ratelimit.NewIPRegistry(time.Duration(rate)),
+		Rate:         int64(rate),
+	}
+	pool.SetCache(10, time.Minute)
+	pool.AddService(target)
+	fn := pool.LoadBalancer()
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodGet, "/cached", nil)
+		require.Nil(t, err)
+		req.Header.Add("X-REAL-IP", "127.0.0.1")
+		rr := httptest.NewRecorder()
+		fn(rr, req)
+		resp := rr.Result()
+		respBody, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, body, string(respBody))
+	}
+	require.Equal(t, 1, hits)
+
+	// Non-GET requests always hit the backend
+	req, err := http.NewRequest(http.MethodPost, "/cached", nil)
+	require.Nil(t, err)
+	req.Header.Add("X-REAL-IP", "127.0.0.1")
+	fn(httptest.NewRecorder(), req)
+	require.Equal(t, 2, hits)
+}
+
+func TestServicePoolProxy(t *testing.T) {
+	rate := time.Second * 3
+	body := "{\"hello\": \"world\"}"
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+	req.Header.Add("X-REAL-IP", "127.0.0.1")
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s", body)
+		}),
+	)
+	defer ts.Close()
+
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	pool := &servicePool{
+		RateCapacity: 1,
+		IPRegistry:   ratelimit.NewIPRegistry(time.Duration(rate)),
+		Rate:         int64(rate),
+	}
+	pool.AddService(targets.NewServiceTarget(targetUrl))
+	var rr *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		rr = httptest.NewRecorder()
+		pool.LoadBalancer()(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	pool.LoadBalancer()(rr, req)
+	require.Equal(t, http.StatusTooManyRequests, rr.Code)
+
+	// The proxy is not rate limited
+	fn := pool.Proxy()
+	for i := 0; i < 3; i++ {
+		rr = httptest.NewRecorder()
+		fn(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Equal(t, body, rr.Body.String())
+	}
+}
+
+func TestServicePoolRetryBudget(t *testing.T) {
+	// Backends that drop every connection fail each try
+	var hits int32
+	drop := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	})
+	servers := []*httptest.Server{
+		httptest.NewServer(drop),
+		httptest.NewServer(drop),
+	}
+	for _, ts := range servers {
+		defer ts.Close()
+	}
+
+	tests := []struct {
+		Budget   int
+		Expected int32
+	}{
+		{-1, DefaultRetryBudget + 1}, // Ignored
+		{0, 1},
+		{1, 2},
+	}
+	for _, test := range tests {
+		// Failed services are marked down; so start from a new pool
+		pool := New(int64(time.Millisecond), 100)
+		for _, ts := range servers {
+			targetUrl, err := url.Parse(ts.URL)
+			require.Nil(t, err)
+			require.Nil(t, pool.AddService(
+				targets.NewServiceTarget(targetUrl)))
+		}
+		pool.SetRetryBudget(test.Budget)
+		atomic.StoreInt32(&hits, 0)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		pool.LoadBalancer().ServeHTTP(w, r)
+		require.Equal(t, http.StatusServiceUnavailable, w.Code)
+		require.Equal(t, test.Expected, atomic.LoadInt32(&hits))
+	}
+}
+
+func TestServicePoolRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}),
+	)
+	defer ts.Close()
+	defer close(release)
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	target := targets.NewServiceTarget(targetUrl)
+	pool := New(int64(time.Millisecond), 100)
+	require.Nil(t, pool.AddService(target))
+	pool.SetRequestTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	pool.LoadBalancer().ServeHTTP(w, r)
+	require.Equal(t, http.StatusGatewayTimeout, w.Code)
+	require.Less(t, time.Since(start), time.Second)
+	// A slow request does not mark the service down
+	require.True(t, target.IsAlive())
+}
+
+func TestServicePoolGatewayTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}),
+	)
+	defer ts.Close()
+	defer close(release)
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	pool := New(int64(time.Millisecond), 100).(*servicePool)
+	require.Nil(t, pool.AddService(targets.NewServiceTarget(targetUrl)))
+	pool.SetRetryBudget(0)
+	pool.Services[0].Proxy.Transport = &http.Transport{
+		ResponseHeaderTimeout: 50 * time.Millisecond,
+	}
+
+	// A connected service that is too slow
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	pool.LoadBalancer().ServeHTTP(w, r)
+	require.Equal(t, http.StatusGatewayTimeout, w.Code)
+
+	// No service to connect to
+	pool.Services[0].Target.SetAlive(true)
+	ts.Close()
+	w = httptest.NewRecorder()
+	pool.LoadBalancer().ServeHTTP(w, r)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestServicePoolGatewayTimeoutFailover(t *testing.T) {
+	slow := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}),
+	)
+	defer slow.Close()
+	slowUrl, err := url.Parse(slow.URL)
+	require.Nil(t, err)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedUrl, err := url.Parse(closed.URL)
+	require.Nil(t, err)
+	closed.Close()
+
+	// The error of the last service tried answers the request, not the
+	// error of the service that failed first
+	tests := []struct {
+		Order    []*url.URL
+		Expected int
+	}{
+		{[]*url.URL{slowUrl, closedUrl}, http.StatusServiceUnavailable},
+		{[]*url.URL{closedUrl, slowUrl}, http.StatusGatewayTimeout},
+	}
+	for _, test := range tests {
+		pool := New(int64(time.Millisecond), 100).(*servicePool)
+		pool.SetRetryBudget(10)
+		pool.SetRetryBackoff(targets.Backoff{Base: time.Millisecond,
+			Max: time.Millisecond, Multiplier: 1})
+		for _, u := range test.Order {
+			target := targets.NewServiceTarget(u)
+			require.Nil(t, pool.AddService(target))
+		}
+		for _, svc := range pool.Services {
+			svc.Proxy.Transport = &http.Transport{
+				ResponseHeaderTimeout: 50 * time.Millisecond,
+			}
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		pool.LoadBalancer().ServeHTTP(w, r)
+		require.Equal(t, test.Expected, w.Code)
+		require.Equal(t, int64(1), pool.Services[1].Total)
+	}
+}
+
+func TestIsGatewayTimeout(t *testing.T) {
+	require.True(t, isGatewayTimeout(context.DeadlineExceeded))
+	require.True(t, isGatewayTimeout(&net.OpError{
+		Op:  "read",
+		Err: os.ErrDeadlineExceeded,
+	}))
+	require.False(t, isGatewayTimeout(&net.OpError{
+		Op:  "dial",
+		Err: os.ErrDeadlineExceeded,
+	}))
+	require.False(t, isGatewayTimeout(fmt.Errorf("connection refused")))
+}
+
+func TestServicePoolRetryAllMethods(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+
+	tests := []struct {
+		Method   string
+		RetryAll bool
+		Expected int32
+	}{
+		{http.MethodPost, false, 1},
+		{http.MethodPost, true, DefaultRetryBudget + 1},
+		{http.MethodPut, false, DefaultRetryBudget + 1},
+	}
+	for _, test := range tests {
+		pool := New(int64(time.Millisecond), 100)
+		require.Nil(t, pool.AddService(
+			targets.NewServiceTarget(targetUrl)))
+		pool.SetRetryAllMethods(test.RetryAll)
+		atomic.StoreInt32(&hits, 0)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(test.Method, "/", nil)
+		pool.LoadBalancer().ServeHTTP(w, r)
+		require.Equal(t, http.StatusServiceUnavailable, w.Code)
+		require.Equal(t, test.Expected, atomic.LoadInt32(&hits))
+	}
+}
+
+func TestServicePoolBasePath(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Seen-Path", r.URL.RequestURI())
+		}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL + "/api")
+	require.Nil(t, err)
+	pool := New(int64(time.Millisecond), 100)
+	require.Nil(t, pool.AddService(targets.NewServiceTarget(targetUrl)))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/users?id=1", nil)
+	pool.LoadBalancer().ServeHTTP(w, r)
+	require.Equal(t, "/api/users?id=1", w.Header().Get("X-Seen-Path"))
+}
+
+func TestServicePoolIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback is not available")
+	}
+	ts := httptest.NewUnstartedServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "ok")
+		}),
+	)
+	ts.Listener.Close()
+	ts.Listener = ln
+	ts.Start()
+	defer ts.Close()
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	require.Nil(t, err)
+	portNum, err := strconv.Atoi(port)
+	require.Nil(t, err)
+	pool := New(int64(time.Millisecond), 100)
+	require.Nil(t, pool.AddService(targets.NewTarget("::1", portNum, "http")))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	pool.LoadBalancer().ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "ok", w.Body.String())
+}
+
+func TestServicePoolUpstreamHeaders(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	target := targets.NewServiceTarget(targetUrl)
+	pool := New(int64(time.Millisecond), 100)
+	require.Nil(t, pool.AddService(target))
+
+	// Disabled by default
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	pool.LoadBalancer().ServeHTTP(w, r)
+	require.Equal(t, "", w.Header().Get(UpstreamHeader))
+	require.Equal(t, "", w.Header().Get(UpstreamGroupHeader))
+
+	pool.SetUpstreamHeaders("api", true)
+	w = httptest.NewRecorder()
+	pool.LoadBalancer().ServeHTTP(w, r)
+	require.Equal(t, target.URL(), w.Header().Get(UpstreamHeader))
+	require.Equal(t, "api", w.Header().Get(UpstreamGroupHeader))
+}
+
+func TestServicePoolSetTransport(t *testing.T) {
+	var lock sync.Mutex
+	closes := []bool{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			closes = append(closes,
+				r.Close && r.Header.Get("Connection") == "close")
+			lock.Unlock()
+		}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	pool := New(int64(time.Millisecond), 100)
+	require.Nil(t, pool.AddService(targets.NewServiceTarget(targetUrl)))
+
+	// Keep-alives are used by default
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	pool.LoadBalancer().ServeHTTP(httptest.NewRecorder(), r)
+	lock.Lock()
+	require.Equal(t, []bool{false}, closes)
+	lock.Unlock()
+
+	// Set on services already in the pool, and services added after
+	pool.SetTransport(&targets.TransportConfig{DisableKeepAlives: true})
+	require.Nil(t, pool.AddService(targets.NewServiceTarget(targetUrl)))
+	for i := 0; i < 2; i++ {
+		pool.LoadBalancer().ServeHTTP(httptest.NewRecorder(), r)
+	}
+	lock.Lock()
+	require.Equal(t, []bool{false, true, true}, closes)
+	lock.Unlock()
+}
+
+func TestServicePoolTlsServerName(t *testing.T) {
+	serverNames := []string{}
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serverNames = append(serverNames, r.TLS.ServerName)
+		}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+
+	// The test server's certificate is valid for example.com; trust it
+	// and connect by IP
+	for _, c := range []struct {
+		ServerName string
+		Code       int
+	}{
+		{"example.com", http.StatusOK},
+		{"other.example.org", http.StatusServiceUnavailable},
+	} {
+		pool := New(int64(time.Millisecond), 100).(*servicePool)
+		pool.Transport = ts.Client().Transport
+		target := targets.NewServiceTarget(targetUrl)
+		target.SetTlsServerName(c.ServerName)
+		require.Nil(t, pool.AddService(target))
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		pool.LoadBalancer().ServeHTTP(w, r)
+		require.Equal(t, c.Code, w.Code)
+	}
+	require.Equal(t, []string{"example.com"}, serverNames)
+}
+
+func TestServicePoolTransportIdleTimeout(t *testing.T) {
+	var closed int32
+	ts := httptest.NewUnstartedServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			atomic.AddInt32(&closed, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	pool := New(int64(time.Millisecond), 100).(*servicePool)
+	require.Nil(t, pool.AddService(targets.NewServiceTarget(targetUrl)))
+	pool.SetTransport(&targets.TransportConfig{
+		IdleConnTimeout: 50 * time.Millisecond,
+		MaxConnsPerHost: 4,
+	})
+	transport := pool.Transport.(*http.Transport)
+	require.Equal(t, 50*time.Millisecond, transport.IdleConnTimeout)
+	require.Equal(t, 4, transport.MaxConnsPerHost)
+
+	// The kept-alive connection is closed by the pool once it has been
+	// idle for the timeout; not by the backend
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	pool.LoadBalancer().ServeHTTP(httptest.NewRecorder(), r)
+	require.Equal(t, int32(0), atomic.LoadInt32(&closed))
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&closed) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
 func TestServiceSetResponseFormat(t *testing.T) {
 	expected := ResponseFormatJson
 	pool := &servicePool{}
 	pool.SetResponseFormat(expected)
 	require.Equal(t, expected, pool.RespFormat)
+
+	// Unknown and out-of-range formats are ignored
+	pool.SetResponseFormat(ResponseFormatUnknown)
+	require.Equal(t, expected, pool.RespFormat)
+	pool.SetResponseFormat(ResponseFormat(1000))
+	require.Equal(t, expected, pool.RespFormat)
+}
+
+func TestServicePoolSetTargets(t *testing.T) {
+	pool := New(int64(time.Second), 100).(*servicePool)
+	target1 := targets.NewTarget("127.0.0.1", 8080, "http")
+	target2 := targets.NewTarget("127.0.0.1", 8081, "http")
+	require.Nil(t, pool.AddService(target1))
+	target1.SetAlive(false)
+
+	// Existing services are kept along with their health
+	update := targets.NewTarget("127.0.0.1", 8080, "http")
+	update.SetWeight(3)
+	update.SetBackup(true)
+	require.Nil(t, pool.SetTargets([]targets.Target{update, target2}))
+	require.Len(t, pool.Services, 2)
+	require.Equal(t, target1, pool.Services[0].Target)
+	require.False(t, pool.Services[0].Target.IsAlive())
+	require.Equal(t, 3, pool.Services[0].Target.Weight())
+	require.True(t, pool.Services[0].Target.IsBackup())
+	require.Equal(t, target2, pool.Services[1].Target)
+
+	// Health ports are updated, but a changed TLS server name replaces the
+	// service
+	update.SetHealthPort(9090)
+	require.Nil(t, pool.SetTargets([]targets.Target{update, target2}))
+	require.Equal(t, target1, pool.Services[0].Target)
+	require.Equal(t, 9090, pool.Services[0].Target.HealthPort())
+	update = targets.NewTarget("127.0.0.1", 8081, "http")
+	update.SetTlsServerName("backend.example.com")
+	require.Nil(t, pool.SetTargets([]targets.Target{target1, update}))
+	require.Equal(t, update, pool.Services[1].Target)
+	require.Equal(t, "backend.example.com",
+		pool.Services[1].Target.TlsServerName())
+
+	require.Nil(t, pool.SetTargets(nil))
+	require.Len(t, pool.Services, 0)
+	require.Nil(t, pool.NextService(nil))
+	require.Nil(t, pool.CurrentService())
+}
+
+func TestServicePoolUse(t *testing.T) {
+	hits := 0
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits++
+			w.WriteHeader(http.StatusOK)
+		}),
+	)
+	defer ts.Close()
+
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	pool := New(int64(time.Second), 100)
+	require.Nil(t, pool.AddService(targets.NewServiceTarget(targetUrl)))
+	pool.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Block") != "" {
+				w.WriteHeader(http.StatusTeapot)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	fn := pool.LoadBalancer()
+
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-REAL-IP", "127.0.0.1")
+	rr1 := httptest.NewRecorder()
+	fn(rr1, req)
+	require.Equal(t, http.StatusOK, rr1.Code)
+	require.Equal(t, 1, hits)
+
+	req.Header.Set("X-Block", "1")
+	rr2 := httptest.NewRecorder()
+	fn(rr2, req)
+	require.Equal(t, http.StatusTeapot, rr2.Code)
+	require.Equal(t, 1, hits)
 }
 
 func TestServicePoolNextIndex(t *testing.T) {
@@ -342,9 +1025,9 @@ func TestServicePoolNextIndex(t *testing.T) {
 	target2 := targets.NewServiceTarget(targetUrl2)
 	pool.AddService(target1)
 	pool.AddService(target2)
-	expected := 1
-	actual := pool.NextIndex()
-	require.Equal(t, expected, actual)
+	require.Equal(t, 0, pool.NextIndex())
+	require.Equal(t, 1, pool.NextIndex())
+	require.Equal(t, 0, pool.NextIndex())
 }
 
 func TestServicePoolNextService(t *testing.T) {
@@ -357,9 +1040,235 @@ func TestServicePoolNextService(t *testing.T) {
 	target2 := targets.NewServiceTarget(targetUrl2)
 	pool.AddService(target1)
 	pool.AddService(target2)
-	svc := pool.NextService()
+	svc := pool.NextService(nil)
+	require.NotNil(t, svc)
+	require.Equal(t, svc.Target.Summary(), target1.Summary())
+	require.Equal(t, svc, pool.CurrentService())
+	svc = pool.NextService(nil)
 	require.NotNil(t, svc)
 	require.Equal(t, svc.Target.Summary(), target2.Summary())
+	require.Equal(t, svc, pool.CurrentService())
+
+	// Draining services are skipped
+	target1.SetDraining(true)
+	svc = pool.NextService(nil)
+	require.NotNil(t, svc)
+	require.Equal(t, svc.Target.Summary(), target2.Summary())
+}
+
+func TestServicePoolNextServiceConcurrent(t *testing.T) {
+	pool := &servicePool{}
+	ts := []targets.Target{}
+	for port := 8080; port < 8083; port++ {
+		target := targets.NewTarget("127.0.0.1", port, "http")
+		require.Nil(t, pool.AddService(target))
+		ts = append(ts, target)
+	}
+	pick := func(workers, picks int) map[int]int {
+		var lock sync.Mutex
+		var wg sync.WaitGroup
+		counts := map[int]int{}
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < picks; j++ {
+					port := 0
+					if svc := pool.NextService(nil); svc != nil {
+						port = svc.Target.Port()
+					}
+					lock.Lock()
+					counts[port]++
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		return counts
+	}
+
+	// Every concurrent pick is a different turn; none are skipped
+	counts := pick(30, 100)
+	for _, target := range ts {
+		require.Equal(t, 1000, counts[target.Port()])
+	}
+
+	// Unavailable services are never picked
+	ts[1].SetAlive(false)
+	counts = pick(30, 100)
+	require.Equal(t, 0, counts[8081])
+	require.Equal(t, 3000, counts[8080]+counts[8082])
+	require.Greater(t, counts[8080], 0)
+	require.Greater(t, counts[8082], 0)
+}
+
+func TestServicePoolWeightedRandom(t *testing.T) {
+	pool := New(int64(time.Second), 100).(*servicePool)
+	pool.SetStrategy(targets.StrategyWeightedRandom)
+	require.Equal(t, targets.StrategyWeightedRandom, pool.Strategy)
+	pool.SetStrategy(targets.StrategyIpHash)
+	require.Equal(t, targets.StrategyWeightedRandom, pool.Strategy)
+	weights := []int{1, 3}
+	for i, w := range weights {
+		target := targets.NewTarget("127.0.0.1", 8080+i, "http")
+		target.SetWeight(w)
+		require.Nil(t, pool.AddService(target))
+	}
+
+	counts := map[int]int{}
+	n := 4000
+	for i := 0; i < n; i++ {
+		svc := pool.NextService(nil)
+		require.NotNil(t, svc)
+		require.Equal(t, svc, pool.CurrentService())
+		counts[svc.Target.Port()]++
+	}
+	require.InDelta(t, n/4, counts[8080], float64(n)*0.05)
+	require.InDelta(t, 3*n/4, counts[8081], float64(n)*0.05)
+
+	// Unavailable services are never picked
+	pool.Services[1].Target.SetDraining(true)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, 8080, pool.NextService(nil).Target.Port())
+	}
+	pool.Services[0].Target.SetAlive(false)
+	require.Nil(t, pool.NextService(nil))
+}
+
+func TestServicePoolPowerOfTwo(t *testing.T) {
+	// spread returns the difference of the most and least requests in
+	// flight after n requests are picked by the given function and never
+	// finish
+	spread := func(svcs []*service, n int, pick func(*http.Request) *service) int64 {
+		for i := 0; i < n; i++ {
+			svc := pick(nil)
+			require.NotNil(t, svc)
+			svc.InFlight++
+		}
+		min, max := svcs[0].InFlight, svcs[0].InFlight
+		for _, svc := range svcs {
+			if svc.InFlight < min {
+				min = svc.InFlight
+			}
+			if svc.InFlight > max {
+				max = svc.InFlight
+			}
+		}
+		return max - min
+	}
+	newPool := func(strategy targets.Strategy) *servicePool {
+		pool := New(int64(time.Second), 100).(*servicePool)
+		pool.SetStrategy(strategy)
+		for port := 8080; port < 8088; port++ {
+			target := targets.NewTarget("127.0.0.1", port, "http")
+			require.Nil(t, pool.AddService(target))
+		}
+		return pool
+	}
+	// The spread of random picks varies between runs, so the picks are
+	// seeded for the bounds to hold
+	targets.SeedRandom(1)
+	n := 8000
+	random := newPool(targets.StrategyWeightedRandom)
+	randomSpread := spread(random.Services, n, random.NextService)
+	p2c := newPool(targets.StrategyPowerOfTwo)
+	require.Equal(t, targets.StrategyPowerOfTwo, p2c.Strategy)
+	p2cSpread := spread(p2c.Services, n, p2c.NextService)
+	require.LessOrEqual(t, p2cSpread, int64(5))
+	require.Less(t, p2cSpread, randomSpread)
+
+	// Unavailable services are passed over
+	for _, svc := range p2c.Services[1:] {
+		svc.Target.SetAlive(false)
+	}
+	for i := 0; i < 10; i++ {
+		require.Equal(t, p2c.Services[0], p2c.NextService(nil))
+	}
+}
+
+func TestServicePoolBackupService(t *testing.T) {
+	strategies := []targets.Strategy{
+		targets.StrategyRoundRobin,
+		targets.StrategyWeightedRandom,
+		targets.StrategyPowerOfTwo,
+	}
+	for _, strategy := range strategies {
+		pool := New(int64(time.Second), 100).(*servicePool)
+		pool.SetStrategy(strategy)
+		for port := 8080; port < 8083; port++ {
+			target := targets.NewTarget("127.0.0.1", port, "http")
+			target.SetBackup(port == 8080)
+			require.Nil(t, pool.AddService(target))
+		}
+
+		// Backups are only picked once the primaries are unavailable
+		for i := 0; i < 10; i++ {
+			svc := pool.NextService(nil)
+			require.NotNil(t, svc)
+			require.NotEqual(t, 8080, svc.Target.Port(), strategy)
+		}
+		pool.Services[1].Target.SetAlive(false)
+		pool.Services[2].Target.SetDraining(true)
+		for i := 0; i < 10; i++ {
+			require.Equal(t, pool.Services[0], pool.NextService(nil), strategy)
+		}
+		pool.Services[0].Target.SetAlive(false)
+		require.Nil(t, pool.NextService(nil))
+	}
+}
+
+func TestServicePoolStats(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/block" {
+				<-release
+			}
+		}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	pool := New(int64(time.Millisecond), 100)
+	require.Nil(t, pool.AddService(targets.NewServiceTarget(targetUrl)))
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		pool.LoadBalancer().ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	stats := pool.Stats()
+	require.Len(t, stats, 1)
+	require.Equal(t, targetUrl.String(), stats[0].Target.URL())
+	require.Equal(t, int64(0), stats[0].InFlight)
+	require.Equal(t, int64(3), stats[0].Total)
+	require.Equal(t, int64(0), stats[0].Errors)
+	require.Equal(t, int64(3), stats[0].Latency.Count)
+	require.Greater(t, stats[0].Latency.P99, time.Duration(0))
+	require.GreaterOrEqual(t, stats[0].Latency.P99, stats[0].Latency.P50)
+
+	// Requests being served are in flight
+	done := make(chan struct{})
+	go func() {
+		r := httptest.NewRequest(http.MethodGet, "/block", nil)
+		pool.LoadBalancer().ServeHTTP(httptest.NewRecorder(), r)
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		return pool.Stats()[0].InFlight == 1
+	}, time.Second, time.Millisecond)
+	close(release)
+	<-done
+	require.Equal(t, int64(0), pool.Stats()[0].InFlight)
+	require.Equal(t, int64(4), pool.Stats()[0].Total)
+
+	// Failed proxy attempts are errors
+	ts.Close()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	pool.LoadBalancer().ServeHTTP(w, r)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Greater(t, pool.Stats()[0].Errors, int64(0))
 }
 
 func TestServicePoolRetryService(t *testing.T) {
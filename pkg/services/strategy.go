@@ -0,0 +1,255 @@
+package services
+
+import (
+	"math"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+// Strategy represents the balancing strategy of a service pool; it picks the
+// service of each request from the pool's available services. Implement it for
+// custom routing; E.g. to shard requests by a header. A strategy is shared by
+// the pool's concurrent requests, so it must be safe for concurrent use.
+type Strategy interface {
+	// Select returns the index of the candidate that serves the given
+	// request, or -1 to pick none. Candidates are the available primary
+	// services, or the available backup services if no primary is
+	// available; Select is not called without candidates.
+	Select(candidates []Candidate, r *http.Request) int
+}
+
+// Candidate represents an available service that a strategy may pick.
+type Candidate struct {
+	Target   targets.Target // Service target
+	InFlight int64          // Requests being served
+	index    int            // Index of the service in its pool
+	version  uint64         // State version of the pool it was taken at
+}
+
+// NewStrategy returns a new instance of the given built-in strategy; round
+// robin if the strategy is not supported by service pools. The consistent hash
+// strategy needs a header, so it is created by NewConsistentHashStrategy.
+func NewStrategy(s targets.Strategy) Strategy {
+	switch s {
+	case targets.StrategyWeightedRandom:
+		return NewWeightedRandomStrategy()
+	case targets.StrategyPowerOfTwo:
+		return NewPowerOfTwoStrategy()
+	}
+	return NewRoundRobinStrategy()
+}
+
+// roundRobinStrategy implements the Strategy interface by picking the
+// candidates in turn.
+type roundRobinStrategy struct {
+	Index uint64 // Next turn
+}
+
+// NewRoundRobinStrategy returns a new Strategy that picks the candidates in
+// turn.
+func NewRoundRobinStrategy() Strategy {
+	return &roundRobinStrategy{}
+}
+
+func (s *roundRobinStrategy) Select(candidates []Candidate, r *http.Request) int {
+	return nextTurn(&s.Index, len(candidates))
+}
+
+// nextTurn returns the index of the next turn of a list of n candidates, and
+// advances the given turn index past it; -1 is returned if n is zero.
+func nextTurn(index *uint64, n int) int {
+	if n == 0 {
+		return -1
+	}
+	return int((atomic.AddUint64(index, 1) - 1) % uint64(n))
+}
+
+// weightedRandomStrategy implements the Strategy interface by picking the
+// candidates at random by weight.
+type weightedRandomStrategy struct {
+	Weighted targets.WeightedCache // Weighted random tables
+}
+
+// NewWeightedRandomStrategy returns a new Strategy that picks a candidate with a
+// probability proportional to its weight. The weight tables are only rebuilt
+// once the state of the targets changes, since the candidates do not change
+// until then.
+func NewWeightedRandomStrategy() Strategy {
+	return &weightedRandomStrategy{}
+}
+
+func (s *weightedRandomStrategy) Select(candidates []Candidate, r *http.Request) int {
+	if len(candidates) == 0 {
+		return -1
+	}
+	backup := candidates[0].Target.IsBackup()
+	idx := s.Weighted.Index(candidates[0].version, len(candidates), backup,
+		func(i int, backup bool) int {
+			// Weighed by the targets' current state, in case
+			// it changed since the candidates were taken
+			if !available(candidates[i].Target, backup) {
+				return 0
+			}
+			return candidates[i].Target.Weight()
+		})
+	if idx < 0 {
+		// The tables are stale, since every candidate was available
+		// when taken
+		weights := make([]int, len(candidates))
+		for i, c := range candidates {
+			weights[i] = c.Target.Weight()
+		}
+		idx = targets.WeightedIndex(weights)
+	}
+	return idx
+}
+
+// powerOfTwoStrategy implements the Strategy interface by picking the less
+// loaded of two random candidates.
+type powerOfTwoStrategy struct{}
+
+// NewPowerOfTwoStrategy returns a new Strategy that picks the candidate with
+// fewer requests in flight of two candidates picked at random.
+func NewPowerOfTwoStrategy() Strategy {
+	return powerOfTwoStrategy{}
+}
+
+func (powerOfTwoStrategy) Select(candidates []Candidate, r *http.Request) int {
+	switch len(candidates) {
+	case 0:
+		return -1
+	case 1:
+		return 0
+	}
+	i, j := targets.RandomPair(len(candidates))
+	if candidates[j].InFlight < candidates[i].InFlight {
+		return j
+	}
+	return i
+}
+
+// consistentHashStrategy implements the Strategy interface by picking the
+// candidates on a consistent hash ring of a request header's value.
+type consistentHashStrategy struct {
+	Header     string             // Header keying the hash ring
+	LoadFactor float64            // Bound of the loads; unbounded if zero
+	RoundRobin roundRobinStrategy // Picks requests without the header
+	rings      atomic.Value       // *hashRings
+}
+
+// hashRings are the hash rings of a pool's primary and backup services built
+// at a state version.
+type hashRings struct {
+	Version uint64
+	Tiers   [2]*targets.HashRing // Primary and backup services
+}
+
+// NewConsistentHashStrategy returns a new Strategy that picks a candidate by
+// the value of the given request header on a hash ring of the candidates; E.g.
+// so each tenant always lands on the same backend. Adding or removing a
+// candidate only moves the keys of its share of the ring. Requests without the
+// header are picked in turn. The rings are only rebuilt once the state of the
+// targets changes, since the candidates do not change until then.
+func NewConsistentHashStrategy(header string) Strategy {
+	return &consistentHashStrategy{Header: http.CanonicalHeaderKey(header)}
+}
+
+// NewBoundedHashStrategy returns a new consistent hash Strategy with bounded
+// loads; a candidate with the given load factor times the average requests in
+// flight overflows its keys to the next candidate around the ring, so a hot key
+// does not overload its backend. E.g. a load factor of 1.25 lets a candidate
+// serve up to 25% more than the average. Load factors less than one are
+// raised to one; the tightest bound.
+func NewBoundedHashStrategy(header string, loadFactor float64) Strategy {
+	if loadFactor < 1 {
+		loadFactor = 1
+	}
+	return &consistentHashStrategy{
+		Header:     http.CanonicalHeaderKey(header),
+		LoadFactor: loadFactor,
+	}
+}
+
+func (s *consistentHashStrategy) Select(candidates []Candidate, r *http.Request) int {
+	if len(candidates) == 0 {
+		return -1
+	}
+	key := ""
+	if r != nil && s.Header != "" {
+		key = r.Header.Get(s.Header)
+	}
+	if key == "" {
+		return s.RoundRobin.Select(candidates, r)
+	}
+	accept := s.acceptFunc(candidates)
+	url := s.ring(candidates).Next(key, accept)
+	if i := candidateOf(candidates, url); i >= 0 {
+		return i
+	}
+	// The ring is stale, since the state changed after the candidates
+	// were taken
+	return candidateOf(candidates, newHashRing(candidates).Next(key, accept))
+}
+
+// acceptFunc returns the func accepting the members of a hash ring that are
+// among the given candidates and, if the loads are bounded, below the bound.
+// The bound is the load factor times the average requests in flight, counting
+// the request being picked, so at least one candidate is always below it.
+func (s *consistentHashStrategy) acceptFunc(candidates []Candidate) func(string) bool {
+	bound := int64(math.MaxInt64)
+	if s.LoadFactor > 0 {
+		total := int64(1)
+		for _, c := range candidates {
+			total += c.InFlight
+		}
+		avg := float64(total) / float64(len(candidates))
+		bound = int64(math.Ceil(s.LoadFactor * avg))
+	}
+	return func(url string) bool {
+		i := candidateOf(candidates, url)
+		return i >= 0 && candidates[i].InFlight < bound
+	}
+}
+
+// ring returns the hash ring of the given candidates' tier, built at the state
+// version the candidates were taken at.
+func (s *consistentHashStrategy) ring(candidates []Candidate) *targets.HashRing {
+	tier := 0
+	if candidates[0].Target.IsBackup() {
+		tier = 1
+	}
+	version := candidates[0].version
+	rings, ok := s.rings.Load().(*hashRings)
+	if ok && rings.Version == version && rings.Tiers[tier] != nil {
+		return rings.Tiers[tier]
+	}
+	next := &hashRings{Version: version}
+	if ok && rings.Version == version {
+		next.Tiers = rings.Tiers
+	}
+	next.Tiers[tier] = newHashRing(candidates)
+	s.rings.Store(next)
+	return next.Tiers[tier]
+}
+
+// newHashRing returns a new hash ring of the given candidates' URLs.
+func newHashRing(candidates []Candidate) *targets.HashRing {
+	urls := make([]string, len(candidates))
+	for i, c := range candidates {
+		urls[i] = c.Target.URL()
+	}
+	return targets.NewHashRing(urls, targets.DefaultHashRingReplicas)
+}
+
+// candidateOf returns the index of the candidate of the given URL; -1 if there
+// is none.
+func candidateOf(candidates []Candidate, url string) int {
+	for i, c := range candidates {
+		if c.Target.URL() == url {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,228 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+// shardStrategy is a custom strategy that shards requests by a header.
+type shardStrategy struct{}
+
+func (shardStrategy) Select(candidates []Candidate, r *http.Request) int {
+	for i, c := range candidates {
+		if c.Target.Name() == r.Header.Get("X-Shard") {
+			return i
+		}
+	}
+	return -1
+}
+
+// racingStrategy is a strategy that calls Change once, before its first pick;
+// E.g. to change the state of its pool while a pick is in flight.
+type racingStrategy struct {
+	Strategy
+	Change func()
+}
+
+func (s *racingStrategy) Select(candidates []Candidate, r *http.Request) int {
+	if s.Change != nil {
+		s.Change()
+		s.Change = nil
+	}
+	return s.Strategy.Select(candidates, r)
+}
+
+func TestNewStrategy(t *testing.T) {
+	require.IsType(t, &roundRobinStrategy{},
+		NewStrategy(targets.StrategyRoundRobin))
+	require.IsType(t, &weightedRandomStrategy{},
+		NewStrategy(targets.StrategyWeightedRandom))
+	require.IsType(t, powerOfTwoStrategy{},
+		NewStrategy(targets.StrategyPowerOfTwo))
+	require.IsType(t, &roundRobinStrategy{},
+		NewStrategy(targets.StrategyIpHash))
+}
+
+func TestRoundRobinStrategy(t *testing.T) {
+	s := NewRoundRobinStrategy()
+	candidates := make([]Candidate, 3)
+	for i := 0; i < 6; i++ {
+		require.Equal(t, i%3, s.Select(candidates, nil))
+	}
+	require.Equal(t, -1, s.Select(nil, nil))
+}
+
+func TestPowerOfTwoStrategy(t *testing.T) {
+	s := NewPowerOfTwoStrategy()
+	candidates := []Candidate{{InFlight: 5}, {InFlight: 0}}
+	for i := 0; i < 10; i++ {
+		require.Equal(t, 1, s.Select(candidates, nil))
+	}
+	require.Equal(t, 0, s.Select(candidates[:1], nil))
+	require.Equal(t, -1, s.Select(nil, nil))
+}
+
+func TestConsistentHashStrategy(t *testing.T) {
+	s := NewConsistentHashStrategy("x-tenant")
+	candidates := make([]Candidate, 5)
+	for i := range candidates {
+		candidates[i].Target = targets.NewTarget("127.0.0.1", 8080+i,
+			"http")
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	owners := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		tenant := fmt.Sprintf("tenant-%d", i)
+		r.Header.Set("X-Tenant", tenant)
+		idx := s.Select(candidates, r)
+		require.GreaterOrEqual(t, idx, 0)
+		// The same tenant always lands on the same candidate
+		require.Equal(t, idx, s.Select(candidates, r))
+		owners[tenant] = candidates[idx].Target.URL()
+	}
+
+	// Removing a candidate only moves the tenants it served
+	removed := candidates[2].Target.URL()
+	remaining := append(append([]Candidate{}, candidates[:2]...),
+		candidates[3:]...)
+	for i := range remaining {
+		remaining[i].version = 1
+	}
+	moved := 0
+	for tenant, owner := range owners {
+		r.Header.Set("X-Tenant", tenant)
+		url := remaining[s.Select(remaining, r)].Target.URL()
+		if owner == removed {
+			require.NotEqual(t, removed, url)
+			moved++
+		} else {
+			require.Equal(t, owner, url)
+		}
+	}
+	require.Greater(t, moved, 0)
+	require.Less(t, moved, len(owners)/2)
+
+	// A stale ring still picks one of the candidates
+	require.GreaterOrEqual(t, s.Select(candidates, r), 0)
+
+	// Requests without the header are picked in turn
+	r.Header.Del("X-Tenant")
+	for i := 0; i < 10; i++ {
+		require.Equal(t, i%5, s.Select(candidates, r))
+	}
+	require.Equal(t, 0, s.Select(candidates, nil))
+	require.Equal(t, -1, s.Select(nil, r))
+}
+
+func TestConsistentHashStrategyStateChange(t *testing.T) {
+	pool := New(int64(time.Second), 100).(*servicePool)
+	for port := 8080; port < 8083; port++ {
+		target := targets.NewTarget("127.0.0.1", port, "http")
+		require.Nil(t, pool.AddService(target))
+	}
+	dead := pool.Services[1].Target.URL()
+	hash := NewConsistentHashStrategy("x-tenant").(*consistentHashStrategy)
+	pool.SetCustomStrategy(&racingStrategy{
+		Strategy: hash,
+		Change:   func() { pool.SetAlive(dead, false) },
+	})
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Tenant", "tenant")
+	require.NotNil(t, pool.NextService(r))
+
+	// The ring built from the candidates taken before the change is not
+	// cached at the version after it
+	rings := hash.rings.Load().(*hashRings)
+	require.Less(t, rings.Version, atomic.LoadUint64(&pool.Version))
+	for i := 0; i < 100; i++ {
+		r.Header.Set("X-Tenant", fmt.Sprintf("tenant-%d", i))
+		svc := pool.NextService(r)
+		require.NotNil(t, svc)
+		require.NotEqual(t, dead, svc.Target.URL())
+	}
+	rings = hash.rings.Load().(*hashRings)
+	require.Equal(t, atomic.LoadUint64(&pool.Version), rings.Version)
+	for i := 0; i < 100; i++ {
+		require.NotEqual(t, dead,
+			rings.Tiers[0].Get(fmt.Sprintf("tenant-%d", i)))
+	}
+}
+
+func TestBoundedHashStrategy(t *testing.T) {
+	s := NewBoundedHashStrategy("X-Tenant", 1.25)
+	candidates := make([]Candidate, 4)
+	for i := range candidates {
+		candidates[i].Target = targets.NewTarget("127.0.0.1", 8080+i,
+			"http")
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Tenant", "hot")
+	owner := s.Select(candidates, r)
+	require.Equal(t, owner,
+		NewConsistentHashStrategy("X-Tenant").Select(candidates, r))
+
+	// A key stays on its candidate while it is under the bound
+	for i := range candidates {
+		candidates[i].InFlight = 1
+	}
+	require.Equal(t, owner, s.Select(candidates, r))
+
+	// and overflows to the same next candidate past it
+	candidates[owner].InFlight = 10
+	next := s.Select(candidates, r)
+	require.NotEqual(t, owner, next)
+	require.Equal(t, next, s.Select(candidates, r))
+
+	// A hot key is spread out, so no candidate serves more than the load
+	// factor times the average
+	for i := range candidates {
+		candidates[i].InFlight = 0
+	}
+	for i := 0; i < 100; i++ {
+		candidates[s.Select(candidates, r)].InFlight++
+	}
+	for _, c := range candidates {
+		require.LessOrEqual(t, c.InFlight, int64(32))
+	}
+
+	// Load factors less than one are the tightest bound
+	s = NewBoundedHashStrategy("X-Tenant", 0)
+	require.Equal(t, 1.0, s.(*consistentHashStrategy).LoadFactor)
+}
+
+func TestServicePoolCustomStrategy(t *testing.T) {
+	pool := New(int64(time.Second), 100).(*servicePool)
+	for i, name := range []string{"a", "b", "c"} {
+		target := targets.NewTarget("127.0.0.1", 8080+i, "http")
+		target.SetName(name)
+		require.Nil(t, pool.AddService(target))
+	}
+	pool.SetCustomStrategy(shardStrategy{})
+	pool.SetStrategy(targets.StrategyWeightedRandom)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, name := range []string{"b", "c", "a", "b"} {
+		r.Header.Set("X-Shard", name)
+		svc := pool.NextService(r)
+		require.NotNil(t, svc)
+		require.Equal(t, name, svc.Target.Name())
+		require.Equal(t, svc, pool.CurrentService())
+	}
+
+	// Unavailable services are not candidates
+	r.Header.Set("X-Shard", "b")
+	pool.Services[1].Target.SetAlive(false)
+	require.Nil(t, pool.NextService(r))
+
+	// Nil restores the built-in strategy
+	pool.SetCustomStrategy(nil)
+	require.IsType(t, &weightedRandomStrategy{}, pool.Selector)
+	require.NotNil(t, pool.NextService(r))
+}
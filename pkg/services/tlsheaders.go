@@ -0,0 +1,69 @@
+package services
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+)
+
+// TlsHeaders represents the names of the headers that pass the details of a
+// client's connection to backend services. Headers with an empty name are not
+// set, and any values sent by the client for the configured headers are
+// removed; so backends can trust them.
+type TlsHeaders struct {
+	Proto         string // Original scheme; "http" or "https"
+	Cipher        string // TLS cipher suite name
+	Version       string // TLS version; E.g. "TLSv1.3"
+	ClientSubject string // Verified client certificate subject
+}
+
+// Set sets the headers of the given outgoing request from the TLS state of the
+// connection it was received on. TLS headers are not set for plain HTTP
+// requests.
+func (h TlsHeaders) Set(r *http.Request) {
+	for _, name := range []string{
+		h.Proto, h.Cipher, h.Version, h.ClientSubject,
+	} {
+		if name != "" {
+			r.Header.Del(name)
+		}
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	setHeader(r, h.Proto, proto)
+	if r.TLS == nil {
+		return
+	}
+	setHeader(r, h.Cipher, tls.CipherSuiteName(r.TLS.CipherSuite))
+	setHeader(r, h.Version, tlsVersionName(r.TLS.Version))
+	// Only chains verified by the listener identify the client
+	if len(r.TLS.VerifiedChains) > 0 && len(r.TLS.PeerCertificates) > 0 {
+		setHeader(r, h.ClientSubject,
+			r.TLS.PeerCertificates[0].Subject.String())
+	}
+}
+
+// setHeader sets the named header of the given request to the value, if the
+// name is not empty.
+func setHeader(r *http.Request, name, value string) {
+	if name != "" {
+		r.Header.Set(name, value)
+	}
+}
+
+// tlsVersionName returns the name of the given TLS version.
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1.0"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
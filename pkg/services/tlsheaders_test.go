@@ -0,0 +1,77 @@
+package services
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+var testTlsHeaders = TlsHeaders{
+	Proto:         "X-Forwarded-Proto",
+	Cipher:        "X-Tls-Cipher",
+	Version:       "X-Tls-Version",
+	ClientSubject: "X-Client-Subject",
+}
+
+func TestTlsHeadersSet(t *testing.T) {
+	// Client sent values are not trusted
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.Header.Set("X-Client-Subject", "CN=admin")
+	testTlsHeaders.Set(r)
+	require.Equal(t, "http", r.Header.Get("X-Forwarded-Proto"))
+	require.Equal(t, "", r.Header.Get("X-Tls-Cipher"))
+	require.Equal(t, "", r.Header.Get("X-Client-Subject"))
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client-1"}}
+	r = httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	r.TLS = &tls.ConnectionState{
+		Version:          tls.VersionTLS13,
+		CipherSuite:      tls.TLS_AES_128_GCM_SHA256,
+		PeerCertificates: []*x509.Certificate{cert},
+	}
+	testTlsHeaders.Set(r)
+	require.Equal(t, "https", r.Header.Get("X-Forwarded-Proto"))
+	require.Equal(t, "TLS_AES_128_GCM_SHA256", r.Header.Get("X-Tls-Cipher"))
+	require.Equal(t, "TLSv1.3", r.Header.Get("X-Tls-Version"))
+	// Unverified certificates do not identify the client
+	require.Equal(t, "", r.Header.Get("X-Client-Subject"))
+
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	testTlsHeaders.Set(r)
+	require.Equal(t, "CN=client-1", r.Header.Get("X-Client-Subject"))
+
+	// Headers without a name are not set
+	r = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	TlsHeaders{}.Set(r)
+	require.Len(t, r.Header, 0)
+}
+
+func TestServicePoolTlsHeaders(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Seen-Version",
+				r.Header.Get("X-Tls-Version"))
+		}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	pool := New(int64(time.Millisecond), 100)
+	pool.SetTlsHeaders(testTlsHeaders)
+	require.Nil(t, pool.AddService(targets.NewServiceTarget(targetUrl)))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	r.TLS = &tls.ConnectionState{Version: tls.VersionTLS12}
+	pool.LoadBalancer().ServeHTTP(w, r)
+	require.Equal(t, "TLSv1.2", w.Header().Get("X-Seen-Version"))
+}
@@ -0,0 +1,73 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+var ErrHijackNotSupported = errors.New("Response writer does not support hijacking")
+
+// responseWriter wraps a http.ResponseWriter to track whether any part of the
+// response was sent to the client; after which a failed request can no longer
+// be retried. The status and the last service attempted are tracked for the
+// slow request log.
+type responseWriter struct {
+	http.ResponseWriter        // Client response writer
+	Started             bool   // Response started
+	Status              int    // Response status code
+	Target              string // URL of the last service attempted
+}
+
+// newResponseWriter returns the given response writer wrapped to track the
+// response, unless it is already tracked.
+func newResponseWriter(w http.ResponseWriter) *responseWriter {
+	if rw, ok := w.(*responseWriter); ok {
+		return rw
+	}
+	return &responseWriter{ResponseWriter: w}
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.Started = true
+	if rw.Status == 0 {
+		rw.Status = http.StatusOK
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *responseWriter) WriteHeader(statusCode int) {
+	rw.Started = true
+	if rw.Status == 0 {
+		rw.Status = statusCode
+	}
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Flush flushes buffered data to the client, if the wrapped writer supports
+// it; so streamed responses are not held back.
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		rw.Started = true
+		f.Flush()
+	}
+}
+
+// Hijack hands over the client connection, if the wrapped writer supports it;
+// E.g. for protocol upgrades.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, ErrHijackNotSupported
+	}
+	rw.Started = true
+	return hj.Hijack()
+}
+
+// responseStarted returns true if any part of the response was sent by the
+// given response writer.
+func responseStarted(w http.ResponseWriter) bool {
+	rw, ok := w.(*responseWriter)
+	return ok && rw.Started
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/targets"
+)
+
+func TestResponseWriter(t *testing.T) {
+	rr := httptest.NewRecorder()
+	w := newResponseWriter(rr)
+	require.False(t, responseStarted(w))
+	require.False(t, responseStarted(rr))
+	require.Equal(t, 0, w.Status)
+	// Tracked writers are not wrapped again
+	require.Equal(t, w, newResponseWriter(w))
+
+	_, err := w.Write([]byte("hello"))
+	require.Nil(t, err)
+	require.True(t, responseStarted(w))
+	require.Equal(t, "hello", rr.Body.String())
+	require.Equal(t, http.StatusOK, w.Status)
+
+	w = newResponseWriter(httptest.NewRecorder())
+	w.WriteHeader(http.StatusNotFound)
+	w.WriteHeader(http.StatusOK)
+	require.Equal(t, http.StatusNotFound, w.Status)
+
+	w = newResponseWriter(httptest.NewRecorder())
+	w.Flush()
+	require.True(t, responseStarted(w))
+
+	w = newResponseWriter(httptest.NewRecorder())
+	_, _, err = w.Hijack()
+	require.Equal(t, ErrHijackNotSupported, err)
+	require.False(t, responseStarted(w))
+}
+
+func TestServiceErrorHandlerResponseStarted(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+		}),
+	)
+	defer ts.Close()
+	targetUrl, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	pool := New(int64(time.Millisecond), 100).(*servicePool)
+	require.Nil(t, pool.AddService(targets.NewServiceTarget(targetUrl)))
+	svc := pool.Services[0]
+
+	// Failures after the response started are not retried
+	rr := httptest.NewRecorder()
+	w := newResponseWriter(rr)
+	w.WriteHeader(http.StatusOK)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	svc.Proxy.ErrorHandler(w, r, errors.New("connection reset"))
+	require.Equal(t, int32(0), atomic.LoadInt32(&hits))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	// Failures before it are
+	rr = httptest.NewRecorder()
+	svc.Proxy.ErrorHandler(newResponseWriter(rr), r,
+		errors.New("connection refused"))
+	require.Equal(t, int32(1), atomic.LoadInt32(&hits))
+	require.Equal(t, http.StatusOK, rr.Code)
+}
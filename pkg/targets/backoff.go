@@ -0,0 +1,76 @@
+package targets
+
+import (
+	"time"
+)
+
+const (
+	// Retry backoff defaults
+	DefaultBackoffBase       = 100 * time.Millisecond
+	DefaultBackoffMultiplier = 2.0
+	DefaultBackoffMax        = 2 * time.Second
+)
+
+// Backoff represents the exponential backoff between the retries of a failed
+// target; each delay is the last one grown by the multiplier, up to the maximum
+// delay. Delays are jittered, so the retries of concurrent requests do not
+// synchronize and hit a struggling backend at once. Zero values are replaced
+// by the defaults.
+type Backoff struct {
+	Base       time.Duration // Delay before the first retry
+	Multiplier float64       // Growth of the delay per retry
+	Max        time.Duration // Maximum delay
+}
+
+// DefaultBackoff is the backoff of retries when none is set.
+var DefaultBackoff = Backoff{
+	Base:       DefaultBackoffBase,
+	Multiplier: DefaultBackoffMultiplier,
+	Max:        DefaultBackoffMax,
+}
+
+// Delay returns the jittered delay before the given retry, counted from zero.
+// The delay is picked at random from the upper half of the retry's backoff, so
+// delays keep growing with each retry while still being spread out.
+func (b Backoff) Delay(retry int) time.Duration {
+	d := b.backoff(retry)
+	if d <= 1 {
+		return d
+	}
+	randomLock.Lock()
+	jitter := time.Duration(random.Int63n(int64(d / 2)))
+	randomLock.Unlock()
+	return d - jitter
+}
+
+// backoff returns the unjittered delay before the given retry.
+func (b Backoff) backoff(retry int) time.Duration {
+	b = b.normalize()
+	d := float64(b.Base)
+	for i := 0; i < retry && d < float64(b.Max); i++ {
+		d *= b.Multiplier
+	}
+	if d > float64(b.Max) {
+		return b.Max
+	}
+	return time.Duration(d)
+}
+
+// normalize returns the backoff with its unset or invalid values replaced by
+// the defaults. A multiplier less than one would shrink the delays, and a
+// maximum below the base would cap them under the first delay.
+func (b Backoff) normalize() Backoff {
+	if b.Base <= 0 {
+		b.Base = DefaultBackoffBase
+	}
+	if b.Multiplier < 1 {
+		b.Multiplier = DefaultBackoffMultiplier
+	}
+	if b.Max < b.Base {
+		b.Max = DefaultBackoffMax
+		if b.Max < b.Base {
+			b.Max = b.Base
+		}
+	}
+	return b
+}
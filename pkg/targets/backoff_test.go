@@ -0,0 +1,55 @@
+package targets
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{
+		Base:       10 * time.Millisecond,
+		Multiplier: 2,
+		Max:        time.Second,
+	}
+	delays := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		last := time.Duration(0)
+		for retry := 0; retry < 5; retry++ {
+			// Jittered within the upper half of the retry's backoff
+			max := b.Base << retry
+			d := b.Delay(retry)
+			require.Greater(t, d, max/2)
+			require.LessOrEqual(t, d, max)
+			require.GreaterOrEqual(t, d, last)
+			last = d
+			delays[d] = true
+		}
+	}
+	// Delays are spread out rather than fixed per retry
+	require.Greater(t, len(delays), 5)
+
+	// Delays are capped at the maximum
+	for retry := 7; retry < 64; retry++ {
+		d := b.Delay(retry)
+		require.Greater(t, d, b.Max/2)
+		require.LessOrEqual(t, d, b.Max)
+	}
+}
+
+func TestBackoffNormalize(t *testing.T) {
+	require.Equal(t, DefaultBackoff, Backoff{}.normalize())
+	require.Equal(t, DefaultBackoff, Backoff{
+		Base:       -time.Second,
+		Multiplier: 0.5,
+		Max:        -time.Second,
+	}.normalize())
+	require.Equal(t, Backoff{
+		Base:       5 * time.Second,
+		Multiplier: DefaultBackoffMultiplier,
+		Max:        5 * time.Second,
+	}, Backoff{Base: 5 * time.Second}.normalize())
+	require.Equal(t, DefaultBackoffBase, DefaultBackoff.backoff(0))
+	require.Equal(t, DefaultBackoffMax, DefaultBackoff.backoff(10))
+}
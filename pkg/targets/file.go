@@ -0,0 +1,218 @@
+package targets
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/logging"
+)
+
+// FileReloadDelay is how long a targets file must go without changes before it
+// is read again; so that a file being written is read once it is complete.
+const FileReloadDelay = 100 * time.Millisecond
+
+// log is the logger of the targets package.
+var log = logging.New("targets")
+
+var (
+	ErrEmptyTargetsFile   = errors.New("Targets file contains no targets")
+	ErrInvalidTargetsFile = errors.New("Invalid targets file")
+)
+
+// fileTarget represents a target in a JSON targets file.
+type fileTarget struct {
+	Name   string `json:"name"`   // Target name
+	Host   string `json:"host"`   // Hostname (IP/Domain/etc)
+	Port   int    `json:"port"`   // Port number of the targeted service
+	Weight int    `json:"weight"` // Relative weight of the target
+}
+
+// ParseTargetsFile parses the contents of a targets file into targets for the
+// given protocol. The file either lists a "host:port" per line, ignoring blank
+// lines and lines starting with '#', or is a JSON array of "host:port" strings
+// or objects with host, port, and optional name and weight fields. The whole
+// file must be valid and list at least one target.
+func ParseTargetsFile(b []byte, protocol string) ([]Target, error) {
+	var ts []Target
+	var err error
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '[' {
+		ts, err = parseJsonTargets(trimmed, protocol)
+	} else {
+		ts, err = parseLineTargets(b, protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(ts) == 0 {
+		return nil, ErrEmptyTargetsFile
+	}
+	return ts, nil
+}
+
+// parseLineTargets parses targets from "host:port" lines.
+func parseLineTargets(b []byte, protocol string) ([]Target, error) {
+	ts := []Target{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		t, err := parseHostPort(line, protocol)
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// parseJsonTargets parses targets from a JSON array of "host:port" strings or
+// target objects.
+func parseJsonTargets(b []byte, protocol string) ([]Target, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(b, &items); err != nil {
+		return nil, fmt.Errorf("%s - '%s'", ErrInvalidTargetsFile, err)
+	}
+	ts := []Target{}
+	for _, item := range items {
+		var hostPort string
+		if err := json.Unmarshal(item, &hostPort); err == nil {
+			t, err := parseHostPort(hostPort, protocol)
+			if err != nil {
+				return nil, err
+			}
+			ts = append(ts, t)
+			continue
+		}
+		var ft fileTarget
+		if err := json.Unmarshal(item, &ft); err != nil {
+			return nil, fmt.Errorf("%s - '%s'",
+				ErrInvalidTargetsFile, err)
+		}
+		if ft.Host == "" || ft.Port <= 0 || ft.Port > 65535 {
+			return nil, fmt.Errorf("%s - '%s'",
+				ErrInvalidTargetsFile, string(item))
+		}
+		t := NewTarget(ft.Host, ft.Port, protocol)
+		t.SetName(ft.Name)
+		t.SetWeight(ft.Weight)
+		ts = append(ts, t)
+	}
+	return ts, nil
+}
+
+// parseHostPort parses a "host:port" target.
+func parseHostPort(s, protocol string) (Target, error) {
+	host, p, err := net.SplitHostPort(s)
+	if err != nil || host == "" {
+		return nil, fmt.Errorf("%s - '%s'", ErrInvalidTargetsFile, s)
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("%s - '%s'", ErrInvalidTargetsFile, s)
+	}
+	return NewTarget(host, port, protocol), nil
+}
+
+// fileProvider implements the Provider interface for a targets file that is
+// read again whenever it changes.
+type fileProvider struct {
+	Path string // Targets file path
+}
+
+// NewFileProvider returns a new Provider of the targets listed in the given
+// file. See ParseTargetsFile for the file's format.
+func NewFileProvider(path string) Provider {
+	return &fileProvider{Path: path}
+}
+
+func (p *fileProvider) Targets(protocol string) ([]Target, error) {
+	b, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTargetsFile(b, protocol)
+}
+
+func (p *fileProvider) Watch(protocol string, fn func([]Target)) StopFn {
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		// Watch the directory, since editors and tools commonly
+		// replace the file instead of writing to it
+		err = watcher.Add(filepath.Dir(p.Path))
+	}
+	if err != nil {
+		log.Error("Failed to watch targets file", logging.Fields{
+			"file":             p.Path,
+			logging.FieldError: err,
+		})
+		if watcher != nil {
+			watcher.Close()
+		}
+		return func() {}
+	}
+	name := filepath.Clean(p.Path)
+	quit := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		reload := time.NewTimer(FileReloadDelay)
+		reload.Stop()
+		for {
+			select {
+			case <-quit:
+				reload.Stop()
+				return
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) == name {
+					reload.Reset(FileReloadDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Error("Failed to watch targets file",
+					logging.Fields{
+						"file":             p.Path,
+						logging.FieldError: err,
+					})
+			case <-reload.C:
+				ts, err := p.Targets(protocol)
+				if err != nil {
+					// Keep the current targets until the
+					// file is valid again
+					log.Error("Failed to reload targets file",
+						logging.Fields{
+							"file":             p.Path,
+							logging.FieldError: err,
+						})
+					continue
+				}
+				fn(ts)
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-stopped
+		watcher.Close()
+	}
+}
@@ -0,0 +1,84 @@
+package targets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTargetsFile(t *testing.T) {
+	ts, err := ParseTargetsFile([]byte(`
+# web servers
+10.0.0.1:8080
+
+web-2.local:8081
+[::1]:8082
+`), "http")
+	require.Nil(t, err)
+	require.Len(t, ts, 3)
+	require.Equal(t, "http://10.0.0.1:8080", ts[0].URL())
+	require.Equal(t, "http://web-2.local:8081", ts[1].URL())
+	require.Equal(t, "::1", ts[2].Host())
+
+	ts, err = ParseTargetsFile([]byte(`[
+		"10.0.0.1:8080",
+		{"name": "web-2", "host": "10.0.0.2", "port": 8080, "weight": 3}
+	]`), "http")
+	require.Nil(t, err)
+	require.Len(t, ts, 2)
+	require.Equal(t, "http://10.0.0.1:8080", ts[0].URL())
+	require.Equal(t, "web-2", ts[1].Name())
+	require.Equal(t, 3, ts[1].Weight())
+
+	_, err = ParseTargetsFile([]byte("# nothing yet\n"), "http")
+	require.Equal(t, ErrEmptyTargetsFile, err)
+	_, err = ParseTargetsFile([]byte("10.0.0.1:8080\n10.0.0."), "http")
+	require.NotNil(t, err)
+	_, err = ParseTargetsFile([]byte(`["10.0.0.1:8080", {"host": "10.0`),
+		"http")
+	require.NotNil(t, err)
+	_, err = ParseTargetsFile([]byte(`[{"host": "10.0.0.1"}]`), "http")
+	require.NotNil(t, err)
+}
+
+func TestFileProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "targets")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "targets.txt")
+	require.Nil(t, ioutil.WriteFile(path, []byte("10.0.0.1:8080\n"), 0644))
+
+	p := NewFileProvider(path)
+	ts, err := p.Targets("http")
+	require.Nil(t, err)
+	require.Len(t, ts, 1)
+
+	updated := make(chan []Target, 1)
+	stop := p.Watch("http", func(ts []Target) { updated <- ts })
+	defer stop()
+
+	// Invalid contents keep the current targets
+	require.Nil(t, ioutil.WriteFile(path, []byte("10.0.0."), 0644))
+	select {
+	case <-updated:
+		t.Fatal("invalid targets file was applied")
+	case <-time.After(3 * FileReloadDelay):
+	}
+
+	// Replacing the file applies its targets
+	tmp := filepath.Join(dir, "targets.tmp")
+	require.Nil(t, ioutil.WriteFile(tmp,
+		[]byte("10.0.0.1:8080\n10.0.0.2:8080\n"), 0644))
+	require.Nil(t, os.Rename(tmp, path))
+	select {
+	case ts := <-updated:
+		require.Len(t, ts, 2)
+		require.Equal(t, "http://10.0.0.2:8080", ts[1].URL())
+	case <-time.After(time.Second):
+		t.Fatal("targets were not reloaded")
+	}
+}
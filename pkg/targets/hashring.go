@@ -0,0 +1,107 @@
+package targets
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// DefaultHashRingReplicas is the number of points each member is placed at on a
+// hash ring; more points spread the keys more evenly across the members.
+const DefaultHashRingReplicas = 128
+
+// HashRing is a consistent hash ring of members; E.g. the URLs of targets. A key
+// belongs to the member of the first point at or after the key's hash, so
+// adding or removing a member only moves the keys of the points it gains or
+// loses, about 1/n of them, rather than reshuffling every key.
+type HashRing struct {
+	Points  []uint64 // Sorted hashes of the members' points
+	Members []string // Member of each point
+}
+
+// NewHashRing returns a new hash ring of the given members, each placed at the
+// given number of points; DefaultHashRingReplicas if it is not positive.
+func NewHashRing(members []string, replicas int) *HashRing {
+	if replicas <= 0 {
+		replicas = DefaultHashRingReplicas
+	}
+	type point struct {
+		Hash   uint64
+		Member string
+	}
+	points := make([]point, 0, len(members)*replicas)
+	for _, m := range members {
+		for i := 0; i < replicas; i++ {
+			points = append(points, point{
+				Hash:   hashKey(m + "#" + strconv.Itoa(i)),
+				Member: m,
+			})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].Hash == points[j].Hash {
+			// Ties are ordered by member, so they do not
+			// depend on the order of the members
+			return points[i].Member < points[j].Member
+		}
+		return points[i].Hash < points[j].Hash
+	})
+	ring := &HashRing{
+		Points:  make([]uint64, len(points)),
+		Members: make([]string, len(points)),
+	}
+	for i, p := range points {
+		ring.Points[i] = p.Hash
+		ring.Members[i] = p.Member
+	}
+	return ring
+}
+
+// Get returns the member that the given key belongs to; empty if the ring has
+// no members.
+func (r *HashRing) Get(key string) string {
+	return r.Next(key, nil)
+}
+
+// Next returns the first member from the given key's point around the ring that
+// the accept func accepts; E.g. to overflow a key from a loaded member to the
+// next one. Each member is only offered once, and a nil accept func accepts
+// any member. Empty is returned if no member is accepted.
+func (r *HashRing) Next(key string, accept func(member string) bool) string {
+	n := len(r.Points)
+	if n == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	start := sort.Search(n, func(i int) bool {
+		return r.Points[i] >= h
+	})
+	rejected := map[string]bool{}
+	for i := 0; i < n; i++ {
+		// Past the last point, the ring wraps around
+		m := r.Members[(start+i)%n]
+		if rejected[m] {
+			continue
+		}
+		if accept == nil || accept(m) {
+			return m
+		}
+		rejected[m] = true
+	}
+	return ""
+}
+
+// hashKey returns the hash of the given key on a hash ring. FNV alone barely
+// spreads keys that only differ at the end, like "tenant-1" and "tenant-2", so
+// its hash is mixed by the MurmurHash3 finalizer.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,103 @@
+package targets
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashRing(t *testing.T) {
+	members := []string{}
+	for i := 0; i < 10; i++ {
+		members = append(members, fmt.Sprintf("http://10.0.0.%d:8080", i))
+	}
+	keys := []string{}
+	for i := 0; i < 10000; i++ {
+		keys = append(keys, fmt.Sprintf("tenant-%d", i))
+	}
+	owners := func(ring *HashRing) map[string]string {
+		m := map[string]string{}
+		for _, k := range keys {
+			m[k] = ring.Get(k)
+		}
+		return m
+	}
+	ring := NewHashRing(members, 0)
+	before := owners(ring)
+
+	// Keys are spread across the members
+	counts := map[string]int{}
+	for _, m := range before {
+		counts[m]++
+	}
+	require.Len(t, counts, len(members))
+	for _, n := range counts {
+		require.InDelta(t, len(keys)/len(members), n,
+			float64(len(keys))*0.05)
+	}
+
+	// The order of the members does not matter
+	reversed := make([]string, len(members))
+	for i, m := range members {
+		reversed[len(members)-1-i] = m
+	}
+	require.Equal(t, before, owners(NewHashRing(reversed, 0)))
+
+	// Removing a member only moves its own keys
+	removed := members[3]
+	after := owners(NewHashRing(append(append([]string{}, members[:3]...),
+		members[4:]...), 0))
+	moved := 0
+	for _, k := range keys {
+		if before[k] != after[k] {
+			require.Equal(t, removed, before[k])
+			moved++
+		}
+	}
+	require.Equal(t, counts[removed], moved)
+
+	// Adding a member only moves keys to it, about 1/n of them
+	added := "http://10.0.0.10:8080"
+	after = owners(NewHashRing(append(append([]string{}, members...),
+		added), 0))
+	moved = 0
+	for _, k := range keys {
+		if before[k] != after[k] {
+			require.Equal(t, added, after[k])
+			moved++
+		}
+	}
+	require.Greater(t, moved, 0)
+	require.Less(t, moved, len(keys)/5)
+}
+
+func TestHashRingEmpty(t *testing.T) {
+	require.Equal(t, "", NewHashRing(nil, 0).Get("tenant"))
+	require.Equal(t, "a", NewHashRing([]string{"a"}, 1).Get("tenant"))
+}
+
+func TestHashRingNext(t *testing.T) {
+	members := []string{"a", "b", "c", "d"}
+	ring := NewHashRing(members, 0)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owner := ring.Get(key)
+		require.Equal(t, owner, ring.Next(key, nil))
+
+		// Members are offered once each, starting at the key's owner
+		offered := []string{}
+		require.Equal(t, "", ring.Next(key, func(m string) bool {
+			offered = append(offered, m)
+			return false
+		}))
+		require.Equal(t, owner, offered[0])
+		require.ElementsMatch(t, members, offered)
+
+		// A rejected owner overflows to the next member offered
+		next := ring.Next(key, func(m string) bool {
+			return m != owner
+		})
+		require.Equal(t, offered[1], next)
+	}
+}
@@ -0,0 +1,18 @@
+package targets
+
+// StopFn is a prototype for a stop routine function.
+type StopFn func()
+
+// Provider represents a source of dynamic targets; E.g. DNS SRV records or a
+// service discovery backend.
+type Provider interface {
+	// Targets returns the provider's current targets for the given
+	// protocol.
+	Targets(protocol string) ([]Target, error)
+
+	// Watch starts a routine that calls fn with the provider's targets for
+	// the given protocol whenever they are updated. Failures are logged and
+	// retried, and fn is never called with an empty list of targets. It
+	// returns a stop function to stop the routine.
+	Watch(protocol string, fn func([]Target)) StopFn
+}
@@ -0,0 +1,105 @@
+package targets
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/logging"
+)
+
+// DefaultSrvRefreshInterval is how often SRV records are resolved again when
+// no interval is set.
+const DefaultSrvRefreshInterval = 30 * time.Second
+
+var (
+	ErrNoSrvRecords = errors.New("No SRV records found")
+)
+
+// lookupSRV resolves SRV records; it is replaced in tests.
+var lookupSRV = net.LookupSRV
+
+// ResolveSRV resolves the given SRV record name (E.g.
+// "_http._tcp.web.service.consul") into targets for the given protocol. Only
+// the records with the lowest priority value are used, since the others are
+// meant as fallbacks. Each record's weight is given to its target; records
+// with a weight of zero are given the default weight.
+func ResolveSRV(name, protocol string) ([]Target, error) {
+	_, records, err := lookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, ErrNoSrvRecords
+	}
+	priority := records[0].Priority
+	for _, rec := range records {
+		if rec.Priority < priority {
+			priority = rec.Priority
+		}
+	}
+	ts := []Target{}
+	for _, rec := range records {
+		if rec.Priority != priority {
+			continue
+		}
+		t := NewTarget(strings.TrimSuffix(rec.Target, "."),
+			int(rec.Port), protocol)
+		t.SetWeight(int(rec.Weight))
+		ts = append(ts, t)
+	}
+	return ts, nil
+}
+
+// srvProvider implements the Provider interface for a SRV record name that is
+// resolved at an interval.
+type srvProvider struct {
+	Interval time.Duration // Refresh interval
+	Name     string        // SRV record name
+}
+
+// NewSrvProvider returns a new Provider of the targets of the given SRV record
+// name; resolved again at the given interval. If the interval is not set, the
+// default interval is used.
+func NewSrvProvider(name string, interval time.Duration) Provider {
+	if interval <= 0 {
+		interval = DefaultSrvRefreshInterval
+	}
+	return &srvProvider{Interval: interval, Name: name}
+}
+
+func (p *srvProvider) Targets(protocol string) ([]Target, error) {
+	return ResolveSRV(p.Name, protocol)
+}
+
+func (p *srvProvider) Watch(protocol string, fn func([]Target)) StopFn {
+	quit := make(chan struct{})
+	stopped := make(chan struct{})
+	t := time.NewTicker(p.Interval)
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-quit:
+				t.Stop()
+				return
+			case <-t.C:
+				ts, err := p.Targets(protocol)
+				if err != nil {
+					log.Error("Failed to resolve SRV",
+						logging.Fields{
+							"name":             p.Name,
+							logging.FieldError: err,
+						})
+					continue
+				}
+				fn(ts)
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-stopped
+	}
+}
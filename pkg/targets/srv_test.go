@@ -0,0 +1,85 @@
+package targets
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
+)
+
+func TestResolveSRV(t *testing.T) {
+	defer func(fn func(string, string, string) (string, []*net.SRV, error)) {
+		lookupSRV = fn
+	}(lookupSRV)
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		require.Equal(t, "_http._tcp.web.local", name)
+		return name, []*net.SRV{
+			{Target: "web-1.local.", Port: 8080, Priority: 10, Weight: 5},
+			{Target: "web-2.local.", Port: 8081, Priority: 10, Weight: 0},
+			{Target: "backup.local.", Port: 8080, Priority: 20, Weight: 1},
+		}, nil
+	}
+	ts, err := ResolveSRV("_http._tcp.web.local", "http")
+	require.Nil(t, err)
+	require.Len(t, ts, 2)
+	require.Equal(t, "http://web-1.local:8080", ts[0].URL())
+	require.Equal(t, 5, ts[0].Weight())
+	require.Equal(t, "http://web-2.local:8081", ts[1].URL())
+	require.Equal(t, DefaultTargetWeight, ts[1].Weight())
+
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		return name, nil, nil
+	}
+	_, err = ResolveSRV("_http._tcp.web.local", "http")
+	require.Equal(t, ErrNoSrvRecords, err)
+
+	lookupErr := errors.New("lookup failed")
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		return "", nil, lookupErr
+	}
+	_, err = ResolveSRV("_http._tcp.web.local", "http")
+	require.Equal(t, lookupErr, err)
+}
+
+func TestSrvProvider(t *testing.T) {
+	defer func(fn func(string, string, string) (string, []*net.SRV, error)) {
+		lookupSRV = fn
+	}(lookupSRV)
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		return name, []*net.SRV{
+			{Target: "web-2.local.", Port: 8080, Weight: 2},
+		}, nil
+	}
+	p := NewSrvProvider("_http._tcp.web.local", 0)
+	require.Equal(t, DefaultSrvRefreshInterval, p.(*srvProvider).Interval)
+	ts, err := p.Targets("http")
+	require.Nil(t, err)
+	require.Len(t, ts, 1)
+	require.Equal(t, "http://web-2.local:8080", ts[0].URL())
+
+	p = NewSrvProvider("_http._tcp.web.local", 10*time.Millisecond)
+	watched := make(chan []Target, 1)
+	stop := p.Watch("http", func(ts []Target) {
+		select {
+		case watched <- ts:
+		default:
+		}
+	})
+	defer stop()
+	select {
+	case ts := <-watched:
+		require.Len(t, ts, 1)
+		require.Equal(t, 2, ts[0].Weight())
+	case <-time.After(time.Second):
+		t.Fatal("SRV records were not resolved again")
+	}
+
+	group := NewTargetGroup("web", "http", rules.Rule{})
+	require.False(t, group.IsDynamic())
+	group.Providers = append(group.Providers, p)
+	require.True(t, group.IsDynamic())
+}
@@ -0,0 +1,226 @@
+package targets
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy represents a balancing strategy; how a pool picks the target of the
+// next request or connection.
+type Strategy uint32
+
+const (
+	// Strategies
+	StrategyUnknown Strategy = iota
+	StrategyRoundRobin
+	StrategyIpHash
+	StrategyWeightedRandom
+	StrategyPowerOfTwo
+	StrategyConsistentHash
+)
+
+const DefaultStrategy = StrategyRoundRobin
+
+// StrategyStrings is a list of string representations of known strategies.
+var StrategyStrings = []string{
+	"unknown",
+	"round_robin",
+	"ip_hash",
+	"weighted_random",
+	"power_of_two",
+	"consistent_hash",
+}
+
+var (
+	// random is the seeded source of the random strategies; it is not safe
+	// for concurrent use, so it is guarded by randomLock.
+	random     = rand.New(rand.NewSource(time.Now().UnixNano()))
+	randomLock sync.Mutex
+)
+
+// SeedRandom seeds the source of the random strategies; E.g. so the picks of a
+// test are reproducible. The source is seeded with the current time by
+// default.
+func SeedRandom(seed int64) {
+	randomLock.Lock()
+	random.Seed(seed)
+	randomLock.Unlock()
+}
+
+// ToStrategy returns the Strategy for a given string. If a match can not be
+// made, StrategyUnknown is returned.
+func ToStrategy(v string) Strategy {
+	for idx, s := range StrategyStrings {
+		if strings.EqualFold(s, v) {
+			return Strategy(idx)
+		}
+	}
+	return StrategyUnknown
+}
+
+// Normalize returns the strategy if it is known, otherwise StrategyUnknown is
+// returned.
+func (s Strategy) Normalize() Strategy {
+	if int(s) >= len(StrategyStrings) {
+		return StrategyUnknown
+	}
+	return s
+}
+
+// String returns the string representation for a given strategy. If the
+// strategy is not known the string representation of StrategyUnknown is
+// returned instead.
+func (s Strategy) String() string {
+	return StrategyStrings[int(s.Normalize())]
+}
+
+// HashIndex returns the index that the given key hashes to in a list of n
+// targets; E.g. to pin a client IP to a target. Zero is returned if n is not
+// positive.
+func HashIndex(key string, n int) int {
+	if n <= 0 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// RoundRobinIndex returns the index of the next available target of a list of n
+// targets in turn, and advances the given counter past it; -1 is returned if no
+// target is available. The counter is only advanced by a compare-and-swap of
+// the value the pick started from, and the pick is made again if another caller
+// advanced it first; so concurrent callers each get their own turn, and a pick
+// that skips unavailable targets does not undo another's.
+func RoundRobinIndex(counter *uint64, n int, available func(i int) bool) int {
+	if n <= 0 {
+		return -1
+	}
+	for {
+		cur := atomic.LoadUint64(counter)
+		idx := -1
+		next := cur
+		for i := uint64(0); i < uint64(n); i++ {
+			if j := int((cur + i) % uint64(n)); available(j) {
+				idx, next = j, cur+i+1
+				break
+			}
+		}
+		if idx < 0 {
+			return -1
+		}
+		if atomic.CompareAndSwapUint64(counter, cur, next) {
+			return idx
+		}
+	}
+}
+
+// WeightedIndex returns an index of the given weights picked at random, with a
+// probability proportional to its weight; E.g. for weights 3 and 1 the first
+// index is picked three times as often. Indexes with weights less than one are
+// never picked, and -1 is returned if no weight is positive.
+func WeightedIndex(weights []int) int {
+	return NewWeightedTable(weights).Index()
+}
+
+// WeightedTable is the cumulative weights of a list of targets; so a target is
+// picked at random by weight in O(log n), without allocating.
+type WeightedTable struct {
+	Cumulative []int // Running totals of the weights
+}
+
+// NewWeightedTable returns the weight table of the given weights. Weights less
+// than one are never picked.
+func NewWeightedTable(weights []int) *WeightedTable {
+	cumulative := make([]int, len(weights))
+	total := 0
+	for i, w := range weights {
+		if w > 0 {
+			total += w
+		}
+		cumulative[i] = total
+	}
+	return &WeightedTable{Cumulative: cumulative}
+}
+
+// Index returns an index of the table picked at random, with a probability
+// proportional to its weight; -1 is returned if no weight is positive.
+func (t *WeightedTable) Index() int {
+	total := 0
+	if n := len(t.Cumulative); n > 0 {
+		total = t.Cumulative[n-1]
+	}
+	if total == 0 {
+		return -1
+	}
+	randomLock.Lock()
+	n := random.Intn(total)
+	randomLock.Unlock()
+	// The first index whose cumulative weight is past n
+	return sort.SearchInts(t.Cumulative, n+1)
+}
+
+// WeightedCache caches the weight tables of a pool's primary and backup
+// targets; they are only rebuilt once the pool's state version changes, rather
+// than on each pick. Pools bump their version when their list of targets or the
+// health of a target changes. The zero value is ready to use.
+type WeightedCache struct {
+	tables atomic.Value // *weightedTables
+}
+
+// weightedTables are the weight tables of a list of targets built at a state
+// version.
+type weightedTables struct {
+	Version uint64
+	Size    int
+	Tiers   [2]*WeightedTable // Primary and backup targets
+}
+
+// Index returns an index of a list of n targets picked at random by weight, of
+// either its primary or backup targets; -1 is returned if none is available.
+// The version is the pool's state version, read before the list was taken. The
+// given weight func returns the weight of a target of the given tier, and zero
+// if it is unavailable; it is only called when the tables are rebuilt. A pick
+// made while the state changes may be stale, so callers should check it.
+func (c *WeightedCache) Index(version uint64, n int, backup bool, weight func(i int, backup bool) int) int {
+	tier := 0
+	if backup {
+		tier = 1
+	}
+	wt, ok := c.tables.Load().(*weightedTables)
+	if !ok || wt.Version != version || wt.Size != n {
+		wt = &weightedTables{Version: version, Size: n}
+		for i, b := range []bool{false, true} {
+			weights := make([]int, n)
+			for j := range weights {
+				weights[j] = weight(j, b)
+			}
+			wt.Tiers[i] = NewWeightedTable(weights)
+		}
+		c.tables.Store(wt)
+	}
+	return wt.Tiers[tier].Index()
+}
+
+// RandomPair returns two distinct indexes picked at random from a list of n
+// targets; E.g. the two choices of the power of two strategy. Both indexes are
+// zero if n is less than two.
+func RandomPair(n int) (int, int) {
+	if n < 2 {
+		return 0, 0
+	}
+	randomLock.Lock()
+	i := random.Intn(n)
+	j := random.Intn(n - 1)
+	randomLock.Unlock()
+	// Skip over i, so the second pick is any other index
+	if j >= i {
+		j++
+	}
+	return i, j
+}
@@ -0,0 +1,172 @@
+package targets
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestToStrategy(t *testing.T) {
+	require.Equal(t, StrategyRoundRobin, ToStrategy("round_robin"))
+	require.Equal(t, StrategyIpHash, ToStrategy("IP_HASH"))
+	require.Equal(t, StrategyWeightedRandom, ToStrategy("weighted_random"))
+	require.Equal(t, StrategyUnknown, ToStrategy("random"))
+}
+
+func TestStrategyString(t *testing.T) {
+	require.Equal(t, "ip_hash", StrategyIpHash.String())
+	require.Equal(t, "unknown", Strategy(100).String())
+}
+
+func TestHashIndex(t *testing.T) {
+	require.Equal(t, 0, HashIndex("10.0.0.1", 0))
+	idx := HashIndex("10.0.0.1", 5)
+	require.True(t, idx >= 0 && idx < 5)
+	require.Equal(t, idx, HashIndex("10.0.0.1", 5))
+}
+
+func TestWeightedIndex(t *testing.T) {
+	require.Equal(t, -1, WeightedIndex(nil))
+	require.Equal(t, -1, WeightedIndex([]int{0, -1}))
+	require.Equal(t, 1, WeightedIndex([]int{0, 5, 0}))
+
+	// Picks roughly match the weights over many iterations
+	weights := []int{1, 0, 3, 6}
+	counts := make([]int, len(weights))
+	n := 10000
+	for i := 0; i < n; i++ {
+		counts[WeightedIndex(weights)]++
+	}
+	require.Equal(t, 0, counts[1])
+	for i, w := range weights {
+		expected := float64(n*w) / 10
+		require.InDelta(t, expected, float64(counts[i]), float64(n)*0.03)
+	}
+}
+
+func TestWeightedCache(t *testing.T) {
+	ts := []Target{}
+	for i, w := range []int{1, 3} {
+		target := NewTarget("127.0.0.1", 8080+i, "http")
+		target.SetWeight(w)
+		ts = append(ts, target)
+	}
+	ts[1].SetBackup(true)
+	builds := 0
+	weight := func(i int, backup bool) int {
+		builds++
+		if ts[i].IsAlive() && ts[i].IsBackup() == backup {
+			return ts[i].Weight()
+		}
+		return 0
+	}
+
+	// Tables are only rebuilt once the state version changes
+	var c WeightedCache
+	for i := 0; i < 10; i++ {
+		require.Equal(t, 0, c.Index(0, len(ts), false, weight))
+		require.Equal(t, 1, c.Index(0, len(ts), true, weight))
+	}
+	require.Equal(t, 4, builds)
+	ts[0].SetAlive(false)
+	require.Equal(t, 0, c.Index(0, len(ts), false, weight))
+	require.Equal(t, 4, builds)
+	require.Equal(t, -1, c.Index(1, len(ts), false, weight))
+	require.Equal(t, 8, builds)
+	require.Equal(t, 1, c.Index(1, len(ts), true, weight))
+	require.Equal(t, 8, builds)
+
+	// So are tables of another number of targets
+	require.Equal(t, -1, c.Index(1, 1, true, weight))
+	require.Equal(t, 10, builds)
+}
+
+func TestRandomPair(t *testing.T) {
+	i, j := RandomPair(1)
+	require.Equal(t, 0, i)
+	require.Equal(t, 0, j)
+	for n := 2; n < 100; n++ {
+		i, j := RandomPair(n)
+		require.NotEqual(t, i, j)
+		require.True(t, i >= 0 && i < n)
+		require.True(t, j >= 0 && j < n)
+	}
+}
+
+func TestSeedRandom(t *testing.T) {
+	pairs := func() [][2]int {
+		SeedRandom(1)
+		p := [][2]int{}
+		for k := 0; k < 10; k++ {
+			i, j := RandomPair(10)
+			p = append(p, [2]int{i, j})
+		}
+		return p
+	}
+	require.Equal(t, pairs(), pairs())
+}
+
+func TestRoundRobinIndex(t *testing.T) {
+	var counter uint64
+	all := func(i int) bool { return true }
+	require.Equal(t, -1, RoundRobinIndex(&counter, 0, all))
+	require.Equal(t, 0, RoundRobinIndex(&counter, 3, all))
+	require.Equal(t, 1, RoundRobinIndex(&counter, 3, all))
+	require.Equal(t, 2, RoundRobinIndex(&counter, 3, all))
+	require.Equal(t, 0, RoundRobinIndex(&counter, 3, all))
+
+	// Unavailable targets are skipped, and the counter moves past them
+	notOne := func(i int) bool { return i != 1 }
+	require.Equal(t, 2, RoundRobinIndex(&counter, 3, notOne))
+	require.Equal(t, uint64(6), counter)
+	require.Equal(t, 0, RoundRobinIndex(&counter, 3, notOne))
+	require.Equal(t, -1, RoundRobinIndex(&counter, 3,
+		func(i int) bool { return false }))
+}
+
+// benchmarkWeighted benchmarks weighted picks of 100 targets, one of which
+// flaps every given number of picks; each flap bumps the state version.
+func benchmarkWeighted(b *testing.B, flap int, pick func(ts []Target, version uint64) int) {
+	ts := []Target{}
+	for i := 0; i < 100; i++ {
+		target := NewTarget("127.0.0.1", 8000+i, "http")
+		target.SetWeight(1 + i%5)
+		ts = append(ts, target)
+	}
+	version := uint64(0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%flap == 0 {
+			ts[0].SetAlive(!ts[0].IsAlive())
+			version++
+		}
+		if pick(ts, version) < 0 {
+			b.Fatal("no target picked")
+		}
+	}
+}
+
+func BenchmarkWeightedIndex(b *testing.B) {
+	benchmarkWeighted(b, 1000, func(ts []Target, version uint64) int {
+		weights := make([]int, len(ts))
+		for i, t := range ts {
+			if t.IsAlive() {
+				weights[i] = t.Weight()
+			}
+		}
+		return WeightedIndex(weights)
+	})
+}
+
+func BenchmarkWeightedCache(b *testing.B) {
+	var c WeightedCache
+	benchmarkWeighted(b, 1000, func(ts []Target, version uint64) int {
+		return c.Index(version, len(ts), false, func(i int, backup bool) int {
+			if ts[i].IsAlive() && ts[i].IsBackup() == backup {
+				return ts[i].Weight()
+			}
+			return 0
+		})
+	})
+}
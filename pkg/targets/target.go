@@ -39,6 +39,8 @@ var (
 	}
 
 	// Errors
+	ErrMissingHost     = errors.New("Target is missing host")
+	ErrMissingPort     = errors.New("Target is missing a port; its protocol has no default port")
 	ErrMissingProtocol = errors.New("Target is missing protocol")
 	ErrUnknownProtocol = errors.New("Unknown network protocol")
 )
@@ -99,91 +101,307 @@ func (tt TargetType) String() string {
 
 // Target represents an interface to a load balancer target.
 type Target interface {
+	// DialTimeout returns the timeout of connecting to the target; zero if
+	// not set, so its group's or load balancer's timeout is used.
+	DialTimeout() time.Duration
+
 	// Get returns the value for the given key name of  the target's
 	// attribute. Keys include:
 	//   - alive
+	//   - backup
+	//   - dial_timeout
+	//   - draining
+	//   - health_port
 	//   - host
+	//   - idle_timeout
+	//   - name
+	//   - path
 	//   - port
 	//   - protocol
+	//   - tls_server_name
 	//   - type
+	//   - weight
 	Get(key string) string
 
+	// HealthPort returns the port that health checks probe; the target's
+	// health check port if set, otherwise its port. E.g. a service on 8080
+	// with its health on a management port 8081.
+	HealthPort() int
+
+	// HealthURL returns a URL formatted string of the target's health
+	// check port. ("<scheme>://<host>[:<health port>]")
+	HealthURL() string
+
+	// Host returns the host of the target.
+	Host() string
+
+	// IdleTimeout returns how long a relay to the target may go without
+	// data before it is closed; zero if not set, so its group's or load
+	// balancer's timeout is used.
+	IdleTimeout() time.Duration
+
 	// IsAlive returns true if the target is set alive.
 	IsAlive() bool
 
-	// IsAvailable tries to dial the target with the given timeout and
-	// returns true if the connection succeeded.
+	// IsAvailable tries to dial the target's health check port with the
+	// given timeout and returns true if the connection succeeded.
 	IsAvailable(to time.Duration) bool
 
+	// IsBackup returns true if the target is set as a backup. Backup
+	// targets are only given requests or connections while no primary
+	// target is available.
+	IsBackup() bool
+
+	// IsDraining returns true if the target is set draining. Draining
+	// targets are not given new requests or connections.
+	IsDraining() bool
+
+	// Name returns the name of the target.
+	Name() string
+
+	// Path returns the base path that requests to the target are proxied
+	// under; empty if not set. E.g. "/api" for "http://backend/api".
+	Path() string
+
+	// Port returns the port of the target; zero if not set.
+	Port() int
+
+	// Protocol returns the protocol of the target.
+	Protocol() string
+
 	// SetAlive sets the alive attribute of the target.
 	SetAlive(v bool)
 
+	// SetBackup sets the backup attribute of the target.
+	SetBackup(v bool)
+
+	// SetDialTimeout sets the dial timeout attribute of the target; E.g.
+	// longer for a backend that is slow to accept connections.
+	SetDialTimeout(v time.Duration)
+
+	// SetDraining sets the draining attribute of the target.
+	SetDraining(v bool)
+
+	// SetHealthPort sets the health check port attribute of the target;
+	// zero probes the target's port.
+	SetHealthPort(v int)
+
+	// SetIdleTimeout sets the idle timeout attribute of the target.
+	SetIdleTimeout(v time.Duration)
+
+	// SetName sets the name attribute of the target.
+	SetName(v string)
+
+	// SetTlsServerName sets the server name attribute of the target.
+	SetTlsServerName(v string)
+
+	// SetWeight sets the weight attribute of the target. Weights less than
+	// one are ignored.
+	SetWeight(v int)
+
 	// Summary returns a comma-separated string of key-value pairs of the
-	// target's attributes.
+	// target's attributes. Attributes that are not set are omitted.
 	Summary() string
 
+	// TlsServerName returns the name that TLS connections to the target
+	// send for SNI and verify its certificate against; empty if not set,
+	// so the target's host is used. E.g. to verify a backend addressed by
+	// IP against its shared certificate.
+	TlsServerName() string
+
 	// URL returns a URL formatted string of the target.
 	// ("<scheme>://<host>[:<port>]")
 	URL() string
+
+	// Weight returns the weight of the target.
+	Weight() int
+}
+
+// ProbeRetryInterval is the delay before a failed health check probe is retried.
+const ProbeRetryInterval = 100 * time.Millisecond
+
+// Probe calls the given health check probe until it succeeds, retrying a failed
+// probe at most the given number of times after ProbeRetryInterval; so a single
+// dropped packet does not fail the check. It returns true if a probe
+// succeeded.
+func Probe(retries int, probe func() bool) bool {
+	for i := 0; ; i++ {
+		if probe() {
+			return true
+		}
+		if i >= retries {
+			return false
+		}
+		time.Sleep(ProbeRetryInterval)
+	}
 }
 
+// HealthChangeFn is a prototype for a function that is called when a health
+// check finds a target's alive state changed.
+type HealthChangeFn func(t Target, wasAlive, alive bool)
+
+// DefaultTargetWeight is the weight given to targets that do not set one.
+const DefaultTargetWeight = 1
+
 // target implements the Target interface.
 type target struct {
-	Port       int
-	Protocol   string
-	Host       string
-	TargetType TargetType
-	Alive      bool
-	Lock       *sync.RWMutex
+	name        string
+	path        string
+	port        int
+	healthPort  int
+	protocol    string
+	host        string
+	serverName  string
+	dialTimeout time.Duration
+	idleTimeout time.Duration
+	TargetType  TargetType
+	weight      int
+	Alive       bool
+	Backup      bool
+	Draining    bool
+	Lock        *sync.RWMutex
 }
 
-// NewTarget returns a new Target for the given parameters.
+// NewTarget returns a new Target for the given parameters. A bracketed IPv6
+// literal (E.g. "[::1]") is accepted and stored without its brackets.
 func NewTarget(host string, port int, protocol string) Target {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
 	targetType := TargetTypeIP
 	if net.ParseIP(host) == nil {
 		targetType = TargetTypeDomain
 	}
 	return &target{
-		Port:       port,
-		Protocol:   protocol,
-		Host:       host,
+		port:       port,
+		protocol:   protocol,
+		host:       host,
 		TargetType: targetType,
+		weight:     DefaultTargetWeight,
 		Alive:      true,
 		Lock:       new(sync.RWMutex),
 	}
 }
 
-// NewServiceTarget returns a new service target for the given URL.
-func NewServiceTarget(target *url.URL) Target {
-	proto := target.Scheme
+// ValidServiceURL returns an error if a service target for the given URL would
+// not be routable; I.E. the URL has no scheme or host, or has no port and its
+// scheme has no common port. E.g. "grpc://backend" must set a port.
+func ValidServiceURL(u *url.URL) error {
+	if u.Scheme == "" {
+		return fmt.Errorf("%s - '%s'", ErrMissingProtocol, u)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("%s - '%s'", ErrMissingHost, u)
+	}
+	if u.Port() == "" && GetPort(u.Scheme) == 0 {
+		return fmt.Errorf("%s - '%s'", ErrMissingPort, u)
+	}
+	return nil
+}
+
+// NewServiceTarget returns a new service target for the given URL. The URL's
+// path, if any, is kept as the target's base path.
+func NewServiceTarget(u *url.URL) Target {
+	proto := u.Scheme
 	port := GetPort(proto)
-	host := target.Host
-	if h, p, err := net.SplitHostPort(host); err == nil {
-		host = h
-		if i, err := strconv.Atoi(p); err == nil {
-			port = i
-		}
+	// Hostname strips the brackets of IPv6 literals
+	host := u.Hostname()
+	if i, err := strconv.Atoi(u.Port()); err == nil {
+		port = i
 	}
-	return NewTarget(host, port, proto)
+	t := NewTarget(host, port, proto).(*target)
+	if u.Path != "/" {
+		t.path = u.Path
+	}
+	return t
+}
+
+func (t *target) DialTimeout() time.Duration {
+	var to time.Duration
+	t.Lock.RLock()
+	to = t.dialTimeout
+	t.Lock.RUnlock()
+	return to
 }
 
 func (t *target) Get(key string) string {
 	v := ""
 	switch strings.ToLower(key) {
 	case "alive":
-		v = fmt.Sprintf("%t", t.Alive)
+		v = fmt.Sprintf("%t", t.IsAlive())
+	case "backup":
+		v = fmt.Sprintf("%t", t.IsBackup())
+	case "dial_timeout":
+		if to := t.DialTimeout(); to > 0 {
+			v = to.String()
+		}
+	case "draining":
+		v = fmt.Sprintf("%t", t.IsDraining())
+	case "health_port":
+		if port := t.healthPortAttr(); port > 0 {
+			v = strconv.Itoa(port)
+		}
 	case "host":
-		v = t.Host
+		v = t.Host()
+	case "idle_timeout":
+		if to := t.IdleTimeout(); to > 0 {
+			v = to.String()
+		}
+	case "name":
+		v = t.Name()
+	case "path":
+		v = t.Path()
 	case "port":
-		v = strconv.Itoa(t.Port)
+		if port := t.Port(); port > 0 {
+			v = strconv.Itoa(port)
+		}
 	case "protocol":
-		v = t.Protocol
+		v = t.Protocol()
+	case "tls_server_name":
+		v = t.TlsServerName()
 	case "type":
 		v = t.TargetType.String()
+	case "weight":
+		if weight := t.Weight(); weight > 0 {
+			v = strconv.Itoa(weight)
+		}
 	}
 	return v
 }
 
+func (t *target) HealthPort() int {
+	if port := t.healthPortAttr(); port > 0 {
+		return port
+	}
+	return t.port
+}
+
+// healthPortAttr returns the health check port attribute of the target; zero
+// if not set.
+func (t *target) healthPortAttr() int {
+	var port int
+	t.Lock.RLock()
+	port = t.healthPort
+	t.Lock.RUnlock()
+	return port
+}
+
+func (t *target) HealthURL() string {
+	return t.url(t.HealthPort())
+}
+
+func (t *target) IdleTimeout() time.Duration {
+	var to time.Duration
+	t.Lock.RLock()
+	to = t.idleTimeout
+	t.Lock.RUnlock()
+	return to
+}
+
+func (t *target) Host() string {
+	return t.host
+}
+
 func (t *target) IsAlive() bool {
 	var alive bool
 	t.Lock.RLock()
@@ -192,39 +410,168 @@ func (t *target) IsAlive() bool {
 	return alive
 }
 
+func (t *target) IsBackup() bool {
+	var backup bool
+	t.Lock.RLock()
+	backup = t.Backup
+	t.Lock.RUnlock()
+	return backup
+}
+
+func (t *target) IsDraining() bool {
+	var draining bool
+	t.Lock.RLock()
+	draining = t.Draining
+	t.Lock.RUnlock()
+	return draining
+}
+
+func (t *target) Name() string {
+	var name string
+	t.Lock.RLock()
+	name = t.name
+	t.Lock.RUnlock()
+	return name
+}
+
+func (t *target) Path() string {
+	return t.path
+}
+
+func (t *target) Port() int {
+	return t.port
+}
+
+func (t *target) Protocol() string {
+	return t.protocol
+}
+
 func (t *target) SetAlive(v bool) {
 	t.Lock.Lock()
 	t.Alive = v
 	t.Lock.Unlock()
 }
 
+func (t *target) SetBackup(v bool) {
+	t.Lock.Lock()
+	t.Backup = v
+	t.Lock.Unlock()
+}
+
+func (t *target) SetDialTimeout(v time.Duration) {
+	t.Lock.Lock()
+	t.dialTimeout = v
+	t.Lock.Unlock()
+}
+
+func (t *target) SetDraining(v bool) {
+	t.Lock.Lock()
+	t.Draining = v
+	t.Lock.Unlock()
+}
+
+func (t *target) SetHealthPort(v int) {
+	t.Lock.Lock()
+	t.healthPort = v
+	t.Lock.Unlock()
+}
+
+func (t *target) SetIdleTimeout(v time.Duration) {
+	t.Lock.Lock()
+	t.idleTimeout = v
+	t.Lock.Unlock()
+}
+
+func (t *target) SetName(v string) {
+	t.Lock.Lock()
+	t.name = v
+	t.Lock.Unlock()
+}
+
+func (t *target) SetTlsServerName(v string) {
+	t.Lock.Lock()
+	t.serverName = v
+	t.Lock.Unlock()
+}
+
+func (t *target) SetWeight(v int) {
+	if v < 1 {
+		return
+	}
+	t.Lock.Lock()
+	t.weight = v
+	t.Lock.Unlock()
+}
+
 func (t *target) Summary() string {
-	summary := ""
-	keys := []string{"alive", "host", "port", "protocol", "type"}
-	for i, k := range keys {
+	pairs := []string{}
+	keys := []string{
+		"alive",
+		"dial_timeout",
+		"health_port",
+		"host",
+		"idle_timeout",
+		"name",
+		"path",
+		"port",
+		"protocol",
+		"tls_server_name",
+		"type",
+		"weight",
+	}
+	for _, k := range keys {
 		if v := t.Get(k); v != "" {
-			summary = fmt.Sprintf("%s%s=%s", summary, k, v)
-			if i < (len(keys) - 1) {
-				summary = fmt.Sprintf("%s,", summary)
-			}
+			pairs = append(pairs, fmt.Sprintf("%s=%s", k, v))
 		}
 	}
-	return summary
+	// Backup and draining are only worth noting while they are set
+	if t.IsBackup() {
+		pairs = append(pairs, "backup=true")
+	}
+	if t.IsDraining() {
+		pairs = append(pairs, "draining=true")
+	}
+	return strings.Join(pairs, ",")
 }
 
 func (t *target) URL() string {
-	url := fmt.Sprintf("%s://%s", t.Protocol, t.Host)
-	if t.Port > 0 {
-		url = fmt.Sprintf("%s:%d", url, t.Port)
+	return t.url(t.port)
+}
+
+// url returns a URL formatted string of the target with the given port; the
+// port is omitted if it is not set.
+func (t *target) url(port int) string {
+	host := t.host
+	if port > 0 {
+		host = net.JoinHostPort(host, strconv.Itoa(port))
+	} else if strings.Contains(host, ":") {
+		// Bracket IPv6 literals
+		host = "[" + host + "]"
 	}
-	return url
+	return fmt.Sprintf("%s://%s", t.protocol, host)
+}
+
+func (t *target) TlsServerName() string {
+	var name string
+	t.Lock.RLock()
+	name = t.serverName
+	t.Lock.RUnlock()
+	return name
+}
+
+func (t *target) Weight() int {
+	var weight int
+	t.Lock.RLock()
+	weight = t.weight
+	t.Lock.RUnlock()
+	return weight
 }
 
 func (t *target) IsAvailable(to time.Duration) bool {
 	available := false
-	useTls := IsTLS(t.Protocol)
-	hostPort := net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
-	networks := GetTransport(t.Protocol)
+	useTls := IsTLS(t.protocol)
+	hostPort := net.JoinHostPort(t.host, strconv.Itoa(t.HealthPort()))
+	networks := GetTransport(t.protocol)
 	for _, network := range networks {
 		available = dialTarget(network, hostPort, to, useTls)
 		if available {
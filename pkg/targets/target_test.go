@@ -2,14 +2,18 @@ package targets
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+
+	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
 )
 
 func TestGetPort(t *testing.T) {
@@ -63,6 +67,13 @@ func TestTargetGet(t *testing.T) {
 	require.Equal(t, port, target.Get("port"))
 	require.Equal(t, proto, target.Get("protocol"))
 	require.Equal(t, TargetTypeDomain.String(), target.Get("type"))
+	require.Equal(t, "", target.Get("name"))
+	require.Equal(t, "1", target.Get("weight"))
+
+	target.SetName("web-1")
+	target.SetWeight(5)
+	require.Equal(t, "web-1", target.Get("name"))
+	require.Equal(t, "5", target.Get("weight"))
 }
 
 func TestTargetIsAlive(t *testing.T) {
@@ -75,6 +86,102 @@ func TestTargetIsAlive(t *testing.T) {
 	require.False(t, target.IsAlive())
 }
 
+func TestTargetAccessors(t *testing.T) {
+	target := NewTarget("example.com", 8080, "http")
+	require.Equal(t, "example.com", target.Host())
+	require.Equal(t, 8080, target.Port())
+	require.Equal(t, "http", target.Protocol())
+	require.Equal(t, "", target.Name())
+	require.Equal(t, DefaultTargetWeight, target.Weight())
+	require.False(t, target.IsDraining())
+	require.False(t, target.IsBackup())
+
+	target.SetName("web-1")
+	target.SetWeight(4)
+	target.SetDraining(true)
+	target.SetBackup(true)
+	require.Equal(t, "web-1", target.Name())
+	require.Equal(t, 4, target.Weight())
+	require.True(t, target.IsDraining())
+	require.Equal(t, "true", target.Get("draining"))
+	require.True(t, target.IsBackup())
+	require.Equal(t, "true", target.Get("backup"))
+}
+
+func TestValidServiceURL(t *testing.T) {
+	tests := []struct {
+		Url string
+		Err error
+	}{
+		{"http://backend", nil},
+		{"grpc://backend:50051", nil},
+		{"grpc://backend", ErrMissingPort},
+		{"backend:8080", ErrMissingHost},
+		{"//backend:8080", ErrMissingProtocol},
+		{"http://:8080", ErrMissingHost},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.Url)
+		require.Nil(t, err)
+		err = ValidServiceURL(u)
+		if test.Err == nil {
+			require.Nil(t, err, test.Url)
+		} else {
+			require.NotNil(t, err, test.Url)
+			require.Contains(t, err.Error(), test.Err.Error())
+		}
+	}
+}
+
+func TestNewTargetIPv6(t *testing.T) {
+	for _, host := range []string{"::1", "[::1]"} {
+		target := NewTarget(host, 8080, "http")
+		require.Equal(t, "::1", target.Host())
+		require.Equal(t, TargetTypeIP.String(), target.Get("type"))
+		require.Equal(t, "http://[::1]:8080", target.URL())
+	}
+}
+
+func TestTargetTlsServerName(t *testing.T) {
+	target := NewTarget("10.0.0.1", 443, "https")
+	require.Equal(t, "", target.TlsServerName())
+	require.NotContains(t, target.Summary(), "tls_server_name")
+	target.SetTlsServerName("api.example.com")
+	require.Equal(t, "api.example.com", target.TlsServerName())
+	require.Equal(t, "api.example.com", target.Get("tls_server_name"))
+	require.Contains(t, target.Summary(),
+		"tls_server_name=api.example.com")
+}
+
+func TestNewServiceTargetIPv6(t *testing.T) {
+	u, err := url.Parse("http://[::1]:8080")
+	require.Nil(t, err)
+	target := NewServiceTarget(u)
+	require.Equal(t, "::1", target.Host())
+	require.Equal(t, 8080, target.Port())
+	require.Equal(t, "http://[::1]:8080", target.URL())
+
+	u, err = url.Parse("https://[::1]")
+	require.Nil(t, err)
+	target = NewServiceTarget(u)
+	require.Equal(t, "::1", target.Host())
+	require.Equal(t, 443, target.Port())
+}
+
+func TestNewServiceTargetPath(t *testing.T) {
+	u, err := url.Parse("http://backend:8080/api")
+	require.Nil(t, err)
+	target := NewServiceTarget(u)
+	require.Equal(t, "/api", target.Path())
+	require.Equal(t, "/api", target.Get("path"))
+	require.Equal(t, "http://backend:8080", target.URL())
+
+	// A root path is no base path
+	u, err = url.Parse("http://backend/")
+	require.Nil(t, err)
+	require.Equal(t, "", NewServiceTarget(u).Path())
+}
+
 func TestTargetIsAvailable(t *testing.T) {
 	ts := httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -96,6 +203,46 @@ func TestTargetIsAvailable(t *testing.T) {
 	require.False(t, status)
 }
 
+func TestTargetHealthPort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	healthPort := ln.Addr().(*net.TCPAddr).Port
+
+	// Nothing listens on the service port
+	target := NewTarget("127.0.0.1", 1, "tcp")
+	require.Equal(t, 1, target.HealthPort())
+	require.Equal(t, "", target.Get("health_port"))
+	require.False(t, target.IsAvailable(time.Second))
+
+	target.SetHealthPort(healthPort)
+	require.Equal(t, 1, target.Port())
+	require.Equal(t, healthPort, target.HealthPort())
+	require.Equal(t, strconv.Itoa(healthPort), target.Get("health_port"))
+	require.Equal(t, fmt.Sprintf("tcp://127.0.0.1:%d", healthPort),
+		target.HealthURL())
+	require.Equal(t, "tcp://127.0.0.1:1", target.URL())
+	require.True(t, target.IsAvailable(time.Second))
+}
+
+func TestProbe(t *testing.T) {
+	probes := 0
+	failTwice := func() bool {
+		probes++
+		return probes > 2
+	}
+	require.False(t, Probe(1, failTwice))
+	require.Equal(t, 2, probes)
+	probes = 0
+	require.True(t, Probe(2, failTwice))
+	require.Equal(t, 3, probes)
+
+	// Successful probes are not retried
+	probes = 0
+	require.True(t, Probe(3, func() bool { probes++; return true }))
+	require.Equal(t, 1, probes)
+}
+
 func TestTargetSetAlive(t *testing.T) {
 	target := &target{
 		Alive: true,
@@ -105,21 +252,82 @@ func TestTargetSetAlive(t *testing.T) {
 	require.False(t, target.IsAlive())
 }
 
+func TestTargetSetName(t *testing.T) {
+	target := &target{Lock: new(sync.RWMutex)}
+	target.SetName("web-1")
+	require.Equal(t, "web-1", target.Name())
+}
+
+func TestTargetSetWeight(t *testing.T) {
+	target := &target{
+		weight: DefaultTargetWeight,
+		Lock:   new(sync.RWMutex),
+	}
+	target.SetWeight(3)
+	require.Equal(t, 3, target.Weight())
+	target.SetWeight(0)
+	require.Equal(t, 3, target.Weight())
+	target.SetWeight(-1)
+	require.Equal(t, 3, target.Weight())
+}
+
 func TestTargetSummary(t *testing.T) {
 	host := "example.com"
 	port := 8080
 	proto := "http"
+	name := "web-1"
+	weight := 2
 	expected := fmt.Sprintf(
-		"alive=true,host=%s,port=%d,protocol=%s,type=%s",
-		host, port, proto, TargetTypeDomain.String(),
+		"alive=true,host=%s,name=%s,port=%d,protocol=%s,type=%s,weight=%d",
+		host, name, port, proto, TargetTypeDomain.String(), weight,
 	)
 	targetUrl, err := url.Parse(
 		fmt.Sprintf("%s://%s:%d", proto, host, port))
 	require.Nil(t, err)
-	target := NewServiceTarget(targetUrl)
-	require.NotNil(t, target)
-	summary := target.Summary()
+	svcTarget := NewServiceTarget(targetUrl)
+	require.NotNil(t, svcTarget)
+	svcTarget.SetName(name)
+	svcTarget.SetWeight(weight)
+	summary := svcTarget.Summary()
 	require.Equal(t, expected, summary)
+
+	// Optional fields that are not set are left out of the summary
+	// entirely; no empty values or dangling commas.
+	tgt := &target{
+		host:       host,
+		port:       port,
+		TargetType: TargetTypeDomain,
+		Lock:       new(sync.RWMutex),
+	}
+	expected = fmt.Sprintf(
+		"alive=false,host=%s,port=%d,type=%s",
+		host, port, TargetTypeDomain.String(),
+	)
+	require.Equal(t, expected, tgt.Summary())
+
+	// A target without a port or name should not leave empty pairs
+	// behind; E.g. "host=example.com,,protocol=http".
+	tgt = &target{
+		host:       host,
+		protocol:   proto,
+		TargetType: TargetTypeDomain,
+		weight:     DefaultTargetWeight,
+		Alive:      true,
+		Lock:       new(sync.RWMutex),
+	}
+	require.Equal(t, "", tgt.Get("port"))
+	require.Equal(t, "", tgt.Get("name"))
+	expected = fmt.Sprintf(
+		"alive=true,host=%s,protocol=%s,type=%s,weight=%d",
+		host, proto, TargetTypeDomain.String(), DefaultTargetWeight,
+	)
+	require.Equal(t, expected, tgt.Summary())
+
+	// Backup and draining are only included while they are set
+	tgt.SetBackup(true)
+	tgt.SetDraining(true)
+	expected += ",backup=true,draining=true"
+	require.Equal(t, expected, tgt.Summary())
 }
 
 func TestTargetURL(t *testing.T) {
@@ -144,14 +352,82 @@ func TestTargetURL(t *testing.T) {
 			Port:     0,
 			Protocol: "ssh",
 			Expected: "ssh://10.125.16.2",
+		}, {
+			Host:     "::1",
+			Port:     8080,
+			Protocol: "http",
+			Expected: "http://[::1]:8080",
+		}, {
+			Host:     "fe80::1",
+			Port:     0,
+			Protocol: "http",
+			Expected: "http://[fe80::1]",
 		},
 	}
 	for _, test := range tests {
 		tgt := &target{
-			Host:     test.Host,
-			Port:     test.Port,
-			Protocol: test.Protocol,
+			host:     test.Host,
+			port:     test.Port,
+			protocol: test.Protocol,
 		}
 		require.Equal(t, test.Expected, tgt.URL())
 	}
 }
+
+func TestTargetGroupAddProtocolTarget(t *testing.T) {
+	tg := NewTargetGroup("web", "http", rules.Rule{})
+	t1 := tg.AddTarget("10.0.0.1", 80)
+	t2 := tg.AddProtocolTarget("10.0.0.2", 443, "https")
+	t3 := tg.AddProtocolTarget("10.0.0.3", 8080, "")
+	require.Len(t, tg.Targets, 3)
+	require.Equal(t, "http", t1.Protocol())
+	require.Equal(t, "https", t2.Protocol())
+	require.Equal(t, "http", t3.Protocol())
+}
+
+func TestTargetGroupCheckTargets(t *testing.T) {
+	tg := NewTargetGroup("web", "http", rules.Rule{})
+	tg.AddTarget("10.0.0.1", 80)
+	tg.AddTarget("10.0.0.1", 8080)
+	tg.AddProtocolTarget("10.0.0.1", 80, "https")
+	require.Nil(t, tg.CheckTargets(tg.Targets))
+
+	// Service URLs are the same backends as their host and port
+	tests := []string{
+		"http://10.0.0.1",
+		"http://10.0.0.1:80/",
+		"HTTP://10.0.0.1:8080",
+		"https://10.0.0.1:80",
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test)
+		require.Nil(t, err)
+		ts := append(append([]Target{}, tg.Targets...), NewServiceTarget(u))
+		require.NotNil(t, tg.CheckTargets(ts), test)
+	}
+	ipv6 := NewTargetGroup("web", "http", rules.Rule{})
+	ipv6.AddTarget("[::1]", 80)
+	ipv6.AddServiceTarget(&url.URL{Scheme: "http", Host: "[::1]"})
+	require.NotNil(t, ipv6.CheckTargets(ipv6.Targets))
+	names := NewTargetGroup("web", "http", rules.Rule{})
+	names.AddTarget("Backend.Example.com", 80)
+	names.AddTarget("backend.example.com", 80)
+	require.NotNil(t, names.CheckTargets(names.Targets))
+
+	// Targets with different base paths are different backends
+	paths := NewTargetGroup("web", "http", rules.Rule{})
+	paths.AddServiceTarget(&url.URL{Scheme: "http", Host: "10.0.0.1",
+		Path: "/a"})
+	paths.AddServiceTarget(&url.URL{Scheme: "http", Host: "10.0.0.1",
+		Path: "/b"})
+	require.Nil(t, paths.CheckTargets(paths.Targets))
+	paths.AddServiceTarget(&url.URL{Scheme: "http", Host: "10.0.0.1:80",
+		Path: "/a"})
+	require.NotNil(t, paths.CheckTargets(paths.Targets))
+
+	// Groups may cap their number of targets
+	tg.MaxTargets = 3
+	require.Nil(t, tg.CheckTargets(tg.Targets))
+	tg.MaxTargets = 2
+	require.NotNil(t, tg.CheckTargets(tg.Targets))
+}
@@ -1,17 +1,184 @@
 package targets
 
 import (
+	"errors"
+	"fmt"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/crossedbot/simpleloadbalancer/pkg/rules"
 )
 
+var (
+	// Errors
+	ErrDuplicateTarget = errors.New("Duplicate target in group")
+	ErrTooManyTargets  = errors.New("Target group exceeds its maximum targets")
+)
+
+// BasicAuthConfig represents the HTTP basic authentication settings of a target
+// group. Credentials map usernames to bcrypt password hashes. Requests from the
+// allowed IP addresses or CIDR ranges bypass authentication.
+type BasicAuthConfig struct {
+	Realm       string            // Authentication realm
+	Credentials map[string]string // Bcrypt password hashes by username
+	AllowIps    []string          // IPs or CIDR ranges that bypass auth
+}
+
+// CacheConfig represents the response caching settings of a target group.
+type CacheConfig struct {
+	MaxEntries int           // Maximum number of cached responses
+	TTL        time.Duration // Maximum time-to-live of a cached response
+}
+
+// CorsConfig represents the CORS settings of a target group. Preflight requests
+// are answered by the load balancer using these settings.
+type CorsConfig struct {
+	AllowOrigins     []string      // Allowed origins ("*" for any)
+	AllowMethods     []string      // Allowed methods
+	AllowHeaders     []string      // Allowed request headers ("*" for any)
+	AllowCredentials bool          // Allow credentials
+	MaxAge           time.Duration // How long preflights may be cached
+}
+
+// DnsConfig represents the settings of an experimental DNS target group. Rather
+// than relaying connections, a network load balancer answers A and AAAA queries
+// for the name with the addresses of the group's alive targets.
+type DnsConfig struct {
+	Name string        // Answered domain name; E.g. api.example.com
+	TTL  time.Duration // Time-to-live of the answers
+}
+
+// Health check types
+const (
+	HealthCheckTypeHttp = "http" // HTTP request, or send/expect for networks
+	HealthCheckTypeGrpc = "grpc" // gRPC health checking protocol
+)
+
+// HealthCheckConfig represents the health check settings of a target group.
+// Application targets are probed with an HTTP request for the path, and are
+// alive if they respond with a 2xx or 3xx status, and a body that matches the
+// BodyMatch regular expression if it is set; E.g. `"status":\s*"ok"` to tell a
+// degraded backend that still responds 200 apart. The Host field overrides the
+// probe's host header for virtual-hosted targets. Network targets are sent the
+// Send payload, and are alive if their response starts with the Expect payload;
+// E.g. send "PING\r\n" and expect "PONG". Targets of the grpc type are instead
+// alive if the grpc.health.v1 Check RPC for the Service reports SERVING.
+type HealthCheckConfig struct {
+	Type      string            // Health check type; defaults to http
+	Path      string            // Request path; E.g. /health
+	Method    string            // Request method; defaults to GET
+	Headers   map[string]string // Request headers
+	Body      string            // Optional request body
+	BodyMatch string            // Optional response body regular expression
+	Host      string            // Optional host header
+	Send      string            // Network probe payload
+	Expect    string            // Network probe response prefix
+	Service   string            // gRPC service name; empty for the server
+}
+
+// IsGrpc returns true if the health check uses the gRPC health checking
+// protocol.
+func (c *HealthCheckConfig) IsGrpc() bool {
+	return c != nil && c.Type == HealthCheckTypeGrpc
+}
+
+// JwtConfig represents the JSON web token authentication settings of a target
+// group. HS256 tokens are verified with the secret and RS256 tokens with the
+// public key or the keys fetched from the JWKS URL. Required claims must equal
+// the configured value, or contain it if the claim is a list.
+type JwtConfig struct {
+	Secret        string            // HS256 shared secret
+	PublicKey     string            // PEM encoded RS256 public key
+	JwksUrl       string            // URL of an RS256 JSON web key set
+	Claims        map[string]string // Required claim values
+	SubjectHeader string            // Header to pass the token subject in
+}
+
+// RateLimitConfig represents the rate limit of the requests matching the rule
+// of an application target group; each client IP is allowed a request per rate,
+// with the capacity of queued requests. It applies in addition to the load
+// balancer's rate limit; E.g. to limit a route to an expensive endpoint, like
+// /search, more tightly than the rest of the service.
+type RateLimitConfig struct {
+	Rate           time.Duration // Time between requests of a client
+	Capacity       int64         // Capacity of queued requests of a client
+	TrustedProxies []string      // Proxies trusted to forward client IPs
+}
+
+// RedirectConfig represents the redirect settings of a target group with the
+// redirect action. Each part of the redirect URL is a template that may contain
+// the placeholders {scheme}, {host}, {port}, {path}, and {query} for the parts
+// of the request's URL; the port includes its leading colon if set. Parts that
+// are not set keep the request's value, and the path prefix is stripped from
+// the request's path first; only if it is the path or its leading segments.
+type RedirectConfig struct {
+	Scheme      string // Scheme template; E.g. https
+	Host        string // Host template; E.g. new.example.com
+	Path        string // Path template; E.g. /v2{path}
+	Query       string // Query template; E.g. {query}&from=old
+	StripPrefix string // Prefix to strip from the request's path
+	StatusCode  int    // Redirect status code; defaults to 301
+}
+
+// ResponseHeadersConfig represents the rules an application target group
+// applies to the headers of its targets' responses before they reach clients.
+// Removed headers are stripped first, then set headers replace any values from
+// the target. With RewriteLocation, redirects to a target's own URL are
+// rewritten to the host and scheme the client used; E.g. a backend redirecting
+// to http://10.0.0.1:8080/login is answered as https://api.example.com/login.
+type ResponseHeadersConfig struct {
+	Remove          []string          // Headers to strip; E.g. Server
+	Set             map[string]string // Headers to set or replace
+	RewriteLocation bool              // Rewrite redirects to the target
+}
+
+// TimeoutConfig represents the timeouts of the connections a network target
+// group relays to its targets; a dial timeout of connecting to a target, and an
+// idle timeout after which a relay without data is closed. Targets may set
+// their own, and zero values keep the load balancer's timeouts.
+type TimeoutConfig struct {
+	Dial time.Duration // Timeout of connecting to a target
+	Idle time.Duration // How long a relay may go without data
+}
+
+// TransportConfig represents the settings of the connections an application
+// target group makes to its targets. Disabling keep-alives closes each
+// connection after its request, and requests are sent with "Connection: close";
+// for backends that misbehave with or leak persistent connections. Idle
+// connections are closed after the idle timeout, so they are recycled before a
+// backend or NAT timeout drops them. Zero values keep the defaults of
+// http.DefaultTransport.
+type TransportConfig struct {
+	DisableKeepAlives bool          // Close each connection after one request
+	IdleConnTimeout   time.Duration // How long a connection may be idle
+	MaxConnsPerHost   int           // Maximum connections per target
+}
+
 // TargetGroup represents a group of targets.
 type TargetGroup struct {
-	Name     string     // Group name
-	Protocol string     // Common group protocol
-	Rule     rules.Rule // Request rule
-	Targets  []Target   // List of targets
+	Name       string                 // Group name
+	Listener   string                 // Optional listener name or port to bind to
+	MirrorTo   string                 // Optional name of a group to mirror requests to
+	Protocol   string                 // Common group protocol
+	Rule       rules.Rule             // Request rule
+	Targets    []Target               // List of targets
+	Providers  []Provider             // Providers of dynamic targets
+	BasicAuth  *BasicAuthConfig       // Optional basic authentication
+	Cache      *CacheConfig           // Optional response caching
+	Cors       *CorsConfig            // Optional CORS preflight handling
+	Dns        *DnsConfig             // Optional DNS answers (experimental)
+	HashHeader string                 // Header keying the consistent hash strategy
+	HashLoad   float64                // Optional load factor bounding the consistent hash strategy
+	Health     *HealthCheckConfig     // Optional HTTP health check
+	Jwt        *JwtConfig             // Optional JWT authentication
+	MaxTargets int                    // Optional maximum number of targets
+	RateLimit  *RateLimitConfig       // Optional rate limit of the route
+	Redirect   *RedirectConfig        // Optional redirect templates
+	Response   *ResponseHeadersConfig // Optional response header rules
+	Strategy   Strategy               // Optional balancing strategy
+	Timeouts   *TimeoutConfig         // Optional network connection timeouts
+	Transport  *TransportConfig       // Optional upstream connection settings
 }
 
 // NewTargetGroup returns a new TargetGroup.
@@ -24,14 +191,61 @@ func NewTargetGroup(name, protocol string, rule rules.Rule, target ...Target) *T
 	}
 }
 
-// AddServiceTarget adds a new target as a service via a given URL.
-func (tg *TargetGroup) AddServiceTarget(target *url.URL) {
+// AddServiceTarget adds a new target as a service via a given URL and returns
+// it.
+func (tg *TargetGroup) AddServiceTarget(target *url.URL) Target {
 	t := NewServiceTarget(target)
 	tg.Targets = append(tg.Targets, t)
+	return t
+}
+
+// AddTarget adds a new target via a given host and port and returns it.
+func (tg *TargetGroup) AddTarget(host string, port int) Target {
+	return tg.AddProtocolTarget(host, port, "")
 }
 
-// AddTarget adds a new target via a given host and port.
-func (tg *TargetGroup) AddTarget(host string, port int) {
-	t := NewTarget(host, port, tg.Protocol)
+// AddProtocolTarget adds a new target via a given host, port, and protocol and
+// returns it; so a group may mix protocols, E.g. "http" and "https" services.
+// If the protocol is empty, the group's protocol is used.
+func (tg *TargetGroup) AddProtocolTarget(host string, port int, protocol string) Target {
+	if protocol == "" {
+		protocol = tg.Protocol
+	}
+	t := NewTarget(host, port, protocol)
 	tg.Targets = append(tg.Targets, t)
+	return t
+}
+
+// BackendKey returns the key of the backend of the given target; targets with
+// equal keys are the same backend. Their URLs are equal without regard to case
+// and their base paths are equal; E.g. a service target of "http://10.0.0.1"
+// and a target of host 10.0.0.1 and port 80 with the http protocol.
+func BackendKey(t Target) string {
+	return strings.ToLower(t.URL()) + t.Path()
+}
+
+// CheckTargets returns an error if the given targets of the group contain the
+// same backend twice (see BackendKey), or outnumber the group's maximum targets
+// if it is set.
+func (tg *TargetGroup) CheckTargets(ts []Target) error {
+	if tg.MaxTargets > 0 && len(ts) > tg.MaxTargets {
+		return fmt.Errorf("%s - '%s' has %d of %d", ErrTooManyTargets,
+			tg.Name, len(ts), tg.MaxTargets)
+	}
+	seen := make(map[string]bool, len(ts))
+	for _, t := range ts {
+		key := BackendKey(t)
+		if seen[key] {
+			return fmt.Errorf("%s - '%s' of '%s'", ErrDuplicateTarget,
+				t.URL(), tg.Name)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// IsDynamic returns true if the group's targets may change while it is in use;
+// I.E. the group has target providers.
+func (tg *TargetGroup) IsDynamic() bool {
+	return len(tg.Providers) > 0
 }